@@ -0,0 +1,306 @@
+// Package accesslog records one structured entry per HTTP request or CONNECT
+// tunnel handled by the proxy, written as JSON lines or in Common/Combined Log
+// Format through a rotator.
+//
+// Logging requires both the Filter, which should come first in the filter
+// chain, and the Listener wrapper, which tracks bytes transferred on each
+// connection and logs CONNECT tunnels once they close. Wrap individual filters
+// with Named so that the entry records which filter rejected a request.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/proxy"
+	"github.com/getlantern/proxy/filters"
+	"github.com/getlantern/rotator"
+
+	"github.com/getlantern/http-proxy/proxyfilters"
+)
+
+const (
+	// FormatJSON writes one JSON object per line
+	FormatJSON = "json"
+	// FormatCommon writes entries in Common Log Format
+	FormatCommon = "common"
+	// FormatCombined writes entries in Combined Log Format
+	FormatCombined = "combined"
+
+	clfTimestampFormat = "02/Jan/2006:15:04:05 -0700"
+
+	defaultRotationSize = 64 * 1024 * 1024
+	defaultMaxRotation  = 10
+)
+
+type ctxKey string
+
+const (
+	recordKey = ctxKey("accesslog.record")
+)
+
+var (
+	log = golog.LoggerFor("http-proxy.accesslog")
+)
+
+// Record is a single access log entry.
+type Record struct {
+	Time       time.Time `json:"time"`
+	ClientIP   string    `json:"clientIP"`
+	User       string    `json:"user,omitempty"`
+	Method     string    `json:"method"`
+	Host       string    `json:"host"`
+	URL        string    `json:"url"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	BytesIn    int       `json:"bytesIn"`
+	BytesOut   int       `json:"bytesOut"`
+	DurationMs int64     `json:"durationMs"`
+	RejectedBy string    `json:"rejectedBy,omitempty"`
+	Egress     string    `json:"egress,omitempty"`
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"userAgent,omitempty"`
+}
+
+// Opts configures an access log file.
+type Opts struct {
+	// File is the path of the access log.
+	File string
+
+	// Format is "json" (the default), "common" or "combined".
+	Format string
+
+	// Daily rotates the file once a day instead of by size.
+	Daily bool
+
+	// RotationSize is the size in bytes at which the file is rotated, unless
+	// rotating daily.
+	RotationSize int64
+
+	// MaxRotation is the number of rotated files to keep, unless rotating
+	// daily.
+	MaxRotation int
+}
+
+// Validate checks that these Opts are usable.
+func (opts *Opts) Validate() error {
+	if opts.File == "" {
+		return fmt.Errorf("Access log is missing file")
+	}
+	return checkFormat(opts.Format)
+}
+
+func checkFormat(format string) error {
+	switch format {
+	case "", FormatJSON, FormatCommon, FormatCombined:
+		return nil
+	default:
+		return fmt.Errorf("Unknown access log format '%v'", format)
+	}
+}
+
+// Logger writes access log entries.
+type Logger struct {
+	out    io.Writer
+	format string
+	mx     sync.Mutex
+}
+
+// New constructs a Logger that writes entries in the given format to out.
+func New(out io.Writer, format string) (*Logger, error) {
+	if err := checkFormat(format); err != nil {
+		return nil, err
+	}
+	if format == "" {
+		format = FormatJSON
+	}
+	return &Logger{out: out, format: format}, nil
+}
+
+// Open constructs a Logger that writes to the rotated file described by opts.
+func Open(opts *Opts) (*Logger, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(opts.File), 0755); err != nil {
+		return nil, fmt.Errorf("Unable to create directory for access log %v: %v", opts.File, err)
+	}
+	var out rotator.Rotator
+	if opts.Daily {
+		out = rotator.NewDailyRotator(opts.File)
+	} else {
+		sr := rotator.NewSizeRotator(opts.File)
+		sr.RotationSize = defaultRotationSize
+		if opts.RotationSize > 0 {
+			sr.RotationSize = opts.RotationSize
+		}
+		sr.MaxRotation = defaultMaxRotation
+		if opts.MaxRotation > 0 {
+			sr.MaxRotation = opts.MaxRotation
+		}
+		out = sr
+	}
+	return New(out, opts.Format)
+}
+
+// Log writes the given Record.
+func (l *Logger) Log(rec *Record) {
+	var line []byte
+	switch l.format {
+	case FormatCommon, FormatCombined:
+		line = []byte(l.clf(rec))
+	default:
+		var err error
+		line, err = json.Marshal(rec)
+		if err != nil {
+			log.Errorf("Unable to marshal access log record: %v", err)
+			return
+		}
+	}
+	line = append(line, '\n')
+	// Write in single operation so that entries don't interleave
+	l.mx.Lock()
+	_, err := l.out.Write(line)
+	l.mx.Unlock()
+	if err != nil {
+		log.Errorf("Unable to write access log: %v", err)
+	}
+}
+
+func (l *Logger) clf(rec *Record) string {
+	status := "-"
+	if rec.Status > 0 {
+		status = strconv.Itoa(rec.Status)
+	}
+	bytesOut := "-"
+	if rec.BytesOut > 0 {
+		bytesOut = strconv.Itoa(rec.BytesOut)
+	}
+	line := fmt.Sprintf(`%v - %v [%v] "%v %v %v" %v %v`,
+		orDash(rec.ClientIP),
+		orDash(rec.User),
+		rec.Time.Format(clfTimestampFormat),
+		rec.Method, rec.URL, rec.Proto,
+		status, bytesOut)
+	if l.format == FormatCombined {
+		line += fmt.Sprintf(` "%v" "%v"`, quoteEscape(orDash(rec.Referer)), quoteEscape(orDash(rec.UserAgent)))
+	}
+	return line
+}
+
+// Close closes the underlying writer if it's an io.Closer.
+func (l *Logger) Close() error {
+	if closer, ok := l.out.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Filter returns a filter that records every request that passes through it.
+// Plain HTTP requests are logged once their response has been written, and
+// successful CONNECT tunnels once their connection closes.
+func (l *Logger) Filter() filters.Filter {
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		start := time.Now()
+		rec := &Record{
+			Time:      start,
+			ClientIP:  clientIP(req),
+			Method:    req.Method,
+			Host:      req.Host,
+			URL:       req.URL.String(),
+			Proto:     req.Proto,
+			Referer:   req.Referer(),
+			UserAgent: req.UserAgent(),
+		}
+		if req.Method == http.MethodConnect {
+			rec.Host = req.URL.Host
+			rec.URL = req.URL.Host
+		}
+		// HTTP/2 streams count their own bytes, since they share the connection
+		// with other requests
+		stream, _ := ctx.DownstreamConn().(proxy.StreamConn)
+		tc := trackedConnFor(ctx.DownstreamConn())
+
+		ctx = proxy.OnUpstreamConn(ctx.WithValue(recordKey, rec), func(conn net.Conn) {
+			if host, _, err := net.SplitHostPort(conn.LocalAddr().String()); err == nil {
+				rec.Egress = host
+			}
+		})
+		resp, nextCtx, err := next(ctx, req)
+		if nextCtx != nil {
+			rec.User = proxyfilters.AuthenticatedIdentity(nextCtx)
+		}
+		if resp != nil {
+			rec.Status = resp.StatusCode
+		}
+
+		finish := func() {
+			rec.DurationMs = int64(time.Since(start) / time.Millisecond)
+			if stream != nil {
+				rec.BytesIn, rec.BytesOut = stream.BytesTransferred()
+			} else if tc != nil {
+				rec.BytesIn, rec.BytesOut = tc.bytesSinceLast()
+			}
+			l.Log(rec)
+		}
+		switch {
+		case (req.Method == http.MethodConnect && rec.Status == http.StatusOK || rec.Status == http.StatusSwitchingProtocols) && resp.Body == nil && tc != nil:
+			// Tunnel (or upgraded connection) lasts until the connection closes.
+			// Tunnels over HTTP/2 streams end when their body is closed instead.
+			tc.setTunnel(finish)
+		case resp == nil || resp.Body == nil:
+			finish()
+		default:
+			resp.Body = proxyfilters.OnBodyClosed(resp.Body, finish)
+		}
+		return resp, nextCtx, err
+	})
+}
+
+// Named wraps a filter so that if it rejects a request, the access log records
+// name as the filter that rejected it. A filter rejects a request when it
+// fails or responds with an error status without passing it on.
+func Named(name string, filter filters.Filter) filters.Filter {
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		passed := false
+		resp, nextCtx, err := filter.Apply(ctx, req, func(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+			passed = true
+			return next(ctx, req)
+		})
+		if !passed && (err != nil || resp == nil || resp.StatusCode >= 400) {
+			if rec, ok := ctx.Value(recordKey).(*Record); ok && rec.RejectedBy == "" {
+				rec.RejectedBy = name
+			}
+		}
+		return resp, nextCtx, err
+	})
+}
+
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func quoteEscape(s string) string {
+	return strings.Replace(s, `"`, `\"`, -1)
+}
@@ -0,0 +1,262 @@
+package accesslog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+
+	"github.com/getlantern/http-proxy/proxyfilters"
+	"github.com/getlantern/http-proxy/server"
+)
+
+type syncBuffer struct {
+	bytes.Buffer
+	mx sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func (b *syncBuffer) records() []*Record {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	var records []*Record
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		rec := &Record{}
+		if err := json.Unmarshal([]byte(line), rec); err == nil {
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+func TestCLF(t *testing.T) {
+	rec := &Record{
+		Time:      time.Date(2000, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600)),
+		ClientIP:  "127.0.0.1",
+		User:      "frank",
+		Method:    "GET",
+		URL:       "http://example.com/apache_pb.gif",
+		Proto:     "HTTP/1.0",
+		Status:    200,
+		BytesOut:  2326,
+		Referer:   "http://example.com/start.html",
+		UserAgent: `Mozilla/4.08 "quoted"`,
+	}
+	var buf bytes.Buffer
+	common, _ := New(&buf, FormatCommon)
+	common.Log(rec)
+	combined, _ := New(&buf, FormatCombined)
+	combined.Log(rec)
+	rec.User = ""
+	rec.Status = 0
+	rec.BytesOut = 0
+	common.Log(rec)
+
+	assert.Equal(t, `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET http://example.com/apache_pb.gif HTTP/1.0" 200 2326
+127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET http://example.com/apache_pb.gif HTTP/1.0" 200 2326 "http://example.com/start.html" "Mozilla/4.08 \"quoted\""
+127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET http://example.com/apache_pb.gif HTTP/1.0" - -
+`, buf.String())
+
+	_, err := New(&buf, "xml")
+	assert.Error(t, err)
+}
+
+func TestAccessLog(t *testing.T) {
+	const originResponse = "hello from origin"
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte(originResponse))
+	}))
+	defer origin.Close()
+	originURL, _ := url.Parse(origin.URL)
+	_, originPort, _ := net.SplitHostPort(originURL.Host)
+	port, _ := strconv.Atoi(originPort)
+
+	out := &syncBuffer{}
+	logger, _ := New(out, FormatJSON)
+	srv := server.New(&server.Opts{
+		IdleTimeout: 30 * time.Second,
+		Filter: filters.Join(
+			logger.Filter(),
+			Named("restrictConnectPorts", proxyfilters.RestrictConnectPorts([]int{port})),
+		),
+	})
+	srv.AddListenerWrappers(logger.Listener)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	go srv.Serve(l, nil)
+	defer l.Close()
+
+	// Plain HTTP
+	proxyURL, _ := url.Parse("http://" + l.Addr().String())
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(origin.URL + "/path")
+	if assert.NoError(t, err) {
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	connect := func(addr string) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", addr, addr)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if !assert.NoError(t, err) || resp.StatusCode != http.StatusOK {
+			return
+		}
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %v\r\nConnection: close\r\n\r\n", addr)
+		resp, err = http.ReadResponse(br, nil)
+		if assert.NoError(t, err) {
+			ioutil.ReadAll(resp.Body)
+		}
+	}
+	connect(originURL.Host)
+	connect("127.0.0.1:1")
+
+	var records []*Record
+	for i := 0; i < 50; i++ {
+		records = out.records()
+		if len(records) == 3 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !assert.Len(t, records, 3) {
+		return
+	}
+	byMethodAndStatus := make(map[string]*Record)
+	for _, rec := range records {
+		byMethodAndStatus[rec.Method+" "+strconv.Itoa(rec.Status)] = rec
+	}
+
+	get := byMethodAndStatus["GET 200"]
+	if assert.NotNil(t, get) {
+		assert.Equal(t, "127.0.0.1", get.ClientIP)
+		assert.Equal(t, originURL.Host, get.Host)
+		assert.Equal(t, origin.URL+"/path", get.URL)
+		assert.True(t, get.BytesIn > 0)
+		assert.True(t, get.BytesOut > len(originResponse))
+		assert.Empty(t, get.RejectedBy)
+	}
+
+	tunnel := byMethodAndStatus["CONNECT 200"]
+	if assert.NotNil(t, tunnel) {
+		assert.Equal(t, originURL.Host, tunnel.Host)
+		assert.True(t, tunnel.BytesOut > len(originResponse), "tunnel should count bytes until the connection closes")
+		assert.Empty(t, tunnel.RejectedBy)
+	}
+
+	blocked := byMethodAndStatus["CONNECT 403"]
+	if assert.NotNil(t, blocked) {
+		assert.Equal(t, "127.0.0.1:1", blocked.Host)
+		assert.Equal(t, "restrictConnectPorts", blocked.RejectedBy)
+	}
+}
+
+func TestAccessLogHTTP2(t *testing.T) {
+	// Both requests reach the origin before either is answered, so that their
+	// streams transfer data on the shared connection at the same time
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		arrived.Done()
+		arrived.Wait()
+		size, _ := strconv.Atoi(req.URL.Query().Get("size"))
+		resp.Write(bytes.Repeat([]byte("o"), size))
+	}))
+	defer origin.Close()
+
+	out := &syncBuffer{}
+	logger, _ := New(out, FormatJSON)
+	srv := server.New(&server.Opts{
+		IdleTimeout: 30 * time.Second,
+		Filter:      logger.Filter(),
+	})
+	srv.AddListenerWrappers(logger.Listener)
+	dir := t.TempDir()
+	ready := make(chan string)
+	go srv.ListenAndServeHTTPS("localhost:0", filepath.Join(dir, "key.pem"), filepath.Join(dir, "cert.pem"), func(addr string) {
+		ready <- addr
+	})
+	addr := <-ready
+
+	tlsConn, err := tls.Dial("tcp", addr, &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h2"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer tlsConn.Close()
+	cc, err := (&http2.Transport{}).NewClientConn(tlsConn)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	sizes := map[string][2]int{"/small": {100, 1000}, "/large": {20000, 50000}}
+	var wg sync.WaitGroup
+	for path, size := range sizes {
+		wg.Add(1)
+		go func(path string, in, out int) {
+			defer wg.Done()
+			u := fmt.Sprintf("%v%v?size=%d", origin.URL, path, out)
+			req, _ := http.NewRequest(http.MethodPost, u, bytes.NewReader(make([]byte, in)))
+			resp, err := cc.RoundTrip(req)
+			if assert.NoError(t, err) {
+				body, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				assert.Len(t, body, out)
+			}
+		}(path, size[0], size[1])
+	}
+	wg.Wait()
+
+	var records []*Record
+	for i := 0; i < 50; i++ {
+		records = out.records()
+		if len(records) == 2 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !assert.Len(t, records, 2) {
+		return
+	}
+	for _, rec := range records {
+		recURL, _ := url.Parse(rec.URL)
+		size := sizes[recURL.Path]
+		assert.Equal(t, "HTTP/2.0", rec.Proto)
+		assert.Equal(t, size[0], rec.BytesIn, "%v should only count its own request body", recURL.Path)
+		assert.Equal(t, size[1], rec.BytesOut, "%v should only count its own response body", recURL.Path)
+	}
+}
@@ -0,0 +1,117 @@
+package accesslog
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/getlantern/measured"
+	"github.com/getlantern/netx"
+
+	"github.com/getlantern/http-proxy/listeners"
+)
+
+const (
+	rateInterval = 1 * time.Second
+)
+
+// Listener wraps l so that the Filter can attribute bytes transferred to
+// individual requests and log CONNECT tunnels when their connections close.
+// Byte counts come from measured; if the connection is already measured (for
+// example by a metrics listener wrapper) those measurements are reused.
+// Requests on HTTP/2 streams are counted by their streams instead (see
+// proxy.StreamConn).
+func (l *Logger) Listener(ln net.Listener) net.Listener {
+	return &trackingListener{ln}
+}
+
+type trackingListener struct {
+	net.Listener
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	var mc measured.Conn
+	netx.WalkWrapped(conn, func(wrapped net.Conn) bool {
+		mc, _ = wrapped.(measured.Conn)
+		return mc == nil
+	})
+	tc := &trackedConn{Conn: conn, stats: mc}
+	if mc == nil {
+		tc.stats = measured.Wrap(conn, rateInterval, nil)
+		tc.Conn = tc.stats
+	}
+	tc.WrapConnEmbeddable, _ = conn.(listeners.WrapConnEmbeddable)
+	return tc, nil
+}
+
+// trackedConn remembers how many bytes had been transferred when the last
+// request was logged, and holds the pending log entry for a CONNECT tunnel.
+type trackedConn struct {
+	listeners.WrapConnEmbeddable
+	net.Conn
+	stats        measured.Conn
+	lastSent     int
+	lastRecv     int
+	finishTunnel func()
+	mx           sync.Mutex
+}
+
+func trackedConnFor(conn net.Conn) *trackedConn {
+	if conn == nil {
+		return nil
+	}
+	var tc *trackedConn
+	netx.WalkWrapped(conn, func(wrapped net.Conn) bool {
+		tc, _ = wrapped.(*trackedConn)
+		return tc == nil
+	})
+	return tc
+}
+
+// bytesSinceLast returns the number of bytes received and sent since the last
+// call.
+func (c *trackedConn) bytesSinceLast() (int, int) {
+	stats := c.stats.Stats()
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	recv, sent := stats.RecvTotal-c.lastRecv, stats.SentTotal-c.lastSent
+	c.lastRecv, c.lastSent = stats.RecvTotal, stats.SentTotal
+	return recv, sent
+}
+
+func (c *trackedConn) setTunnel(finish func()) {
+	c.mx.Lock()
+	c.finishTunnel = finish
+	c.mx.Unlock()
+}
+
+func (c *trackedConn) OnState(s http.ConnState) {
+	if s == http.StateClosed {
+		c.mx.Lock()
+		finish := c.finishTunnel
+		c.finishTunnel = nil
+		c.mx.Unlock()
+		if finish != nil {
+			finish()
+		}
+	}
+	if c.WrapConnEmbeddable != nil {
+		c.WrapConnEmbeddable.OnState(s)
+	}
+}
+
+func (c *trackedConn) ControlMessage(msgType string, data interface{}) {
+	if c.WrapConnEmbeddable != nil {
+		c.WrapConnEmbeddable.ControlMessage(msgType, data)
+	}
+}
+
+// Wrapped implements the interface netx.WrappedConn
+func (c *trackedConn) Wrapped() net.Conn {
+	return c.Conn
+}
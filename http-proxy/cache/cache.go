@@ -0,0 +1,421 @@
+// Package cache provides a filter that caches responses to plain HTTP (and
+// intercepted HTTPS) GET requests following the rules for shared caches in
+// RFC 7234. Fresh responses are served from the cache, stale ones are
+// revalidated with conditional requests where possible and concurrent misses
+// for the same resource are coalesced into a single upstream request.
+//
+// Responses are buffered in memory until complete before being stored, so
+// MaxObjectBytes bounds the memory used by each download.
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/proxy/filters"
+)
+
+const (
+	// XCache is the response header that says how a response was served, one
+	// of "HIT", "MISS" or "REVALIDATED".
+	XCache = "X-Cache"
+
+	defaultMaxBytes       = 256 * 1024 * 1024
+	defaultMaxObjectBytes = 32 * 1024 * 1024
+)
+
+var (
+	log = golog.LoggerFor("http-proxy.cache")
+
+	// hopByHopHeaders aren't stored, see RFC 7230 section 6.1
+	hopByHopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "TE", "Trailer", "Transfer-Encoding", "Upgrade"}
+)
+
+// Opts configures a Cache.
+type Opts struct {
+	// Dir, if set, stores the cache on disk in this directory. Otherwise, the
+	// cache is kept in memory.
+	Dir string
+
+	// MaxBytes is the total size of the cache, defaults to 256 MB.
+	MaxBytes int64
+
+	// MaxObjectBytes is the size of the largest response that will be cached,
+	// defaults to 32 MB.
+	MaxObjectBytes int64
+}
+
+// Validate checks that these Opts are usable.
+func (opts *Opts) Validate() error {
+	if opts.MaxBytes < 0 || opts.MaxObjectBytes < 0 {
+		return fmt.Errorf("Cache sizes must not be negative")
+	}
+	return nil
+}
+
+// Cache is a shared HTTP cache.
+type Cache struct {
+	storage        Storage
+	maxObjectBytes int64
+	inflight       map[string]chan struct{}
+	mx             sync.Mutex
+	now            func() time.Time
+}
+
+// New constructs a Cache using the Storage described by opts.
+func New(opts *Opts) (*Cache, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	maxBytes := opts.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = defaultMaxBytes
+	}
+	var storage Storage
+	if opts.Dir != "" {
+		var err error
+		storage, err = NewDiskStorage(opts.Dir, maxBytes)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		storage = NewMemoryStorage(maxBytes)
+	}
+	return NewWithStorage(storage, opts.MaxObjectBytes), nil
+}
+
+// NewWithStorage constructs a Cache that uses the given Storage and caches
+// responses of up to maxObjectBytes (0 meaning the default).
+func NewWithStorage(storage Storage, maxObjectBytes int64) *Cache {
+	if maxObjectBytes == 0 {
+		maxObjectBytes = defaultMaxObjectBytes
+	}
+	return &Cache{
+		storage:        storage,
+		maxObjectBytes: maxObjectBytes,
+		inflight:       make(map[string]chan struct{}),
+		now:            time.Now,
+	}
+}
+
+// Filter returns a filter that serves requests from the cache and caches
+// responses from upstream. It should come after any filters that need to see
+// every request, like authentication and access control.
+func (c *Cache) Filter() filters.Filter {
+	return filters.FilterFunc(c.apply)
+}
+
+func (c *Cache) apply(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch:
+		return c.invalidating(ctx, req, next)
+	default:
+		return next(ctx, req)
+	}
+	reqCC := parseCacheControl(req.Header)
+	if req.Header.Get("Range") != "" || req.Header.Get("Upgrade") != "" || reqCC.has("no-store") {
+		// We don't store partial responses or upgraded connections
+		return next(ctx, req)
+	}
+
+	key := req.URL.String()
+	coalesced := false
+	for {
+		entryKey, entry := c.lookup(key, req)
+		if entry != nil {
+			if ok, stale := entry.usable(reqCC, c.now()); ok {
+				return c.serve(ctx, req, entry, "HIT", stale)
+			}
+		}
+		if reqCC.has("only-if-cached") {
+			return filters.ShortCircuit(ctx, req, &http.Response{StatusCode: http.StatusGatewayTimeout})
+		}
+
+		done, wait := c.join(key)
+		if wait != nil && !coalesced {
+			// Somebody else is already fetching this, wait for them and try
+			// again, fetching ourselves if it turned out not to be cacheable
+			log.Tracef("Waiting for concurrent request for %v", key)
+			select {
+			case <-wait:
+			case <-ctx.Done():
+				return nil, ctx, ctx.Err()
+			}
+			coalesced = true
+			continue
+		}
+		if entry != nil && !entry.revalidatable() {
+			entry = nil
+		}
+		return c.fetch(ctx, req, next, reqCC, key, entryKey, entry, done)
+	}
+}
+
+// join registers a fetch of key. If there's already one in flight, it returns
+// a channel that's closed once that finishes. Otherwise, it returns a function
+// to call once this fetch has finished.
+func (c *Cache) join(key string) (func(), chan struct{}) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if wait, found := c.inflight[key]; found {
+		return func() {}, wait
+	}
+	ch := make(chan struct{})
+	c.inflight[key] = ch
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mx.Lock()
+			delete(c.inflight, key)
+			c.mx.Unlock()
+			close(ch)
+		})
+	}, nil
+}
+
+// lookup gets the entry for req stored under key, selecting the right variant
+// for responses that Vary. It returns the key under which the entry was found.
+func (c *Cache) lookup(key string, req *http.Request) (string, *Entry) {
+	entry, found := c.storage.Get(key)
+	if !found {
+		return key, nil
+	}
+	if entry.Vary != nil {
+		key = variantKey(key, entry.Vary, req)
+		entry, found = c.storage.Get(key)
+		if !found {
+			return key, nil
+		}
+	}
+	return key, entry
+}
+
+// variantKey is the key of the response to req among those that vary by the
+// given request headers.
+func variantKey(key string, vary []string, req *http.Request) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range vary {
+		b.WriteString("\x00")
+		b.WriteString(name)
+		b.WriteString(":")
+		b.WriteString(strings.Join(req.Header[name], ","))
+	}
+	return b.String()
+}
+
+// varyFields parses the Vary header into sorted, canonical header names.
+func varyFields(header http.Header) []string {
+	var fields []string
+	for _, value := range header["Vary"] {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				fields = append(fields, textproto.CanonicalMIMEHeaderKey(field))
+			}
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// fetch gets the response to req from upstream, revalidating entry if it's
+// set, and caches the response if possible. done is called once the response
+// has been cached or found to be uncacheable, or as soon as its headers arrive
+// if waiting for it to be cached could take too long or be useless.
+func (c *Cache) fetch(ctx filters.Context, req *http.Request, next filters.Next, reqCC cacheControl, key string, entryKey string, entry *Entry, done func()) (*http.Response, filters.Context, error) {
+	upstreamReq := req
+	if entry != nil {
+		upstreamReq = req.WithContext(ctx)
+		upstreamReq.Header = req.Header.Clone()
+		// Our validators replace the client's, we'll evaluate theirs ourselves
+		for _, conditional := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"} {
+			upstreamReq.Header.Del(conditional)
+		}
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			upstreamReq.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+			upstreamReq.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	requestTime := c.now()
+	resp, nextCtx, err := next(ctx, upstreamReq)
+	responseTime := c.now()
+	if resp == nil || err != nil {
+		done()
+		return resp, nextCtx, err
+	}
+
+	if entry != nil && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		updated := entry.updatedBy(resp, requestTime, responseTime)
+		c.storage.Put(entryKey, updated)
+		done()
+		return c.serve(nextCtx, req, updated, "REVALIDATED", false)
+	}
+
+	if !storable(req, reqCC, resp) || resp.ContentLength > c.maxObjectBytes {
+		if entry != nil && resp.StatusCode < 500 {
+			// The stored response has been replaced by one we can't store
+			c.storage.Delete(entryKey)
+		}
+		done()
+		return resp, nextCtx, err
+	}
+
+	resp.Header.Set(XCache, "MISS")
+	newEntry := &Entry{
+		StatusCode:   resp.StatusCode,
+		Header:       storedHeader(resp.Header),
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+	if resp.ContentLength < 0 || (newEntry.freshnessLifetime() == 0 && !newEntry.revalidatable()) {
+		// Streamed responses of unknown length could take forever, and other
+		// requests couldn't use responses without freshness or validators
+		// anyway, so don't make concurrent requests wait for the body
+		done()
+	}
+	vary := varyFields(resp.Header)
+	if resp.Body == nil {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(nil))
+	}
+	resp.Body = &cachingBody{
+		ReadCloser: resp.Body,
+		maxBytes:   c.maxObjectBytes,
+		onComplete: func(body []byte) {
+			newEntry.Body = body
+			if len(vary) == 0 {
+				c.storage.Put(key, newEntry)
+			} else {
+				c.storage.Put(key, &Entry{Vary: vary})
+				c.storage.Put(variantKey(key, vary, req), newEntry)
+			}
+			log.Tracef("Cached %v", key)
+		},
+		onDone: done,
+	}
+	return resp, nextCtx, err
+}
+
+// invalidating passes on unsafe requests and invalidates the cached response
+// for their URL if they succeed, see RFC 7234 section 4.4.
+func (c *Cache) invalidating(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+	resp, nextCtx, err := next(ctx, req)
+	if err == nil && resp != nil && resp.StatusCode < 400 {
+		key := req.URL.String()
+		if entry, found := c.storage.Get(key); found && entry.Vary != nil {
+			// We only know about the variant for this request
+			c.storage.Delete(variantKey(key, entry.Vary, req))
+		}
+		c.storage.Delete(key)
+	}
+	return resp, nextCtx, err
+}
+
+// serve responds to req with the given entry, or with 304 Not Modified if that
+// satisfies req's conditional headers.
+func (c *Cache) serve(ctx filters.Context, req *http.Request, entry *Entry, xcache string, stale bool) (*http.Response, filters.Context, error) {
+	header := entry.Header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(entry.age(c.now())/time.Second), 10))
+	header.Set(XCache, xcache)
+	if stale {
+		header.Add("Warning", `110 - "Response is Stale"`)
+	}
+	resp := &http.Response{
+		StatusCode: entry.StatusCode,
+		Header:     header,
+		Request:    req,
+	}
+	if entry.notModified(req) {
+		resp.StatusCode = http.StatusNotModified
+		header.Del("Content-Length")
+	} else if len(entry.Body) > 0 {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(entry.Body))
+		resp.ContentLength = int64(len(entry.Body))
+	}
+	return filters.ShortCircuit(ctx, req, resp)
+}
+
+// updatedBy updates the entry with the headers from a 304 Not Modified
+// response, see RFC 7234 section 4.3.4.
+func (e *Entry) updatedBy(resp *http.Response, requestTime time.Time, responseTime time.Time) *Entry {
+	updated := &Entry{
+		StatusCode:   e.StatusCode,
+		Header:       e.Header.Clone(),
+		Body:         e.Body,
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+	for name, values := range storedHeader(resp.Header) {
+		if name == "Content-Length" {
+			continue
+		}
+		updated.Header[name] = values
+	}
+	return updated
+}
+
+func storedHeader(header http.Header) http.Header {
+	stored := header.Clone()
+	for _, name := range hopByHopHeaders {
+		stored.Del(name)
+	}
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			stored.Del(strings.TrimSpace(name))
+		}
+	}
+	stored.Del(XCache)
+	return stored
+}
+
+// cachingBody buffers a response body as it's read, calling onComplete with the
+// whole body once it's been read entirely (unless it turned out too big) and
+// onDone once it's closed or turned out too big.
+type cachingBody struct {
+	io.ReadCloser
+	buf        bytes.Buffer
+	maxBytes   int64
+	tooBig     bool
+	onComplete func(body []byte)
+	onDone     func()
+	doneOnce   sync.Once
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.tooBig {
+		if int64(b.buf.Len()+n) > b.maxBytes {
+			b.tooBig = true
+			b.buf = bytes.Buffer{}
+			// It won't be cached, so nobody needs to wait for the rest
+			b.doneOnce.Do(b.onDone)
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.tooBig && b.onComplete != nil {
+		b.onComplete(b.buf.Bytes())
+		b.onComplete = nil
+	}
+	return n, err
+}
+
+func (b *cachingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.doneOnce.Do(b.onDone)
+	return err
+}
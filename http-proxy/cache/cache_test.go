@@ -0,0 +1,377 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+const testURL = "http://example.com/artifact.tgz"
+
+// testOrigin serves requests passed to next with handler.
+type testOrigin struct {
+	handler  http.HandlerFunc
+	requests int32
+}
+
+func (o *testOrigin) next(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+	atomic.AddInt32(&o.requests, 1)
+	rec := httptest.NewRecorder()
+	o.handler(rec, req)
+	return rec.Result(), ctx, nil
+}
+
+func (o *testOrigin) count() int {
+	return int(atomic.LoadInt32(&o.requests))
+}
+
+// testCache is a Cache with a fake clock
+type testCache struct {
+	*Cache
+	clock time.Time
+}
+
+func newTestCache(storage Storage) *testCache {
+	tc := &testCache{Cache: NewWithStorage(storage, 1024), clock: time.Now()}
+	tc.now = func() time.Time { return tc.clock }
+	return tc
+}
+
+func (tc *testCache) advance(d time.Duration) {
+	tc.clock = tc.clock.Add(d)
+}
+
+// do does a request through the cache and returns the response's status,
+// X-Cache header and body.
+func (tc *testCache) do(o *testOrigin, method string, url string, header ...string) (int, string, string) {
+	req, _ := http.NewRequest(method, url, nil)
+	for i := 0; i < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, _, err := tc.Filter().Apply(filters.BackgroundContext(), req, o.next)
+	if err != nil {
+		return 0, "", err.Error()
+	}
+	body := ""
+	if resp.Body != nil {
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		body = string(b)
+	}
+	return resp.StatusCode, resp.Header.Get(XCache), body
+}
+
+func TestFreshness(t *testing.T) {
+	tc := newTestCache(NewMemoryStorage(1024 * 1024))
+	o := &testOrigin{}
+	o.handler = func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintf(resp, "version %d", o.count())
+	}
+
+	status, xcache, body := tc.do(o, http.MethodGet, testURL)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "MISS", xcache)
+	assert.Equal(t, "version 1", body)
+
+	tc.advance(30 * time.Second)
+	_, xcache, body = tc.do(o, http.MethodGet, testURL)
+	assert.Equal(t, "HIT", xcache)
+	assert.Equal(t, "version 1", body)
+	assert.Equal(t, 1, o.count())
+
+	// Clients can ask for fresher responses
+	_, xcache, body = tc.do(o, http.MethodGet, testURL, "Cache-Control", "max-age=10")
+	assert.Equal(t, "MISS", xcache)
+	assert.Equal(t, "version 2", body)
+
+	tc.advance(61 * time.Second)
+	_, xcache, body = tc.do(o, http.MethodGet, testURL)
+	assert.Equal(t, "MISS", xcache, "stale response without validators should be fetched again")
+	assert.Equal(t, "version 3", body)
+
+	// Or accept staler ones
+	tc.advance(90 * time.Second)
+	_, xcache, body = tc.do(o, http.MethodGet, testURL, "Cache-Control", "max-stale=60")
+	assert.Equal(t, "HIT", xcache)
+	assert.Equal(t, "version 3", body)
+
+	status, _, _ = tc.do(o, http.MethodGet, "http://example.com/other", "Cache-Control", "only-if-cached")
+	assert.Equal(t, http.StatusGatewayTimeout, status)
+	assert.Equal(t, 3, o.count())
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	entry := func(status int, header ...string) *Entry {
+		e := &Entry{StatusCode: status, Header: make(http.Header), RequestTime: now, ResponseTime: now}
+		e.Header.Set("Date", now.UTC().Format(http.TimeFormat))
+		for i := 0; i < len(header); i += 2 {
+			e.Header.Set(header[i], header[i+1])
+		}
+		return e
+	}
+	in := func(d time.Duration) string {
+		return now.Add(d).UTC().Format(http.TimeFormat)
+	}
+
+	assert.Equal(t, 30*time.Second, entry(200, "Cache-Control", "max-age=60, s-maxage=30").freshnessLifetime())
+	assert.Equal(t, time.Hour, entry(200, "Expires", in(time.Hour)).freshnessLifetime())
+	assert.Equal(t, time.Duration(0), entry(200, "Expires", "0").freshnessLifetime())
+	assert.Equal(t, time.Hour, entry(200, "Last-Modified", in(-10*time.Hour)).freshnessLifetime(), "heuristic freshness")
+	assert.Equal(t, maxHeuristicFreshness, entry(200, "Last-Modified", in(-1000*time.Hour)).freshnessLifetime())
+	assert.Equal(t, time.Duration(0), entry(http.StatusFound, "Last-Modified", in(-10*time.Hour)).freshnessLifetime())
+
+	aged := entry(200, "Age", "100")
+	assert.Equal(t, 110*time.Second, aged.age(now.Add(10*time.Second)))
+}
+
+func TestRevalidation(t *testing.T) {
+	tc := newTestCache(NewMemoryStorage(1024 * 1024))
+	o := &testOrigin{handler: func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Cache-Control", "no-cache")
+		resp.Header().Set("ETag", `"v1"`)
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			resp.Header().Set("X-Revalidated", "true")
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+		resp.Write([]byte("content"))
+	}}
+
+	_, xcache, _ := tc.do(o, http.MethodGet, testURL)
+	assert.Equal(t, "MISS", xcache)
+	status, xcache, body := tc.do(o, http.MethodGet, testURL)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "REVALIDATED", xcache)
+	assert.Equal(t, "content", body)
+	assert.Equal(t, 2, o.count())
+
+	// The client's own conditions are evaluated against the cached response
+	status, xcache, body = tc.do(o, http.MethodGet, testURL, "If-None-Match", `"v1"`)
+	assert.Equal(t, http.StatusNotModified, status)
+	assert.Equal(t, "REVALIDATED", xcache)
+	assert.Empty(t, body)
+
+	entry, found := tc.storage.Get(testURL)
+	if assert.True(t, found) {
+		assert.Equal(t, "true", entry.Header.Get("X-Revalidated"), "headers should have been updated by 304")
+	}
+}
+
+func TestVary(t *testing.T) {
+	tc := newTestCache(NewMemoryStorage(1024 * 1024))
+	o := &testOrigin{handler: func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Cache-Control", "max-age=60")
+		resp.Header().Set("Vary", "accept-language")
+		resp.Write([]byte("content in " + req.Header.Get("Accept-Language")))
+	}}
+
+	_, xcache, body := tc.do(o, http.MethodGet, testURL, "Accept-Language", "en")
+	assert.Equal(t, "MISS", xcache)
+	assert.Equal(t, "content in en", body)
+	_, xcache, body = tc.do(o, http.MethodGet, testURL, "Accept-Language", "de")
+	assert.Equal(t, "MISS", xcache)
+	assert.Equal(t, "content in de", body)
+	_, xcache, body = tc.do(o, http.MethodGet, testURL, "Accept-Language", "en")
+	assert.Equal(t, "HIT", xcache)
+	assert.Equal(t, "content in en", body)
+	_, xcache, body = tc.do(o, http.MethodGet, testURL, "Accept-Language", "de")
+	assert.Equal(t, "HIT", xcache)
+	assert.Equal(t, "content in de", body)
+	assert.Equal(t, 2, o.count())
+}
+
+func TestNotStored(t *testing.T) {
+	tc := newTestCache(NewMemoryStorage(1024 * 1024))
+	cacheControl := ""
+	o := &testOrigin{handler: func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Cache-Control", cacheControl)
+		if req.URL.Path == "/big" {
+			resp.Write(make([]byte, 2048))
+		}
+		resp.Write([]byte("content"))
+	}}
+
+	for _, cc := range []string{"no-store", "private, max-age=60"} {
+		cacheControl = cc
+		tc.do(o, http.MethodGet, testURL)
+		_, xcache, _ := tc.do(o, http.MethodGet, testURL)
+		assert.Empty(t, xcache, cc)
+	}
+
+	cacheControl = "max-age=60"
+	tc.do(o, http.MethodGet, testURL, "Authorization", "Basic Zm9vOmJhcg==")
+	_, found := tc.storage.Get(testURL)
+	assert.False(t, found, "responses to authorized requests shouldn't be stored")
+
+	tc.do(o, http.MethodGet, "http://example.com/big")
+	_, found = tc.storage.Get("http://example.com/big")
+	assert.False(t, found, "responses over MaxObjectBytes shouldn't be stored")
+
+	tc.do(o, http.MethodGet, testURL)
+	_, xcache, _ := tc.do(o, http.MethodGet, testURL)
+	assert.Equal(t, "HIT", xcache)
+	tc.do(o, http.MethodPost, testURL)
+	_, xcache, _ = tc.do(o, http.MethodGet, testURL)
+	assert.Equal(t, "MISS", xcache, "successful POST should have invalidated the cached response")
+}
+
+func TestCoalescing(t *testing.T) {
+	tc := newTestCache(NewMemoryStorage(1024 * 1024))
+	release := make(chan struct{})
+	o := &testOrigin{handler: func(resp http.ResponseWriter, req *http.Request) {
+		<-release
+		resp.Header().Set("Cache-Control", "max-age=60")
+		resp.Header().Set("Content-Length", "7")
+		resp.Write([]byte("content"))
+	}}
+
+	const concurrency = 5
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	bodies := make(chan string, concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			_, _, body := tc.do(o, http.MethodGet, testURL)
+			bodies <- body
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(bodies)
+	for body := range bodies {
+		assert.Equal(t, "content", body)
+	}
+	assert.Equal(t, 1, o.count(), "concurrent misses should have been coalesced")
+}
+
+func TestCoalescingStreamed(t *testing.T) {
+	tc := newTestCache(NewMemoryStorage(1024 * 1024))
+	release := make(chan struct{})
+	var requests int32
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Cache-Control", "max-age=60")
+		resp.Write([]byte("first "))
+		resp.(http.Flusher).Flush()
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// The first response keeps streaming
+			<-release
+		}
+		resp.Write([]byte("last"))
+	}))
+	defer origin.Close()
+	next := func(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		return resp, ctx, err
+	}
+	get := func() (*http.Response, error) {
+		req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+		resp, _, err := tc.Filter().Apply(filters.BackgroundContext(), req, next)
+		return resp, err
+	}
+
+	streaming, err := get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer streaming.Body.Close()
+	b := make([]byte, len("first "))
+	if _, err := io.ReadFull(streaming.Body, b); !assert.NoError(t, err) {
+		return
+	}
+
+	// A concurrent request doesn't wait for the stream to end
+	second := make(chan string, 1)
+	go func() {
+		resp, err := get()
+		if err != nil {
+			second <- err.Error()
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		second <- string(body)
+	}()
+	select {
+	case body := <-second:
+		assert.Equal(t, "first last", body)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "concurrent request waited for the streamed response")
+	}
+	close(release)
+	rest, _ := ioutil.ReadAll(streaming.Body)
+	assert.Equal(t, "last", string(rest))
+}
+
+func TestDiskStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	storage, err := NewDiskStorage(dir, 1024*1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	tc := newTestCache(storage)
+	o := &testOrigin{handler: func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Cache-Control", "max-age=60")
+		resp.Write([]byte("content"))
+	}}
+	tc.do(o, http.MethodGet, testURL)
+
+	// Entries survive restarts
+	storage, err = NewDiskStorage(dir, 1024*1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	tc.Cache = NewWithStorage(storage, 1024)
+	tc.now = func() time.Time { return tc.clock }
+	_, xcache, body := tc.do(o, http.MethodGet, testURL)
+	assert.Equal(t, "HIT", xcache)
+	assert.Equal(t, "content", body)
+
+	// Least recently used entries are evicted
+	small, err := NewDiskStorage(dir, 1)
+	if !assert.NoError(t, err) {
+		return
+	}
+	small.Put("a", &Entry{StatusCode: http.StatusOK, Body: []byte("a")})
+	small.Put("b", &Entry{StatusCode: http.StatusOK, Body: []byte("b")})
+	_, found := small.Get("a")
+	assert.False(t, found)
+	entry, found := small.Get("b")
+	if assert.True(t, found) {
+		assert.Equal(t, "b", string(entry.Body))
+	}
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1)
+}
+
+func TestMemoryStorageEviction(t *testing.T) {
+	storage := NewMemoryStorage(10)
+	storage.Put("a", &Entry{Body: []byte("aaaa")})
+	storage.Put("b", &Entry{Body: []byte("bbbb")})
+	storage.Get("a")
+	storage.Put("c", &Entry{Body: []byte("cccc")})
+	_, found := storage.Get("b")
+	assert.False(t, found, "least recently used entry should have been evicted")
+	_, found = storage.Get("a")
+	assert.True(t, found)
+	_, found = storage.Get("c")
+	assert.True(t, found)
+}
@@ -0,0 +1,221 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxHeuristicFreshness caps the freshness lifetime of responses that
+	// don't specify one, see RFC 7234 section 4.2.2.
+	maxHeuristicFreshness = 24 * time.Hour
+)
+
+// cacheableByDefault are the status codes that can be cached without explicit
+// freshness information, see RFC 7231 section 6.1.
+var cacheableByDefault = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+	http.StatusPermanentRedirect:    true,
+}
+
+// cacheControl holds the directives of a Cache-Control header, mapping
+// directives without arguments to "".
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := make(cacheControl)
+	for _, value := range header["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, arg := directive, ""
+			if idx := strings.IndexByte(directive, '='); idx >= 0 {
+				name, arg = directive[:idx], strings.Trim(strings.TrimSpace(directive[idx+1:]), `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(name))] = arg
+		}
+	}
+	// Pragma: no-cache is the HTTP/1.0 equivalent of Cache-Control: no-cache
+	if len(header["Cache-Control"]) == 0 && strings.EqualFold(header.Get("Pragma"), "no-cache") {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, found := cc[directive]
+	return found
+}
+
+// seconds returns the value of a delta-seconds directive. Invalid values are
+// treated as 0 (i.e. as stale as possible) and a max-stale without a value
+// as unlimited.
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	arg, found := cc[directive]
+	if !found {
+		return 0, false
+	}
+	if arg == "" && directive == "max-stale" {
+		return time.Duration(1<<63 - 1), true
+	}
+	secs, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || secs < 0 {
+		return 0, true
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
+// storable checks whether a shared cache may store the response to req, see
+// RFC 7234 section 3.
+func storable(req *http.Request, reqCC cacheControl, resp *http.Response) bool {
+	if req.Method != http.MethodGet || reqCC.has("no-store") {
+		return false
+	}
+	respCC := parseCacheControl(resp.Header)
+	if respCC.has("no-store") || respCC.has("private") {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" && !respCC.has("public") && !respCC.has("s-maxage") && !respCC.has("must-revalidate") {
+		return false
+	}
+	if strings.TrimSpace(resp.Header.Get("Vary")) == "*" {
+		return false
+	}
+	if cacheableByDefault[resp.StatusCode] {
+		return true
+	}
+	// Other final responses may be cached if they say for how long
+	return resp.StatusCode >= 200 && resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusNotModified &&
+		(respCC.has("public") || respCC.has("s-maxage") || respCC.has("max-age") || resp.Header.Get("Expires") != "")
+}
+
+// freshnessLifetime calculates how long the entry is fresh for, see RFC 7234
+// section 4.2.1.
+func (e *Entry) freshnessLifetime() time.Duration {
+	cc := parseCacheControl(e.Header)
+	if lifetime, found := cc.seconds("s-maxage"); found {
+		return lifetime
+	}
+	if lifetime, found := cc.seconds("max-age"); found {
+		return lifetime
+	}
+	date := e.date()
+	if expiresHeader := e.Header.Get("Expires"); expiresHeader != "" {
+		expires, err := http.ParseTime(expiresHeader)
+		if err != nil || expires.Before(date) {
+			// Invalid dates like "0" mean already expired
+			return 0
+		}
+		return expires.Sub(date)
+	}
+	if !cacheableByDefault[e.StatusCode] {
+		return 0
+	}
+	if lastModified, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && lastModified.Before(date) {
+		// Heuristic freshness is 10% of the time since the last modification
+		lifetime := date.Sub(lastModified) / 10
+		if lifetime > maxHeuristicFreshness {
+			lifetime = maxHeuristicFreshness
+		}
+		return lifetime
+	}
+	return 0
+}
+
+func (e *Entry) date() time.Time {
+	date, err := http.ParseTime(e.Header.Get("Date"))
+	if err != nil {
+		return e.ResponseTime
+	}
+	return date
+}
+
+// age calculates the current age of the entry, see RFC 7234 section 4.2.3.
+func (e *Entry) age(now time.Time) time.Duration {
+	apparentAge := e.ResponseTime.Sub(e.date())
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+	var ageValue time.Duration
+	if secs, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && secs > 0 {
+		ageValue = time.Duration(secs) * time.Second
+	}
+	correctedAgeValue := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	correctedInitialAge := apparentAge
+	if correctedAgeValue > correctedInitialAge {
+		correctedInitialAge = correctedAgeValue
+	}
+	return correctedInitialAge + now.Sub(e.ResponseTime)
+}
+
+// usable checks whether the entry can be served for a request with the given
+// Cache-Control directives without revalidating it, see RFC 7234 section 4.2.4
+// and 5.2.1. It also returns whether the entry is stale.
+func (e *Entry) usable(reqCC cacheControl, now time.Time) (ok bool, stale bool) {
+	respCC := parseCacheControl(e.Header)
+	if reqCC.has("no-cache") || respCC.has("no-cache") {
+		return false, false
+	}
+	lifetime := e.freshnessLifetime()
+	age := e.age(now)
+	if maxAge, found := reqCC.seconds("max-age"); found && age > maxAge {
+		return false, false
+	}
+	if minFresh, found := reqCC.seconds("min-fresh"); found {
+		age += minFresh
+	}
+	if age < lifetime {
+		return true, false
+	}
+	if respCC.has("must-revalidate") || respCC.has("proxy-revalidate") || respCC.has("s-maxage") {
+		return false, true
+	}
+	maxStale, found := reqCC.seconds("max-stale")
+	return found && age-lifetime <= maxStale, true
+}
+
+// revalidatable checks whether the entry has a validator with which to make a
+// conditional request.
+func (e *Entry) revalidatable() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// notModified checks whether the entry satisfies req's conditional headers, in
+// which case the client should get a 304, see RFC 7232 section 6.
+func (e *Entry) notModified(req *http.Request) bool {
+	if e.StatusCode != http.StatusOK {
+		return false
+	}
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(e.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	return err == nil && !lastModified.After(ims)
+}
@@ -0,0 +1,268 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+// Entry is a cached response.
+type Entry struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+
+	// RequestTime and ResponseTime are when the request that produced this
+	// response was sent and when the response was received, used to calculate
+	// its age.
+	RequestTime  time.Time
+	ResponseTime time.Time
+
+	// Vary, if set, means that this entry only records which request headers
+	// the response varies by. The actual responses are stored under variant
+	// keys.
+	Vary []string
+}
+
+func (e *Entry) size() int64 {
+	size := int64(len(e.Body))
+	for key, values := range e.Header {
+		size += int64(len(key))
+		for _, value := range values {
+			size += int64(len(value))
+		}
+	}
+	for _, v := range e.Vary {
+		size += int64(len(v))
+	}
+	return size
+}
+
+// Storage stores cache entries. Implementations must be safe for concurrent
+// use and should log rather than return their errors, treating entries that
+// can't be read as missing.
+type Storage interface {
+	// Get gets the entry stored under key.
+	Get(key string) (*Entry, bool)
+
+	// Put stores entry under key, replacing any existing entry.
+	Put(key string, entry *Entry)
+
+	// Delete removes the entry stored under key, if any.
+	Delete(key string)
+}
+
+// lruIndex tracks the sizes and recency of stored entries so that the least
+// recently used ones can be evicted once they exceed maxBytes.
+type lruIndex struct {
+	maxBytes int64
+	size     int64
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+type lruItem struct {
+	key   string
+	size  int64
+	entry *Entry
+}
+
+func newLRUIndex(maxBytes int64) *lruIndex {
+	return &lruIndex{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+func (idx *lruIndex) get(key string) (*lruItem, bool) {
+	el, found := idx.elements[key]
+	if !found {
+		return nil, false
+	}
+	idx.order.MoveToFront(el)
+	return el.Value.(*lruItem), true
+}
+
+// add adds an item and returns the items that had to be evicted to make room.
+func (idx *lruIndex) add(item *lruItem) []*lruItem {
+	idx.remove(item.key)
+	idx.elements[item.key] = idx.order.PushFront(item)
+	idx.size += item.size
+	var evicted []*lruItem
+	for idx.size > idx.maxBytes && idx.order.Len() > 1 {
+		oldest := idx.order.Back().Value.(*lruItem)
+		idx.remove(oldest.key)
+		evicted = append(evicted, oldest)
+	}
+	return evicted
+}
+
+func (idx *lruIndex) remove(key string) bool {
+	el, found := idx.elements[key]
+	if !found {
+		return false
+	}
+	idx.order.Remove(el)
+	delete(idx.elements, key)
+	idx.size -= el.Value.(*lruItem).size
+	return true
+}
+
+type memoryStorage struct {
+	idx *lruIndex
+	mx  sync.Mutex
+}
+
+// NewMemoryStorage constructs a Storage that keeps up to maxBytes of entries
+// in memory, evicting the least recently used ones.
+func NewMemoryStorage(maxBytes int64) Storage {
+	return &memoryStorage{idx: newLRUIndex(maxBytes)}
+}
+
+func (s *memoryStorage) Get(key string) (*Entry, bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	item, found := s.idx.get(key)
+	if !found {
+		return nil, false
+	}
+	return item.entry, true
+}
+
+func (s *memoryStorage) Put(key string, entry *Entry) {
+	s.mx.Lock()
+	s.idx.add(&lruItem{key: key, size: entry.size(), entry: entry})
+	s.mx.Unlock()
+}
+
+func (s *memoryStorage) Delete(key string) {
+	s.mx.Lock()
+	s.idx.remove(key)
+	s.mx.Unlock()
+}
+
+type diskStorage struct {
+	dir string
+	idx *lruIndex
+	mx  sync.Mutex
+}
+
+// NewDiskStorage constructs a Storage that keeps up to maxBytes of entries in
+// files in dir, evicting the least recently used ones. Entries already in dir
+// are reused.
+func NewDiskStorage(dir string, maxBytes int64) (Storage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.New("Unable to create cache directory %v: %v", dir, err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.New("Unable to read cache directory %v: %v", dir, err)
+	}
+	s := &diskStorage{dir: dir, idx: newLRUIndex(maxBytes)}
+	// Oldest first so that the most recently modified files end up at the
+	// front
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		for _, evicted := range s.idx.add(&lruItem{key: name, size: file.Size()}) {
+			s.removeFile(evicted.key)
+		}
+	}
+	return s, nil
+}
+
+func (s *diskStorage) fileName(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func (s *diskStorage) Get(key string) (*Entry, bool) {
+	name := s.fileName(key)
+	s.mx.Lock()
+	_, found := s.idx.get(name)
+	s.mx.Unlock()
+	if !found {
+		return nil, false
+	}
+	file, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		log.Errorf("Unable to open cache entry: %v", err)
+		s.Delete(key)
+		return nil, false
+	}
+	defer file.Close()
+	entry := &Entry{}
+	if err := gob.NewDecoder(file).Decode(entry); err != nil {
+		log.Errorf("Unable to decode cache entry from %v: %v", file.Name(), err)
+		s.Delete(key)
+		return nil, false
+	}
+	return entry, true
+}
+
+func (s *diskStorage) Put(key string, entry *Entry) {
+	name := s.fileName(key)
+	// Write to a temporary file first so that readers never see partial
+	// entries
+	tmp, err := ioutil.TempFile(s.dir, ".tmp")
+	if err != nil {
+		log.Errorf("Unable to create cache file: %v", err)
+		return
+	}
+	err = gob.NewEncoder(tmp).Encode(entry)
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(s.dir, name))
+	}
+	if err != nil {
+		log.Errorf("Unable to write cache entry: %v", err)
+		os.Remove(tmp.Name())
+		return
+	}
+	info, err := os.Stat(filepath.Join(s.dir, name))
+	if err != nil {
+		log.Errorf("Unable to stat cache entry: %v", err)
+		return
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for _, evicted := range s.idx.add(&lruItem{key: name, size: info.Size()}) {
+		s.removeFile(evicted.key)
+	}
+}
+
+func (s *diskStorage) Delete(key string) {
+	name := s.fileName(key)
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.idx.remove(name) {
+		s.removeFile(name)
+	}
+}
+
+func (s *diskStorage) removeFile(name string) {
+	if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !os.IsNotExist(err) {
+		log.Errorf("Unable to remove cache entry: %v", err)
+	}
+}
@@ -0,0 +1,667 @@
+// Package config provides a declarative JSON configuration for the http-proxy
+// command, describing its listeners, listener wrappers, filter chain and
+// logging.
+//
+// An example configuration:
+//
+//	{
+//	  "idleTimeout": "30s",
+//	  "shutdownTimeout": "1m",
+//	  "maxConns": 1000,
+//	  "proxyProtocol": {"trustedCIDRs": ["10.0.0.0/24"]},
+//	  "listeners": [
+//	    {"protocol": "http", "addr": ":8080"},
+//	    {"protocol": "https", "addr": ":8443", "keyFile": "key.pem", "certFile": "cert.pem"},
+//	    {"protocol": "lampshade", "addr": ":14443", "keyFile": "lampshade.pem", "fallback": "127.0.0.1:80"}
+//	  ],
+//	  "filters": [
+//	    {"type": "auth", "realm": "proxy", "htpasswdFile": "htpasswd", "tokens": {"s3cr3t": "monitoring"}},
+//	    {"type": "blockLocal", "exceptions": ["127.0.0.1:7300"]},
+//	    {"type": "acl", "deny": [".ads.example.com", "path:^/tracking/"], "denyFiles": ["/etc/http-proxy/deny.txt"], "reloadInterval": "5m"},
+//	    {"type": "restrictConnectPorts", "ports": [80, 443]},
+//	    {"type": "rateLimit", "numClients": 5000, "hostPeriods": {"example.com": "1s"}},
+//	    {"type": "egress", "rules": [{"users": ["batch"], "sourceIPs": ["192.0.2.10", "192.0.2.11"], "family": "ipv4"}]},
+//	    {"type": "rewriteHeaders", "rules": [{"request": [{"action": "strip"}, {"action": "via"}], "response": [{"action": "remove", "name": "Server"}]}]},
+//	    {"type": "addForwardedFor"}
+//	  ],
+//	  "upstream": {
+//	    "parents": {
+//	      "corp": {"type": "http", "addr": "proxy.corp.example.com:3128", "username": "user", "password": "pass"},
+//	      "backup": {"type": "socks5", "addr": "socks.corp.example.com:1080"}
+//	    },
+//	    "rules": [
+//	      {"suffixes": ["corp.example.com"], "cidrs": ["10.0.0.0/8"], "via": ["direct"]}
+//	    ],
+//	    "default": ["corp", "backup"]
+//	  },
+//	  "socks5": {},
+//	  "cache": {"dir": "/var/cache/http-proxy", "maxBytes": 10737418240, "maxObjectBytes": 536870912},
+//	  "mitm": {"caKeyFile": "mitm-ca-key.pem", "caCertFile": "mitm-ca-cert.pem", "hosts": [".example.com"]},
+//	  "pool": {"maxIdleConnsPerOrigin": 16, "preDialConnect": 2},
+//	  "dns": {"servers": ["https://1.1.1.1/dns-query", "udp://9.9.9.9"], "negativeTTL": "10s"},
+//	  "throttle": {"global": {"bytesPerSecond": 125000000}, "perClient": {"bytesPerSecond": 1250000, "burst": 5000000}},
+//	  "admin": {"addr": "127.0.0.1:9090"},
+//	  "pac": {"host": "proxy.example.com", "bypass": [".intranet.example.com", "10.0.0.0/8"], "fallbackDirect": true},
+//	  "accessLog": {"file": "/var/log/http-proxy/access.log", "format": "combined"},
+//	  "logging": {"dir": "/var/log/http-proxy", "rotationSize": 4194304, "maxRotation": 5}
+//	}
+//
+// The filter chain can be reloaded at runtime without affecting existing
+// connections (see Filter). Changes to listeners, listener wrappers, upstream
+// and logging only take effect on restart.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/lampshade"
+	"github.com/getlantern/proxy"
+	"github.com/getlantern/proxy/filters"
+
+	"github.com/getlantern/http-proxy/accesslog"
+	"github.com/getlantern/http-proxy/cache"
+	"github.com/getlantern/http-proxy/listeners"
+	"github.com/getlantern/http-proxy/logging"
+	"github.com/getlantern/http-proxy/mitm"
+	"github.com/getlantern/http-proxy/pac"
+	"github.com/getlantern/http-proxy/proxyfilters"
+	"github.com/getlantern/http-proxy/resolver"
+	"github.com/getlantern/http-proxy/throttle"
+)
+
+const (
+	// ProtocolHTTP is a plain HTTP listener
+	ProtocolHTTP = "http"
+	// ProtocolHTTPS is a TLS listener
+	ProtocolHTTPS = "https"
+	// ProtocolLampshade is a lampshade-multiplexed listener
+	ProtocolLampshade = "lampshade"
+)
+
+const (
+	defaultIdleTimeout     = 30 * time.Second
+	defaultShutdownTimeout = 60 * time.Second
+)
+
+var (
+	log = golog.LoggerFor("http-proxy.config")
+)
+
+// Config is the complete configuration for the http-proxy command.
+type Config struct {
+	// IdleTimeout is how long connections may remain idle before being closed.
+	IdleTimeout Duration `json:"idleTimeout"`
+
+	// ShutdownTimeout is how long to wait for in-flight requests and tunnels to
+	// finish when shutting down before forcibly closing them.
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+
+	// MaxConns limits the number of simultaneous connections, 0 means
+	// unlimited.
+	MaxConns uint64 `json:"maxConns"`
+
+	// Listeners are the addresses on which the proxy accepts connections.
+	Listeners []*Listener `json:"listeners"`
+
+	// ProxyProtocol, if set, accepts PROXY protocol headers from trusted load
+	// balancers on all listeners.
+	ProxyProtocol *ProxyProtocol `json:"proxyProtocol"`
+
+	// Filters is the ordered filter chain applied to every request.
+	Filters []*FilterConfig `json:"filters"`
+
+	// Upstream configures parent proxies, if nil destinations are dialed
+	// directly.
+	Upstream *Upstream `json:"upstream"`
+
+	// SOCKS5, if set, enables SOCKS5 clients on all listeners alongside HTTP
+	// clients.
+	SOCKS5 *SOCKS5 `json:"socks5"`
+
+	// Cache, if set, caches responses to GET requests.
+	Cache *cache.Opts `json:"cache"`
+
+	// MITM, if set, intercepts HTTPS to selected hosts so that the requests
+	// inside of CONNECT tunnels go through the filter chain.
+	MITM *mitm.Opts `json:"mitm"`
+
+	// Pool configures the pool of upstream connections shared by all clients.
+	Pool *Pool `json:"pool"`
+
+	// DNS configures how destinations are resolved, if nil the system
+	// resolver is used (with caching).
+	DNS *DNS `json:"dns"`
+
+	// Throttle, if set, limits bandwidth globally, per client IP and per
+	// authenticated user.
+	Throttle *throttle.Opts `json:"throttle"`
+
+	// Admin, if set, serves Prometheus metrics at /metrics on a separate
+	// listener.
+	Admin *Admin `json:"admin"`
+
+	// PAC, if set, serves a Proxy Auto-Config file for the proxy's listeners
+	// at /proxy.pac and /wpad.dat on the admin listener.
+	PAC *PAC `json:"pac"`
+
+	// AccessLog, if set, records every request and CONNECT tunnel.
+	AccessLog *accesslog.Opts `json:"accessLog"`
+
+	// Logging configures log output.
+	Logging *logging.Opts `json:"logging"`
+
+	resolver *resolver.Resolver
+	built    *Built
+}
+
+// Built holds what gets built from a Config, see Build.
+type Built struct {
+	// Resolver is shared by the Filter and the Dial.
+	Resolver        *resolver.Resolver
+	Filter          filters.Filter
+	Dial            proxy.DialFunc
+	SOCKS5Passwords proxyfilters.PasswordBackend
+}
+
+// Listener configures a single listener.
+type Listener struct {
+	// Protocol is one of "http", "https" or "lampshade".
+	Protocol string `json:"protocol"`
+
+	// Addr is the address to listen on.
+	Addr string `json:"addr"`
+
+	// KeyFile is the private key file name (https and lampshade only). For
+	// lampshade, this is the RSA key used to decrypt session initialization.
+	KeyFile string `json:"keyFile"`
+
+	// CertFile is the certificate file name (https only).
+	CertFile string `json:"certFile"`
+
+	// Fallback is the address of a decoy server, like a local web server, to
+	// which connections that don't start a valid session are proxied
+	// (lampshade only). This makes the listener look like the decoy to active
+	// probes. If empty, such connections are ignored until they give up.
+	Fallback string `json:"fallback"`
+
+	// RequireTimestamp rejects sessions from older lampshade clients whose
+	// init messages aren't timestamped, which can otherwise be replayed once
+	// they've dropped out of the replay cache (lampshade only). Enable it once
+	// all clients have been upgraded.
+	RequireTimestamp bool `json:"requireTimestamp"`
+
+	// MaxClockSkew is how far the timestamps of init messages may be from the
+	// listener's clock (lampshade only), defaults to 2 minutes.
+	MaxClockSkew Duration `json:"maxClockSkew"`
+
+	// ReplayCacheSize is how many init messages are remembered to detect
+	// replays per 2 * MaxClockSkew (lampshade only), defaults to 100,000.
+	ReplayCacheSize int `json:"replayCacheSize"`
+}
+
+// LampshadeFallback returns the lampshade.Fallback for this listener, or nil
+// for the default.
+func (l *Listener) LampshadeFallback() lampshade.Fallback {
+	if l.Fallback == "" {
+		return nil
+	}
+	return lampshade.ProxyFallbackTo(l.Fallback)
+}
+
+// LampshadeOpts returns the lampshade.ListenerOpts for this listener, without
+// the pool and private key.
+func (l *Listener) LampshadeOpts() *lampshade.ListenerOpts {
+	return &lampshade.ListenerOpts{
+		Fallback:         l.LampshadeFallback(),
+		RequireTimestamp: l.RequireTimestamp,
+		MaxClockSkew:     time.Duration(l.MaxClockSkew),
+		ReplayCacheSize:  l.ReplayCacheSize,
+	}
+}
+
+// ProxyProtocol configures PROXY protocol support, see
+// listeners.NewProxyProtocolListener.
+type ProxyProtocol struct {
+	// TrustedCIDRs are the IPs or networks of the load balancers, which are
+	// required to send PROXY headers. Other clients connect as usual.
+	TrustedCIDRs []string `json:"trustedCIDRs"`
+
+	// HeaderTimeout limits how long load balancers have to send the header.
+	HeaderTimeout Duration `json:"headerTimeout"`
+}
+
+// Opts returns the listener options, or nil if PROXY protocol isn't enabled.
+func (pp *ProxyProtocol) Opts() (*listeners.ProxyProtocolOpts, error) {
+	if pp == nil {
+		return nil, nil
+	}
+	if len(pp.TrustedCIDRs) == 0 {
+		return nil, fmt.Errorf("PROXY protocol requires trustedCIDRs")
+	}
+	opts := &listeners.ProxyProtocolOpts{HeaderTimeout: time.Duration(pp.HeaderTimeout)}
+	for _, cidr := range pp.TrustedCIDRs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid PROXY protocol trusted CIDR: %v", err)
+		}
+		opts.TrustedCIDRs = append(opts.TrustedCIDRs, ipNet)
+	}
+	return opts, nil
+}
+
+// SOCKS5 configures SOCKS5 support.
+type SOCKS5 struct {
+	// HtpasswdFile, if set, requires SOCKS5 clients to authenticate with a
+	// username and password listed in this file (bcrypt only). Otherwise,
+	// credentials are left to the filter chain (see the auth filter).
+	HtpasswdFile string `json:"htpasswdFile"`
+}
+
+// Pool configures the pool of upstream connections, see proxy.PoolOpts.
+type Pool struct {
+	// MaxConnsPerOrigin limits the connections for plain HTTP requests to each
+	// origin, 0 means unlimited.
+	MaxConnsPerOrigin int `json:"maxConnsPerOrigin"`
+
+	// MaxIdleConnsPerOrigin limits the idle keep-alive connections kept for
+	// each origin.
+	MaxIdleConnsPerOrigin int `json:"maxIdleConnsPerOrigin"`
+
+	// MaxIdleConns limits the total number of idle connections.
+	MaxIdleConns int `json:"maxIdleConns"`
+
+	// PreDialConnect is the number of spare connections to keep dialed to the
+	// origins of recent CONNECT requests, 0 disables pre-dialing.
+	PreDialConnect int `json:"preDialConnect"`
+
+	// HealthCheckInterval is how often pre-dialed connections are checked.
+	HealthCheckInterval Duration `json:"healthCheckInterval"`
+}
+
+// Opts returns the pool options for the proxy, or nil for the defaults.
+func (p *Pool) Opts() *proxy.PoolOpts {
+	if p == nil {
+		return nil
+	}
+	return &proxy.PoolOpts{
+		MaxConnsPerOrigin:     p.MaxConnsPerOrigin,
+		MaxIdleConnsPerOrigin: p.MaxIdleConnsPerOrigin,
+		MaxIdleConns:          p.MaxIdleConns,
+		PreDialCONNECT:        p.PreDialConnect,
+		HealthCheckInterval:   time.Duration(p.HealthCheckInterval),
+	}
+}
+
+// DNS configures the resolver, see resolver.Opts.
+type DNS struct {
+	// Servers are the DNS servers to query in order of preference, as
+	// "udp://ip:port", "tcp://ip:port" or DoH URLs. If empty, the system
+	// resolver is used.
+	Servers []string `json:"servers"`
+
+	// Timeout limits each query to a server.
+	Timeout Duration `json:"timeout"`
+
+	// MinTTL and MaxTTL bound how long answers are cached.
+	MinTTL Duration `json:"minTTL"`
+	MaxTTL Duration `json:"maxTTL"`
+
+	// NegativeTTL is how long names that don't exist are cached if the answer
+	// doesn't say.
+	NegativeTTL Duration `json:"negativeTTL"`
+
+	// SystemTTL is how long answers from the system resolver are cached.
+	SystemTTL Duration `json:"systemTTL"`
+
+	// CacheSize limits the number of names cached.
+	CacheSize int `json:"cacheSize"`
+}
+
+// Opts returns the resolver options, or nil for the defaults.
+func (d *DNS) Opts() *resolver.Opts {
+	if d == nil {
+		return nil
+	}
+	return &resolver.Opts{
+		Servers:     d.Servers,
+		Timeout:     time.Duration(d.Timeout),
+		MinTTL:      time.Duration(d.MinTTL),
+		MaxTTL:      time.Duration(d.MaxTTL),
+		NegativeTTL: time.Duration(d.NegativeTTL),
+		SystemTTL:   time.Duration(d.SystemTTL),
+		CacheSize:   d.CacheSize,
+	}
+}
+
+// Admin configures the admin listener.
+type Admin struct {
+	// Addr is the address to listen on. It should not be reachable by proxy
+	// clients.
+	Addr string `json:"addr"`
+}
+
+// PAC configures the Proxy Auto-Config file, see pac.Opts.
+type PAC struct {
+	// Host is the proxy's host name as clients know it. Defaults to the host
+	// that clients requested the PAC file from.
+	Host string `json:"host"`
+
+	// Bypass lists destinations that clients reach directly, as hosts,
+	// ".domains", "*.subdomains", IPs or IPv4 CIDRs, in addition to the ones
+	// that upstream rules route directly.
+	Bypass []string `json:"bypass"`
+
+	// BypassLocal bypasses the proxy for plain host names and loopback
+	// addresses. It's implied by a blockLocal filter, since the proxy refuses
+	// those anyway.
+	BypassLocal bool `json:"bypassLocal"`
+
+	// FallbackDirect lets clients connect directly if the proxy is down.
+	FallbackDirect bool `json:"fallbackDirect"`
+
+	// TemplateFile is a text/template to generate the file with instead of
+	// the default one, see pac.Data.
+	TemplateFile string `json:"templateFile"`
+}
+
+// PACFile builds the Proxy Auto-Config file generator, or returns nil if it's not
+// configured. Clients are pointed at all http and https listeners (and at http
+// listeners for SOCKS5 if that's enabled) in the order they're configured.
+// Destinations that the proxy would dial directly anyway according to the
+// upstream rules bypass it.
+func (cfg *Config) PACFile() (*pac.PAC, error) {
+	if cfg.PAC == nil {
+		return nil, nil
+	}
+	opts := &pac.Opts{
+		Host:           cfg.PAC.Host,
+		Bypass:         append(cfg.Upstream.directDestinations(), cfg.PAC.Bypass...),
+		BypassLocal:    cfg.PAC.BypassLocal,
+		FallbackDirect: cfg.PAC.FallbackDirect,
+	}
+	var socks5 []*pac.Proxy
+	for _, l := range cfg.Listeners {
+		_, portString, err := net.SplitHostPort(l.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to determine port of listener %v: %v", l.Addr, err)
+		}
+		port, err := strconv.Atoi(portString)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to determine port of listener %v: %v", l.Addr, err)
+		}
+		switch l.Protocol {
+		case ProtocolHTTP:
+			opts.Proxies = append(opts.Proxies, &pac.Proxy{Type: pac.ProxyTypeHTTP, Port: port})
+			if cfg.SOCKS5 != nil {
+				socks5 = append(socks5, &pac.Proxy{Type: pac.ProxyTypeSOCKS5, Port: port})
+			}
+		case ProtocolHTTPS:
+			opts.Proxies = append(opts.Proxies, &pac.Proxy{Type: pac.ProxyTypeHTTPS, Port: port})
+		}
+	}
+	opts.Proxies = append(opts.Proxies, socks5...)
+	for _, fc := range cfg.Filters {
+		if fc.Type == "blockLocal" {
+			opts.BypassLocal = true
+		}
+	}
+	if cfg.PAC.TemplateFile != "" {
+		b, err := ioutil.ReadFile(cfg.PAC.TemplateFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read PAC template: %v", err)
+		}
+		opts.Template = string(b)
+	}
+	return pac.New(opts)
+}
+
+// Load reads and validates the configuration at the given path.
+func Load(path string) (*Config, error) {
+	return LoadWithResolver(path, nil)
+}
+
+// LoadWithResolver is like Load, but if r is not nil the configuration is
+// built with it instead of a new resolver, ignoring the DNS section. This
+// allows reloaded filters to share the running resolver with the dialer.
+func LoadWithResolver(path string, r *resolver.Resolver) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read config file %v: %v", path, err)
+	}
+	cfg, err := parse(b, r)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load config file %v: %v", path, err)
+	}
+	log.Debugf("Loaded config from %v", path)
+	return cfg, nil
+}
+
+// NotReloaded returns the names of the sections that differ in newCfg, other
+// than filters. Only filters get reloaded, so changes to the others need a
+// restart.
+func (cfg *Config) NotReloaded(newCfg *Config) []string {
+	sections := func(c *Config) []interface{} {
+		return []interface{}{c.IdleTimeout, c.ShutdownTimeout, c.MaxConns, c.Listeners, c.ProxyProtocol,
+			c.Upstream, c.SOCKS5, c.Cache, c.MITM, c.Pool, c.DNS, c.Throttle, c.Admin, c.PAC, c.AccessLog, c.Logging}
+	}
+	names := []string{"idleTimeout", "shutdownTimeout", "maxConns", "listeners", "proxyProtocol",
+		"upstream", "socks5", "cache", "mitm", "pool", "dns", "throttle", "admin", "pac", "accessLog", "logging"}
+	old, updated := sections(cfg), sections(newCfg)
+	var changed []string
+	for i, name := range names {
+		a, errA := json.Marshal(old[i])
+		b, errB := json.Marshal(updated[i])
+		if errA != nil || errB != nil || string(a) != string(b) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// Parse parses and validates the given JSON configuration.
+func Parse(b []byte) (*Config, error) {
+	return parse(b, nil)
+}
+
+func parse(b []byte, r *resolver.Resolver) (*Config, error) {
+	cfg := &Config{resolver: r}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("Unable to parse config: %v", err)
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = Duration(defaultIdleTimeout)
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		cfg.ShutdownTimeout = Duration(defaultShutdownTimeout)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate checks that the configuration is usable, including that it can be
+// built (see Build).
+func (cfg *Config) Validate() error {
+	if len(cfg.Listeners) == 0 {
+		return fmt.Errorf("No listeners configured")
+	}
+	for i, l := range cfg.Listeners {
+		if l.Addr == "" {
+			return fmt.Errorf("Listener %d is missing addr", i)
+		}
+		if l.Fallback != "" && l.Protocol != ProtocolLampshade {
+			return fmt.Errorf("Listener %d (%v) only supports fallback with lampshade", i, l.Addr)
+		}
+		if (l.RequireTimestamp || l.MaxClockSkew != 0 || l.ReplayCacheSize != 0) && l.Protocol != ProtocolLampshade {
+			return fmt.Errorf("Listener %d (%v) only supports replay protection with lampshade", i, l.Addr)
+		}
+		if l.MaxClockSkew < 0 || l.ReplayCacheSize < 0 {
+			return fmt.Errorf("Listener %d (%v) has negative maxClockSkew or replayCacheSize", i, l.Addr)
+		}
+		switch l.Protocol {
+		case ProtocolHTTP:
+		case ProtocolHTTPS:
+			if l.KeyFile == "" || l.CertFile == "" {
+				return fmt.Errorf("Listener %d (%v) requires keyFile and certFile", i, l.Addr)
+			}
+		case ProtocolLampshade:
+			if l.KeyFile == "" {
+				return fmt.Errorf("Listener %d (%v) requires keyFile", i, l.Addr)
+			}
+			if l.Fallback != "" {
+				if _, _, err := net.SplitHostPort(l.Fallback); err != nil {
+					return fmt.Errorf("Listener %d (%v) has invalid fallback: %v", i, l.Addr, err)
+				}
+			}
+		default:
+			return fmt.Errorf("Listener %d (%v) has unknown protocol '%v'", i, l.Addr, l.Protocol)
+		}
+	}
+	if _, err := cfg.ProxyProtocol.Opts(); err != nil {
+		return err
+	}
+	if cfg.Admin != nil && cfg.Admin.Addr == "" {
+		return fmt.Errorf("Admin is missing addr")
+	}
+	if cfg.PAC != nil && cfg.Admin == nil {
+		return fmt.Errorf("PAC requires admin")
+	}
+	if _, err := cfg.PACFile(); err != nil {
+		return err
+	}
+	if cfg.Cache != nil {
+		if err := cfg.Cache.Validate(); err != nil {
+			return err
+		}
+	}
+	if cfg.MITM != nil {
+		if err := cfg.MITM.Validate(); err != nil {
+			return err
+		}
+	}
+	if p := cfg.Pool; p != nil && (p.MaxConnsPerOrigin < 0 || p.MaxIdleConnsPerOrigin < 0 || p.MaxIdleConns < 0 || p.PreDialConnect < 0 || p.HealthCheckInterval < 0) {
+		return fmt.Errorf("Pool limits must not be negative")
+	}
+	if cfg.DNS != nil {
+		if err := cfg.DNS.Opts().Validate(); err != nil {
+			return err
+		}
+	}
+	if cfg.Throttle != nil {
+		for name, limits := range map[string]*throttle.Limits{"global": cfg.Throttle.Global, "perClient": cfg.Throttle.PerClient, "perUser": cfg.Throttle.PerUser} {
+			if limits != nil && (limits.BytesPerSecond < 0 || limits.Burst < 0) {
+				return fmt.Errorf("Throttle %v limits must not be negative", name)
+			}
+		}
+	}
+	if cfg.AccessLog != nil {
+		if err := cfg.AccessLog.Validate(); err != nil {
+			return err
+		}
+	}
+	_, err := cfg.Build()
+	return err
+}
+
+// Build builds the resolver, filter chain, upstream dialer and SOCKS5
+// passwords. They're only built once, later calls return the same ones.
+func (cfg *Config) Build() (*Built, error) {
+	if cfg.built != nil {
+		return cfg.built, nil
+	}
+	r, err := cfg.Resolver()
+	if err != nil {
+		return nil, err
+	}
+	filter, err := cfg.buildFilter(r)
+	if err != nil {
+		return nil, err
+	}
+	dial, err := cfg.buildDial(r)
+	if err != nil {
+		return nil, err
+	}
+	socks5Passwords, err := cfg.SOCKS5Passwords()
+	if err != nil {
+		return nil, err
+	}
+	cfg.built = &Built{
+		Resolver:        r,
+		Filter:          filter,
+		Dial:            dial,
+		SOCKS5Passwords: socks5Passwords,
+	}
+	return cfg.built, nil
+}
+
+// Resolver returns the resolver used by filters and for dialing destinations,
+// building it on first use.
+func (cfg *Config) Resolver() (*resolver.Resolver, error) {
+	if cfg.resolver == nil {
+		r, err := resolver.New(cfg.DNS.Opts())
+		if err != nil {
+			return nil, err
+		}
+		cfg.resolver = r
+	}
+	return cfg.resolver, nil
+}
+
+// SOCKS5Passwords loads the passwords with which SOCKS5 clients authenticate,
+// or returns nil if SOCKS5 is disabled or doesn't require authentication.
+func (cfg *Config) SOCKS5Passwords() (proxyfilters.PasswordBackend, error) {
+	if cfg.SOCKS5 == nil || cfg.SOCKS5.HtpasswdFile == "" {
+		return nil, nil
+	}
+	return proxyfilters.LoadHtpasswd(cfg.SOCKS5.HtpasswdFile)
+}
+
+// SOCKS5UDP checks whether SOCKS5 clients may relay UDP, which is only the
+// case if SOCKS5 is enabled and nothing is routed via upstream parents, since
+// datagrams always leave directly from this host.
+func (cfg *Config) SOCKS5UDP() bool {
+	return cfg.SOCKS5 != nil && !cfg.Upstream.viaParents()
+}
+
+// Duration is a time.Duration that can be unmarshaled from JSON either as a
+// string like "1m30s" or as a number of seconds.
+type Duration time.Duration
+
+// UnmarshalJSON implements the interface json.Unmarshaler
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		parsed, err := time.ParseDuration(unquoted)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+		return nil
+	}
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid duration %v", s)
+	}
+	*d = Duration(secs * float64(time.Second))
+	return nil
+}
+
+// MarshalJSON implements the interface json.Marshaler
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(time.Duration(d).String())), nil
+}
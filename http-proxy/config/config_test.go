@@ -0,0 +1,429 @@
+package config
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/proxyfilters"
+	"github.com/getlantern/http-proxy/resolver"
+)
+
+const (
+	validConfig = `{
+  "idleTimeout": "45s",
+  "maxConns": 10,
+  "proxyProtocol": {"trustedCIDRs": ["10.0.0.0/24", "192.0.2.1"], "headerTimeout": "2s"},
+  "listeners": [
+    {"protocol": "http", "addr": ":8080"},
+    {"protocol": "https", "addr": ":8443", "keyFile": "key.pem", "certFile": "cert.pem"},
+    {"protocol": "lampshade", "addr": ":14443", "keyFile": "lampshade.pem", "fallback": "127.0.0.1:80", "requireTimestamp": true, "maxClockSkew": "1m"}
+  ],
+  "filters": [
+    {"type": "blockLocal", "exceptions": ["127.0.0.1:7300"]},
+    {"type": "restrictConnectPorts", "ports": [443]},
+    {"type": "rateLimit", "numClients": 10, "hostPeriods": {"example.com": 1}},
+    {"type": "rewriteHeaders", "rules": [{"hosts": [".example.com"], "request": [{"action": "forwarded"}, {"action": "via", "value": "gw"}]}]},
+    {"type": "addForwardedFor"}
+  ],
+  "socks5": {},
+  "cache": {"dir": "/tmp/http-proxy-cache", "maxObjectBytes": 1048576},
+  "pool": {"maxIdleConnsPerOrigin": 4, "preDialConnect": 1, "healthCheckInterval": "10s"},
+  "dns": {"servers": ["127.0.0.1:5353", "https://127.0.0.1/dns-query"], "negativeTTL": "10s", "cacheSize": 100},
+  "throttle": {"perClient": {"bytesPerSecond": 1000, "burst": 4000}},
+  "admin": {"addr": "127.0.0.1:9090"},
+  "pac": {"host": "proxy.example.com", "bypass": [".intranet.example.com"]},
+  "accessLog": {"file": "/tmp/http-proxy-logs/access.log", "format": "common", "daily": true},
+  "logging": {"dir": "/tmp/http-proxy-logs", "rotationSize": 1024, "maxRotation": 2}
+}`
+)
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse([]byte(validConfig))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 45*time.Second, time.Duration(cfg.IdleTimeout))
+	assert.EqualValues(t, 10, cfg.MaxConns)
+	if assert.Len(t, cfg.Listeners, 3) {
+		assert.Equal(t, ProtocolHTTPS, cfg.Listeners[1].Protocol)
+		assert.Equal(t, "cert.pem", cfg.Listeners[1].CertFile)
+		assert.Equal(t, ProtocolLampshade, cfg.Listeners[2].Protocol)
+		assert.Equal(t, "lampshade.pem", cfg.Listeners[2].KeyFile)
+		assert.NotNil(t, cfg.Listeners[2].LampshadeFallback())
+		assert.Nil(t, cfg.Listeners[0].LampshadeFallback())
+		opts := cfg.Listeners[2].LampshadeOpts()
+		assert.True(t, opts.RequireTimestamp)
+		assert.Equal(t, time.Minute, opts.MaxClockSkew)
+		assert.Zero(t, opts.ReplayCacheSize, "should use lampshade's default")
+		assert.NotNil(t, opts.Fallback)
+	}
+	if assert.Len(t, cfg.Filters, 5) {
+		assert.Equal(t, "rateLimit", cfg.Filters[2].Type)
+		assert.Equal(t, "rewriteHeaders", cfg.Filters[3].Type)
+	}
+	if assert.NotNil(t, cfg.SOCKS5) {
+		passwords, err := cfg.SOCKS5Passwords()
+		assert.NoError(t, err)
+		assert.Nil(t, passwords)
+	}
+	if assert.NotNil(t, cfg.Cache) {
+		assert.Equal(t, "/tmp/http-proxy-cache", cfg.Cache.Dir)
+		assert.EqualValues(t, 1048576, cfg.Cache.MaxObjectBytes)
+	}
+	if poolOpts := cfg.Pool.Opts(); assert.NotNil(t, poolOpts) {
+		assert.Equal(t, 4, poolOpts.MaxIdleConnsPerOrigin)
+		assert.Equal(t, 1, poolOpts.PreDialCONNECT)
+		assert.Equal(t, 10*time.Second, poolOpts.HealthCheckInterval)
+	}
+	if ppOpts, err := cfg.ProxyProtocol.Opts(); assert.NoError(t, err) && assert.NotNil(t, ppOpts) {
+		assert.Len(t, ppOpts.TrustedCIDRs, 2)
+		assert.Equal(t, "192.0.2.1/32", ppOpts.TrustedCIDRs[1].String())
+		assert.Equal(t, 2*time.Second, ppOpts.HeaderTimeout)
+	}
+	if dnsOpts := cfg.DNS.Opts(); assert.NotNil(t, dnsOpts) {
+		assert.Len(t, dnsOpts.Servers, 2)
+		assert.Equal(t, 10*time.Second, dnsOpts.NegativeTTL)
+		assert.Equal(t, 100, dnsOpts.CacheSize)
+	}
+	if r, err := cfg.Resolver(); assert.NoError(t, err) {
+		assert.Same(t, r, cfg.Filters[0].Resolver(), "filters should share the resolver")
+		if built, err := cfg.Build(); assert.NoError(t, err) {
+			assert.Same(t, r, built.Resolver, "dialer should share the resolver")
+			again, _ := cfg.Build()
+			assert.Same(t, built, again, "config should only be built once")
+		}
+	}
+	if assert.NotNil(t, cfg.Throttle) && assert.NotNil(t, cfg.Throttle.PerClient) {
+		assert.EqualValues(t, 1000, cfg.Throttle.PerClient.BytesPerSecond)
+		assert.EqualValues(t, 4000, cfg.Throttle.PerClient.Burst)
+		assert.Nil(t, cfg.Throttle.Global)
+	}
+	if assert.NotNil(t, cfg.Admin) {
+		assert.Equal(t, "127.0.0.1:9090", cfg.Admin.Addr)
+	}
+	if pacFile, err := cfg.PACFile(); assert.NoError(t, err) && assert.NotNil(t, pacFile) {
+		b, err := pacFile.Generate("192.0.2.1", "")
+		if assert.NoError(t, err) {
+			assert.Contains(t, string(b), "PROXY proxy.example.com:8080; HTTPS proxy.example.com:8443; SOCKS5 proxy.example.com:8080")
+			assert.Contains(t, string(b), "isPlainHostName", "blockLocal should imply bypassing local destinations")
+		}
+	}
+	if assert.NotNil(t, cfg.AccessLog) {
+		assert.Equal(t, "/tmp/http-proxy-logs/access.log", cfg.AccessLog.File)
+		assert.Equal(t, "common", cfg.AccessLog.Format)
+		assert.True(t, cfg.AccessLog.Daily)
+	}
+	if assert.NotNil(t, cfg.Logging) {
+		assert.Equal(t, "/tmp/http-proxy-logs", cfg.Logging.Dir)
+		assert.EqualValues(t, 1024, cfg.Logging.RotationSize)
+		assert.Equal(t, 2, cfg.Logging.MaxRotation)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, invalid := range []string{
+		`{"listeners": []}`,
+		`{"listeners": [{"protocol": "gopher", "addr": ":70"}]}`,
+		`{"listeners": [{"protocol": "https", "addr": ":443"}]}`,
+		`{"listeners": [{"protocol": "lampshade", "addr": ":14443"}]}`,
+		`{"listeners": [{"protocol": "lampshade", "addr": ":14443", "keyFile": "key.pem", "fallback": "localhost"}]}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80", "fallback": "127.0.0.1:8080"}]}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80", "requireTimestamp": true}]}`,
+		`{"listeners": [{"protocol": "lampshade", "addr": ":14443", "keyFile": "key.pem", "replayCacheSize": -1}]}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "filters": [{"type": "unknown"}]}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "filters": [{"type": "restrictConnectPorts", "ports": "443"}]}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "idleTimeout": "forever"}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "filters": [{"type": "auth"}]}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "filters": [{"type": "auth", "htpasswdFile": "missing"}]}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "upstream": {"default": ["missing"]}}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "upstream": {"parents": {"direct": {"type": "http", "addr": ":3128"}}}}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "upstream": {"parents": {"p": {"type": "ftp", "addr": ":21"}}}}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "upstream": {"parents": {"p": {"type": "lampshade", "addr": ":14443"}}}}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "upstream": {"rules": [{"cidrs": ["10.0.0.0"], "via": ["direct"]}]}}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "upstream": {"rules": [{"ports": [25]}]}}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "socks5": {"htpasswdFile": "missing"}}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "admin": {}}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "pac": {}}`,
+		`{"listeners": [{"protocol": "lampshade", "addr": ":80", "keyFile": "key.pem"}], "admin": {"addr": ":9090"}, "pac": {}}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "proxyProtocol": {}}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "proxyProtocol": {"trustedCIDRs": ["balancer.example.com"]}}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "throttle": {"perUser": {"bytesPerSecond": -1}}}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "cache": {"maxBytes": -1}}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "pool": {"maxConnsPerOrigin": -1}}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "mitm": {"caKeyFile": "ca-key.pem"}}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "dns": {"servers": ["dns.example.com"]}}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "dns": {"cacheSize": -1}}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "filters": [{"type": "acl", "deny": ["10.0.0.0/99"]}]}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "filters": [{"type": "acl", "allowFiles": ["missing"]}]}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "filters": [{"type": "egress", "rules": [{"family": "ipv5"}]}]}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "filters": [{"type": "egress", "rules": [{"sourceIPs": ["egress.example.com"]}]}]}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "filters": [{"type": "rewriteHeaders", "rules": [{"request": [{"action": "rename"}]}]}]}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "filters": [{"type": "rewriteHeaders", "rules": [{"response": [{"action": "forwarded"}]}]}]}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "accessLog": {"format": "json"}}`,
+		`{"listeners": [{"protocol": "http", "addr": ":80"}], "accessLog": {"file": "access.log", "format": "xml"}}`,
+	} {
+		_, err := Parse([]byte(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	cfg, err := Parse([]byte(`{
+  "listeners": [{"protocol": "http", "addr": ":8080"}],
+  "filters": [{"type": "restrictConnectPorts", "ports": [443]}]
+}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	filter, err := cfg.Filter()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, http.StatusForbidden, apply(filter, "example.com:80"))
+	assert.Equal(t, http.StatusOK, apply(filter, "example.com:443"))
+}
+
+func TestACLFilter(t *testing.T) {
+	cfg, err := Parse([]byte(`{
+  "listeners": [{"protocol": "http", "addr": ":8080"}],
+  "filters": [{"type": "acl", "allow": [".example.com"], "deny": ["*.ads.example.com"], "reloadInterval": "5m"}]
+}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	filter, err := cfg.Filter()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, http.StatusOK, apply(filter, "www.example.com:443"))
+	assert.Equal(t, http.StatusForbidden, apply(filter, "x.ads.example.com:443"))
+	assert.Equal(t, http.StatusForbidden, apply(filter, "example.org:443"))
+}
+
+func TestAuthFilter(t *testing.T) {
+	cfg, err := Parse([]byte(`{
+  "listeners": [{"protocol": "http", "addr": ":8080"}],
+  "filters": [{"type": "auth", "tokens": {"s3cr3t": "monitoring"}}]
+}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	filter, err := cfg.Filter()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, http.StatusProxyAuthRequired, apply(filter, "example.com:443"))
+	req, _ := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+	req.Header.Set("Proxy-Authorization", "Bearer s3cr3t")
+	resp, _, _ := filter.Apply(filters.BackgroundContext(), req, func(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+		assert.Equal(t, "monitoring", proxyfilters.AuthenticatedIdentity(ctx))
+		return &http.Response{StatusCode: http.StatusOK}, ctx, nil
+	})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestUpstream(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	// The parent doesn't exist, so only destinations routed directly can be
+	// reached
+	cfg, err := Parse([]byte(`{
+  "listeners": [{"protocol": "http", "addr": ":8080"}],
+  "upstream": {
+    "parents": {"parent": {"type": "http", "addr": "localhost:1"}},
+    "rules": [{"cidrs": ["127.0.0.0/8"], "ports": [` + port + `], "via": ["direct"]}],
+    "default": ["parent"]
+  }
+}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	dial, err := cfg.Dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	conn, err := dial(context.Background(), true, "tcp", l.Addr().String())
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	_, err = dial(context.Background(), true, "tcp", "example.com:443")
+	assert.Error(t, err)
+
+	// Host names match CIDRs by the IPs they resolve to or that are pinned
+	conn, err = dial(context.Background(), true, "tcp", "localhost:"+port)
+	if assert.NoError(t, err, "localhost should have been matched by its IP") {
+		conn.Close()
+	}
+	ctx := resolver.WithResolved(filters.BackgroundContext(), "pinned.example.com", []net.IP{net.ParseIP("127.0.0.1")})
+	conn, err = dial(ctx, true, "tcp", "pinned.example.com:"+port)
+	if assert.NoError(t, err, "pinned IP should have been matched") {
+		conn.Close()
+	}
+
+	noUpstream, _ := Parse([]byte(`{"listeners": [{"protocol": "http", "addr": ":8080"}]}`))
+	dial, err = noUpstream.Dial()
+	if assert.NoError(t, err) && assert.NotNil(t, dial, "should dial directly using resolver") {
+		conn, err := dial(context.Background(), true, "tcp", l.Addr().String())
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+	}
+}
+
+func TestNotReloaded(t *testing.T) {
+	old, err := Parse([]byte(`{
+  "listeners": [{"protocol": "http", "addr": ":8080"}],
+  "filters": [{"type": "blockLocal"}],
+  "dns": {"servers": ["127.0.0.1:5353"]}
+}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	sameButFilters, _ := Parse([]byte(`{
+  "listeners": [{"protocol": "http", "addr": ":8080"}],
+  "filters": [{"type": "restrictConnectPorts", "ports": [443]}],
+  "dns": {"servers": ["127.0.0.1:5353"]}
+}`))
+	assert.Empty(t, old.NotReloaded(sameButFilters))
+
+	changed, _ := Parse([]byte(`{
+  "listeners": [{"protocol": "http", "addr": ":8081"}],
+  "filters": [{"type": "blockLocal"}],
+  "throttle": {"global": {"bytesPerSecond": 1000}},
+  "socks5": {}
+}`))
+	assert.Equal(t, []string{"listeners", "socks5", "dns", "throttle"}, old.NotReloaded(changed))
+}
+
+func TestSOCKS5UDP(t *testing.T) {
+	parse := func(upstream string) *Config {
+		cfg, err := Parse([]byte(`{
+  "listeners": [{"protocol": "http", "addr": ":8080"}],
+  "socks5": {}` + upstream + `
+}`))
+		assert.NoError(t, err)
+		return cfg
+	}
+	assert.True(t, parse(``).SOCKS5UDP())
+	assert.True(t, parse(`,
+  "upstream": {"rules": [{"hosts": ["example.com"], "via": ["direct"]}]}`).SOCKS5UDP())
+	assert.False(t, parse(`,
+  "upstream": {
+    "parents": {"parent": {"type": "http", "addr": "localhost:3128"}},
+    "default": ["parent"]
+  }`).SOCKS5UDP(), "default route goes via parent")
+	assert.False(t, parse(`,
+  "upstream": {
+    "parents": {"parent": {"type": "http", "addr": "localhost:3128"}},
+    "rules": [{"hosts": ["example.com"], "via": ["parent", "direct"]}]
+  }`).SOCKS5UDP(), "rule goes via parent")
+
+	noSOCKS5, _ := Parse([]byte(`{"listeners": [{"protocol": "http", "addr": ":8080"}]}`))
+	assert.False(t, noSOCKS5.SOCKS5UDP())
+}
+
+func TestPACBypassFromUpstream(t *testing.T) {
+	cfg, err := Parse([]byte(`{
+  "listeners": [{"protocol": "http", "addr": ":8080"}],
+  "upstream": {
+    "parents": {"parent": {"type": "http", "addr": "localhost:3128"}},
+    "rules": [
+      {"hosts": ["direct.example.com"], "suffixes": ["intranet.example.com"], "cidrs": ["10.0.0.0/8", "fd00::/8"], "via": ["direct"]},
+      {"hosts": ["smtp.example.com"], "ports": [25], "via": ["direct"]},
+      {"suffixes": ["example.org"], "via": ["parent", "direct"]},
+      {"hosts": ["shadowed.example.org"], "via": ["direct"]}
+    ],
+    "default": ["parent"]
+  },
+  "admin": {"addr": "127.0.0.1:9090"},
+  "pac": {"bypass": ["extra.example.com"]}
+}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	pacFile, err := cfg.PACFile()
+	if !assert.NoError(t, err) {
+		return
+	}
+	b, err := pacFile.Generate("192.0.2.1", "proxy.example.com")
+	if !assert.NoError(t, err) {
+		return
+	}
+	file := string(b)
+	for _, bypassed := range []string{"direct.example.com", ".intranet.example.com", "10.0.0.0", "extra.example.com"} {
+		assert.Contains(t, file, `"`+bypassed+`"`)
+	}
+	for _, proxied := range []string{"fd00::", "smtp.example.com", "example.org", "shadowed.example.org"} {
+		assert.NotContains(t, file, proxied)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+
+	write := func(ports string) {
+		ioutil.WriteFile(path, []byte(`{
+  "listeners": [{"protocol": "http", "addr": ":8080"}],
+  "filters": [{"type": "restrictConnectPorts", "ports": [`+ports+`]}]
+}`), 0644)
+	}
+
+	write("443")
+	cfg, err := Load(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	built, err := cfg.Build()
+	if !assert.NoError(t, err) {
+		return
+	}
+	swappable := proxyfilters.NewSwappable(built.Filter)
+	assert.Equal(t, http.StatusForbidden, apply(swappable, "example.com:80"))
+
+	write("80, 443")
+	newCfg, err := LoadWithResolver(path, built.Resolver)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, newCfg.Filters, 1) {
+		assert.Same(t, built.Resolver, newCfg.Filters[0].Resolver(), "reloaded filters should keep using the running resolver")
+	}
+	newFilter, err := newCfg.Filter()
+	if !assert.NoError(t, err) {
+		return
+	}
+	swappable.Set(newFilter)
+	assert.Equal(t, http.StatusOK, apply(swappable, "example.com:80"))
+}
+
+func apply(filter filters.Filter, host string) int {
+	req, _ := http.NewRequest(http.MethodConnect, "http://"+host, nil)
+	req.Host = host
+	resp, _, _ := filter.Apply(filters.BackgroundContext(), req, func(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+		return &http.Response{StatusCode: http.StatusOK}, ctx, nil
+	})
+	return resp.StatusCode
+}
@@ -0,0 +1,213 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/getlantern/proxy/filters"
+
+	"github.com/getlantern/http-proxy/accesslog"
+	"github.com/getlantern/http-proxy/egress"
+	"github.com/getlantern/http-proxy/proxyfilters"
+	"github.com/getlantern/http-proxy/resolver"
+)
+
+// FilterBuilder builds a Filter from its configuration.
+type FilterBuilder func(fc *FilterConfig) (filters.Filter, error)
+
+var (
+	filterBuilders = map[string]FilterBuilder{
+		"blockLocal":                      buildBlockLocal,
+		"restrictConnectPorts":            buildRestrictConnectPorts,
+		"rateLimit":                       buildRateLimit,
+		"addForwardedFor":                 static(proxyfilters.AddForwardedFor),
+		"discardInitialPersistentRequest": static(proxyfilters.DiscardInitialPersistentRequest),
+		"recordOp":                        static(proxyfilters.RecordOp),
+		"auth":                            buildAuth,
+		"acl":                             buildACL,
+		"egress":                          buildEgress,
+		"rewriteHeaders":                  buildRewriteHeaders,
+	}
+)
+
+// RegisterFilter registers a FilterBuilder for the given filter type so that
+// it can be referenced from config files.
+func RegisterFilter(filterType string, builder FilterBuilder) {
+	filterBuilders[filterType] = builder
+}
+
+// FilterConfig configures a single Filter in the chain. Type selects the
+// filter and all other fields in the JSON object are parameters for that
+// filter.
+type FilterConfig struct {
+	Type     string
+	params   json.RawMessage
+	resolver *resolver.Resolver
+}
+
+// UnmarshalJSON implements the interface json.Unmarshaler
+func (fc *FilterConfig) UnmarshalJSON(b []byte) error {
+	var typed struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(b, &typed); err != nil {
+		return err
+	}
+	fc.Type = typed.Type
+	fc.params = append(json.RawMessage(nil), b...)
+	return nil
+}
+
+// Decode decodes this filter's parameters into v.
+func (fc *FilterConfig) Decode(v interface{}) error {
+	if len(fc.params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(fc.params, v); err != nil {
+		return fmt.Errorf("Invalid parameters for filter %v: %v", fc.Type, err)
+	}
+	return nil
+}
+
+// Resolver returns the resolver that the filter should use to look up hosts,
+// which is the same one used to dial them.
+func (fc *FilterConfig) Resolver() *resolver.Resolver {
+	return fc.resolver
+}
+
+// Filter returns the configured filter chain (see Build).
+func (cfg *Config) Filter() (filters.Filter, error) {
+	built, err := cfg.Build()
+	if err != nil {
+		return nil, err
+	}
+	return built.Filter, nil
+}
+
+func (cfg *Config) buildFilter(r *resolver.Resolver) (filters.Filter, error) {
+	chain := filters.Join()
+	for i, fc := range cfg.Filters {
+		builder := filterBuilders[fc.Type]
+		if builder == nil {
+			return nil, fmt.Errorf("Filter %d has unknown type '%v'", i, fc.Type)
+		}
+		fc.resolver = r
+		filter, err := builder(fc)
+		if err != nil {
+			return nil, err
+		}
+		// Name the filter so that the access log can record which one rejected
+		// a request
+		chain = chain.Append(accesslog.Named(fc.Type, filter))
+	}
+	return chain, nil
+}
+
+func static(filter filters.Filter) FilterBuilder {
+	return func(fc *FilterConfig) (filters.Filter, error) {
+		return filter, nil
+	}
+}
+
+func buildBlockLocal(fc *FilterConfig) (filters.Filter, error) {
+	var params struct {
+		Exceptions []string `json:"exceptions"`
+	}
+	if err := fc.Decode(&params); err != nil {
+		return nil, err
+	}
+	return proxyfilters.BlockLocalWith(params.Exceptions, fc.resolver.LookupIP), nil
+}
+
+func buildRestrictConnectPorts(fc *FilterConfig) (filters.Filter, error) {
+	var params struct {
+		Ports []int `json:"ports"`
+	}
+	if err := fc.Decode(&params); err != nil {
+		return nil, err
+	}
+	return proxyfilters.RestrictConnectPorts(params.Ports), nil
+}
+
+func buildRateLimit(fc *FilterConfig) (filters.Filter, error) {
+	var params struct {
+		NumClients  int                 `json:"numClients"`
+		HostPeriods map[string]Duration `json:"hostPeriods"`
+	}
+	if err := fc.Decode(&params); err != nil {
+		return nil, err
+	}
+	hostPeriods := make(map[string]time.Duration, len(params.HostPeriods))
+	for host, period := range params.HostPeriods {
+		hostPeriods[host] = time.Duration(period)
+	}
+	return proxyfilters.RateLimit(params.NumClients, hostPeriods), nil
+}
+
+func buildAuth(fc *FilterConfig) (filters.Filter, error) {
+	var params struct {
+		Realm        string            `json:"realm"`
+		HtpasswdFile string            `json:"htpasswdFile"`
+		Tokens       map[string]string `json:"tokens"`
+	}
+	if err := fc.Decode(&params); err != nil {
+		return nil, err
+	}
+	if params.HtpasswdFile == "" && len(params.Tokens) == 0 {
+		return nil, fmt.Errorf("Filter %v requires htpasswdFile or tokens", fc.Type)
+	}
+	opts := &proxyfilters.AuthOpts{Realm: params.Realm}
+	if params.HtpasswdFile != "" {
+		passwords, err := proxyfilters.LoadHtpasswd(params.HtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		opts.Passwords = passwords
+	}
+	if len(params.Tokens) > 0 {
+		opts.Tokens = proxyfilters.StaticTokens(params.Tokens)
+	}
+	return proxyfilters.ProxyAuth(opts), nil
+}
+
+func buildACL(fc *FilterConfig) (filters.Filter, error) {
+	var params struct {
+		Deny           []string `json:"deny"`
+		DenyFiles      []string `json:"denyFiles"`
+		Allow          []string `json:"allow"`
+		AllowFiles     []string `json:"allowFiles"`
+		ReloadInterval Duration `json:"reloadInterval"`
+	}
+	if err := fc.Decode(&params); err != nil {
+		return nil, err
+	}
+	return proxyfilters.AccessControl(&proxyfilters.ACLOpts{
+		Deny:           params.Deny,
+		DenyFiles:      params.DenyFiles,
+		Allow:          params.Allow,
+		AllowFiles:     params.AllowFiles,
+		ReloadInterval: time.Duration(params.ReloadInterval),
+		LookupIP:       fc.resolver.LookupIP,
+	})
+}
+
+func buildEgress(fc *FilterConfig) (filters.Filter, error) {
+	var params egress.Opts
+	if err := fc.Decode(&params); err != nil {
+		return nil, err
+	}
+	policy, err := egress.New(&params)
+	if err != nil {
+		return nil, err
+	}
+	return proxyfilters.Egress(policy), nil
+}
+
+func buildRewriteHeaders(fc *FilterConfig) (filters.Filter, error) {
+	var params proxyfilters.HeaderOpts
+	if err := fc.Decode(&params); err != nil {
+		return nil, err
+	}
+	return proxyfilters.RewriteHeaders(&params)
+}
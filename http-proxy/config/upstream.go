@@ -0,0 +1,263 @@
+package config
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/getlantern/keyman"
+	"github.com/getlantern/lampshade"
+	"github.com/getlantern/proxy"
+
+	"github.com/getlantern/http-proxy/buffers"
+	"github.com/getlantern/http-proxy/dialer"
+	"github.com/getlantern/http-proxy/resolver"
+)
+
+const (
+	// ParentDirect is the reserved parent name for dialing directly.
+	ParentDirect = "direct"
+
+	// ParentHTTP is a parent HTTP proxy supporting CONNECT
+	ParentHTTP = "http"
+	// ParentHTTPS is a parent HTTP proxy supporting CONNECT, reached over TLS
+	ParentHTTPS = "https"
+	// ParentSOCKS5 is a parent SOCKS5 proxy
+	ParentSOCKS5 = "socks5"
+	// ParentLampshade is a parent http-proxy lampshade listener
+	ParentLampshade = "lampshade"
+)
+
+// Upstream configures how the proxy reaches destinations. Destinations are
+// matched against Rules in order and dialed via the parents listed in the
+// first matching rule's Via, or via Default if no rule matches. When several
+// parents are listed, later ones are used if earlier ones fail. The parent
+// name "direct" dials without a parent. SOCKS5 UDP datagrams can't go through
+// parents, so SOCKS5 UDP ASSOCIATE is refused if anything is routed via one.
+type Upstream struct {
+	Parents map[string]*Parent `json:"parents"`
+	Rules   []*Rule            `json:"rules"`
+	Default []string           `json:"default"`
+}
+
+// Parent configures an upstream proxy.
+type Parent struct {
+	// Type is one of "http", "https", "socks5" or "lampshade".
+	Type string `json:"type"`
+
+	// Addr is the address of the parent proxy.
+	Addr string `json:"addr"`
+
+	// Username and Password are used to authenticate with http, https and
+	// socks5 parents.
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// CertFile is the lampshade server's certificate, whose RSA public key is
+	// used to initialize sessions (lampshade only).
+	CertFile string `json:"certFile"`
+
+	// Cipher is "aes128gcm" (the default) or "chacha20poly1305" (lampshade
+	// only).
+	Cipher string `json:"cipher"`
+
+	// Version is the lampshade protocol version, 1 (the default) or 2, which
+	// provides forward secrecy (lampshade only).
+	Version int `json:"version"`
+}
+
+// Rule matches destinations to parents, see dialer.Rule.
+type Rule struct {
+	Hosts    []string `json:"hosts"`
+	Suffixes []string `json:"suffixes"`
+	CIDRs    []string `json:"cidrs"`
+	Ports    []int    `json:"ports"`
+	Via      []string `json:"via"`
+}
+
+// Dial returns the configured upstream dial function (see Build).
+// Destinations that are dialed directly, including all of them if no upstream
+// is configured, are resolved with the configured resolver (see Resolver),
+// honoring IPs pinned by filters.
+func (cfg *Config) Dial() (proxy.DialFunc, error) {
+	built, err := cfg.Build()
+	if err != nil {
+		return nil, err
+	}
+	return built.Dial, nil
+}
+
+func (cfg *Config) buildDial(r *resolver.Resolver) (proxy.DialFunc, error) {
+	direct := dialer.ParentFunc(r.Dial)
+	if cfg.Upstream == nil {
+		return dialer.DialFunc(direct), nil
+	}
+	u := cfg.Upstream
+
+	parents := map[string]dialer.Parent{ParentDirect: direct}
+	for name, pc := range u.Parents {
+		if name == ParentDirect {
+			return nil, fmt.Errorf("Parent name '%v' is reserved", name)
+		}
+		parent, err := pc.build()
+		if err != nil {
+			return nil, fmt.Errorf("Parent %v: %v", name, err)
+		}
+		parents[name] = parent
+	}
+
+	via := func(names []string) (dialer.Parent, error) {
+		if len(names) == 0 {
+			return nil, fmt.Errorf("No parents specified")
+		}
+		selected := make([]dialer.Parent, 0, len(names))
+		for _, name := range names {
+			parent, found := parents[name]
+			if !found {
+				return nil, fmt.Errorf("Unknown parent '%v'", name)
+			}
+			selected = append(selected, parent)
+		}
+		return dialer.Failover(selected...), nil
+	}
+
+	rules := make([]*dialer.Rule, 0, len(u.Rules))
+	for i, rc := range u.Rules {
+		parent, err := via(rc.Via)
+		if err != nil {
+			return nil, fmt.Errorf("Upstream rule %d: %v", i, err)
+		}
+		rule := &dialer.Rule{
+			Hosts:    rc.Hosts,
+			Suffixes: rc.Suffixes,
+			Ports:    rc.Ports,
+			Parent:   parent,
+		}
+		for _, cidr := range rc.CIDRs {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("Upstream rule %d: %v", i, err)
+			}
+			rule.CIDRs = append(rule.CIDRs, ipNet)
+		}
+		rules = append(rules, rule)
+	}
+
+	var fallback dialer.Parent = direct
+	if len(u.Default) > 0 {
+		var err error
+		fallback, err = via(u.Default)
+		if err != nil {
+			return nil, fmt.Errorf("Upstream default: %v", err)
+		}
+	}
+
+	return dialer.DialFunc(dialer.Router(rules, fallback, r.LookupForDial)), nil
+}
+
+// directDestinations lists the destinations of rules that dial directly, as
+// PAC bypass entries. Rules that only apply to some ports are left out, since
+// PAC files can't bypass by port, as are direct rules after any rule via a
+// parent, which might take precedence over them.
+func (u *Upstream) directDestinations() []string {
+	if u == nil {
+		return nil
+	}
+	var entries []string
+	for _, rc := range u.Rules {
+		if len(rc.Via) != 1 || rc.Via[0] != ParentDirect {
+			break
+		}
+		if len(rc.Ports) > 0 {
+			continue
+		}
+		entries = append(entries, rc.Hosts...)
+		for _, suffix := range rc.Suffixes {
+			entries = append(entries, "."+strings.TrimPrefix(suffix, "."))
+		}
+		for _, cidr := range rc.CIDRs {
+			// PAC files only support IPv4 CIDRs
+			if ip, _, err := net.ParseCIDR(cidr); err == nil && ip.To4() != nil {
+				entries = append(entries, cidr)
+			}
+		}
+	}
+	return entries
+}
+
+// viaParents checks whether any destinations are routed via a parent rather
+// than directly.
+func (u *Upstream) viaParents() bool {
+	if u == nil {
+		return false
+	}
+	vias := [][]string{u.Default}
+	for _, rc := range u.Rules {
+		vias = append(vias, rc.Via)
+	}
+	for _, via := range vias {
+		for _, name := range via {
+			if name != ParentDirect {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (pc *Parent) build() (dialer.Parent, error) {
+	if pc.Addr == "" {
+		return nil, fmt.Errorf("Missing addr")
+	}
+	switch pc.Type {
+	case ParentHTTP:
+		return dialer.HTTPConnect(pc.Addr, &dialer.HTTPConnectOpts{
+			Username: pc.Username,
+			Password: pc.Password,
+		}), nil
+	case ParentHTTPS:
+		return dialer.HTTPConnect(pc.Addr, &dialer.HTTPConnectOpts{
+			Username:  pc.Username,
+			Password:  pc.Password,
+			TLSConfig: &tls.Config{},
+		}), nil
+	case ParentSOCKS5:
+		return dialer.SOCKS5(pc.Addr, pc.Username, pc.Password)
+	case ParentLampshade:
+		if pc.CertFile == "" {
+			return nil, fmt.Errorf("Lampshade parent requires certFile")
+		}
+		cert, err := keyman.LoadCertificateFromFile(pc.CertFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load certFile: %v", err)
+		}
+		publicKey, ok := cert.X509().PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("Certificate in %v does not have an RSA public key", pc.CertFile)
+		}
+		var cipher lampshade.Cipher
+		switch strings.ToLower(pc.Cipher) {
+		case "", "aes128gcm":
+			cipher = lampshade.AES128GCM
+		case "chacha20poly1305":
+			cipher = lampshade.ChaCha20Poly1305
+		default:
+			return nil, fmt.Errorf("Unknown cipher '%v'", pc.Cipher)
+		}
+		switch pc.Version {
+		case 0, lampshade.ProtocolVersion1, lampshade.ProtocolVersion2:
+		default:
+			return nil, fmt.Errorf("Unknown lampshade version %d", pc.Version)
+		}
+		return dialer.Lampshade(pc.Addr, lampshade.NewDialer(&lampshade.DialerOpts{
+			Pool:            buffers.Pool(),
+			Cipher:          cipher,
+			ServerPublicKey: publicKey,
+			ProtocolVersion: pc.Version,
+		})), nil
+	default:
+		return nil, fmt.Errorf("Unknown type '%v'", pc.Type)
+	}
+}
@@ -0,0 +1,74 @@
+// Package dialer provides upstream dialers for the proxy. Connections can go
+// out directly or be chained through a parent HTTP CONNECT proxy, a SOCKS5
+// proxy or a lampshade server, with the parent chosen per destination by a
+// Router and multiple parents combined with Failover.
+package dialer
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/proxy"
+)
+
+const (
+	defaultDialTimeout = 30 * time.Second
+)
+
+var (
+	log = golog.LoggerFor("http-proxy.dialer")
+)
+
+// Parent opens connections to destinations, possibly through an upstream
+// proxy.
+type Parent interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// ParentFunc adapts a function to a Parent
+type ParentFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// DialContext implements the interface Parent
+func (fn ParentFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return fn(ctx, network, addr)
+}
+
+// Direct is a Parent that dials destinations directly.
+var Direct Parent = ParentFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: defaultDialTimeout}
+	return d.DialContext(ctx, network, addr)
+})
+
+// DialFunc adapts a Parent to a proxy.DialFunc for use in server.Opts.
+func DialFunc(parent Parent) proxy.DialFunc {
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		return parent.DialContext(ctx, network, addr)
+	}
+}
+
+// parentError marks errors that come from a parent itself, like failing to
+// connect or authenticate to it, as opposed to errors reaching the destination
+// through it. Only the former make Failover back off from the parent.
+type parentError struct {
+	error
+}
+
+func isParentError(err error) bool {
+	_, ok := err.(*parentError)
+	return ok
+}
+
+// withDeadline applies the deadline of the given context (if any) to conn for
+// the duration of a handshake, returning a function that clears it again.
+func withDeadline(ctx context.Context, conn net.Conn) func() {
+	deadline, hasDeadline := ctx.Deadline()
+	if !hasDeadline {
+		deadline = time.Now().Add(defaultDialTimeout)
+	}
+	conn.SetDeadline(deadline)
+	return func() {
+		conn.SetDeadline(time.Time{})
+	}
+}
@@ -0,0 +1,214 @@
+package dialer
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/keyman"
+	"github.com/getlantern/lampshade"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/buffers"
+)
+
+func TestRouter(t *testing.T) {
+	var selected string
+	named := func(name string) Parent {
+		return ParentFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			selected = name
+			return nil, nil
+		})
+	}
+	_, internal, _ := net.ParseCIDR("10.0.0.0/8")
+	var lookups []string
+	lookupIP := func(ctx context.Context, host string) ([]net.IP, error) {
+		lookups = append(lookups, host)
+		if host == "intranet" {
+			return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("10.1.2.3")}, nil
+		}
+		return nil, errors.New("%v not found", host)
+	}
+	r := Router([]*Rule{
+		{Hosts: []string{"exact.com"}, Parent: named("exact")},
+		{Suffixes: []string{".corp.example.com"}, CIDRs: []*net.IPNet{internal}, Parent: named("internal")},
+		{Suffixes: []string{"example.com"}, Ports: []int{443}, Parent: named("tls")},
+		{Ports: []int{25}, Parent: named("smtp")},
+	}, named("default"), lookupIP)
+
+	parentFor := func(addr string) string {
+		r.DialContext(context.Background(), "tcp", addr)
+		return selected
+	}
+
+	assert.Equal(t, "exact", parentFor("EXACT.com:80"))
+	assert.Equal(t, "default", parentFor("sub.exact.com:80"))
+	assert.Equal(t, "internal", parentFor("corp.example.com:80"))
+	assert.Equal(t, "internal", parentFor("wiki.corp.example.com:443"))
+	assert.Equal(t, "internal", parentFor("10.1.2.3:22"))
+	assert.Equal(t, "tls", parentFor("www.example.com:443"))
+	assert.Equal(t, "tls", parentFor("example.com.:443"))
+	assert.Equal(t, "default", parentFor("www.example.com:80"))
+	assert.Equal(t, "default", parentFor("badexample.com:443"))
+	assert.Equal(t, "smtp", parentFor("mail.other.com:25"))
+	assert.Equal(t, "default", parentFor("11.1.2.3:22"))
+	assert.Equal(t, []string{"sub.exact.com", "www.example.com", "example.com", "www.example.com", "badexample.com", "mail.other.com"}, lookups,
+		"only host names checked against CIDRs should have been resolved")
+	assert.Equal(t, "internal", parentFor("intranet:80"), "host names should match CIDRs by their IPs")
+	assert.Equal(t, "default", parentFor("unknown:80"), "unresolvable host names shouldn't match CIDRs")
+}
+
+func TestFailover(t *testing.T) {
+	var dialed []string
+	parent := func(name string, fail bool) Parent {
+		return ParentFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, name)
+			if fail {
+				return nil, &parentError{errors.New("%v failed", name)}
+			}
+			a, _ := net.Pipe()
+			return a, nil
+		})
+	}
+
+	f := Failover(parent("a", true), parent("b", false))
+	for i := 0; i < 2; i++ {
+		conn, err := f.DialContext(context.Background(), "tcp", "example.com:80")
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+	}
+	assert.Equal(t, []string{"a", "b", "b"}, dialed, "failed parent should be skipped on subsequent dials")
+
+	_, err := Failover(parent("a", true), parent("c", true)).DialContext(context.Background(), "tcp", "example.com:80")
+	assert.Error(t, err)
+
+	// Parents that only failed to reach the destination aren't backed off from
+	dialed = nil
+	unreachable := ParentFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, "d")
+		return nil, errors.New("connection refused")
+	})
+	f = Failover(unreachable, parent("b", false))
+	for i := 0; i < 2; i++ {
+		conn, err := f.DialContext(context.Background(), "tcp", "example.com:80")
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+	}
+	assert.Equal(t, []string{"d", "b", "d", "b"}, dialed)
+}
+
+func TestHTTPConnect(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go serveCONNECT(l)
+
+	parent := HTTPConnect(l.Addr().String(), &HTTPConnectOpts{Username: "user", Password: "pass"})
+	conn, err := parent.DialContext(context.Background(), "tcp", "echo:80")
+	if assert.NoError(t, err) {
+		assertEcho(t, conn)
+	}
+
+	_, err = HTTPConnect(l.Addr().String(), nil).DialContext(context.Background(), "tcp", "echo:80")
+	if assert.Error(t, err, "CONNECT without credentials should be refused") {
+		assert.True(t, isParentError(err), "authentication failures are the parent's")
+	}
+
+	_, err = parent.DialContext(context.Background(), "tcp", "unknown:80")
+	if assert.Error(t, err, "CONNECT to unknown destination should be refused") {
+		assert.False(t, isParentError(err), "unreachable destinations aren't the parent's fault")
+	}
+
+	_, err = HTTPConnect("localhost:1", nil).DialContext(context.Background(), "tcp", "echo:80")
+	if assert.Error(t, err) {
+		assert.True(t, isParentError(err), "failing to connect is the parent's fault")
+	}
+}
+
+func TestSOCKS5DestinationFailed(t *testing.T) {
+	assert.True(t, socks5DestinationFailed(&net.OpError{Op: "socks connect", Err: errors.New("unknown error host unreachable")}))
+	assert.True(t, socks5DestinationFailed(&net.OpError{Op: "socks connect", Err: errors.New("unknown error connection refused")}))
+	assert.False(t, socks5DestinationFailed(&net.OpError{Op: "socks connect", Err: errors.New("unknown error general SOCKS server failure")}))
+	assert.False(t, socks5DestinationFailed(&net.OpError{Op: "socks connect", Err: errors.New("username/password authentication failed")}))
+	assert.False(t, socks5DestinationFailed(&net.OpError{Op: "dial", Err: errors.New("connection refused")}))
+}
+
+func TestLampshade(t *testing.T) {
+	pk, err := keyman.GeneratePK(2048)
+	if !assert.NoError(t, err) {
+		return
+	}
+	l, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	ll := lampshade.WrapListener(l, buffers.Pool(), pk.RSA())
+	defer ll.Close()
+	go serveCONNECT(ll)
+
+	parent := Lampshade(l.Addr().String(), lampshade.NewDialer(&lampshade.DialerOpts{
+		Pool:            buffers.Pool(),
+		Cipher:          lampshade.AES128GCM,
+		ServerPublicKey: &pk.RSA().PublicKey,
+	}))
+	for i := 0; i < 2; i++ {
+		conn, err := parent.DialContext(context.Background(), "tcp", "echo:80")
+		if assert.NoError(t, err) {
+			assertEcho(t, conn)
+		}
+	}
+}
+
+// serveCONNECT serves a minimal CONNECT proxy that only knows how to reach
+// an echo server at "echo:80". Credentials are required except on lampshade
+// streams.
+func serveCONNECT(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			br := bufio.NewReader(conn)
+			req, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			_, isLampshade := conn.(lampshade.Stream)
+			if !isLampshade && req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+				io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+				return
+			}
+			if req.Method != http.MethodConnect || req.Host != "echo:80" {
+				io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+				return
+			}
+			// Write the greeting along with the response to make sure that data
+			// buffered during the handshake isn't lost
+			io.WriteString(conn, "HTTP/1.1 200 OK\r\n\r\nhello ")
+			io.Copy(conn, br)
+		}()
+	}
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	_, err := io.WriteString(conn, "world")
+	if !assert.NoError(t, err) {
+		return
+	}
+	b := make([]byte, len("hello world"))
+	_, err = io.ReadFull(conn, b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "hello world", string(b))
+	}
+}
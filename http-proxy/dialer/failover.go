@@ -0,0 +1,78 @@
+package dialer
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	// failureBackoff is how long a parent that failed is skipped for in favor
+	// of the other parents.
+	failureBackoff = 30 * time.Second
+)
+
+type failover struct {
+	parents  []Parent
+	failedAt []time.Time
+	mx       sync.Mutex
+}
+
+// Failover is a Parent that dials through the first of the given parents,
+// falling back to the next one whenever a dial fails. Parents that recently
+// failed themselves, as opposed to failing to reach the destination, are tried
+// last.
+func Failover(parents ...Parent) Parent {
+	if len(parents) == 1 {
+		return parents[0]
+	}
+	return &failover{
+		parents:  parents,
+		failedAt: make([]time.Time, len(parents)),
+	}
+}
+
+func (f *failover) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var lastErr error
+	for _, i := range f.order() {
+		conn, err := f.parents[i].DialContext(ctx, network, addr)
+		if err == nil {
+			f.mx.Lock()
+			f.failedAt[i] = time.Time{}
+			f.mx.Unlock()
+			return conn, nil
+		}
+		log.Debugf("Parent %d failed to dial %v, failing over: %v", i, addr, err)
+		if isParentError(err) {
+			f.mx.Lock()
+			f.failedAt[i] = time.Now()
+			f.mx.Unlock()
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.New("All parents failed to dial %v, last error: %v", addr, lastErr)
+}
+
+// order returns the indexes of parents in the order in which they should be
+// tried, healthy ones first.
+func (f *failover) order() []int {
+	now := time.Now()
+	healthy := make([]int, 0, len(f.parents))
+	var failing []int
+	f.mx.Lock()
+	for i, failedAt := range f.failedAt {
+		if now.Sub(failedAt) < failureBackoff {
+			failing = append(failing, i)
+		} else {
+			healthy = append(healthy, i)
+		}
+	}
+	f.mx.Unlock()
+	return append(healthy, failing...)
+}
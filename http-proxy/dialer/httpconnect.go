@@ -0,0 +1,117 @@
+package dialer
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/lampshade"
+	"github.com/getlantern/preconn"
+)
+
+// HTTPConnectOpts configures a parent HTTP proxy.
+type HTTPConnectOpts struct {
+	// Username and Password, if set, are sent as Basic Proxy-Authorization.
+	Username string
+	Password string
+
+	// TLSConfig, if set, makes the connection to the parent use TLS.
+	TLSConfig *tls.Config
+}
+
+// HTTPConnect is a Parent that tunnels connections through the HTTP proxy at
+// addr using CONNECT requests.
+func HTTPConnect(addr string, opts *HTTPConnectOpts) Parent {
+	if opts == nil {
+		opts = &HTTPConnectOpts{}
+	}
+	return ParentFunc(func(ctx context.Context, network, target string) (net.Conn, error) {
+		d := &net.Dialer{Timeout: defaultDialTimeout}
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, &parentError{errors.New("Unable to dial parent proxy %v: %v", addr, err)}
+		}
+		if opts.TLSConfig != nil {
+			tlsConfig := opts.TLSConfig
+			if tlsConfig.ServerName == "" {
+				tlsConfig = tlsConfig.Clone()
+				tlsConfig.ServerName, _, _ = net.SplitHostPort(addr)
+			}
+			conn = tls.Client(conn, tlsConfig)
+		}
+		return connect(ctx, conn, addr, target, opts)
+	})
+}
+
+// Lampshade is a Parent that tunnels connections through the http-proxy
+// lampshade listener at addr, sending CONNECT requests over lampshade streams
+// multiplexed by the given Dialer.
+func Lampshade(addr string, d lampshade.Dialer) Parent {
+	dial := func() (net.Conn, error) {
+		return net.DialTimeout("tcp", addr, defaultDialTimeout)
+	}
+	return ParentFunc(func(ctx context.Context, network, target string) (net.Conn, error) {
+		stream, err := d.Dial(dial)
+		if err != nil {
+			return nil, &parentError{errors.New("Unable to dial lampshade parent %v: %v", addr, err)}
+		}
+		return connect(ctx, stream, addr, target, &HTTPConnectOpts{})
+	})
+}
+
+// connect performs a CONNECT handshake to target on conn, closing conn on
+// failure. Failing to talk to the parent or authenticate to it is a
+// parentError, whereas the parent refusing the CONNECT or not answering it in
+// time points at the destination.
+func connect(ctx context.Context, conn net.Conn, addr string, target string, opts *HTTPConnectOpts) (net.Conn, error) {
+	clearDeadline := withDeadline(ctx, conn)
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if opts.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(opts.Username + ":" + opts.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, &parentError{errors.New("Unable to send CONNECT to parent proxy %v: %v", addr, err)}
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		ne, ok := err.(net.Error)
+		err = errors.New("Unable to read CONNECT response from parent proxy %v: %v", addr, err)
+		if ok && ne.Timeout() {
+			// The parent took the request but is still waiting on the destination
+			return nil, err
+		}
+		return nil, &parentError{err}
+	}
+	// Note - don't close resp.Body, for a successful CONNECT it's the tunnel
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		err = errors.New("Parent proxy %v refused CONNECT to %v: %v", addr, target, resp.Status)
+		if resp.StatusCode == http.StatusProxyAuthRequired {
+			return nil, &parentError{err}
+		}
+		return nil, err
+	}
+	clearDeadline()
+	log.Tracef("Connected to %v via %v", target, addr)
+
+	if buffered := br.Buffered(); buffered > 0 {
+		// Don't lose data the origin sent immediately after the handshake
+		head, _ := br.Peek(buffered)
+		return preconn.Wrap(conn, head), nil
+	}
+	return conn, nil
+}
@@ -0,0 +1,131 @@
+package dialer
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Rule selects a Parent for destinations that match it. Within each of the
+// destination criteria (Hosts, Suffixes and CIDRs taken together) and Ports,
+// any entry matching is enough, and criteria that are empty match everything.
+type Rule struct {
+	// Hosts are exact host names or IP addresses.
+	Hosts []string
+
+	// Suffixes match domains and their subdomains, for example "example.com"
+	// (or ".example.com") matches "example.com" and "www.example.com" but not
+	// "badexample.com".
+	Suffixes []string
+
+	// CIDRs match destinations given as IP addresses and, if the Router has a
+	// LookupIPFunc, host names that resolve to an IP in one of them.
+	CIDRs []*net.IPNet
+
+	// Ports are destination ports.
+	Ports []int
+
+	// Parent is used for matching destinations.
+	Parent Parent
+}
+
+func (r *Rule) matches(host string, ips func() []net.IP, port int) bool {
+	return r.matchesPort(port) && r.matchesDestination(host, ips)
+}
+
+func (r *Rule) matchesDestination(host string, ips func() []net.IP) bool {
+	if len(r.Hosts) == 0 && len(r.Suffixes) == 0 && len(r.CIDRs) == 0 {
+		return true
+	}
+	for _, h := range r.Hosts {
+		if strings.EqualFold(host, h) {
+			return true
+		}
+	}
+	for _, suffix := range r.Suffixes {
+		suffix = strings.ToLower(strings.TrimPrefix(suffix, "."))
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	if len(r.CIDRs) == 0 {
+		return false
+	}
+	for _, ip := range ips() {
+		for _, cidr := range r.CIDRs {
+			if cidr.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchesPort(port int) bool {
+	if len(r.Ports) == 0 {
+		return true
+	}
+	for _, p := range r.Ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// LookupIPFunc resolves host names for matching them against CIDRs.
+type LookupIPFunc func(ctx context.Context, host string) ([]net.IP, error)
+
+type router struct {
+	rules    []*Rule
+	fallback Parent
+	lookupIP LookupIPFunc
+}
+
+// Router is a Parent that dials through the Parent of the first Rule matching
+// the destination, or through fallback if none match. If lookupIP is not nil,
+// host names are resolved with it when a rule with CIDRs is checked, so that
+// they match the CIDRs of the IPs they'd be dialed at.
+func Router(rules []*Rule, fallback Parent, lookupIP LookupIPFunc) Parent {
+	if fallback == nil {
+		fallback = Direct
+	}
+	return &router{rules, fallback, lookupIP}
+}
+
+func (r *router) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return r.parentFor(ctx, addr).DialContext(ctx, network, addr)
+}
+
+func (r *router) parentFor(ctx context.Context, addr string) Parent {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	port, _ := strconv.Atoi(portString)
+	var ips []net.IP
+	looked := false
+	lookup := func() []net.IP {
+		if looked {
+			return ips
+		}
+		looked = true
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		} else if r.lookupIP != nil {
+			ips, err = r.lookupIP(ctx, host)
+			if err != nil {
+				log.Debugf("Unable to resolve %v for matching upstream rules: %v", host, err)
+			}
+		}
+		return ips
+	}
+	for _, rule := range r.rules {
+		if rule.matches(host, lookup, port) {
+			return rule.Parent
+		}
+	}
+	return r.fallback
+}
@@ -0,0 +1,59 @@
+package dialer
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/getlantern/errors"
+	"golang.org/x/net/proxy"
+)
+
+// destinationReplies are the SOCKS5 replies (RFC 1928) with which a proxy
+// reports failing to reach the destination, as reported by golang.org/x/net.
+var destinationReplies = []string{
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+}
+
+// SOCKS5 is a Parent that tunnels connections through the SOCKS5 proxy at
+// addr, authenticating with username and password if username is not empty.
+func SOCKS5(addr string, username string, password string) (Parent, error) {
+	var auth *proxy.Auth
+	if username != "" {
+		auth = &proxy.Auth{User: username, Password: password}
+	}
+	d, err := proxy.SOCKS5("tcp", addr, auth, &net.Dialer{Timeout: defaultDialTimeout})
+	if err != nil {
+		return nil, errors.New("Unable to create SOCKS5 dialer for %v: %v", addr, err)
+	}
+	cd := d.(proxy.ContextDialer)
+	return ParentFunc(func(ctx context.Context, network, target string) (net.Conn, error) {
+		conn, err := cd.DialContext(ctx, network, target)
+		if err != nil {
+			destinationFailed := socks5DestinationFailed(err)
+			err = errors.New("Unable to dial %v via SOCKS5 proxy %v: %v", target, addr, err)
+			if destinationFailed {
+				return nil, err
+			}
+			return nil, &parentError{err}
+		}
+		return conn, nil
+	}), nil
+}
+
+// socks5DestinationFailed determines whether err is the SOCKS5 proxy
+// reporting that it couldn't reach the destination, rather than a failure to
+// connect, authenticate or talk to the proxy itself.
+func socks5DestinationFailed(err error) bool {
+	msg := err.Error()
+	for _, reply := range destinationReplies {
+		if strings.Contains(msg, "unknown error "+reply) {
+			return true
+		}
+	}
+	return false
+}
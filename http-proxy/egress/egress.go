@@ -0,0 +1,397 @@
+// Package egress chooses how the proxy connects out to destinations on
+// multi-homed hosts: the local source addresses that dials are bound to and
+// whether IPv4, IPv6 or both are used. Rules select these per client address
+// and per authenticated user.
+//
+// A Policy matches requests to rules and the resulting Binding is carried in
+// the request's context (see WithBinding) to DialIPs, which is what dials
+// destinations.
+package egress
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/proxy"
+	"github.com/getlantern/proxy/filters"
+)
+
+// Family selects the IP address families used to reach destinations.
+type Family string
+
+const (
+	// Any tries the destination's addresses in order, IPv4 first.
+	Any = Family("")
+	// IPv4 only connects over IPv4.
+	IPv4 = Family("ipv4")
+	// IPv6 only connects over IPv6.
+	IPv6 = Family("ipv6")
+	// HappyEyeballs races IPv6 and IPv4 connections, giving IPv6 a head start
+	// (RFC 8305).
+	HappyEyeballs = Family("happyEyeballs")
+)
+
+const (
+	defaultDialTimeout = 30 * time.Second
+
+	// happyEyeballsDelay is the head start that IPv6 gets, same as the
+	// standard library's default.
+	happyEyeballsDelay = 300 * time.Millisecond
+)
+
+type ctxKey string
+
+const (
+	ctxKeyBinding = ctxKey("binding")
+)
+
+var (
+	log = golog.LoggerFor("http-proxy.egress")
+)
+
+// Opts configures a Policy.
+type Opts struct {
+	// Rules are matched in order and the first rule that matches a request
+	// applies to it. Requests that don't match any rule are dialed from the
+	// kernel's choice of source address.
+	Rules []*Rule `json:"rules"`
+}
+
+// Rule selects how requests from some clients are dialed.
+type Rule struct {
+	// Clients are the client IPs or CIDRs that the rule applies to. If empty,
+	// it applies to all clients.
+	Clients []string `json:"clients"`
+
+	// Users are the authenticated identities that the rule applies to. If
+	// empty, it applies to all users, including anonymous ones.
+	Users []string `json:"users"`
+
+	// SourceIPs are the local addresses to dial from, which are used in turn
+	// by successive requests. Destinations are only dialed over the address
+	// families of the listed IPs. If empty, the kernel chooses.
+	SourceIPs []string `json:"sourceIPs"`
+
+	// Family is "ipv4", "ipv6", "happyEyeballs" or empty to try addresses in
+	// order, IPv4 first.
+	Family Family `json:"family"`
+}
+
+// Validate checks that the Opts are usable.
+func (opts *Opts) Validate() error {
+	_, err := New(opts)
+	return err
+}
+
+// Policy matches requests to rules. It's safe for concurrent use.
+type Policy struct {
+	rules []*rule
+}
+
+type rule struct {
+	clients []*net.IPNet
+	users   map[string]bool
+	sources []net.IP
+	family  Family
+	next    uint64
+}
+
+// New builds a Policy.
+func New(opts *Opts) (*Policy, error) {
+	p := &Policy{}
+	for i, rc := range opts.Rules {
+		r := &rule{family: rc.Family}
+		switch rc.Family {
+		case Any, IPv4, IPv6, HappyEyeballs:
+		default:
+			return nil, errors.New("Egress rule %d has unknown family '%v'", i, rc.Family)
+		}
+		for _, client := range rc.Clients {
+			ipNet, err := parseCIDR(client)
+			if err != nil {
+				return nil, errors.New("Egress rule %d: %v", i, err)
+			}
+			r.clients = append(r.clients, ipNet)
+		}
+		if len(rc.Users) > 0 {
+			r.users = make(map[string]bool, len(rc.Users))
+			for _, user := range rc.Users {
+				r.users[user] = true
+			}
+		}
+		for _, source := range rc.SourceIPs {
+			ip := net.ParseIP(source)
+			if ip == nil {
+				return nil, errors.New("Egress rule %d has invalid source IP '%v'", i, source)
+			}
+			if !r.allows(ip) {
+				return nil, errors.New("Egress rule %d has source IP %v outside of family %v", i, ip, rc.Family)
+			}
+			r.sources = append(r.sources, ip)
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p, nil
+}
+
+func parseCIDR(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		return ipNet, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, errors.New("Invalid client IP or CIDR '%v'", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// Match returns the Binding for a request from the given client and user, or
+// nil if no rule applies.
+func (p *Policy) Match(clientIP net.IP, user string) *Binding {
+	for _, r := range p.rules {
+		if r.matches(clientIP, user) {
+			return r.bind()
+		}
+	}
+	return nil
+}
+
+func (r *rule) matches(clientIP net.IP, user string) bool {
+	if r.users != nil && !r.users[user] {
+		return false
+	}
+	if len(r.clients) == 0 {
+		return true
+	}
+	if clientIP == nil {
+		return false
+	}
+	for _, client := range r.clients {
+		if client.Contains(clientIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows checks whether the rule's family allows dialing ip.
+func (r *rule) allows(ip net.IP) bool {
+	switch r.family {
+	case IPv4:
+		return ip.To4() != nil
+	case IPv6:
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+// bind picks the next source address of each family, rotating through them.
+func (r *rule) bind() *Binding {
+	b := &Binding{family: r.family}
+	if len(r.sources) == 0 {
+		return b
+	}
+	// Rotate through the sources starting from the next one, taking the first
+	// address of each family
+	start := int(atomic.AddUint64(&r.next, 1) - 1)
+	b.restricted = true
+	for i := range r.sources {
+		source := r.sources[(start+i)%len(r.sources)]
+		if source.To4() != nil {
+			if b.source4 == nil {
+				b.source4 = source
+			}
+		} else if b.source6 == nil {
+			b.source6 = source
+		}
+	}
+	return b
+}
+
+// Binding describes how a single request's destination is dialed.
+type Binding struct {
+	family  Family
+	source4 net.IP
+	source6 net.IP
+	// restricted means that only families with a source address can be used
+	restricted bool
+}
+
+// String describes the binding, for logging and as the request's pool
+// partition.
+func (b *Binding) String() string {
+	parts := []string{string(b.family)}
+	if b.family == Any {
+		parts[0] = "any"
+	}
+	if b.source4 != nil {
+		parts = append(parts, b.source4.String())
+	}
+	if b.source6 != nil {
+		parts = append(parts, b.source6.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+func (b *Binding) source(ip net.IP) (net.IP, bool) {
+	is4 := ip.To4() != nil
+	switch {
+	case b.family == IPv4 && !is4, b.family == IPv6 && is4:
+		return nil, false
+	case is4 && b.source4 != nil:
+		return b.source4, true
+	case !is4 && b.source6 != nil:
+		return b.source6, true
+	default:
+		return nil, !b.restricted
+	}
+}
+
+// WithBinding binds the request's dials to b. Since connections dialed for one
+// binding mustn't be reused for another, it also places the request in a pool
+// partition for b (see proxy.WithPoolPartition).
+func WithBinding(ctx filters.Context, b *Binding) filters.Context {
+	return proxy.WithPoolPartition(ctx.WithValue(ctxKeyBinding, b), "egress "+b.String())
+}
+
+// BindingFrom returns the Binding for the request with the given context, if
+// any.
+func BindingFrom(ctx context.Context) *Binding {
+	b, _ := ctx.Value(ctxKeyBinding).(*Binding)
+	return b
+}
+
+// DialIPs connects to port on one of ips, following the Binding in ctx if
+// there is one. Without a binding, or with family Any, the IPs are tried in
+// order.
+func DialIPs(ctx context.Context, network string, ips []net.IP, port string) (net.Conn, error) {
+	b := BindingFrom(ctx)
+	if b == nil {
+		b = &Binding{}
+	}
+	var targets []*target
+	for _, ip := range ips {
+		if source, ok := b.source(ip); ok {
+			targets = append(targets, &target{ip, source})
+		}
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("No addresses to dial with egress %v among %v", b, ips)
+	}
+	if b.family == HappyEyeballs {
+		return dialHappyEyeballs(ctx, network, targets, port)
+	}
+	return dialSerial(ctx, network, targets, port)
+}
+
+type target struct {
+	ip     net.IP
+	source net.IP
+}
+
+func (t *target) dial(ctx context.Context, network, port string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: defaultDialTimeout}
+	if t.source != nil {
+		if strings.HasPrefix(network, "udp") {
+			d.LocalAddr = &net.UDPAddr{IP: t.source}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: t.source}
+		}
+	}
+	return d.DialContext(ctx, network, net.JoinHostPort(t.ip.String(), port))
+}
+
+func dialSerial(ctx context.Context, network string, targets []*target, port string) (net.Conn, error) {
+	var lastErr error
+	for _, t := range targets {
+		conn, err := t.dial(ctx, network, port)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// dialHappyEyeballs dials the IPv6 addresses and, after a short delay or as
+// soon as that fails, the IPv4 ones, using whichever connects first.
+func dialHappyEyeballs(ctx context.Context, network string, targets []*target, port string) (net.Conn, error) {
+	var primary, fallback []*target
+	for _, t := range targets {
+		if t.ip.To4() == nil {
+			primary = append(primary, t)
+		} else {
+			fallback = append(fallback, t)
+		}
+	}
+	if len(primary) == 0 || len(fallback) == 0 {
+		return dialSerial(ctx, network, targets, port)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan *result, 2)
+	race := func(targets []*target, primary bool) {
+		conn, err := dialSerial(ctx, network, targets, port)
+		results <- &result{conn, err, primary}
+	}
+	go race(primary, true)
+
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+	pending := 1
+	fallbackStarted := false
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				go race(fallback, false)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if pending > 0 {
+					// Close the loser if it connects after all
+					go func() {
+						if res := <-results; res.conn != nil {
+							res.conn.Close()
+						}
+					}()
+				}
+				return res.conn, nil
+			}
+			log.Tracef("Happy eyeballs dial failed (primary: %v): %v", res.primary, res.err)
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				go race(fallback, false)
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
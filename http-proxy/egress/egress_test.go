@@ -0,0 +1,129 @@
+package egress
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	p, err := New(&Opts{Rules: []*Rule{
+		{Users: []string{"batch"}, SourceIPs: []string{"192.0.2.1", "192.0.2.2"}, Family: IPv4},
+		{Clients: []string{"10.0.0.0/8", "2001:db8::1"}, SourceIPs: []string{"192.0.2.3", "2001:db8::3"}, Family: HappyEyeballs},
+		{Clients: []string{"10.0.0.1"}, Family: IPv6},
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	b := p.Match(net.ParseIP("10.1.2.3"), "batch")
+	if assert.NotNil(t, b) {
+		assert.Equal(t, "ipv4 192.0.2.1", b.String())
+	}
+	b = p.Match(nil, "batch")
+	if assert.NotNil(t, b) {
+		assert.Equal(t, "ipv4 192.0.2.2", b.String(), "should have rotated to next source")
+	}
+	b = p.Match(net.ParseIP("10.0.0.1"), "")
+	if assert.NotNil(t, b) {
+		assert.Equal(t, "happyEyeballs 192.0.2.3 2001:db8::3", b.String(), "first matching rule should win")
+	}
+	b = p.Match(net.ParseIP("2001:db8::1"), "someone")
+	assert.NotNil(t, b)
+	assert.Nil(t, p.Match(net.ParseIP("192.0.2.100"), ""))
+	assert.Nil(t, p.Match(nil, ""))
+}
+
+func TestInvalidRules(t *testing.T) {
+	for _, rule := range []*Rule{
+		{Family: "ipv5"},
+		{Clients: []string{"10.0.0.0/33"}},
+		{Clients: []string{"client.example.com"}},
+		{SourceIPs: []string{"192.0.2"}},
+		{SourceIPs: []string{"2001:db8::1"}, Family: IPv4},
+	} {
+		assert.Error(t, (&Opts{Rules: []*Rule{rule}}).Validate(), "%+v", rule)
+	}
+}
+
+func TestDialIPsBindsSource(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	remoteAddrs := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			remoteAddrs <- host
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	ips := []net.IP{net.ParseIP("127.0.0.1")}
+
+	p, _ := New(&Opts{Rules: []*Rule{{SourceIPs: []string{"127.0.0.2", "127.0.0.3"}}}})
+	for _, expected := range []string{"127.0.0.2", "127.0.0.3", "127.0.0.2"} {
+		ctx := WithBinding(filters.BackgroundContext(), p.Match(nil, ""))
+		conn, err := DialIPs(ctx, "tcp", ips, port)
+		if assert.NoError(t, err) {
+			assert.Equal(t, expected, <-remoteAddrs)
+			conn.Close()
+		}
+	}
+
+	// Without a binding, the kernel chooses
+	conn, err := DialIPs(context.Background(), "tcp", ips, port)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "127.0.0.1", <-remoteAddrs)
+		conn.Close()
+	}
+
+	// There's no IPv4 source to dial from
+	p, _ = New(&Opts{Rules: []*Rule{{SourceIPs: []string{"::1"}}}})
+	_, err = DialIPs(WithBinding(filters.BackgroundContext(), p.Match(nil, "")), "tcp", ips, port)
+	assert.Error(t, err)
+}
+
+func TestDialIPsFamily(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	// Nothing listens on the IPv6 address (if there's IPv6 at all)
+	ips := []net.IP{net.ParseIP("::1"), net.ParseIP("127.0.0.1")}
+
+	dial := func(family Family) (net.Conn, error) {
+		p, _ := New(&Opts{Rules: []*Rule{{Family: family}}})
+		return DialIPs(WithBinding(filters.BackgroundContext(), p.Match(nil, "")), "tcp", ips, port)
+	}
+
+	_, err = dial(IPv6)
+	assert.Error(t, err, "IPv6 only shouldn't fall back to IPv4")
+	for _, family := range []Family{IPv4, HappyEyeballs, Any} {
+		conn, err := dial(family)
+		if assert.NoError(t, err, family) {
+			assert.Equal(t, "127.0.0.1", conn.RemoteAddr().(*net.TCPAddr).IP.String(), family)
+			conn.Close()
+		}
+	}
+}
@@ -1,29 +1,44 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"net"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/getlantern/golog"
+	"github.com/getlantern/proxy/filters"
 
+	"github.com/getlantern/http-proxy/accesslog"
+	"github.com/getlantern/http-proxy/cache"
+	"github.com/getlantern/http-proxy/config"
 	"github.com/getlantern/http-proxy/listeners"
 	"github.com/getlantern/http-proxy/logging"
+	"github.com/getlantern/http-proxy/metrics"
+	"github.com/getlantern/http-proxy/mitm"
 	"github.com/getlantern/http-proxy/proxyfilters"
 	"github.com/getlantern/http-proxy/server"
+	"github.com/getlantern/http-proxy/throttle"
 )
 
 var (
 	log = golog.LoggerFor("http-proxy")
 
-	help      = flag.Bool("help", false, "Get usage help")
-	keyfile   = flag.String("key", "", "Private key file name")
-	certfile  = flag.String("cert", "", "Certificate file name")
-	https     = flag.Bool("https", false, "Use TLS for client to proxy communication")
-	addr      = flag.String("addr", ":8080", "Address to listen")
-	maxConns  = flag.Uint64("maxconns", 0, "Max number of simultaneous connections allowed connections")
-	idleClose = flag.Uint64("idleclose", 30, "Time in seconds that an idle connection will be allowed before closing it")
+	help       = flag.Bool("help", false, "Get usage help")
+	configFile = flag.String("config", "", "JSON config file, if specified the other flags are ignored. Reloaded on SIGHUP.")
+	keyfile    = flag.String("key", "", "Private key file name")
+	certfile   = flag.String("cert", "", "Certificate file name")
+	https      = flag.Bool("https", false, "Use TLS for client to proxy communication")
+	addr       = flag.String("addr", ":8080", "Address to listen")
+	maxConns   = flag.Uint64("maxconns", 0, "Max number of simultaneous connections allowed connections")
+	idleClose  = flag.Uint64("idleclose", 30, "Time in seconds that an idle connection will be allowed before closing it")
+	shutdown   = flag.Uint64("shutdowntimeout", 60, "Time in seconds to wait for active connections to finish when shutting down")
+	adminAddr  = flag.String("adminaddr", "", "Address at which to serve Prometheus metrics on /metrics, disabled if empty")
+	accessLog  = flag.String("accesslog", "", "File to which to write the access log as JSON lines, disabled if empty")
 )
 
 func main() {
@@ -35,38 +50,263 @@ func main() {
 		return
 	}
 
+	cfg := configFromFlags()
+	if *configFile != "" {
+		cfg, err = config.Load(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// Logging
 	// TODO: use real parameters
-	err = logging.Init("instanceid", "version", "releasedate")
+	loggingOpts := cfg.Logging
+	if loggingOpts == nil {
+		loggingOpts = &logging.Opts{}
+	}
+	err = logging.InitWith(loggingOpts, "instanceid", "version", "releasedate")
 	if err != nil {
 		log.Error(err)
 	}
 
+	// Config loaded from a file was already built when validated, so this just
+	// returns it
+	built, err := cfg.Build()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The filter chain is swappable so that it can be reloaded without
+	// disturbing existing connections
+	swappable := proxyfilters.NewSwappable(built.Filter)
+	if *configFile != "" {
+		onReload(func() {
+			log.Debugf("Reloading config from %v", *configFile)
+			// Reloaded filters keep using the resolver that the dialer uses
+			newCfg, err := config.LoadWithResolver(*configFile, built.Resolver)
+			if err != nil {
+				log.Errorf("Not reloading: %v", err)
+				return
+			}
+			newFilter, err := newCfg.Filter()
+			if err != nil {
+				log.Errorf("Not reloading: %v", err)
+				return
+			}
+			swappable.Set(newFilter)
+			log.Debug("Reloaded filters")
+			if changed := cfg.NotReloaded(newCfg); len(changed) > 0 {
+				log.Errorf("Changes to %v not reloaded, restart to apply them", strings.Join(changed, ", "))
+			}
+		})
+	}
+
+	dial := built.Dial
+	proxyProtocol, err := cfg.ProxyProtocol.Opts()
+	if err != nil {
+		log.Fatal(err)
+	}
+	pacFile, err := cfg.PACFile()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var filter filters.Filter = swappable
+
+	// Bandwidth throttling
+	var throttler *throttle.Throttle
+	if cfg.Throttle != nil {
+		throttler = throttle.New(cfg.Throttle)
+		// Users are known once the configured filters have run
+		filter = filters.Join(filter, throttler.Filter())
+	}
+
+	// Metrics, counting requests as blocked only if the configured filters or
+	// throttle blocked them
+	var m *metrics.Proxy
+	if cfg.Admin != nil {
+		m = metrics.NewProxy()
+		m.ReportOps()
+		filter = m.Filter(filter)
+		dial = m.Dial(dial)
+	}
+
+	// Caching
+	if cfg.Cache != nil {
+		c, err := cache.New(cfg.Cache)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Cache hits still go through all of the configured filters
+		filter = filters.Join(filter, c.Filter())
+	}
+
+	// Access log
+	var accessLogger *accesslog.Logger
+	if cfg.AccessLog != nil {
+		accessLogger, err = accesslog.Open(cfg.AccessLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Log first so that the record reflects the whole chain
+		filter = filters.Join(accessLogger.Filter(), filter)
+	}
+
+	// HTTPS interception
+	var interceptor *mitm.Interceptor
+	if cfg.MITM != nil {
+		interceptor, err = mitm.New(cfg.MITM)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// Create server
-	srv := server.New(&server.Opts{
-		IdleTimeout: time.Duration(*idleClose),
-		Filter:      proxyfilters.BlockLocal([]string{}),
-	})
+	idleTimeout := time.Duration(cfg.IdleTimeout)
+	serverOpts := &server.Opts{
+		IdleTimeout:     idleTimeout,
+		Filter:          filter,
+		Dial:            dial,
+		SOCKS5:          cfg.SOCKS5 != nil,
+		SOCKS5Passwords: built.SOCKS5Passwords,
+		Pool:            cfg.Pool.Opts(),
+		ProxyProtocol:   proxyProtocol,
+		Resolver:        built.Resolver,
+	}
+	// UDP datagrams can't go through upstream parents
+	serverOpts.DisableSOCKS5UDP = !cfg.SOCKS5UDP()
+	if m != nil {
+		serverOpts.OnLampshadeListener = m.LampshadeListener
+	}
+	if interceptor != nil {
+		serverOpts.MITM = interceptor.Intercept
+		serverOpts.MITMUpstreamTLSConfig = interceptor.UpstreamTLSConfig()
+	}
+	srv := server.New(serverOpts)
 
 	// Add net.Listener wrappers for inbound connections
 	srv.AddListenerWrappers(
 		// Limit max number of simultaneous connections
 		func(ls net.Listener) net.Listener {
-			return listeners.NewLimitedListener(ls, *maxConns)
+			return listeners.NewLimitedListener(ls, cfg.MaxConns)
 		},
-		// Close connections after 30 seconds of no activity
+		// Close connections after idleTimeout of no activity
 		func(ls net.Listener) net.Listener {
-			return listeners.NewIdleConnListener(ls, time.Duration(*idleClose)*time.Second)
+			return listeners.NewIdleConnListener(ls, idleTimeout)
 		},
 	)
+	if throttler != nil {
+		srv.AddListenerWrappers(throttler.Listener)
+	}
+	if m != nil {
+		// Count connections and bytes transferred
+		srv.AddListenerWrappers(m.Listener)
+	}
+	if accessLogger != nil {
+		// Attribute bytes to requests and log tunnels when they close
+		srv.AddListenerWrappers(accessLogger.Listener)
+	}
+
+	var admin *http.Server
+	if m != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", m)
+		if throttler != nil {
+			mux.Handle("/throttle", throttler)
+		}
+		mux.HandleFunc("/pool", srv.ServePoolStats)
+		if pacFile != nil {
+			mux.Handle("/proxy.pac", pacFile)
+			mux.Handle("/wpad.dat", pacFile)
+		}
+		admin = &http.Server{Addr: cfg.Admin.Addr, Handler: mux}
+		go func() {
+			log.Debugf("Serving metrics at http://%v/metrics", cfg.Admin.Addr)
+			if err := admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Errorf("Error serving metrics on %v: %v", cfg.Admin.Addr, err)
+			}
+		}()
+	}
+
+	// Shut down gracefully on SIGTERM/SIGINT
+	shutdownStarted := make(chan struct{})
+	shutdownFinished := make(chan struct{})
+	onShutdown(func() {
+		close(shutdownStarted)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Errorf("Error shutting down gracefully: %v", err)
+		}
+		if admin != nil {
+			admin.Close()
+		}
+		if accessLogger != nil {
+			accessLogger.Close()
+		}
+		close(shutdownFinished)
+	})
+
+	// Serve on all listeners, sharing the same filters and listener wrappers
+	var wg sync.WaitGroup
+	wg.Add(len(cfg.Listeners))
+	for _, l := range cfg.Listeners {
+		go func(l *config.Listener) {
+			defer wg.Done()
+			var err error
+			switch l.Protocol {
+			case config.ProtocolHTTPS:
+				err = srv.ListenAndServeHTTPS(l.Addr, l.KeyFile, l.CertFile, nil)
+			case config.ProtocolLampshade:
+				err = srv.ListenAndServeLampshadeWithOpts(l.Addr, l.KeyFile, l.LampshadeOpts(), nil)
+			default:
+				err = srv.ListenAndServeHTTP(l.Addr, nil)
+			}
+			if err != nil && err != server.ErrServerClosed {
+				log.Errorf("Error serving on %v: %v", l.Addr, err)
+			}
+		}(l)
+	}
+	wg.Wait()
+
+	select {
+	case <-shutdownStarted:
+		<-shutdownFinished
+		log.Debug("Shut down")
+	default:
+	}
+}
 
-	// Serve HTTP/S
+// configFromFlags builds a Config from the command-line flags, for use when
+// no config file was specified.
+func configFromFlags() *config.Config {
+	protocol := config.ProtocolHTTP
 	if *https {
-		err = srv.ListenAndServeHTTPS(*addr, *keyfile, *certfile, nil)
-	} else {
-		err = srv.ListenAndServeHTTP(*addr, nil)
+		protocol = config.ProtocolHTTPS
 	}
-	if err != nil {
-		log.Errorf("Error serving: %v", err)
+	var admin *config.Admin
+	if *adminAddr != "" {
+		admin = &config.Admin{Addr: *adminAddr}
+	}
+	var accessLogOpts *accesslog.Opts
+	if *accessLog != "" {
+		accessLogOpts = &accesslog.Opts{File: *accessLog}
+	}
+	return &config.Config{
+		IdleTimeout:     config.Duration(time.Duration(*idleClose) * time.Second),
+		ShutdownTimeout: config.Duration(time.Duration(*shutdown) * time.Second),
+		MaxConns:        *maxConns,
+		Listeners: []*config.Listener{
+			{
+				Protocol: protocol,
+				Addr:     *addr,
+				KeyFile:  *keyfile,
+				CertFile: *certfile,
+			},
+		},
+		Filters: []*config.FilterConfig{
+			{Type: "blockLocal"},
+		},
+		Admin:     admin,
+		AccessLog: accessLogOpts,
 	}
 }
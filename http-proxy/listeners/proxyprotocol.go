@@ -0,0 +1,323 @@
+package listeners
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/preconn"
+)
+
+const (
+	defaultProxyHeaderTimeout = 5 * time.Second
+
+	// maxProxyV1HeaderLength is the longest a v1 header can be, including the
+	// CRLF.
+	maxProxyV1HeaderLength = 107
+)
+
+var (
+	proxyV1Prefix  = []byte("PROXY ")
+	proxyV2Sig     = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	errNoProxyAddr = errors.New("No addresses in PROXY header")
+)
+
+// ProxyProtocolOpts configures a PROXY protocol listener.
+type ProxyProtocolOpts struct {
+	// TrustedCIDRs are the networks of the load balancers that send PROXY
+	// headers. Connections from anywhere else are passed on untouched, without
+	// looking for a header, so that clients can't pretend to come from
+	// somewhere else.
+	TrustedCIDRs []*net.IPNet
+
+	// HeaderTimeout limits how long trusted sources have to send the header,
+	// defaults to 5 seconds.
+	HeaderTimeout time.Duration
+}
+
+// NewProxyProtocolListener wraps a listener whose connections come through TCP
+// load balancers using the HAProxy PROXY protocol (version 1 or 2). Connections
+// from trusted sources must start with a PROXY header, which is consumed, and
+// report the client and destination addresses from the header as their
+// RemoteAddr and LocalAddr. Connections from trusted sources without a valid
+// header are closed.
+//
+// Headers are read in the background so that slow connections don't hold up
+// Accept. The listener should wrap the raw TCP listener, beneath TLS and other
+// wrappers that look at RemoteAddr.
+func NewProxyProtocolListener(l net.Listener, opts *ProxyProtocolOpts) net.Listener {
+	pl := &proxyProtocolListener{
+		Listener:      l,
+		trusted:       opts.TrustedCIDRs,
+		headerTimeout: opts.HeaderTimeout,
+		accepted:      make(chan net.Conn),
+		closed:        make(chan struct{}),
+	}
+	if pl.headerTimeout <= 0 {
+		pl.headerTimeout = defaultProxyHeaderTimeout
+	}
+	go pl.accept()
+	return pl
+}
+
+type proxyProtocolListener struct {
+	net.Listener
+	trusted       []*net.IPNet
+	headerTimeout time.Duration
+	accepted      chan net.Conn
+	closed        chan struct{}
+	closeOnce     sync.Once
+	// closeErr is only set before closed is closed
+	closeErr error
+}
+
+func (l *proxyProtocolListener) accept() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Debugf("Temporary error accepting PROXY protocol connection: %v", err)
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			l.closeWith(err)
+			return
+		}
+		if !l.isTrusted(conn.RemoteAddr()) {
+			l.deliver(conn)
+			continue
+		}
+		go func() {
+			proxied, err := readProxyHeader(conn, l.headerTimeout)
+			if err != nil {
+				log.Debugf("Closing connection from %v: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			l.deliver(proxied)
+		}()
+	}
+}
+
+func (l *proxyProtocolListener) deliver(conn net.Conn) {
+	select {
+	case l.accepted <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *proxyProtocolListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range l.trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.closed:
+		return nil, l.closeErr
+	}
+}
+
+func (l *proxyProtocolListener) Close() error {
+	return l.closeWith(errors.New("Listener closed"))
+}
+
+// closeWith closes the listener, making Accept return acceptErr unless it was
+// already closed.
+func (l *proxyProtocolListener) closeWith(acceptErr error) error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() {
+		l.closeErr = acceptErr
+		close(l.closed)
+	})
+	return err
+}
+
+// proxiedConn is a connection whose addresses came from a PROXY header.
+type proxiedConn struct {
+	net.Conn
+	wrapped    net.Conn
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	closed     int32
+}
+
+// Read reads what was buffered along with the header first. Nothing is read
+// once the connection has been closed, even if it's still buffered.
+func (c *proxiedConn) Read(b []byte) (int, error) {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return 0, net.ErrClosed
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxiedConn) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return c.Conn.Close()
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *proxiedConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *proxiedConn) Wrapped() net.Conn {
+	return c.wrapped
+}
+
+// readProxyHeader reads the PROXY header at the start of conn. If the header
+// doesn't say where the connection came from (like v1 UNKNOWN or v2 LOCAL
+// headers used for health checks), conn's own addresses are kept.
+func readProxyHeader(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReaderSize(conn, 256)
+	var remoteAddr, localAddr net.Addr
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, errors.New("Unable to read PROXY header: %v", err)
+	}
+	if first[0] == proxyV1Prefix[0] {
+		remoteAddr, localAddr, err = readProxyV1(br)
+	} else {
+		remoteAddr, localAddr, err = readProxyV2(br)
+	}
+	if err == errNoProxyAddr {
+		remoteAddr, localAddr = conn.RemoteAddr(), conn.LocalAddr()
+	} else if err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	head, _ := br.Peek(br.Buffered())
+	return &proxiedConn{
+		Conn:       preconn.Wrap(conn, append([]byte(nil), head...)),
+		wrapped:    conn,
+		remoteAddr: remoteAddr,
+		localAddr:  localAddr,
+	}, nil
+}
+
+// readProxyV1 reads a human-readable header like
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readProxyV1(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	line, err := br.ReadSlice('\n')
+	if err != nil || len(line) > maxProxyV1HeaderLength {
+		return nil, nil, errors.New("Invalid PROXY v1 header")
+	}
+	if !bytes.HasPrefix(line, proxyV1Prefix) || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("Invalid PROXY v1 header")
+	}
+	fields := strings.Split(string(line[len(proxyV1Prefix):len(line)-2]), " ")
+	switch fields[0] {
+	case "UNKNOWN":
+		return nil, nil, errNoProxyAddr
+	case "TCP4", "TCP6":
+	default:
+		return nil, nil, errors.New("Unsupported PROXY v1 protocol '%v'", fields[0])
+	}
+	if len(fields) != 5 {
+		return nil, nil, errors.New("Invalid PROXY v1 header")
+	}
+	src, err := parseProxyV1Addr(fields[0], fields[1], fields[3])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyV1Addr(fields[0], fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyV1Addr(protocol, ipString, portString string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(ipString)
+	if ip == nil || (ip.To4() != nil) != (protocol == "TCP4") {
+		return nil, errors.New("Invalid %v address '%v' in PROXY v1 header", protocol, ipString)
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, errors.New("Invalid port '%v' in PROXY v1 header", portString)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header.
+func readProxyV2(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, nil, errors.New("Unable to read PROXY header: %v", err)
+	}
+	if !bytes.Equal(header[:12], proxyV2Sig) {
+		return nil, nil, errors.New("Missing PROXY header")
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, errors.New("Unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	command, family := header[12]&0x0F, header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, nil, errors.New("Unable to read PROXY v2 addresses: %v", err)
+	}
+
+	switch command {
+	case 0x0:
+		// LOCAL, the balancer itself connected, for example for a health check
+		return nil, nil, errNoProxyAddr
+	case 0x1:
+	default:
+		return nil, nil, errors.New("Unsupported PROXY v2 command %d", command)
+	}
+
+	var ipLen int
+	switch family >> 4 {
+	case 0x1:
+		ipLen = net.IPv4len
+	case 0x2:
+		ipLen = net.IPv6len
+	default:
+		// AF_UNSPEC or AF_UNIX, nothing useful for us. Any TLVs that follow the
+		// addresses are ignored.
+		return nil, nil, errNoProxyAddr
+	}
+	if family&0x0F != 0x1 {
+		return nil, nil, errors.New("Unsupported PROXY v2 transport %d", family&0x0F)
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, errors.New("PROXY v2 addresses too short")
+	}
+	src := &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), payload[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), payload[ipLen:2*ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+	return src, dst, nil
+}
@@ -0,0 +1,247 @@
+package listeners
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// proxyV2Header builds a v2 header with the given version and command byte,
+// family byte and payload (addresses followed by any TLVs).
+func proxyV2Header(versionCommand, family byte, payload ...[]byte) []byte {
+	var body []byte
+	for _, p := range payload {
+		body = append(body, p...)
+	}
+	header := append([]byte(nil), proxyV2Sig...)
+	header = append(header, versionCommand, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(body)))
+	return append(header, body...)
+}
+
+// proxyV2Addrs builds the address block for src and dst IPs and ports.
+func proxyV2Addrs(src, dst string, srcPort, dstPort uint16) []byte {
+	srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+	if ip4 := srcIP.To4(); ip4 != nil {
+		srcIP, dstIP = ip4, dstIP.To4()
+	}
+	addrs := append(append([]byte(nil), srcIP...), dstIP...)
+	return binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(addrs, srcPort), dstPort)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	const own = "own"
+	tcp4 := proxyV2Addrs("192.0.2.1", "198.51.100.1", 56324, 443)
+	tcp6 := proxyV2Addrs("2001:db8::1", "2001:db8::2", 56324, 443)
+	tlvs := []byte{0x04, 0x00, 0x03, 'a', 'b', 'c', 0x01, 0x00, 0x02, 'h', '2'}
+
+	for _, tc := range []struct {
+		name   string
+		header []byte
+		// remote and local are the expected addresses, own meaning the
+		// connection's own, or "" if the header should be rejected
+		remote string
+		local  string
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), "192.0.2.1:56324", "198.51.100.1:443"},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), "[2001:db8::1]:56324", "[2001:db8::2]:443"},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), own, own},
+		{"v1 UNKNOWN with addresses", []byte("PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n"), own, own},
+		{"v1 TCP4 with IPv6 address", []byte("PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n"), "", ""},
+		{"v1 TCP6 with IPv4 address", []byte("PROXY TCP6 192.0.2.1 2001:db8::2 56324 443\r\n"), "", ""},
+		{"v1 invalid IP", []byte("PROXY TCP4 192.0.2 198.51.100.1 56324 443\r\n"), "", ""},
+		{"v1 port out of range", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n"), "", ""},
+		{"v1 missing port", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n"), "", ""},
+		{"v1 extra field", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443 80\r\n"), "", ""},
+		{"v1 unsupported protocol", []byte("PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n"), "", ""},
+		{"v1 without CR", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n"), "", ""},
+		{"v1 bad prefix", []byte("PROXYTCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), "", ""},
+		{"v1 too long", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443" + strings.Repeat(" ", maxProxyV1HeaderLength) + "\r\n"), "", ""},
+		{"v1 too long without LF", []byte("PROXY " + strings.Repeat("A", 300)), "", ""},
+		{"v2 PROXY TCP4", proxyV2Header(0x21, 0x11, tcp4), "192.0.2.1:56324", "198.51.100.1:443"},
+		{"v2 PROXY TCP6", proxyV2Header(0x21, 0x21, tcp6), "[2001:db8::1]:56324", "[2001:db8::2]:443"},
+		{"v2 PROXY with TLVs", proxyV2Header(0x21, 0x11, tcp4, tlvs), "192.0.2.1:56324", "198.51.100.1:443"},
+		{"v2 LOCAL", proxyV2Header(0x20, 0x00), own, own},
+		{"v2 LOCAL with addresses", proxyV2Header(0x20, 0x11, tcp4), own, own},
+		{"v2 PROXY AF_UNSPEC", proxyV2Header(0x21, 0x00), own, own},
+		{"v2 PROXY AF_UNIX", proxyV2Header(0x21, 0x31, make([]byte, 216)), own, own},
+		{"v2 PROXY UDP", proxyV2Header(0x21, 0x12, tcp4), "", ""},
+		{"v2 unsupported command", proxyV2Header(0x22, 0x11, tcp4), "", ""},
+		{"v2 unsupported version", proxyV2Header(0x11, 0x11, tcp4), "", ""},
+		{"v2 bad signature", append([]byte("\r\n\r\n\x00\r\nQUIT!"), proxyV2Header(0x21, 0x11, tcp4)[12:]...), "", ""},
+		{"v2 addresses too short", proxyV2Header(0x21, 0x11, tcp4[:8]), "", ""},
+		{"v2 TCP6 with TCP4 addresses", proxyV2Header(0x21, 0x21, tcp4), "", ""},
+		{"v2 truncated header", proxyV2Header(0x21, 0x11, tcp4)[:14], "", ""},
+		{"v2 truncated addresses", proxyV2Header(0x21, 0x11, tcp4)[:20], "", ""},
+		{"v2 truncated TLVs", proxyV2Header(0x21, 0x11, tcp4, tlvs)[:16+len(tcp4)+4], "", ""},
+		{"no header", []byte("GET / HTTP/1.1\r\n\r\n"), "", ""},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			go func() {
+				client.Write(tc.header)
+				client.Write([]byte("data"))
+				if tc.remote == "" {
+					// Make sure that truncated headers end
+					client.Close()
+				}
+			}()
+
+			conn, err := readProxyHeader(server, time.Second)
+			if tc.remote == "" {
+				assert.Error(t, err)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			if tc.remote == own {
+				assert.Equal(t, server.RemoteAddr(), conn.RemoteAddr())
+				assert.Equal(t, server.LocalAddr(), conn.LocalAddr())
+			} else {
+				assert.Equal(t, tc.remote, conn.RemoteAddr().String())
+				assert.Equal(t, tc.local, conn.LocalAddr().String())
+			}
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(conn, b); assert.NoError(t, err) {
+				assert.Equal(t, "data", string(b), "should have kept what followed the header")
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderTimeout(t *testing.T) {
+	for _, partial := range []string{"", "PROXY TCP4 192.0.2.1", "\r\n\r\n\x00\r\n"} {
+		client, server := net.Pipe()
+		go client.Write([]byte(partial))
+		start := time.Now()
+		_, err := readProxyHeader(server, 50*time.Millisecond)
+		assert.Error(t, err, "%q", partial)
+		assert.True(t, time.Since(start) < time.Second, "should have timed out on %q", partial)
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	newListener := func(trusted string) net.Listener {
+		wrapped, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		_, ipNet, _ := net.ParseCIDR(trusted)
+		return NewProxyProtocolListener(wrapped, &ProxyProtocolOpts{
+			TrustedCIDRs:  []*net.IPNet{ipNet},
+			HeaderTimeout: 250 * time.Millisecond,
+		})
+	}
+	dial := func(l net.Listener, data string) net.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		conn.Write([]byte(data))
+		return conn
+	}
+	accept := func(l net.Listener) net.Conn {
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err == nil {
+				accepted <- conn
+			}
+		}()
+		select {
+		case conn := <-accepted:
+			return conn
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "nothing accepted")
+			return nil
+		}
+	}
+	header := "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+
+	// Trusted sources are honored, and slow or missing headers don't hold up
+	// other connections
+	l := newListener("127.0.0.0/8")
+	if l == nil {
+		return
+	}
+	defer l.Close()
+	silent := dial(l, "")
+	defer silent.Close()
+	invalid := dial(l, "hello\r\n")
+	defer invalid.Close()
+	good := dial(l, header+"data")
+	defer good.Close()
+	if conn := accept(l); conn != nil {
+		assert.Equal(t, "192.0.2.1:56324", conn.RemoteAddr().String())
+		assert.Equal(t, "198.51.100.1:443", conn.LocalAddr().String())
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(conn, b); assert.NoError(t, err) {
+			assert.Equal(t, "data", string(b))
+		}
+		conn.Close()
+	}
+	// The connections without valid headers get closed
+	for _, conn := range []net.Conn{silent, invalid} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		assert.Error(t, err)
+		if ne, ok := err.(net.Error); ok {
+			assert.False(t, ne.Timeout(), "connection should have been closed")
+		}
+	}
+
+	// Untrusted sources are passed on untouched, header and all
+	l2 := newListener("10.0.0.0/8")
+	if l2 == nil {
+		return
+	}
+	defer l2.Close()
+	untrusted := dial(l2, header)
+	defer untrusted.Close()
+	if conn := accept(l2); conn != nil {
+		assert.Equal(t, untrusted.LocalAddr().String(), conn.RemoteAddr().String())
+		b := make([]byte, len(header))
+		if _, err := io.ReadFull(conn, b); assert.NoError(t, err) {
+			assert.Equal(t, header, string(b))
+		}
+		conn.Close()
+	}
+}
+
+func TestProxyProtocolListenerClose(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		wrapped, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assert.NoError(t, err) {
+			return
+		}
+		l := NewProxyProtocolListener(wrapped, &ProxyProtocolOpts{})
+		errs := make(chan error, 2)
+		for j := 0; j < 2; j++ {
+			go func() {
+				_, err := l.Accept()
+				errs <- err
+			}()
+		}
+		l.Close()
+		for j := 0; j < 2; j++ {
+			select {
+			case err := <-errs:
+				assert.Error(t, err)
+			case <-time.After(5 * time.Second):
+				assert.Fail(t, "Accept should have returned after Close")
+				return
+			}
+		}
+	}
+}
@@ -16,12 +16,15 @@ import (
 
 const (
 	logTimestampFormat = "Jan 02 15:04:05.000"
+
+	defaultRotationSize = 4 * 1024 * 1024
+	defaultMaxRotation  = 5
 )
 
 var (
-	log          = golog.LoggerFor("flashlight.logging")
-	logdir       = logDir()
-	processStart = time.Now()
+	log           = golog.LoggerFor("flashlight.logging")
+	defaultLogDir = logDir()
+	processStart  = time.Now()
 
 	logFile *rotator.SizeRotator
 
@@ -50,7 +53,29 @@ func (t timestamped) Write(p []byte) (int, error) {
 	return io.WriteString(t.Writer, time.Now().In(time.UTC).Format(logTimestampFormat)+" "+string(p))
 }
 
+// Opts configures where and how logs are written. Zero values fall back to
+// the defaults.
+type Opts struct {
+	// Dir is the directory in which to place log files.
+	Dir string
+
+	// RotationSize is the size in bytes at which log files are rotated.
+	RotationSize int64
+
+	// MaxRotation is the number of rotated log files to keep.
+	MaxRotation int
+}
+
 func Init(instanceId string, version string, revisionDate string) error {
+	return InitWith(&Opts{}, instanceId, version, revisionDate)
+}
+
+// InitWith is like Init but uses the given Opts.
+func InitWith(opts *Opts, instanceId string, version string, revisionDate string) error {
+	logdir := opts.Dir
+	if logdir == "" {
+		logdir = defaultLogDir
+	}
 	log.Tracef("Placing logs in %v", logdir)
 	if _, err := os.Stat(logdir); err != nil {
 		if os.IsNotExist(err) {
@@ -61,10 +86,16 @@ func Init(instanceId string, version string, revisionDate string) error {
 		}
 	}
 	logFile = rotator.NewSizeRotator(filepath.Join(logdir, "proxy.log"))
-	// Set log files to 4 MB
-	logFile.RotationSize = 4 * 1024 * 1024
-	// Keep up to 5 log files
-	logFile.MaxRotation = 5
+	// Set log files to 4 MB by default
+	logFile.RotationSize = defaultRotationSize
+	if opts.RotationSize > 0 {
+		logFile.RotationSize = opts.RotationSize
+	}
+	// Keep up to 5 log files by default
+	logFile.MaxRotation = defaultMaxRotation
+	if opts.MaxRotation > 0 {
+		logFile.MaxRotation = opts.MaxRotation
+	}
 
 	// Loggly has its own timestamp so don't bother adding it in message,
 	// moreover, golog always write each line in whole, so we need not to care about line breaks.
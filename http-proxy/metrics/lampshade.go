@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"sync"
+
+	"github.com/getlantern/lampshade"
+)
+
+var (
+	lampshadeSessionsDesc = lampshadeDesc("sessions", "Number of open lampshade sessions.")
+	lampshadeStreamsDesc  = lampshadeDesc("streams", "Number of open lampshade streams.")
+	lampshadeBlockedDesc  = lampshadeDesc("streams_blocked", "Number of open lampshade streams that can't send until the client ACKs what they sent.")
+	lampshadeSentDesc     = lampshadeDesc("bytes_sent", "Bytes sent on open lampshade sessions, including framing, padding and encryption overhead.")
+	lampshadeRecvDesc     = lampshadeDesc("bytes_received", "Bytes received on open lampshade sessions, including framing and encryption overhead.")
+	lampshadePaddingDesc  = lampshadeDesc("padding_bytes", "Bytes of padding sent on open lampshade sessions.")
+	lampshadeWritesDesc   = lampshadeDesc("writes", "Writes to the connections of open lampshade sessions.")
+	lampshadeCoalesceDesc = lampshadeDesc("coalesced_writes", "Writes to the connections of open lampshade sessions that combined more than one frame.")
+	lampshadeRSTSentDesc  = lampshadeDesc("resets_sent", "Streams reset by the proxy on open lampshade sessions.")
+	lampshadeRSTRecvDesc  = lampshadeDesc("resets_received", "Streams reset by clients on open lampshade sessions.")
+	lampshadeLatencyDesc  = lampshadeDesc("ack_latency_seconds", "Average time for data sent on open lampshade sessions to be ACK'ed.")
+)
+
+func lampshadeDesc(name, help string) *desc {
+	return &desc{name: "lampshade_listener_" + name, help: help, metricType: "gauge", labelNames: []string{"listener"}}
+}
+
+// lampshadeListeners collects the stats of the open sessions on lampshade
+// listeners, summed up by listener address. Since the stats of sessions are
+// gone once they close, all of these are gauges, including the byte counts.
+type lampshadeListeners struct {
+	listeners []lampshade.Listener
+	mx        sync.Mutex
+}
+
+// lampshadeTotals are the stats of a listener's open sessions.
+type lampshadeTotals struct {
+	addr                                   string
+	sessions, streams, blocked             int
+	sent, recv, padding, writes, coalesced int64
+	rstsSent, rstsRecv                     int64
+	ackLatencySeconds                      float64
+}
+
+func (ll *lampshadeListeners) add(l lampshade.Listener) {
+	ll.mx.Lock()
+	ll.listeners = append(ll.listeners, l)
+	ll.mx.Unlock()
+}
+
+func (ll *lampshadeListeners) totals() []*lampshadeTotals {
+	ll.mx.Lock()
+	listeners := ll.listeners
+	ll.mx.Unlock()
+	all := make([]*lampshadeTotals, 0, len(listeners))
+	for _, l := range listeners {
+		t := &lampshadeTotals{addr: l.Addr().String()}
+		var latencySessions int
+		for _, s := range l.Sessions() {
+			stats := s.Stats()
+			t.sessions++
+			t.streams += len(stats.Streams)
+			for _, stream := range stats.Streams {
+				if stream.SendWindow <= 0 {
+					t.blocked++
+				}
+			}
+			t.sent += stats.BytesSent
+			t.recv += stats.BytesRecv
+			t.padding += stats.PaddingBytes
+			t.writes += stats.Writes
+			t.coalesced += stats.CoalescedWrites
+			t.rstsSent += stats.RSTsSent
+			t.rstsRecv += stats.RSTsRecv
+			if stats.ACKLatency > 0 {
+				t.ackLatencySeconds += stats.ACKLatency.Seconds()
+				latencySessions++
+			}
+		}
+		if latencySessions > 0 {
+			t.ackLatencySeconds /= float64(latencySessions)
+		}
+		all = append(all, t)
+	}
+	return all
+}
+
+func (ll *lampshadeListeners) writeTo(w *bufio.Writer) {
+	totals := ll.totals()
+	write := func(d *desc, value func(t *lampshadeTotals) float64) {
+		d.writeHeader(w)
+		for _, t := range totals {
+			fmt.Fprintf(w, "%s%s %s\n", d.name, d.labels([]string{t.addr}), formatFloat(value(t)))
+		}
+	}
+	write(lampshadeSessionsDesc, func(t *lampshadeTotals) float64 { return float64(t.sessions) })
+	write(lampshadeStreamsDesc, func(t *lampshadeTotals) float64 { return float64(t.streams) })
+	write(lampshadeBlockedDesc, func(t *lampshadeTotals) float64 { return float64(t.blocked) })
+	write(lampshadeSentDesc, func(t *lampshadeTotals) float64 { return float64(t.sent) })
+	write(lampshadeRecvDesc, func(t *lampshadeTotals) float64 { return float64(t.recv) })
+	write(lampshadePaddingDesc, func(t *lampshadeTotals) float64 { return float64(t.padding) })
+	write(lampshadeWritesDesc, func(t *lampshadeTotals) float64 { return float64(t.writes) })
+	write(lampshadeCoalesceDesc, func(t *lampshadeTotals) float64 { return float64(t.coalesced) })
+	write(lampshadeRSTSentDesc, func(t *lampshadeTotals) float64 { return float64(t.rstsSent) })
+	write(lampshadeRSTRecvDesc, func(t *lampshadeTotals) float64 { return float64(t.rstsRecv) })
+	write(lampshadeLatencyDesc, func(t *lampshadeTotals) float64 { return t.ackLatencySeconds })
+}
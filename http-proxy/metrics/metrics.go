@@ -0,0 +1,327 @@
+// Package metrics exposes proxy metrics in the Prometheus text exposition
+// format. It implements just enough of the format (counters, gauges and
+// histograms with labels) to be scraped by Prometheus without pulling in the
+// full client library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	labelSeparator = "\xff"
+)
+
+// Collector is a metric that can write itself in the text exposition format.
+type Collector interface {
+	writeTo(w *bufio.Writer)
+}
+
+// Registry is a set of Collectors.
+type Registry struct {
+	collectors []Collector
+	mx         sync.RWMutex
+}
+
+// NewRegistry constructs a new empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds the given Collectors to this Registry.
+func (r *Registry) Register(collectors ...Collector) {
+	r.mx.Lock()
+	r.collectors = append(r.collectors, collectors...)
+	r.mx.Unlock()
+}
+
+// WriteText writes all registered metrics to w.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mx.RLock()
+	collectors := r.collectors
+	r.mx.RUnlock()
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.writeTo(bw)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP implements the interface http.Handler
+func (r *Registry) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteText(resp)
+}
+
+// desc describes a metric family
+type desc struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, escapeHelp(d.help), d.name, d.metricType)
+}
+
+// labels formats the given label values (plus any extra name/value pairs) as
+// {name="value",...}.
+func (d *desc) labels(values []string, extra ...string) string {
+	if len(d.labelNames) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(values)+len(extra)/2)
+	for i, name := range d.labelNames {
+		pairs = append(pairs, name+`="`+escapeLabelValue(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabelValue(extra[i+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (d *desc) checkLabels(values []string) {
+	if len(values) != len(d.labelNames) {
+		panic(fmt.Sprintf("metric %v expects %d label values, got %d", d.name, len(d.labelNames), len(values)))
+	}
+}
+
+// Counter is a monotonically increasing value, optionally partitioned by
+// labels.
+type Counter struct {
+	desc
+	series map[string]*counterSeries
+	mx     sync.Mutex
+}
+
+type counterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+// NewCounter constructs a Counter with the given label names.
+func NewCounter(name, help string, labelNames ...string) *Counter {
+	return &Counter{
+		desc:   desc{name: name, help: help, metricType: "counter", labelNames: labelNames},
+		series: make(map[string]*counterSeries),
+	}
+}
+
+// Add adds delta to the counter with the given label values.
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	c.checkLabels(labelValues)
+	key := strings.Join(labelValues, labelSeparator)
+	c.mx.Lock()
+	s := c.series[key]
+	if s == nil {
+		s = &counterSeries{labelValues: labelValues}
+		c.series[key] = s
+	}
+	s.value += delta
+	c.mx.Unlock()
+}
+
+// Inc increments the counter with the given label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Get gets the current value of the counter with the given label values.
+func (c *Counter) Get(labelValues ...string) float64 {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	s := c.series[strings.Join(labelValues, labelSeparator)]
+	if s == nil {
+		return 0
+	}
+	return s.value
+}
+
+func (c *Counter) writeTo(w *bufio.Writer) {
+	c.writeHeader(w)
+	c.mx.Lock()
+	keys := sortedKeys(len(c.series), func(fn func(string)) {
+		for key := range c.series {
+			fn(key)
+		}
+	})
+	for _, key := range keys {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labels(s.labelValues), formatFloat(s.value))
+	}
+	c.mx.Unlock()
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	desc
+	value float64
+	mx    sync.Mutex
+}
+
+// NewGauge constructs a Gauge.
+func NewGauge(name, help string) *Gauge {
+	return &Gauge{desc: desc{name: name, help: help, metricType: "gauge"}}
+}
+
+// Add adds delta (which may be negative) to the gauge.
+func (g *Gauge) Add(delta float64) {
+	g.mx.Lock()
+	g.value += delta
+	g.mx.Unlock()
+}
+
+// Get gets the current value of the gauge.
+func (g *Gauge) Get() float64 {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	return g.value
+}
+
+func (g *Gauge) writeTo(w *bufio.Writer) {
+	g.writeHeader(w)
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.Get()))
+}
+
+type valueFunc struct {
+	desc
+	fn func() float64
+}
+
+// NewGaugeFunc constructs a gauge whose value is obtained by calling fn
+// whenever metrics are collected.
+func NewGaugeFunc(name, help string, fn func() float64) Collector {
+	return &valueFunc{desc{name: name, help: help, metricType: "gauge"}, fn}
+}
+
+// NewCounterFunc constructs a counter whose value is obtained by calling fn
+// whenever metrics are collected.
+func NewCounterFunc(name, help string, fn func() float64) Collector {
+	return &valueFunc{desc{name: name, help: help, metricType: "counter"}, fn}
+}
+
+func (v *valueFunc) writeTo(w *bufio.Writer) {
+	v.writeHeader(w)
+	fmt.Fprintf(w, "%s %s\n", v.name, formatFloat(v.fn()))
+}
+
+// Histogram counts observations in cumulative buckets, optionally partitioned
+// by labels.
+type Histogram struct {
+	desc
+	buckets []float64
+	series  map[string]*histogramSeries
+	mx      sync.Mutex
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+// NewHistogram constructs a Histogram with the given (sorted) bucket upper
+// bounds and label names.
+func NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	return &Histogram{
+		desc:    desc{name: name, help: help, metricType: "histogram", labelNames: labelNames},
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+}
+
+// Observe records the value v in the histogram with the given label values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.checkLabels(labelValues)
+	key := strings.Join(labelValues, labelSeparator)
+	h.mx.Lock()
+	s := h.series[key]
+	if s == nil {
+		s = &histogramSeries{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upperBound := range h.buckets {
+		if v <= upperBound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+	h.mx.Unlock()
+}
+
+// Count gets the number of observations in the histogram with the given label
+// values.
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	s := h.series[strings.Join(labelValues, labelSeparator)]
+	if s == nil {
+		return 0
+	}
+	return s.count
+}
+
+func (h *Histogram) writeTo(w *bufio.Writer) {
+	h.writeHeader(w)
+	h.mx.Lock()
+	keys := sortedKeys(len(h.series), func(fn func(string)) {
+		for key := range h.series {
+			fn(key)
+		}
+	})
+	for _, key := range keys {
+		s := h.series[key]
+		for i, upperBound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labels(s.labelValues, "le", formatFloat(upperBound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labels(s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labels(s.labelValues), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labels(s.labelValues), s.count)
+	}
+	h.mx.Unlock()
+}
+
+func sortedKeys(n int, each func(func(string))) []string {
+	keys := make([]string, 0, n)
+	each(func(key string) {
+		keys = append(keys, key)
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
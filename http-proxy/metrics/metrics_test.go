@@ -0,0 +1,251 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/keyman"
+	"github.com/getlantern/lampshade"
+	"github.com/getlantern/ops"
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/buffers"
+	"github.com/getlantern/http-proxy/cache"
+)
+
+func TestTextFormat(t *testing.T) {
+	r := NewRegistry()
+	c := NewCounter("things_total", "Count of\nthings.", "kind")
+	c.Inc(`a"b`)
+	c.Add(2.5, "plain")
+	h := NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+	r.Register(c, h, NewGaugeFunc("answer", "The answer.", func() float64 { return 42 }))
+
+	var buf bytes.Buffer
+	if !assert.NoError(t, r.WriteText(&buf)) {
+		return
+	}
+	assert.Equal(t, `# HELP things_total Count of\nthings.
+# TYPE things_total counter
+things_total{kind="a\"b"} 1
+things_total{kind="plain"} 2.5
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 5.55
+latency_seconds_count 3
+# HELP answer The answer.
+# TYPE answer gauge
+answer 42
+`, buf.String())
+}
+
+func TestListener(t *testing.T) {
+	p := NewProxy()
+	p.reportInterval = 10 * time.Millisecond
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	ml := p.Listener(l)
+	defer ml.Close()
+
+	go func() {
+		conn, err := ml.Accept()
+		if err != nil {
+			return
+		}
+		b := make([]byte, 5)
+		conn.Read(b)
+		conn.Write([]byte("hi"))
+		conn.Close()
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn.Write([]byte("hello"))
+	ioutil.ReadAll(conn)
+	conn.Close()
+
+	// Measured connections notice that they've closed on their next rate
+	// calculation, which can take a second
+	for i := 0; i < 30 && p.activeConns.Get() > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.EqualValues(t, 1, p.connsTotal.Get())
+	assert.EqualValues(t, 0, p.activeConns.Get())
+	assert.EqualValues(t, 2, p.bytesSent.Get())
+	assert.EqualValues(t, 5, p.bytesReceived.Get())
+}
+
+func TestFilter(t *testing.T) {
+	p := NewProxy()
+	block := filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		if req.URL.Path == "/blocked" {
+			return filters.Fail(ctx, req, http.StatusForbidden, errors.New("blocked"))
+		}
+		return next(ctx, req)
+	})
+	chain := filters.Join(p.Filter(block))
+	upstream := func(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+		if req.URL.Path == "/broken" {
+			return nil, ctx, errors.New("broken")
+		}
+		return &http.Response{StatusCode: http.StatusOK}, ctx, nil
+	}
+
+	do := func(method, path string) {
+		req, _ := http.NewRequest(method, "http://example.com"+path, nil)
+		chain.Apply(filters.BackgroundContext(), req, upstream)
+	}
+	do(http.MethodGet, "/")
+	do(http.MethodGet, "/")
+	do(http.MethodPost, "/blocked")
+	do(http.MethodGet, "/broken")
+	do("BREW", "/")
+
+	assert.EqualValues(t, 2, p.requests.Get("GET", "200", OutcomeForwarded))
+	assert.EqualValues(t, 1, p.requests.Get("POST", "403", OutcomeBlocked))
+	assert.EqualValues(t, 1, p.requests.Get("GET", "none", OutcomeError))
+	assert.EqualValues(t, 1, p.requests.Get("OTHER", "200", OutcomeForwarded))
+}
+
+func TestFilterCacheHits(t *testing.T) {
+	p := NewProxy()
+	c, err := cache.New(&cache.Opts{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	allow := filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		return next(ctx, req)
+	})
+	// Like the proxy, the metrics only wrap the filters that decide whether to
+	// allow requests, and the cache comes after them
+	chain := filters.Join(p.Filter(allow), c.Filter())
+	upstream := func(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Cache-Control": []string{"max-age=60"}},
+			Body:       ioutil.NopCloser(strings.NewReader("cacheable")),
+		}, ctx, nil
+	}
+
+	var cacheStatus []string
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/cacheable", nil)
+		resp, _, err := chain.Apply(filters.BackgroundContext(), req, upstream)
+		if assert.NoError(t, err) {
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			cacheStatus = append(cacheStatus, resp.Header.Get(cache.XCache))
+		}
+	}
+
+	assert.Equal(t, []string{"MISS", "HIT"}, cacheStatus)
+	assert.EqualValues(t, 2, p.requests.Get("GET", "200", OutcomeForwarded))
+	assert.EqualValues(t, 0, p.requests.Get("GET", "200", OutcomeBlocked), "cache hits aren't blocked")
+}
+
+func TestDialAndOps(t *testing.T) {
+	p := NewProxy()
+	p.ReportOps()
+	p.ReportOps()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	dial := p.Dial(nil)
+	conn, err := dial(context.Background(), false, "tcp", l.Addr().String())
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	l.Close()
+	_, err = dial(context.Background(), false, "tcp", l.Addr().String())
+	assert.Error(t, err)
+	assert.EqualValues(t, 1, p.dialDuration.Count(resultSuccess))
+	assert.EqualValues(t, 1, p.dialDuration.Count(resultFailure))
+
+	op := ops.Begin("metrics_test_op")
+	op.FailIf(errors.New("failed"))
+	op.End()
+	ops.Begin("metrics_test_op").End()
+	assert.EqualValues(t, 1, p.ops.Get("metrics_test_op", resultFailure))
+	assert.EqualValues(t, 1, p.ops.Get("metrics_test_op", resultSuccess), "reporter should only be registered once")
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	assert.True(t, strings.Contains(body, `http_proxy_ops_total{op="metrics_test_op",result="failure"} 1`), body)
+	assert.True(t, strings.Contains(body, "lampshade_streams_open "), body)
+}
+
+func TestLampshadeListener(t *testing.T) {
+	pk, err := keyman.GeneratePK(2048)
+	if !assert.NoError(t, err) {
+		return
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	ll := lampshade.WrapListener(l, buffers.Pool(), pk.RSA())
+	defer ll.Close()
+	p := NewProxy()
+	p.LampshadeListener(ll)
+
+	go func() {
+		conn, err := ll.Accept()
+		if err != nil {
+			return
+		}
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(conn, b); err == nil {
+			conn.Write(b)
+		}
+	}()
+	d := lampshade.NewDialer(&lampshade.DialerOpts{
+		Pool:            buffers.Pool(),
+		Cipher:          lampshade.AES128GCM,
+		ServerPublicKey: &pk.RSA().PublicKey,
+	})
+	conn, err := d.Dial(func() (net.Conn, error) {
+		return net.Dial("tcp", l.Addr().String())
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	if _, err := io.ReadFull(conn, make([]byte, 5)); !assert.NoError(t, err) {
+		return
+	}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	label := `{listener="` + l.Addr().String() + `"}`
+	assert.Contains(t, body, "lampshade_listener_sessions"+label+" 1")
+	assert.Contains(t, body, "lampshade_listener_streams"+label+" 1")
+	assert.NotContains(t, body, "lampshade_listener_bytes_sent"+label+" 0\n")
+	assert.NotContains(t, body, "lampshade_listener_bytes_received"+label+" 0\n")
+	assert.Contains(t, body, "# TYPE lampshade_listener_ack_latency_seconds gauge")
+}
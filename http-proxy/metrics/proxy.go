@@ -0,0 +1,215 @@
+package metrics
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getlantern/lampshade"
+	"github.com/getlantern/measured"
+	"github.com/getlantern/ops"
+	"github.com/getlantern/proxy"
+	"github.com/getlantern/proxy/filters"
+
+	"github.com/getlantern/http-proxy/dialer"
+	"github.com/getlantern/http-proxy/listeners"
+)
+
+const (
+	// OutcomeForwarded means the filters passed the request on upstream
+	OutcomeForwarded = "forwarded"
+	// OutcomeBlocked means a filter responded to the request itself
+	OutcomeBlocked = "blocked"
+	// OutcomeError means the request failed upstream
+	OutcomeError = "error"
+
+	resultSuccess = "success"
+	resultFailure = "failure"
+
+	reportInterval = 5 * time.Second
+)
+
+var (
+	dialBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+	knownMethods = map[string]bool{
+		http.MethodConnect: true,
+		http.MethodDelete:  true,
+		http.MethodGet:     true,
+		http.MethodHead:    true,
+		http.MethodOptions: true,
+		http.MethodPatch:   true,
+		http.MethodPost:    true,
+		http.MethodPut:     true,
+		http.MethodTrace:   true,
+	}
+)
+
+// Proxy holds the metrics for an http-proxy. Its instrumentation points are a
+// listener wrapper (Listener), a filter (Filter), a dial function (Dial) and
+// an ops reporter (ReportOps). Proxy is itself the http.Handler that serves
+// the metrics.
+type Proxy struct {
+	*Registry
+
+	activeConns    *Gauge
+	connsTotal     *Counter
+	bytesSent      *Counter
+	bytesReceived  *Counter
+	requests       *Counter
+	dialDuration   *Histogram
+	ops            *Counter
+	lampshade      *lampshadeListeners
+	reportOpsOnce  sync.Once
+	reportInterval time.Duration
+}
+
+// NewProxy constructs a Proxy with all of its metrics registered, including
+// process-wide lampshade session and stream counts, and the stats of sessions
+// on the lampshade listeners added with LampshadeListener.
+func NewProxy() *Proxy {
+	p := &Proxy{
+		Registry:       NewRegistry(),
+		activeConns:    NewGauge("http_proxy_active_connections", "Number of client connections currently open."),
+		connsTotal:     NewCounter("http_proxy_connections_total", "Number of client connections accepted."),
+		bytesSent:      NewCounter("http_proxy_bytes_sent_total", "Bytes sent to clients."),
+		bytesReceived:  NewCounter("http_proxy_bytes_received_total", "Bytes received from clients."),
+		requests:       NewCounter("http_proxy_requests_total", "Requests by method, response status and filter outcome.", "method", "status", "outcome"),
+		dialDuration:   NewHistogram("http_proxy_dial_duration_seconds", "Time taken to dial upstream.", dialBuckets, "result"),
+		ops:            NewCounter("http_proxy_ops_total", "Operations reported via ops, by name and result.", "op", "result"),
+		lampshade:      &lampshadeListeners{},
+		reportInterval: reportInterval,
+	}
+	lampshadeStat := func(get func(*lampshade.GlobalStats) int64) func() float64 {
+		return func() float64 {
+			return float64(get(lampshade.GetGlobalStats()))
+		}
+	}
+	p.Register(
+		p.activeConns,
+		p.connsTotal,
+		p.bytesSent,
+		p.bytesReceived,
+		p.requests,
+		p.dialDuration,
+		p.ops,
+		NewGaugeFunc("lampshade_sessions_open", "Number of open lampshade sessions.", lampshadeStat(func(s *lampshade.GlobalStats) int64 { return s.OpenSessions })),
+		NewGaugeFunc("lampshade_sessions_closing", "Number of lampshade sessions that are closing.", lampshadeStat(func(s *lampshade.GlobalStats) int64 { return s.ClosingSessions })),
+		NewCounterFunc("lampshade_sessions_closed_total", "Number of lampshade sessions closed.", lampshadeStat(func(s *lampshade.GlobalStats) int64 { return s.ClosedSessions })),
+		NewGaugeFunc("lampshade_streams_open", "Number of open lampshade streams.", lampshadeStat(func(s *lampshade.GlobalStats) int64 { return s.OpenStreams })),
+		p.lampshade,
+	)
+	return p
+}
+
+// LampshadeListener adds the stats of the open sessions on l, summed up by
+// listener address, to the metrics. Pass it as
+// server.Opts.OnLampshadeListener to cover all lampshade listeners.
+func (p *Proxy) LampshadeListener(l lampshade.Listener) {
+	p.lampshade.add(l)
+}
+
+// Listener wraps l to count connections and the bytes transferred on them.
+// Byte counts are updated periodically while connections are open and once
+// more when they close.
+func (p *Proxy) Listener(l net.Listener) net.Listener {
+	return &countingListener{
+		Listener: listeners.NewMeasuredListener(l, p.reportInterval, p.reportMeasured),
+		p:        p,
+	}
+}
+
+func (p *Proxy) reportMeasured(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {
+	p.bytesSent.Add(float64(deltaStats.SentTotal))
+	p.bytesReceived.Add(float64(deltaStats.RecvTotal))
+	if final {
+		p.activeConns.Add(-1)
+	}
+}
+
+type countingListener struct {
+	net.Listener
+	p *Proxy
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.p.activeConns.Add(1)
+		l.p.connsTotal.Inc()
+	}
+	return conn, err
+}
+
+// Filter wraps the given filter to count requests by method, response status
+// and outcome. The outcome is "blocked" if the filter responded without
+// passing the request on, "error" if there was no usable response from
+// upstream and "forwarded" otherwise. Only wrap filters that decide whether to
+// allow requests, since other filters that respond themselves (like the cache)
+// would make their responses count as blocked.
+func (p *Proxy) Filter(filter filters.Filter) filters.Filter {
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		forwarded := false
+		resp, nextCtx, err := filter.Apply(ctx, req, func(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+			forwarded = true
+			return next(ctx, req)
+		})
+		outcome := OutcomeBlocked
+		if forwarded {
+			outcome = OutcomeForwarded
+			if err != nil || resp == nil {
+				outcome = OutcomeError
+			}
+		}
+		status := "none"
+		if resp != nil {
+			status = strconv.Itoa(resp.StatusCode)
+		}
+		method := req.Method
+		if !knownMethods[method] {
+			// Keep label cardinality bounded
+			method = "OTHER"
+		}
+		p.requests.Inc(method, status, outcome)
+		return resp, nextCtx, err
+	})
+}
+
+// Dial wraps dial to record how long dials take. If dial is nil, destinations
+// are dialed directly.
+func (p *Proxy) Dial(dial proxy.DialFunc) proxy.DialFunc {
+	if dial == nil {
+		dial = dialer.DialFunc(dialer.Direct)
+	}
+	return func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+		start := time.Now()
+		conn, err := dial(ctx, isCONNECT, network, addr)
+		result := resultSuccess
+		if err != nil {
+			result = resultFailure
+		}
+		p.dialDuration.Observe(time.Since(start).Seconds(), result)
+		return conn, err
+	}
+}
+
+// ReportOps registers an ops reporter that counts ops by name and result.
+// Calling it more than once has no additional effect.
+func (p *Proxy) ReportOps() {
+	p.reportOpsOnce.Do(func() {
+		ops.RegisterReporter(func(failure error, ctx map[string]interface{}) {
+			name, _ := ctx["op"].(string)
+			if name == "" {
+				return
+			}
+			result := resultSuccess
+			if failure != nil {
+				result = resultFailure
+			}
+			p.ops.Inc(name, result)
+		})
+	})
+}
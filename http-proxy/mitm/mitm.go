@@ -0,0 +1,300 @@
+// Package mitm intercepts CONNECT tunnels to selected hosts so that the HTTPS
+// requests inside of them go through the filter chain like plain HTTP
+// requests. The proxy impersonates the origin using leaf certificates that are
+// issued on the fly by a configured CA, which clients need to trust.
+package mitm
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/keyman"
+	"github.com/getlantern/proxy/filters"
+	"github.com/getlantern/tlsdefaults"
+	"github.com/hashicorp/golang-lru"
+
+	"github.com/getlantern/http-proxy/proxyfilters"
+)
+
+const (
+	organization = "Lantern"
+	caCommonName = "Lantern HTTPS Interception CA"
+
+	defaultCacheSize = 1000
+
+	caValidity = 10 * 365 * 24 * time.Hour
+
+	// leafValidity is how long issued leaf certificates are valid for. They're
+	// reissued once they get within leafRenewal of expiring.
+	leafValidity = 30 * 24 * time.Hour
+	leafRenewal  = 24 * time.Hour
+)
+
+var (
+	log = golog.LoggerFor("http-proxy.mitm")
+)
+
+// Opts configures an Interceptor.
+type Opts struct {
+	// CAKeyFile and CACertFile are the PEM-encoded private key and certificate
+	// of the CA that issues leaf certificates. If neither file exists, a new CA
+	// is generated and saved to them.
+	CAKeyFile  string
+	CACertFile string
+
+	// Hosts selects which hosts to intercept, using the host and IP entries of
+	// a proxyfilters.HostList. If empty, all hosts are intercepted.
+	Hosts []string
+
+	// Ports selects which ports to intercept, defaults to 443 only.
+	Ports []int
+
+	// UpstreamCAFile, if set, is a PEM file of additional CA certificates to
+	// trust when verifying origins.
+	UpstreamCAFile string
+
+	// CacheSize is the number of leaf certificates to cache, defaults to 1000.
+	CacheSize int
+}
+
+// Validate checks that these Opts are usable.
+func (opts *Opts) Validate() error {
+	if opts.CAKeyFile == "" || opts.CACertFile == "" {
+		return fmt.Errorf("MITM requires caKeyFile and caCertFile")
+	}
+	for _, port := range opts.Ports {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("Invalid MITM port %d", port)
+		}
+	}
+	if opts.CacheSize < 0 {
+		return fmt.Errorf("MITM cacheSize must not be negative")
+	}
+	return nil
+}
+
+// Interceptor selects CONNECT tunnels to intercept and supplies the TLS
+// configuration with which to impersonate their origins.
+type Interceptor struct {
+	caKey       *keyman.PrivateKey
+	caCert      *keyman.Certificate
+	leafKey     *keyman.PrivateKey
+	hosts       *proxyfilters.HostList
+	ports       map[string]bool
+	upstreamTLS *tls.Config
+	certs       *lru.Cache
+	mx          sync.Mutex
+}
+
+// New constructs an Interceptor, loading or generating its CA.
+func New(opts *Opts) (*Interceptor, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	caKey, caCert, err := loadCA(opts.CAKeyFile, opts.CACertFile)
+	if err != nil {
+		return nil, err
+	}
+	// All leaf certificates share a key since generating RSA keys is slow
+	leafKey, err := keyman.GeneratePK(2048)
+	if err != nil {
+		return nil, errors.New("Unable to generate leaf key: %v", err)
+	}
+	var hosts *proxyfilters.HostList
+	if len(opts.Hosts) > 0 {
+		hosts, err = proxyfilters.NewHostList(opts.Hosts...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ports := make(map[string]bool)
+	for _, port := range opts.Ports {
+		ports[strconv.Itoa(port)] = true
+	}
+	if len(ports) == 0 {
+		ports["443"] = true
+	}
+	var upstreamTLS *tls.Config
+	if opts.UpstreamCAFile != "" {
+		upstreamTLS, err = upstreamTLSConfig(opts.UpstreamCAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cacheSize := opts.CacheSize
+	if cacheSize == 0 {
+		cacheSize = defaultCacheSize
+	}
+	certs, _ := lru.New(cacheSize)
+	return &Interceptor{
+		caKey:       caKey,
+		caCert:      caCert,
+		leafKey:     leafKey,
+		hosts:       hosts,
+		ports:       ports,
+		upstreamTLS: upstreamTLS,
+		certs:       certs,
+	}, nil
+}
+
+func loadCA(keyFile, certFile string) (*keyman.PrivateKey, *keyman.Certificate, error) {
+	_, keyErr := os.Stat(keyFile)
+	_, certErr := os.Stat(certFile)
+	if os.IsNotExist(keyErr) && os.IsNotExist(certErr) {
+		return generateCA(keyFile, certFile)
+	}
+	key, err := keyman.LoadPKFromFile(keyFile)
+	if err != nil {
+		return nil, nil, errors.New("Unable to load MITM CA key from %v: %v", keyFile, err)
+	}
+	cert, err := keyman.LoadCertificateFromFile(certFile)
+	if err != nil {
+		return nil, nil, errors.New("Unable to load MITM CA certificate from %v: %v", certFile, err)
+	}
+	if !cert.X509().IsCA {
+		return nil, nil, errors.New("MITM certificate %v is not a CA", certFile)
+	}
+	return key, cert, nil
+}
+
+func generateCA(keyFile, certFile string) (*keyman.PrivateKey, *keyman.Certificate, error) {
+	log.Debugf("Generating new MITM CA at %v and %v", keyFile, certFile)
+	key, err := keyman.GeneratePK(2048)
+	if err != nil {
+		return nil, nil, errors.New("Unable to generate MITM CA key: %v", err)
+	}
+	cert, err := key.TLSCertificateFor(time.Now().Add(caValidity), true, nil, organization, caCommonName)
+	if err != nil {
+		return nil, nil, errors.New("Unable to generate MITM CA certificate: %v", err)
+	}
+	if err := key.WriteToFile(keyFile); err != nil {
+		return nil, nil, errors.New("Unable to save MITM CA key: %v", err)
+	}
+	if err := cert.WriteToFile(certFile); err != nil {
+		return nil, nil, errors.New("Unable to save MITM CA certificate: %v", err)
+	}
+	return key, cert, nil
+}
+
+func upstreamTLSConfig(caFile string) (*tls.Config, error) {
+	pemBytes, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.New("Unable to read upstream CAs from %v: %v", caFile, err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pemBytes) {
+		return nil, errors.New("No certificates found in %v", caFile)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// CACertificate returns the CA certificate, which clients need to trust.
+func (i *Interceptor) CACertificate() *keyman.Certificate {
+	return i.caCert
+}
+
+// UpstreamTLSConfig returns the TLS configuration for connecting to origins,
+// nil meaning the defaults.
+func (i *Interceptor) UpstreamTLSConfig() *tls.Config {
+	return i.upstreamTLS
+}
+
+// Intercept implements proxy.MITMFunc, intercepting CONNECT requests to the
+// configured hosts and ports.
+func (i *Interceptor) Intercept(ctx filters.Context, req *http.Request) *tls.Config {
+	host, port, err := net.SplitHostPort(req.URL.Host)
+	if err != nil || !i.ports[port] {
+		return nil
+	}
+	if i.hosts != nil && !i.hosts.MatchesHost(host) {
+		return nil
+	}
+	tlsConfig := tlsdefaults.Server()
+	tlsConfig.NextProtos = []string{"http/1.1"}
+	tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		name := hello.ServerName
+		if name == "" {
+			// Clients don't send SNI for IP addresses
+			name = host
+		}
+		return i.certificateFor(name)
+	}
+	return tlsConfig
+}
+
+// certificateFor gets a cached leaf certificate for the given host, issuing a
+// new one if necessary.
+func (i *Interceptor) certificateFor(host string) (*tls.Certificate, error) {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	i.mx.Lock()
+	defer i.mx.Unlock()
+	if cached, found := i.certs.Get(host); found {
+		cert := cached.(*tls.Certificate)
+		if time.Now().Add(leafRenewal).Before(cert.Leaf.NotAfter) {
+			return cert, nil
+		}
+	}
+	cert, err := i.issue(host)
+	if err != nil {
+		return nil, errors.New("Unable to issue certificate for %v: %v", host, err)
+	}
+	i.certs.Add(host, cert)
+	return cert, nil
+}
+
+func (i *Interceptor) issue(host string) (*tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	notAfter := now.Add(leafValidity)
+	if caNotAfter := i.caCert.X509().NotAfter; caNotAfter.Before(notAfter) {
+		notAfter = caNotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{organization},
+			CommonName:   host,
+		},
+		// Allow for clients with clocks that are a bit behind
+		NotBefore:             now.Add(-leafRenewal),
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	leaf, err := i.caKey.CertificateForKey(template, i.caCert, &i.leafKey.RSA().PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	log.Tracef("Issued certificate for %v", host)
+	return &tls.Certificate{
+		Certificate: [][]byte{leaf.DER(), i.caCert.DER()},
+		PrivateKey:  i.leafKey.RSA(),
+		Leaf:        leaf.X509(),
+	}, nil
+}
@@ -0,0 +1,148 @@
+package mitm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/proxyfilters"
+	"github.com/getlantern/http-proxy/server"
+)
+
+func TestIntercept(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("X-Filtered", req.Header.Get("X-Filtered"))
+		resp.Write([]byte("hello from " + req.URL.Path))
+	}))
+	defer origin.Close()
+	originURL, _ := url.Parse(origin.URL)
+	_, originPort, _ := net.SplitHostPort(originURL.Host)
+	port, _ := strconv.Atoi(originPort)
+
+	dir, err := ioutil.TempDir("", "mitm")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	i, err := New(&Opts{
+		CAKeyFile:  filepath.Join(dir, "ca-key.pem"),
+		CACertFile: filepath.Join(dir, "ca-cert.pem"),
+		Hosts:      []string{"127.0.0.1"},
+		Ports:      []int{port},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	upstreamCAs := x509.NewCertPool()
+	upstreamCAs.AddCert(origin.Certificate())
+
+	var seen []string
+	var seenMx sync.Mutex
+	srv := server.New(&server.Opts{
+		IdleTimeout: 30 * time.Second,
+		Filter: filters.Join(
+			proxyfilters.ProxyAuth(&proxyfilters.AuthOpts{Tokens: proxyfilters.StaticTokens(map[string]string{"s3cr3t": "alice"})}),
+			filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+				seenMx.Lock()
+				seen = append(seen, req.Method+" "+req.URL.String()+" "+proxyfilters.AuthenticatedIdentity(ctx))
+				seenMx.Unlock()
+				req.Header.Set("X-Filtered", "true")
+				return next(ctx, req)
+			}),
+		),
+		MITM:                  i.Intercept,
+		MITMUpstreamTLSConfig: &tls.Config{RootCAs: upstreamCAs},
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	go srv.Serve(l, nil)
+	defer l.Close()
+
+	proxyURL, _ := url.Parse("http://" + l.Addr().String())
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:               http.ProxyURL(proxyURL),
+		ProxyConnectHeader:  http.Header{"Proxy-Authorization": []string{"Bearer s3cr3t"}},
+		TLSClientConfig:     &tls.Config{RootCAs: i.CACertificate().PoolContainingCert()},
+		MaxIdleConnsPerHost: 1,
+	}}
+	for _, path := range []string{"/a", "/b"} {
+		resp, err := client.Get(origin.URL + path)
+		if !assert.NoError(t, err) {
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "hello from "+path, string(body))
+		assert.Equal(t, "true", resp.Header.Get("X-Filtered"), "request should have gone through filters")
+		if assert.NotEmpty(t, resp.TLS.PeerCertificates) {
+			assert.Equal(t, "Lantern", resp.TLS.PeerCertificates[0].Issuer.Organization[0], "should have been intercepted")
+		}
+	}
+
+	seenMx.Lock()
+	assert.Equal(t, []string{
+		"CONNECT //" + originURL.Host + " alice",
+		"GET " + origin.URL + "/a alice",
+		"GET " + origin.URL + "/b alice",
+	}, seen, "decrypted requests should have gone through filters on the same connection")
+	seenMx.Unlock()
+}
+
+func TestCertificateCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mitm")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	opts := &Opts{
+		CAKeyFile:  filepath.Join(dir, "ca-key.pem"),
+		CACertFile: filepath.Join(dir, "ca-cert.pem"),
+		Hosts:      []string{".example.com"},
+	}
+	i, err := New(opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	connect := func(host string) *http.Request {
+		req, _ := http.NewRequest(http.MethodConnect, "http://"+host, nil)
+		return req
+	}
+	assert.NotNil(t, i.Intercept(filters.BackgroundContext(), connect("www.example.com:443")))
+	assert.Nil(t, i.Intercept(filters.BackgroundContext(), connect("www.example.com:8443")), "only port 443 by default")
+	assert.Nil(t, i.Intercept(filters.BackgroundContext(), connect("www.example.org:443")))
+
+	cert, err := i.certificateFor("www.Example.com")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"www.example.com"}, cert.Leaf.DNSNames)
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{
+		DNSName: "www.example.com",
+		Roots:   i.CACertificate().PoolContainingCert(),
+	})
+	assert.NoError(t, err)
+	cached, _ := i.certificateFor("www.example.com")
+	assert.True(t, cert == cached, "certificate should have been cached")
+
+	// The generated CA is reused
+	i2, err := New(opts)
+	if assert.NoError(t, err) {
+		assert.Equal(t, i.CACertificate().DER(), i2.CACertificate().DER())
+	}
+}
@@ -0,0 +1,279 @@
+// Package pac generates Proxy Auto-Config files (and serves them for WPAD)
+// that point clients at the proxy's listeners, except for destinations that
+// bypass the proxy. Files are generated per request from a text/template, so
+// that they can differ by client.
+package pac
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+)
+
+const (
+	// ContentType is the MIME type of PAC files.
+	ContentType = "application/x-ns-proxy-autoconfig"
+
+	// ProxyTypeHTTP is a plain HTTP proxy listener
+	ProxyTypeHTTP = "PROXY"
+	// ProxyTypeHTTPS is a TLS proxy listener
+	ProxyTypeHTTPS = "HTTPS"
+	// ProxyTypeSOCKS5 is a SOCKS5 proxy listener
+	ProxyTypeSOCKS5 = "SOCKS5"
+)
+
+var (
+	log = golog.LoggerFor("http-proxy.pac")
+)
+
+// Opts configures a PAC.
+type Opts struct {
+	// Host is the proxy's host name as clients know it. If empty, the host
+	// that clients requested the PAC file from is used.
+	Host string
+
+	// Proxies are the proxy's listeners in order of preference.
+	Proxies []*Proxy
+
+	// Bypass lists destinations that clients reach directly, in the syntax of
+	// host lists (see proxyfilters.ReadHostList): "example.com" for just that
+	// host, "*.example.com" for its subdomains, ".example.com" for both, and
+	// IP addresses or IPv4 CIDRs. Path patterns aren't supported.
+	Bypass []string
+
+	// BypassLocal bypasses the proxy for plain host names (without dots),
+	// localhost and loopback addresses.
+	BypassLocal bool
+
+	// FallbackDirect lets clients connect directly if none of the proxies is
+	// reachable.
+	FallbackDirect bool
+
+	// Template, if set, is a text/template for the PAC file instead of the
+	// default one. See Data for what it has to work with.
+	Template string
+}
+
+// Proxy is a listener that clients can use.
+type Proxy struct {
+	// Type is "PROXY", "HTTPS" or "SOCKS5".
+	Type string
+
+	// Port is the listener's port.
+	Port int
+}
+
+// Data is what templates are executed with.
+type Data struct {
+	// ClientIP is the IP address of the client requesting the PAC file.
+	ClientIP string
+
+	// Host is the proxy's host name.
+	Host string
+
+	// Proxies is the PAC result string for using the proxy, like
+	// "HTTPS proxy.example.com:8443; PROXY proxy.example.com:8080; DIRECT".
+	Proxies string
+
+	// Bypass is JavaScript source defining the function isBypassed(host),
+	// which tells whether a host bypasses the proxy.
+	Bypass string
+}
+
+// DefaultTemplate is the template used if Opts.Template isn't set.
+const DefaultTemplate = `// Generated by http-proxy for {{.ClientIP}}
+{{.Bypass}}
+function FindProxyForURL(url, host) {
+  if (isBypassed(host.toLowerCase())) {
+    return "DIRECT";
+  }
+  return "{{.Proxies}}";
+}
+`
+
+// PAC generates PAC files.
+type PAC struct {
+	opts     Opts
+	bypass   string
+	template *template.Template
+}
+
+// New builds a PAC.
+func New(opts *Opts) (*PAC, error) {
+	if len(opts.Proxies) == 0 {
+		return nil, errors.New("PAC needs at least one proxy")
+	}
+	for _, proxy := range opts.Proxies {
+		switch proxy.Type {
+		case ProxyTypeHTTP, ProxyTypeHTTPS, ProxyTypeSOCKS5:
+		default:
+			return nil, errors.New("Unknown PAC proxy type '%v'", proxy.Type)
+		}
+	}
+	bypass, err := bypassFunction(opts.Bypass, opts.BypassLocal)
+	if err != nil {
+		return nil, err
+	}
+	source := opts.Template
+	if source == "" {
+		source = DefaultTemplate
+	}
+	tmpl, err := template.New("pac").Parse(source)
+	if err != nil {
+		return nil, errors.New("Invalid PAC template: %v", err)
+	}
+	return &PAC{opts: *opts, bypass: bypass, template: tmpl}, nil
+}
+
+// Generate generates the PAC file for the given client.
+func (p *PAC) Generate(clientIP, host string) ([]byte, error) {
+	if p.opts.Host != "" {
+		host = p.opts.Host
+	}
+	if !validHost(host) {
+		return nil, errors.New("Invalid proxy host '%v'", host)
+	}
+	results := make([]string, 0, len(p.opts.Proxies)+1)
+	for _, proxy := range p.opts.Proxies {
+		results = append(results, proxy.Type+" "+net.JoinHostPort(host, strconv.Itoa(proxy.Port)))
+	}
+	if p.opts.FallbackDirect {
+		results = append(results, "DIRECT")
+	}
+	data := &Data{
+		ClientIP: clientIP,
+		Host:     host,
+		Proxies:  strings.Join(results, "; "),
+		Bypass:   p.bypass,
+	}
+	var buf bytes.Buffer
+	if err := p.template.Execute(&buf, data); err != nil {
+		return nil, errors.New("Unable to generate PAC file: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// ServeHTTP serves the PAC file for the requesting client, for example at
+// /proxy.pac and at /wpad.dat for WPAD.
+func (p *PAC) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		clientIP = req.RemoteAddr
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if p.opts.Host == "" && !validHost(host) {
+		http.Error(resp, "Invalid Host", http.StatusBadRequest)
+		return
+	}
+	b, err := p.Generate(clientIP, host)
+	if err != nil {
+		log.Error(err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", ContentType)
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Write(b)
+}
+
+// bypassFunction generates the JavaScript function isBypassed(host). CIDRs are
+// only matched against IP literals, so that clients don't resolve every host.
+func bypassFunction(entries []string, local bool) (string, error) {
+	hosts := map[string]bool{}
+	domains, subdomains := []string{}, []string{}
+	nets := [][2]string{}
+	if local {
+		hosts["localhost"] = true
+		nets = append(nets, [2]string{"127.0.0.0", "255.0.0.0"})
+	}
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+		case strings.Contains(entry, "/"):
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err != nil || ipNet.IP.To4() == nil {
+				return "", errors.New("Invalid PAC bypass CIDR '%v', only IPv4 is supported", entry)
+			}
+			nets = append(nets, [2]string{ipNet.IP.String(), net.IP(ipNet.Mask).String()})
+		case net.ParseIP(entry) != nil:
+			hosts[entry] = true
+		case strings.HasPrefix(entry, "*."):
+			subdomains = append(subdomains, entry[1:])
+		case strings.HasPrefix(entry, "."):
+			domains = append(domains, entry)
+		case strings.ContainsAny(entry, ":* "):
+			return "", errors.New("Invalid PAC bypass entry '%v'", entry)
+		default:
+			hosts[entry] = true
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "var bypassHosts = %v;\n", jsonString(hosts))
+	fmt.Fprintf(&buf, "var bypassDomains = %v;\n", jsonString(domains))
+	fmt.Fprintf(&buf, "var bypassSubdomains = %v;\n", jsonString(subdomains))
+	fmt.Fprintf(&buf, "var bypassNets = %v;\n", jsonString(nets))
+	buf.WriteString(`function isBypassed(host) {
+  if (bypassHosts[host]`)
+	if local {
+		buf.WriteString(` || isPlainHostName(host) || host == "::1"`)
+	}
+	buf.WriteString(`) {
+    return true;
+  }
+  var i;
+  for (i = 0; i < bypassDomains.length; i++) {
+    if (host == bypassDomains[i].substring(1) || dnsDomainIs(host, bypassDomains[i])) {
+      return true;
+    }
+  }
+  for (i = 0; i < bypassSubdomains.length; i++) {
+    if (dnsDomainIs(host, bypassSubdomains[i])) {
+      return true;
+    }
+  }
+  if (/^\d+\.\d+\.\d+\.\d+$/.test(host)) {
+    for (i = 0; i < bypassNets.length; i++) {
+      if (isInNet(host, bypassNets[i][0], bypassNets[i][1])) {
+        return true;
+      }
+    }
+  }
+  return false;
+}`)
+	return buf.String(), nil
+}
+
+// validHost checks that host is a plain host name or IP address, which keeps
+// whatever clients send as their Host out of the generated JavaScript.
+func validHost(host string) bool {
+	if host == "" {
+		return false
+	}
+	for _, r := range host {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func jsonString(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
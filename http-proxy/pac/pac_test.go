@@ -0,0 +1,78 @@
+package pac
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServe(t *testing.T) {
+	p, err := New(&Opts{
+		Proxies:        []*Proxy{{Type: ProxyTypeHTTPS, Port: 8443}, {Type: ProxyTypeHTTP, Port: 8080}},
+		Bypass:         []string{"Intranet.example.com", ".corp.example.com", "*.lab.example.com", "10.0.0.0/8", "192.0.2.1"},
+		BypassLocal:    true,
+		FallbackDirect: true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://proxy.example.com:9090/proxy.pac", nil)
+	req.RemoteAddr = "192.0.2.10:5000"
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, ContentType, rec.Header().Get("Content-Type"))
+	body, _ := ioutil.ReadAll(rec.Body)
+	pac := string(body)
+	assert.Contains(t, pac, "// Generated by http-proxy for 192.0.2.10")
+	assert.Contains(t, pac, `return "HTTPS proxy.example.com:8443; PROXY proxy.example.com:8080; DIRECT";`)
+	assert.Contains(t, pac, `var bypassHosts = {"192.0.2.1":true,"intranet.example.com":true,"localhost":true};`)
+	assert.Contains(t, pac, `var bypassDomains = [".corp.example.com"];`)
+	assert.Contains(t, pac, `var bypassSubdomains = [".lab.example.com"];`)
+	assert.Contains(t, pac, `var bypassNets = [["127.0.0.0","255.0.0.0"],["10.0.0.0","255.0.0.0"]];`)
+	assert.Contains(t, pac, `isPlainHostName(host)`)
+
+	req.Host = `evil";alert(1);"`
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "shouldn't put arbitrary Host into PAC file")
+}
+
+func TestTemplate(t *testing.T) {
+	p, err := New(&Opts{
+		Host:     "proxy.example.com",
+		Proxies:  []*Proxy{{Type: ProxyTypeHTTP, Port: 3128}},
+		Template: `{{.Bypass}}function FindProxyForURL(url, host) { {{if eq .ClientIP "192.0.2.10"}}return "DIRECT";{{else}}return "{{.Proxies}}";{{end}} }`,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	b, err := p.Generate("192.0.2.10", "ignored.example.com")
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(b), `return "DIRECT";`)
+		assert.Contains(t, string(b), "function isBypassed(host)")
+	}
+	b, err = p.Generate("192.0.2.11", "ignored.example.com")
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(b), `return "PROXY proxy.example.com:3128";`)
+		assert.NotContains(t, string(b), "isPlainHostName", "shouldn't bypass local unless asked to")
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	proxies := []*Proxy{{Type: ProxyTypeHTTP, Port: 8080}}
+	for _, opts := range []*Opts{
+		{},
+		{Proxies: []*Proxy{{Type: "QUIC", Port: 443}}},
+		{Proxies: proxies, Bypass: []string{"2001:db8::/32"}},
+		{Proxies: proxies, Bypass: []string{"path:^/ads/"}},
+		{Proxies: proxies, Template: "{{.Missing"},
+	} {
+		_, err := New(opts)
+		assert.Error(t, err, "%+v", opts)
+	}
+}
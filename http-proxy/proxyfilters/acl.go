@@ -0,0 +1,231 @@
+package proxyfilters
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/proxy/filters"
+)
+
+const (
+	defaultListReloadInterval = 1 * time.Minute
+	aclLookupTimeout          = 5 * time.Second
+)
+
+// ACLOpts configures AccessControl. See HostList for the format of entries.
+type ACLOpts struct {
+	// Deny lists destinations that are blocked.
+	Deny []string
+
+	// DenyFiles are files listing more destinations that are blocked, one per
+	// line.
+	DenyFiles []string
+
+	// Allow, if it or AllowFiles is non-empty, lists the only destinations
+	// that are allowed (unless they're also denied).
+	Allow []string
+
+	// AllowFiles are files listing more destinations that are allowed.
+	AllowFiles []string
+
+	// ReloadInterval is how often list files are checked for changes, which
+	// happens in the background as requests come in. Defaults to 1 minute.
+	// Negative values disable reloading.
+	ReloadInterval time.Duration
+
+	// LookupIP resolves hostnames for matching against CIDR entries. Defaults
+	// to net.DefaultResolver. Hostnames are only resolved if a list contains
+	// IP or CIDR entries.
+	LookupIP func(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// AccessControl blocks requests to destinations on the deny list and, if
+// there's an allow list, requests to destinations not on it, responding 403.
+func AccessControl(opts *ACLOpts) (filters.Filter, error) {
+	reloadInterval := opts.ReloadInterval
+	if reloadInterval == 0 {
+		reloadInterval = defaultListReloadInterval
+	}
+	deny, err := newReloadingList(opts.Deny, opts.DenyFiles, reloadInterval)
+	if err != nil {
+		return nil, err
+	}
+	var allow *reloadingList
+	if len(opts.Allow) > 0 || len(opts.AllowFiles) > 0 {
+		allow, err = newReloadingList(opts.Allow, opts.AllowFiles, reloadInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+	lookupIP := opts.LookupIP
+	if lookupIP == nil {
+		lookupIP = lookupIPSystem
+	}
+
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		d := &destination{req: req, lookupIP: lookupIP}
+		d.host = req.URL.Host
+		if d.host == "" {
+			d.host = req.Host
+		}
+		if host, _, err := net.SplitHostPort(d.host); err == nil {
+			d.host = host
+		}
+		d.host = normalizeHost(d.host)
+
+		if d.matches(ctx, deny.get()) {
+			return fail(ctx, req, http.StatusForbidden, "%v is denied", d.host)
+		}
+		if allow != nil && !d.matches(ctx, allow.get()) {
+			return fail(ctx, req, http.StatusForbidden, "%v is not allowed", d.host)
+		}
+		return next(ctx, req)
+	}), nil
+}
+
+// destination is the destination of a request, whose IPs are resolved at most
+// once.
+type destination struct {
+	req      *http.Request
+	host     string
+	lookupIP func(ctx context.Context, host string) ([]net.IP, error)
+	ips      []net.IP
+	resolved bool
+}
+
+func (d *destination) matches(ctx context.Context, hl *HostList) bool {
+	if hl.matchesHost(d.host) {
+		return true
+	}
+	if d.req.Method != http.MethodConnect && hl.matchesPath(d.host, d.req.URL.Path) {
+		return true
+	}
+	if !hl.hasIPs() {
+		return false
+	}
+	for _, ip := range d.resolve(ctx) {
+		if hl.matchesIP(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *destination) resolve(ctx context.Context) []net.IP {
+	if d.resolved {
+		return d.ips
+	}
+	d.resolved = true
+	if ip := net.ParseIP(d.host); ip != nil {
+		d.ips = []net.IP{ip}
+		return d.ips
+	}
+	lookupCtx, cancel := context.WithTimeout(ctx, aclLookupTimeout)
+	defer cancel()
+	ips, err := d.lookupIP(lookupCtx, d.host)
+	if err != nil {
+		log.Debugf("Unable to resolve %v for access control: %v", d.host, err)
+	}
+	d.ips = ips
+	return d.ips
+}
+
+// reloadingList is a HostList built from inline entries plus files, which is
+// rebuilt when any of the files change.
+type reloadingList struct {
+	entries        []string
+	files          []string
+	reloadInterval time.Duration
+	current        atomic.Value
+	modTimes       map[string]time.Time
+	nextCheck      int64
+	checking       int32
+}
+
+func newReloadingList(entries []string, files []string, reloadInterval time.Duration) (*reloadingList, error) {
+	l := &reloadingList{
+		entries:        entries,
+		files:          files,
+		reloadInterval: reloadInterval,
+	}
+	hl, modTimes, err := l.load()
+	if err != nil {
+		return nil, err
+	}
+	l.current.Store(hl)
+	l.modTimes = modTimes
+	l.scheduleCheck()
+	return l, nil
+}
+
+func (l *reloadingList) load() (*HostList, map[string]time.Time, error) {
+	hl := newHostList()
+	for _, entry := range l.entries {
+		if err := hl.add(entry); err != nil {
+			return nil, nil, err
+		}
+	}
+	modTimes := make(map[string]time.Time, len(l.files))
+	for _, file := range l.files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to open list %v: %v", file, err)
+		}
+		info, err := f.Stat()
+		if err == nil {
+			modTimes[file] = info.ModTime()
+			err = hl.read(f)
+		}
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to read list %v: %v", file, err)
+		}
+	}
+	hl.ips.build()
+	return hl, modTimes, nil
+}
+
+func (l *reloadingList) scheduleCheck() {
+	atomic.StoreInt64(&l.nextCheck, time.Now().Add(l.reloadInterval).UnixNano())
+}
+
+// get gets the current HostList, checking for changes in the background if
+// it's time to do so.
+func (l *reloadingList) get() *HostList {
+	if len(l.files) > 0 && l.reloadInterval > 0 && time.Now().UnixNano() > atomic.LoadInt64(&l.nextCheck) {
+		if atomic.CompareAndSwapInt32(&l.checking, 0, 1) {
+			go l.reloadIfChanged()
+		}
+	}
+	return l.current.Load().(*HostList)
+}
+
+func (l *reloadingList) reloadIfChanged() {
+	defer atomic.StoreInt32(&l.checking, 0)
+	defer l.scheduleCheck()
+
+	changed := false
+	for _, file := range l.files {
+		info, err := os.Stat(file)
+		if err != nil || !info.ModTime().Equal(l.modTimes[file]) {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return
+	}
+	hl, modTimes, err := l.load()
+	if err != nil {
+		log.Errorf("Not reloading access control list: %v", err)
+		return
+	}
+	l.current.Store(hl)
+	l.modTimes = modTimes
+	log.Debugf("Reloaded access control list with %d entries from %v", hl.Len(), l.files)
+}
@@ -0,0 +1,185 @@
+package proxyfilters
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostList(t *testing.T) {
+	hl, err := ReadHostList(strings.NewReader(`
+# Comment
+Exact.example.com
+*.wild.example.com   # trailing comment
+.domain.example.com
+192.0.2.1
+10.0.0.0/8
+2001:db8::/32
+path:^/ads/
+only.example.com path:\.exe$
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 8, hl.Len())
+
+	for host, expected := range map[string]bool{
+		"exact.example.com":     true,
+		"sub.exact.example.com": false,
+		"wild.example.com":      false,
+		"a.wild.example.com":    true,
+		"a.b.wild.example.com":  true,
+		"domain.example.com":    true,
+		"a.domain.example.com":  true,
+		"xdomain.example.com":   false,
+		"example.com":           false,
+	} {
+		assert.Equal(t, expected, hl.matchesHost(host), host)
+	}
+
+	for ip, expected := range map[string]bool{
+		"192.0.2.1":     true,
+		"192.0.2.2":     false,
+		"10.1.2.3":      true,
+		"11.0.0.0":      false,
+		"2001:db8::1":   true,
+		"2001:db9::1":   false,
+		"::ffff:a00:1":  true,
+		"9.255.255.255": false,
+	} {
+		assert.Equal(t, expected, hl.matchesIP(net.ParseIP(ip)), ip)
+	}
+
+	assert.True(t, hl.matchesPath("any.example.com", "/ads/banner.png"))
+	assert.False(t, hl.matchesPath("any.example.com", "/news/ads/"))
+	assert.True(t, hl.matchesPath("only.example.com", "/setup.exe"))
+	assert.False(t, hl.matchesPath("other.example.com", "/setup.exe"))
+
+	for _, invalid := range []string{"10.0.0.0/33", "foo.*.example.com", "path:("} {
+		_, err := NewHostList(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestIPRangesMerge(t *testing.T) {
+	hl, err := NewHostList("10.0.0.0/24", "10.0.1.0/24", "10.0.0.128/25", "10.0.3.5")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, hl.ips.ranges, 2, "adjacent and overlapping ranges should be merged")
+	assert.True(t, hl.matchesIP(net.ParseIP("10.0.1.255")))
+	assert.False(t, hl.matchesIP(net.ParseIP("10.0.2.0")))
+	assert.True(t, hl.matchesIP(net.ParseIP("10.0.3.5")))
+}
+
+func TestAccessControl(t *testing.T) {
+	lookupIP := func(ctx context.Context, host string) ([]net.IP, error) {
+		if host == "internal.example.com" {
+			return []net.IP{net.ParseIP("10.1.1.1")}, nil
+		}
+		return []net.IP{net.ParseIP("203.0.113.1")}, nil
+	}
+
+	filter, err := AccessControl(&ACLOpts{
+		Deny:     []string{".blocked.com", "10.0.0.0/8", "path:^/ads/"},
+		LookupIP: lookupIP,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusForbidden, doACL(filter, http.MethodConnect, "blocked.com:443"))
+	assert.Equal(t, http.StatusForbidden, doACL(filter, http.MethodGet, "http://www.BLOCKED.com/"))
+	assert.Equal(t, http.StatusForbidden, doACL(filter, http.MethodConnect, "internal.example.com:443"))
+	assert.Equal(t, http.StatusForbidden, doACL(filter, http.MethodConnect, "10.2.3.4:443"))
+	assert.Equal(t, http.StatusForbidden, doACL(filter, http.MethodGet, "http://example.com/ads/1.png"))
+	assert.Equal(t, http.StatusOK, doACL(filter, http.MethodGet, "http://example.com/news/"))
+	assert.Equal(t, http.StatusOK, doACL(filter, http.MethodConnect, "example.com:443"))
+
+	filter, err = AccessControl(&ACLOpts{
+		Allow:    []string{"*.example.com"},
+		Deny:     []string{"bad.example.com"},
+		LookupIP: lookupIP,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusOK, doACL(filter, http.MethodConnect, "www.example.com:443"))
+	assert.Equal(t, http.StatusForbidden, doACL(filter, http.MethodConnect, "bad.example.com:443"))
+	assert.Equal(t, http.StatusForbidden, doACL(filter, http.MethodConnect, "example.org:443"))
+}
+
+func TestAccessControlReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acl")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "deny.txt")
+	if !assert.NoError(t, ioutil.WriteFile(file, []byte("first.com\n"), 0644)) {
+		return
+	}
+
+	filter, err := AccessControl(&ACLOpts{DenyFiles: []string{file}, ReloadInterval: 10 * time.Millisecond})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusForbidden, doACL(filter, http.MethodConnect, "first.com:443"))
+	assert.Equal(t, http.StatusOK, doACL(filter, http.MethodConnect, "second.com:443"))
+
+	if !assert.NoError(t, ioutil.WriteFile(file, []byte("second.com\n"), 0644)) {
+		return
+	}
+	// Make sure modification time changes even on coarse-grained filesystems
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(file, future, future)
+
+	reloaded := false
+	for i := 0; i < 100 && !reloaded; i++ {
+		time.Sleep(10 * time.Millisecond)
+		reloaded = doACL(filter, http.MethodConnect, "second.com:443") == http.StatusForbidden
+	}
+	assert.True(t, reloaded, "list should have been reloaded")
+	assert.Equal(t, http.StatusOK, doACL(filter, http.MethodConnect, "first.com:443"))
+
+	_, err = AccessControl(&ACLOpts{DenyFiles: []string{filepath.Join(dir, "missing.txt")}})
+	assert.Error(t, err)
+}
+
+func BenchmarkHostListLarge(b *testing.B) {
+	entries := make([]string, 0, 200000)
+	for i := 0; i < 100000; i++ {
+		entries = append(entries, fmt.Sprintf("host%d.example.com", i), fmt.Sprintf(".domain%d.example.org", i))
+	}
+	hl, err := NewHostList(entries...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hl.matchesHost("a.b.c.domain99999.example.org")
+	}
+}
+
+func doACL(filter filters.Filter, method string, target string) int {
+	var req *http.Request
+	if method == http.MethodConnect {
+		req, _ = http.NewRequest(method, "http://"+target, nil)
+		req.URL.Path = ""
+	} else {
+		req, _ = http.NewRequest(method, target, nil)
+	}
+	resp, _, _ := filter.Apply(filters.BackgroundContext(), req, func(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+		return &http.Response{StatusCode: http.StatusOK}, ctx, nil
+	})
+	return resp.StatusCode
+}
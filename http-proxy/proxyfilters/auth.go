@@ -0,0 +1,215 @@
+package proxyfilters
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy"
+	"github.com/getlantern/proxy/filters"
+	"github.com/hashicorp/golang-lru"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	identityKey = ctxKey("identity")
+
+	defaultRealm = "proxy"
+
+	// bcrypt is deliberately slow, so remember recently verified credentials
+	// rather than re-hashing on every request of a persistent connection.
+	verifiedCacheSize = 1000
+)
+
+// PasswordBackend validates username/password pairs presented using the Basic
+// scheme.
+type PasswordBackend interface {
+	CheckPassword(username, password string) bool
+}
+
+// TokenBackend validates tokens presented using the Bearer scheme and returns
+// the identity associated with a valid token.
+type TokenBackend interface {
+	CheckToken(token string) (identity string, ok bool)
+}
+
+// AuthOpts configures ProxyAuth. At least one of Passwords or Tokens should be
+// set, otherwise all requests are rejected.
+type AuthOpts struct {
+	// Realm is included in the Proxy-Authenticate challenge, defaults to
+	// "proxy".
+	Realm string
+
+	// Passwords, if set, enables the Basic scheme.
+	Passwords PasswordBackend
+
+	// Tokens, if set, enables the Bearer scheme.
+	Tokens TokenBackend
+}
+
+// ProxyAuth requires every request to carry valid credentials in the
+// Proxy-Authorization header, responding with 407 Proxy Authentication
+// Required and a Proxy-Authenticate challenge otherwise. The authenticated
+// identity is available to subsequent filters via AuthenticatedIdentity.
+// Requests intercepted from an authenticated CONNECT tunnel (see
+// proxy.Opts.MITM) don't need credentials of their own.
+func ProxyAuth(opts *AuthOpts) filters.Filter {
+	realm := opts.Realm
+	if realm == "" {
+		realm = defaultRealm
+	}
+	var challenges []string
+	if opts.Passwords != nil {
+		challenges = append(challenges, fmt.Sprintf("Basic realm=%q", realm))
+	}
+	if opts.Tokens != nil {
+		challenges = append(challenges, fmt.Sprintf("Bearer realm=%q", realm))
+	}
+
+	authenticate := func(header string) (string, bool) {
+		idx := strings.IndexByte(header, ' ')
+		if idx < 0 {
+			return "", false
+		}
+		scheme, credentials := header[:idx], strings.TrimSpace(header[idx+1:])
+		switch {
+		case strings.EqualFold(scheme, "Basic") && opts.Passwords != nil:
+			decoded, err := base64.StdEncoding.DecodeString(credentials)
+			if err != nil {
+				return "", false
+			}
+			username, password, ok := splitCredentials(string(decoded))
+			if !ok || !opts.Passwords.CheckPassword(username, password) {
+				return "", false
+			}
+			return username, true
+		case strings.EqualFold(scheme, "Bearer") && opts.Tokens != nil:
+			return opts.Tokens.CheckToken(credentials)
+		default:
+			return "", false
+		}
+	}
+
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		if proxy.Intercepted(ctx) != "" && AuthenticatedIdentity(ctx) != "" {
+			// Requests intercepted from a CONNECT tunnel belong to whoever
+			// authenticated the tunnel
+			return next(ctx, req)
+		}
+		header := req.Header.Get("Proxy-Authorization")
+		if header == "" {
+			return challenge(ctx, req, challenges, "Proxy authentication required")
+		}
+		identity, ok := authenticate(header)
+		if !ok {
+			return challenge(ctx, req, challenges, "Invalid proxy credentials")
+		}
+		log.Tracef("Authenticated %v from %v", identity, req.RemoteAddr)
+		// Don't leak credentials to the origin
+		req.Header.Del("Proxy-Authorization")
+		return next(ctx.WithValue(identityKey, identity), req)
+	})
+}
+
+// AuthenticatedIdentity returns the identity established by ProxyAuth for the
+// current request, or "" if the request was not authenticated.
+func AuthenticatedIdentity(ctx filters.Context) string {
+	identity, _ := ctx.Value(identityKey).(string)
+	return identity
+}
+
+func challenge(ctx filters.Context, req *http.Request, challenges []string, description string) (*http.Response, filters.Context, error) {
+	resp, ctx, err := fail(ctx, req, http.StatusProxyAuthRequired, description)
+	for _, c := range challenges {
+		resp.Header.Add("Proxy-Authenticate", c)
+	}
+	return resp, ctx, err
+}
+
+func splitCredentials(decoded string) (string, string, bool) {
+	idx := strings.IndexByte(decoded, ':')
+	if idx < 0 {
+		return "", "", false
+	}
+	return decoded[:idx], decoded[idx+1:], true
+}
+
+type htpasswd struct {
+	hashes   map[string][]byte
+	verified *lru.Cache
+}
+
+// LoadHtpasswd loads an htpasswd-style file of "username:hash" lines for use
+// as a PasswordBackend. Only bcrypt hashes (htpasswd -B) are supported. Blank
+// lines and lines starting with # are ignored.
+func LoadHtpasswd(path string) (PasswordBackend, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.New("Unable to open htpasswd file %v: %v", path, err)
+	}
+	defer file.Close()
+
+	verified, _ := lru.New(verifiedCacheSize)
+	h := &htpasswd{hashes: make(map[string][]byte), verified: verified}
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := splitCredentials(line)
+		if !ok {
+			return nil, errors.New("Malformed line %d in htpasswd file %v", lineNumber, path)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, errors.New("Unsupported hash for %v in htpasswd file %v, only bcrypt is supported", username, path)
+		}
+		h.hashes[username] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.New("Unable to read htpasswd file %v: %v", path, err)
+	}
+	log.Debugf("Loaded %d users from %v", len(h.hashes), path)
+	return h, nil
+}
+
+func (h *htpasswd) CheckPassword(username, password string) bool {
+	hash, found := h.hashes[username]
+	if !found {
+		return false
+	}
+	key := sha256.Sum256([]byte(username + ":" + password))
+	if _, ok := h.verified.Get(key); ok {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	h.verified.Add(key, true)
+	return true
+}
+
+type staticTokens map[[sha256.Size]byte]string
+
+// StaticTokens is a TokenBackend that accepts a fixed set of tokens, mapping
+// each token to its identity.
+func StaticTokens(identitiesByToken map[string]string) TokenBackend {
+	tokens := make(staticTokens, len(identitiesByToken))
+	for token, identity := range identitiesByToken {
+		// Key by digest so that lookups don't leak the token through timing
+		tokens[sha256.Sum256([]byte(token))] = identity
+	}
+	return tokens
+}
+
+func (tokens staticTokens) CheckToken(token string) (string, bool) {
+	identity, found := tokens[sha256.Sum256([]byte(token))]
+	return identity, found
+}
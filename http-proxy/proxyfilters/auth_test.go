@@ -0,0 +1,102 @@
+package proxyfilters
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestProxyAuth(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	// htpasswd -B writes $2y$ hashes
+	htpasswdHash := strings.Replace(string(hash), "$2a$", "$2y$", 1)
+	file, err := ioutil.TempFile("", "htpasswd")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("# users\n\nalice:" + htpasswdHash + "\n")
+	file.Close()
+
+	passwords, err := LoadHtpasswd(file.Name())
+	if !assert.NoError(t, err) {
+		return
+	}
+	filter := ProxyAuth(&AuthOpts{
+		Realm:     "test",
+		Passwords: passwords,
+		Tokens:    StaticTokens(map[string]string{"tok3n": "bob"}),
+	})
+
+	var identity string
+	next := func(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+		identity = AuthenticatedIdentity(ctx)
+		assert.Empty(t, req.Header.Get("Proxy-Authorization"), "credentials should not be forwarded")
+		return &http.Response{StatusCode: http.StatusOK}, ctx, nil
+	}
+	apply := func(authorization string) *http.Response {
+		identity = ""
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+		if authorization != "" {
+			req.Header.Set("Proxy-Authorization", authorization)
+		}
+		resp, _, _ := filter.Apply(filters.BackgroundContext(), req, next)
+		return resp
+	}
+	basic := func(credentials string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	}
+
+	resp := apply("")
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	assert.Equal(t, []string{`Basic realm="test"`, `Bearer realm="test"`}, resp.Header["Proxy-Authenticate"])
+
+	for _, invalid := range []string{
+		basic("alice:wrong"),
+		basic("mallory:secret"),
+		basic("alice"),
+		"Basic !!!",
+		"Bearer wrong",
+		"Digest username=alice",
+		"garbage",
+	} {
+		resp = apply(invalid)
+		assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode, invalid)
+		assert.Empty(t, identity, invalid)
+	}
+
+	// Twice to exercise the verified credentials cache
+	for i := 0; i < 2; i++ {
+		resp = apply(basic("alice:secret"))
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "alice", identity)
+	}
+
+	resp = apply("bearer tok3n")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "bob", identity)
+}
+
+func TestLoadHtpasswdInvalid(t *testing.T) {
+	file, err := ioutil.TempFile("", "htpasswd")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove(file.Name())
+	// MD5 (apr1) hashes are not supported
+	file.WriteString("alice:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/\n")
+	file.Close()
+
+	_, err = LoadHtpasswd(file.Name())
+	assert.Error(t, err)
+
+	_, err = LoadHtpasswd(file.Name() + ".missing")
+	assert.Error(t, err)
+}
@@ -1,16 +1,27 @@
 package proxyfilters
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"strings"
 
+	"github.com/getlantern/http-proxy/resolver"
 	"github.com/getlantern/proxy/filters"
 )
 
 // BlockLocal blocks attempted accesses to localhost unless they're one of the
 // listed exceptions.
 func BlockLocal(exceptions []string) filters.Filter {
+	return BlockLocalWith(exceptions, nil)
+}
+
+// BlockLocalWith is like BlockLocal but resolves hosts with lookupIP, which
+// defaults to the system resolver. Every IP that a host resolves to is checked
+// and the checked IPs are pinned to the request with resolver.WithResolved, so
+// that a resolver.Resolver dialing the request connects to one of them rather
+// than to whatever the host resolves to by then.
+func BlockLocalWith(exceptions []string, lookupIP func(ctx context.Context, host string) ([]net.IP, error)) filters.Filter {
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
 		log.Errorf("Error enumerating local addresses: %v\n", err)
@@ -27,6 +38,10 @@ func BlockLocal(exceptions []string) filters.Filter {
 		localIPs = append(localIPs, ip)
 	}
 
+	if lookupIP == nil {
+		lookupIP = lookupIPSystem
+	}
+
 	isException := func(host string) bool {
 		for _, exception := range exceptions {
 			if strings.EqualFold(host, exception) {
@@ -48,21 +63,36 @@ func BlockLocal(exceptions []string) filters.Filter {
 			host = req.URL.Host
 		}
 
-		ipAddr, err := net.ResolveIPAddr("ip", host)
-
-		// If there was an error resolving is probably because it wasn't an address
-		// in the form host or host:port
-		if err == nil {
-			if ipAddr.IP.IsLoopback() {
-				return fail(ctx, req, http.StatusForbidden, "%v requested loopback address %v (%v)", req.RemoteAddr, req.Host, ipAddr)
+		ips, err := lookupIP(ctx, host)
+		if err != nil {
+			// Nothing to check, and nothing to dial either, so that host can't
+			// resolve to a local address in the meantime
+			log.Debugf("Unable to resolve %v: %v", host, err)
+			ips = nil
+		}
+		for _, ip := range ips {
+			if ip.IsLoopback() || ip.IsUnspecified() {
+				return fail(ctx, req, http.StatusForbidden, "%v requested loopback address %v (%v)", req.RemoteAddr, req.Host, ip)
 			}
 			for _, localIP := range localIPs {
-				if ipAddr.IP.Equal(localIP) {
-					return fail(ctx, req, http.StatusForbidden, "%v requested local address %v (%v)", req.RemoteAddr, req.Host, ipAddr)
+				if ip.Equal(localIP) {
+					return fail(ctx, req, http.StatusForbidden, "%v requested local address %v (%v)", req.RemoteAddr, req.Host, ip)
 				}
 			}
 		}
 
-		return next(ctx, req)
+		return next(resolver.WithResolved(ctx, host, ips), req)
 	})
 }
+
+func lookupIPSystem(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
@@ -1,9 +1,13 @@
 package proxyfilters
 
 import (
+	"context"
+	"fmt"
+	"net"
 	"net/http"
 	"testing"
 
+	"github.com/getlantern/http-proxy/resolver"
 	"github.com/getlantern/proxy/filters"
 	"github.com/stretchr/testify/assert"
 )
@@ -38,3 +42,46 @@ func doTestBlockLocal(t *testing.T, exceptions []string, urlStr string, expected
 	resp, _, _ := filter.Apply(ctx, req, next)
 	assert.Equal(t, expectedStatus, resp.StatusCode)
 }
+
+func TestBlockLocalChecksAllIPs(t *testing.T) {
+	lookupIP := func(ctx context.Context, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("127.0.0.1")}, nil
+	}
+	next := func(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+		return &http.Response{StatusCode: http.StatusOK}, ctx, nil
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://mixed.example.com/", nil)
+	resp, _, _ := BlockLocalWith(nil, lookupIP).Apply(filters.BackgroundContext(), req, next)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestBlockLocalPinsCheckedIPs(t *testing.T) {
+	// Resolves to a public address when checked, but would resolve to
+	// localhost when dialed (DNS rebinding)
+	lookups := 0
+	lookupIP := func(ctx context.Context, host string) ([]net.IP, error) {
+		lookups++
+		if lookups == 1 {
+			return []net.IP{net.ParseIP("192.0.2.1")}, nil
+		}
+		return []net.IP{net.ParseIP("127.0.0.1")}, nil
+	}
+	var pinned []net.IP
+	next := func(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+		pinned, _ = resolver.Resolved(ctx, req.URL.Hostname())
+		return &http.Response{StatusCode: http.StatusOK}, ctx, nil
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://rebind.example.com:8080/", nil)
+	resp, _, _ := BlockLocalWith(nil, lookupIP).Apply(filters.BackgroundContext(), req, next)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []net.IP{net.ParseIP("192.0.2.1")}, pinned, "dial should use the checked IP")
+
+	// Unresolvable hosts are pinned to nothing, so they can't be dialed
+	lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		return nil, fmt.Errorf("no such host")
+	}
+	pinned = []net.IP{}
+	resp, _, _ = BlockLocalWith(nil, lookupIP).Apply(filters.BackgroundContext(), req, next)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, pinned)
+}
@@ -0,0 +1,24 @@
+package proxyfilters
+
+import (
+	"io"
+	"sync"
+)
+
+// OnBodyClosed wraps a response body so that onClose is called once it's been
+// closed, which happens once the response has been written downstream.
+func OnBodyClosed(body io.ReadCloser, onClose func()) io.ReadCloser {
+	return &onCloseBody{ReadCloser: body, onClose: onClose}
+}
+
+type onCloseBody struct {
+	io.ReadCloser
+	onClose   func()
+	closeOnce sync.Once
+}
+
+func (b *onCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.closeOnce.Do(b.onClose)
+	return err
+}
@@ -0,0 +1,28 @@
+package proxyfilters
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/getlantern/proxy/filters"
+
+	"github.com/getlantern/http-proxy/egress"
+)
+
+// Egress binds requests to the egress rule that matches their client IP and
+// authenticated identity (see egress.Policy), so that their destinations get
+// dialed accordingly. It needs to come after ProxyAuth for rules that match
+// users.
+func Egress(policy *egress.Policy) filters.Filter {
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		var clientIP net.IP
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			clientIP = net.ParseIP(host)
+		}
+		if b := policy.Match(clientIP, AuthenticatedIdentity(ctx)); b != nil {
+			log.Tracef("Binding %v for %v to egress %v", req.URL.Host, req.RemoteAddr, b)
+			ctx = egress.WithBinding(ctx, b)
+		}
+		return next(ctx, req)
+	})
+}
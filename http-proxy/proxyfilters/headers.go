@@ -0,0 +1,370 @@
+package proxyfilters
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/netx"
+	"github.com/getlantern/proxy"
+	"github.com/getlantern/proxy/filters"
+)
+
+// Header actions, see HeaderAction.
+const (
+	HeaderAdd       = "add"
+	HeaderSet       = "set"
+	HeaderRemove    = "remove"
+	HeaderReplace   = "replace"
+	HeaderForwarded = "forwarded"
+	HeaderVia       = "via"
+	HeaderStrip     = "strip"
+
+	defaultViaPseudonym = "http-proxy"
+)
+
+// IdentifyingHeaders are the headers removed by the "strip" action, which
+// reveal clients or the proxies that requests went through.
+var IdentifyingHeaders = []string{
+	"Forwarded",
+	"Via",
+	"From",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Port",
+	"X-Real-Ip",
+	"X-Client-Ip",
+	"Client-Ip",
+	"True-Client-Ip",
+	"X-Cluster-Client-Ip",
+	"X-Proxy-Id",
+}
+
+// HeaderOpts configures RewriteHeaders.
+type HeaderOpts struct {
+	// Rules are applied in order. Every rule that matches a request applies to
+	// it, so later rules see the changes made by earlier ones.
+	Rules []*HeaderRule `json:"rules"`
+}
+
+// HeaderRule rewrites the headers of matching requests and their responses. A
+// request matches if it meets all of the rule's conditions, empty conditions
+// match any request.
+type HeaderRule struct {
+	// Hosts are the destinations that the rule applies to, in the syntax of
+	// HostList except for path entries. Host names aren't resolved to match
+	// CIDRs, only IP literals are.
+	Hosts []string `json:"hosts"`
+
+	// Paths are regular expressions, one of which must match the request's
+	// path. CONNECT requests don't have a path.
+	Paths []string `json:"paths"`
+
+	// Methods are the request methods that the rule applies to.
+	Methods []string `json:"methods"`
+
+	// Clients are the client IPs or CIDRs that the rule applies to.
+	Clients []string `json:"clients"`
+
+	// Users are the authenticated identities that the rule applies to (see
+	// ProxyAuth).
+	Users []string `json:"users"`
+
+	// Request are the changes made to the request's headers.
+	Request []*HeaderAction `json:"request"`
+
+	// Response are the changes made to the response's headers.
+	Response []*HeaderAction `json:"response"`
+}
+
+// HeaderAction changes headers. Action is one of:
+//
+//	add        adds Value to header Name
+//	set        replaces header Name with Value
+//	remove     removes header Name
+//	replace    replaces matches of the regular expression Pattern in the values
+//	           of header Name with Value, which can refer to submatches like $1
+//	forwarded  adds an RFC 7239 Forwarded element for the client (requests only)
+//	via        adds the proxy to the Via header, as Value (default "http-proxy")
+//	strip      removes IdentifyingHeaders
+type HeaderAction struct {
+	Action  string `json:"action"`
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	Pattern string `json:"pattern"`
+
+	re *regexp.Regexp
+}
+
+// Validate checks that the HeaderOpts are usable.
+func (opts *HeaderOpts) Validate() error {
+	_, err := RewriteHeaders(opts)
+	return err
+}
+
+type headerRule struct {
+	hosts    *HostList
+	paths    []*regexp.Regexp
+	methods  map[string]bool
+	clients  *HostList
+	users    map[string]bool
+	request  []*HeaderAction
+	response []*HeaderAction
+}
+
+// RewriteHeaders changes request and response headers according to rules. It
+// should come after ProxyAuth for rules that match users. Note that the
+// headers of CONNECT requests only reach upstream proxies, not destinations.
+func RewriteHeaders(opts *HeaderOpts) (filters.Filter, error) {
+	rules := make([]*headerRule, 0, len(opts.Rules))
+	for i, rc := range opts.Rules {
+		r, err := newHeaderRule(rc)
+		if err != nil {
+			return nil, errors.New("Header rule %d: %v", i, err)
+		}
+		rules = append(rules, r)
+	}
+
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		var matched []*headerRule
+		for _, r := range rules {
+			if r.matches(ctx, req) {
+				matched = append(matched, r)
+				for _, action := range r.request {
+					action.apply(req.Header, ctx, req, req.ProtoMajor, req.ProtoMinor)
+				}
+			}
+		}
+		resp, nextCtx, err := next(ctx, req)
+		if resp != nil {
+			for _, r := range matched {
+				for _, action := range r.response {
+					action.apply(resp.Header, ctx, req, resp.ProtoMajor, resp.ProtoMinor)
+				}
+			}
+		}
+		return resp, nextCtx, err
+	}), nil
+}
+
+func newHeaderRule(rc *HeaderRule) (*headerRule, error) {
+	r := &headerRule{}
+	if len(rc.Hosts) > 0 {
+		hosts, err := NewHostList(rc.Hosts...)
+		if err != nil {
+			return nil, err
+		}
+		if len(hosts.paths) > 0 {
+			return nil, errors.New("Path entries aren't supported in hosts, use paths")
+		}
+		r.hosts = hosts
+	}
+	for _, path := range rc.Paths {
+		re, err := regexp.Compile(path)
+		if err != nil {
+			return nil, errors.New("Invalid path pattern '%v': %v", path, err)
+		}
+		r.paths = append(r.paths, re)
+	}
+	if len(rc.Methods) > 0 {
+		r.methods = make(map[string]bool, len(rc.Methods))
+		for _, method := range rc.Methods {
+			r.methods[strings.ToUpper(method)] = true
+		}
+	}
+	if len(rc.Clients) > 0 {
+		clients, err := NewHostList(rc.Clients...)
+		if err != nil {
+			return nil, err
+		}
+		if len(clients.exact)+len(clients.domains)+len(clients.subdomains)+len(clients.paths) > 0 {
+			return nil, errors.New("Clients must be IPs or CIDRs")
+		}
+		r.clients = clients
+	}
+	if len(rc.Users) > 0 {
+		r.users = make(map[string]bool, len(rc.Users))
+		for _, user := range rc.Users {
+			r.users[user] = true
+		}
+	}
+	for _, action := range rc.Request {
+		a, err := action.init()
+		if err != nil {
+			return nil, err
+		}
+		r.request = append(r.request, a)
+	}
+	for _, action := range rc.Response {
+		if action.Action == HeaderForwarded {
+			return nil, errors.New("Action %v only applies to requests", action.Action)
+		}
+		a, err := action.init()
+		if err != nil {
+			return nil, err
+		}
+		r.response = append(r.response, a)
+	}
+	return r, nil
+}
+
+func (r *headerRule) matches(ctx filters.Context, req *http.Request) bool {
+	if r.methods != nil && !r.methods[req.Method] {
+		return false
+	}
+	if r.users != nil && !r.users[AuthenticatedIdentity(ctx)] {
+		return false
+	}
+	if r.clients != nil {
+		clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil || !r.clients.MatchesHost(clientIP) {
+			return false
+		}
+	}
+	if r.hosts != nil {
+		host := req.URL.Host
+		if host == "" {
+			host = req.Host
+		}
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !r.hosts.MatchesHost(strings.Trim(host, "[]")) {
+			return false
+		}
+	}
+	if len(r.paths) > 0 {
+		if req.Method == http.MethodConnect {
+			return false
+		}
+		matched := false
+		for _, re := range r.paths {
+			if re.MatchString(req.URL.Path) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// init returns a copy of the action that's ready to apply.
+func (a *HeaderAction) init() (*HeaderAction, error) {
+	c := *a
+	c.Name = http.CanonicalHeaderKey(c.Name)
+	switch c.Action {
+	case HeaderAdd, HeaderSet, HeaderRemove, HeaderReplace:
+		if c.Name == "" {
+			return nil, errors.New("Action %v requires a header name", c.Action)
+		}
+	case HeaderForwarded, HeaderStrip:
+	case HeaderVia:
+		if c.Value == "" {
+			c.Value = defaultViaPseudonym
+		}
+		if strings.ContainsAny(c.Value, " ,") {
+			return nil, errors.New("Invalid Via pseudonym '%v'", c.Value)
+		}
+	default:
+		return nil, errors.New("Unknown header action '%v'", c.Action)
+	}
+	if c.Action == HeaderReplace {
+		re, err := regexp.Compile(c.Pattern)
+		if err != nil {
+			return nil, errors.New("Invalid pattern '%v' for header %v: %v", c.Pattern, c.Name, err)
+		}
+		c.re = re
+	}
+	return &c, nil
+}
+
+// apply applies the action to header, which belongs to req or its response
+// with the given protocol version.
+func (a *HeaderAction) apply(header http.Header, ctx filters.Context, req *http.Request, protoMajor, protoMinor int) {
+	switch a.Action {
+	case HeaderAdd:
+		header.Add(a.Name, a.Value)
+	case HeaderSet:
+		header.Set(a.Name, a.Value)
+	case HeaderRemove:
+		header.Del(a.Name)
+	case HeaderReplace:
+		values := header[a.Name]
+		for i, v := range values {
+			values[i] = a.re.ReplaceAllString(v, a.Value)
+		}
+	case HeaderForwarded:
+		appendHeader(header, "Forwarded", forwardedElement(ctx, req))
+	case HeaderVia:
+		received := strconv.Itoa(protoMajor)
+		if protoMajor < 2 {
+			received += "." + strconv.Itoa(protoMinor)
+		}
+		appendHeader(header, "Via", received+" "+a.Value)
+	case HeaderStrip:
+		for _, name := range IdentifyingHeaders {
+			header.Del(name)
+		}
+	}
+}
+
+// forwardedElement describes the client's request to the proxy as a Forwarded
+// element (RFC 7239 section 4).
+func forwardedElement(ctx filters.Context, req *http.Request) string {
+	params := make([]string, 0, 3)
+	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if strings.Contains(clientIP, ":") {
+			params = append(params, fmt.Sprintf(`for="[%v]"`, clientIP))
+		} else {
+			params = append(params, "for="+clientIP)
+		}
+	} else {
+		params = append(params, "for=unknown")
+	}
+	if req.Host != "" {
+		params = append(params, "host="+forwardedValue(req.Host))
+	}
+	proto := "http"
+	if overTLS(ctx.DownstreamConn()) || proxy.Intercepted(ctx) != "" {
+		proto = "https"
+	}
+	return strings.Join(append(params, "proto="+proto), ";")
+}
+
+// overTLS checks whether the client connected to the proxy using TLS.
+func overTLS(downstream net.Conn) bool {
+	var tlsConn *tls.Conn
+	netx.WalkWrapped(downstream, func(conn net.Conn) bool {
+		tlsConn, _ = conn.(*tls.Conn)
+		return tlsConn == nil
+	})
+	return tlsConn != nil
+}
+
+// forwardedValue quotes v unless it's a token.
+func forwardedValue(v string) string {
+	for _, r := range v {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", r)) {
+			return strconv.Quote(v)
+		}
+	}
+	return v
+}
+
+// appendHeader appends value to a comma-separated header, combining any
+// existing values into one.
+func appendHeader(header http.Header, name, value string) {
+	if prior, ok := header[name]; ok && len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	header.Set(name, value)
+}
@@ -0,0 +1,125 @@
+package proxyfilters
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriteHeaders(t *testing.T) {
+	filter, err := RewriteHeaders(&HeaderOpts{Rules: []*HeaderRule{
+		{
+			Request: []*HeaderAction{
+				{Action: HeaderStrip},
+				{Action: HeaderForwarded},
+				{Action: HeaderVia, Value: "gw"},
+			},
+			Response: []*HeaderAction{
+				{Action: HeaderRemove, Name: "server"},
+				{Action: HeaderVia, Value: "gw"},
+			},
+		},
+		{
+			Hosts:   []string{".example.com"},
+			Paths:   []string{"^/api/"},
+			Methods: []string{"get"},
+			Request: []*HeaderAction{
+				{Action: HeaderSet, Name: "x-api", Value: "1"},
+				{Action: HeaderReplace, Name: "User-Agent", Pattern: `^(\w+)/[\d.]+`, Value: "$1"},
+			},
+			Response: []*HeaderAction{{Action: HeaderAdd, Name: "X-Rewritten", Value: "yes"}},
+		},
+		{
+			Clients: []string{"10.0.0.0/8"},
+			Users:   []string{"alice"},
+			Request: []*HeaderAction{{Action: HeaderAdd, Name: "X-Team", Value: "a"}},
+		},
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	client, _ := net.Pipe()
+	defer client.Close()
+	plain := filters.WrapContext(context.Background(), client)
+	var forwarded http.Header
+	next := func(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+		forwarded = req.Header.Clone()
+		resp := &http.Response{StatusCode: http.StatusOK, ProtoMajor: 1, ProtoMinor: 1, Header: make(http.Header)}
+		resp.Header.Set("Server", "origin")
+		resp.Header.Set("Via", "1.1 cdn")
+		return resp, ctx, nil
+	}
+	apply := func(ctx filters.Context, method, url, remoteAddr string) *http.Response {
+		req, _ := http.NewRequest(method, url, nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", "192.0.2.99")
+		req.Header.Set("X-Real-IP", "192.0.2.99")
+		req.Header.Set("Via", "1.0 client-side")
+		req.Header.Set("User-Agent", "Mozilla/5.0 (X11)")
+		resp, _, _ := filter.Apply(ctx, req, next)
+		return resp
+	}
+
+	resp := apply(plain, http.MethodGet, "http://www.example.com/api/v1", "192.0.2.1:5000")
+	assert.Empty(t, forwarded.Get("X-Forwarded-For"))
+	assert.Empty(t, forwarded.Get("X-Real-IP"))
+	assert.Equal(t, "for=192.0.2.1;host=www.example.com;proto=http", forwarded.Get("Forwarded"))
+	assert.Equal(t, "1.1 gw", forwarded.Get("Via"), "client's Via should have been stripped first")
+	assert.Equal(t, "1", forwarded.Get("X-Api"))
+	assert.Equal(t, "Mozilla (X11)", forwarded.Get("User-Agent"))
+	assert.Empty(t, forwarded.Get("X-Team"))
+	assert.Empty(t, resp.Header.Get("Server"))
+	assert.Equal(t, "1.1 cdn, 1.1 gw", resp.Header.Get("Via"))
+	assert.Equal(t, "yes", resp.Header.Get("X-Rewritten"))
+
+	for _, url := range []string{"http://www.example.org/api/v1", "http://www.example.com/web"} {
+		resp = apply(plain, http.MethodGet, url, "[2001:db8::1]:5000")
+		assert.Empty(t, forwarded.Get("X-Api"), url)
+		assert.Empty(t, resp.Header.Get("X-Rewritten"), url)
+		assert.Contains(t, forwarded.Get("Forwarded"), `for="[2001:db8::1]"`)
+	}
+	// Clients connected over TLS, possibly behind other wrappers
+	overTLS := filters.WrapContext(context.Background(), &wrappedConn{tls.Server(client, &tls.Config{})})
+	apply(overTLS, http.MethodGet, "http://www.example.com/api/v1", "192.0.2.1:5000")
+	assert.Equal(t, "for=192.0.2.1;host=www.example.com;proto=https", forwarded.Get("Forwarded"))
+
+	apply(plain, http.MethodPost, "http://www.example.com/api/v1", "192.0.2.1:5000")
+	assert.Empty(t, forwarded.Get("X-Api"), "method shouldn't match")
+
+	alice := plain.WithValue(identityKey, "alice")
+	apply(alice, http.MethodGet, "http://www.example.org", "10.1.2.3:5000")
+	assert.Equal(t, "a", forwarded.Get("X-Team"))
+	apply(alice, http.MethodGet, "http://www.example.org", "192.0.2.1:5000")
+	assert.Empty(t, forwarded.Get("X-Team"), "client shouldn't match")
+	apply(plain, http.MethodGet, "http://www.example.org", "10.1.2.3:5000")
+	assert.Empty(t, forwarded.Get("X-Team"), "user shouldn't match")
+}
+
+type wrappedConn struct {
+	net.Conn
+}
+
+func (c *wrappedConn) Wrapped() net.Conn {
+	return c.Conn
+}
+
+func TestRewriteHeadersInvalid(t *testing.T) {
+	for _, rule := range []*HeaderRule{
+		{Request: []*HeaderAction{{Action: "rename", Name: "X-Foo"}}},
+		{Request: []*HeaderAction{{Action: HeaderSet, Value: "foo"}}},
+		{Request: []*HeaderAction{{Action: HeaderReplace, Name: "X-Foo", Pattern: "("}}},
+		{Request: []*HeaderAction{{Action: HeaderVia, Value: "my proxy"}}},
+		{Response: []*HeaderAction{{Action: HeaderForwarded}}},
+		{Hosts: []string{"path:^/api/"}},
+		{Paths: []string{"("}},
+		{Clients: []string{"client.example.com"}},
+	} {
+		assert.Error(t, (&HeaderOpts{Rules: []*HeaderRule{rule}}).Validate(), "%+v", rule)
+	}
+}
@@ -0,0 +1,291 @@
+package proxyfilters
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	pathPrefix = "path:"
+)
+
+// HostList is a set of destinations used for access control. Each entry is
+// one of:
+//
+//	example.com        the host example.com only
+//	*.example.com      any subdomain of example.com, but not example.com itself
+//	.example.com       example.com and any of its subdomains
+//	192.0.2.1          the IP address 192.0.2.1
+//	10.0.0.0/8         any IP in 10.0.0.0/8, including IPs that hostnames resolve to
+//	path:^/ads/        any plain HTTP request whose path matches the regular expression
+//
+// A path entry may be preceded by a host pattern and a space to limit it to
+// that host, e.g. "*.example.com path:^/ads/". Hosts match case-insensitively.
+//
+// Host matching takes time proportional to the number of labels in the host,
+// regardless of the number of entries, and IP matching is a binary search, so
+// lists can be very large.
+type HostList struct {
+	exact      map[string]bool
+	subdomains map[string]bool
+	domains    map[string]bool
+	ips        *ipRanges
+	paths      []*pathPattern
+	numEntries int
+}
+
+type pathPattern struct {
+	host string // empty for any host
+	re   *regexp.Regexp
+}
+
+// NewHostList constructs a HostList from the given entries.
+func NewHostList(entries ...string) (*HostList, error) {
+	hl := newHostList()
+	for _, entry := range entries {
+		if err := hl.add(entry); err != nil {
+			return nil, err
+		}
+	}
+	hl.ips.build()
+	return hl, nil
+}
+
+// ReadHostList reads a HostList with one entry per line from r. Blank lines
+// and comments beginning with # are ignored.
+func ReadHostList(r io.Reader) (*HostList, error) {
+	hl := newHostList()
+	if err := hl.read(r); err != nil {
+		return nil, err
+	}
+	hl.ips.build()
+	return hl, nil
+}
+
+func newHostList() *HostList {
+	return &HostList{
+		exact:      make(map[string]bool),
+		subdomains: make(map[string]bool),
+		domains:    make(map[string]bool),
+		ips:        &ipRanges{},
+	}
+}
+
+func (hl *HostList) read(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line = line[:idx]
+		}
+		if err := hl.add(line); err != nil {
+			return fmt.Errorf("Line %d: %v", lineNumber, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (hl *HostList) add(entry string) error {
+	entry = strings.TrimSpace(entry)
+	if entry == "" {
+		return nil
+	}
+	hl.numEntries++
+
+	if idx := strings.Index(entry, pathPrefix); idx >= 0 {
+		host := strings.TrimSpace(entry[:idx])
+		re, err := regexp.Compile(entry[idx+len(pathPrefix):])
+		if err != nil {
+			return fmt.Errorf("Invalid path pattern in '%v': %v", entry, err)
+		}
+		hl.paths = append(hl.paths, &pathPattern{host: normalizeHost(host), re: re})
+		return nil
+	}
+
+	if strings.Contains(entry, "/") {
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("Invalid CIDR '%v': %v", entry, err)
+		}
+		hl.ips.addCIDR(ipNet)
+		return nil
+	}
+	if ip := net.ParseIP(strings.Trim(entry, "[]")); ip != nil {
+		hl.ips.addIP(ip)
+		return nil
+	}
+
+	host := normalizeHost(entry)
+	switch {
+	case strings.HasPrefix(host, "*."):
+		hl.subdomains[host[2:]] = true
+	case strings.HasPrefix(host, "."):
+		hl.domains[host[1:]] = true
+	case strings.Contains(host, "*"):
+		return fmt.Errorf("Wildcards are only supported as the first label, in '%v'", entry)
+	default:
+		hl.exact[host] = true
+	}
+	return nil
+}
+
+// Len returns the number of entries in this list.
+func (hl *HostList) Len() int {
+	return hl.numEntries
+}
+
+// MatchesHost checks whether the given host name or IP address matches any of
+// the host or IP entries. Unlike the acl filter, it doesn't resolve host names
+// to check them against IP entries.
+func (hl *HostList) MatchesHost(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return hl.matchesIP(ip)
+	}
+	return hl.matchesHost(normalizeHost(host))
+}
+
+// matchesHost checks whether the (normalized) host matches any of the host
+// entries.
+func (hl *HostList) matchesHost(host string) bool {
+	if hl.exact[host] || hl.domains[host] {
+		return true
+	}
+	for i := 0; i < len(host); i++ {
+		if host[i] == '.' {
+			parent := host[i+1:]
+			if hl.subdomains[parent] || hl.domains[parent] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesPath checks whether the given host and path match any of the path
+// entries.
+func (hl *HostList) matchesPath(host string, path string) bool {
+	for _, p := range hl.paths {
+		if p.host != "" && !hostMatchesPattern(host, p.host) {
+			continue
+		}
+		if p.re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (hl *HostList) hasIPs() bool {
+	return !hl.ips.empty()
+}
+
+func (hl *HostList) matchesIP(ip net.IP) bool {
+	return hl.ips.contains(ip)
+}
+
+func hostMatchesPattern(host string, pattern string) bool {
+	switch {
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:])
+	case strings.HasPrefix(pattern, "."):
+		return host == pattern[1:] || strings.HasSuffix(host, pattern)
+	default:
+		return host == pattern
+	}
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// ipRanges is a set of IP ranges that can be searched efficiently once built.
+// IPv4 addresses are stored in their IPv4-mapped IPv6 form.
+type ipRanges struct {
+	ranges []ipRange
+}
+
+type ipRange struct {
+	start, end net.IP
+}
+
+func (r *ipRanges) addIP(ip net.IP) {
+	ip = ip.To16()
+	r.ranges = append(r.ranges, ipRange{ip, ip})
+}
+
+func (r *ipRanges) addCIDR(ipNet *net.IPNet) {
+	start := ipNet.IP.To16()
+	mask := ipNet.Mask
+	if len(mask) == net.IPv4len {
+		ones, _ := mask.Size()
+		mask = net.CIDRMask(ones+96, 128)
+	}
+	end := make(net.IP, net.IPv6len)
+	for i := range end {
+		end[i] = start[i] | ^mask[i]
+	}
+	r.ranges = append(r.ranges, ipRange{start, end})
+}
+
+// build sorts and merges the ranges
+func (r *ipRanges) build() {
+	if len(r.ranges) == 0 {
+		return
+	}
+	sort.Slice(r.ranges, func(i, j int) bool {
+		return bytes.Compare(r.ranges[i].start, r.ranges[j].start) < 0
+	})
+	merged := r.ranges[:1]
+	for _, next := range r.ranges[1:] {
+		last := &merged[len(merged)-1]
+		if bytes.Compare(next.start, last.end) <= 0 || isNext(last.end, next.start) {
+			if bytes.Compare(next.end, last.end) > 0 {
+				last.end = next.end
+			}
+			continue
+		}
+		merged = append(merged, next)
+	}
+	r.ranges = merged
+}
+
+// isNext checks whether b immediately follows a
+func isNext(a, b net.IP) bool {
+	next := make(net.IP, len(a))
+	copy(next, a)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next.Equal(b)
+}
+
+func (r *ipRanges) empty() bool {
+	return len(r.ranges) == 0
+}
+
+func (r *ipRanges) contains(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	// Find the first range that starts after ip, the one before it is the only
+	// candidate
+	idx := sort.Search(len(r.ranges), func(i int) bool {
+		return bytes.Compare(r.ranges[i].start, ip) > 0
+	})
+	if idx == 0 {
+		return false
+	}
+	return bytes.Compare(ip, r.ranges[idx-1].end) <= 0
+}
@@ -1,9 +1,11 @@
 package proxyfilters
 
 import (
+	"net"
 	"net/http"
 
 	"github.com/getlantern/ops"
+	"github.com/getlantern/proxy"
 	"github.com/getlantern/proxy/filters"
 )
 
@@ -15,14 +17,17 @@ func getOp(ctx filters.Context) ops.Op {
 	return ctx.Value(opKey).(ops.Op)
 }
 
-// RecordOp records the proxy_http op.
+// RecordOp records the proxy_http op, including the local address of the
+// upstream connection as egress_addr.
 var RecordOp = filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
 	name := "proxy_http"
 	if req.Method == http.MethodConnect {
 		name += "s"
 	}
 	op := ops.Begin(name)
-	ctx = ctx.WithValue(opKey, op)
+	ctx = proxy.OnUpstreamConn(ctx.WithValue(opKey, op), func(conn net.Conn) {
+		op.Set("egress_addr", conn.LocalAddr().String())
+	})
 	resp, nextCtx, err := next(ctx, req)
 	if err != nil {
 		log.Error(op.FailIf(err))
@@ -0,0 +1,42 @@
+package proxyfilters
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/getlantern/proxy/filters"
+)
+
+// Swappable is a Filter whose underlying Filter can be replaced at runtime,
+// for example when configuration is reloaded. Requests that are already being
+// processed keep using the Filter that was current when they arrived.
+type Swappable struct {
+	current atomic.Value
+}
+
+// filterHolder lets us store different concrete Filter types in an
+// atomic.Value.
+type filterHolder struct {
+	filters.Filter
+}
+
+// NewSwappable constructs a Swappable that initially delegates to the given
+// Filter.
+func NewSwappable(initial filters.Filter) *Swappable {
+	s := &Swappable{}
+	s.Set(initial)
+	return s
+}
+
+// Set replaces the underlying Filter.
+func (s *Swappable) Set(filter filters.Filter) {
+	if filter == nil {
+		filter = filters.Join()
+	}
+	s.current.Store(filterHolder{filter})
+}
+
+// Apply implements the interface filters.Filter
+func (s *Swappable) Apply(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+	return s.current.Load().(filterHolder).Apply(ctx, req, next)
+}
@@ -0,0 +1,75 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/http-proxy/egress"
+	"github.com/getlantern/proxy"
+	"github.com/getlantern/proxy/filters"
+)
+
+type ctxKey string
+
+const (
+	ctxKeyResolved = ctxKey("resolved")
+)
+
+type resolved struct {
+	host string
+	ips  []net.IP
+}
+
+// WithResolved pins host to the given IPs in the request's context, so that
+// Dial connects to one of them rather than resolving host again. Filters that
+// check where requests go should pin the IPs they checked. Pinning no IPs makes
+// dials to host fail. Since the pinned IPs change how the request is dialed,
+// they're also its dial key (see proxy.WithDialKey).
+func WithResolved(ctx filters.Context, host string, ips []net.IP) filters.Context {
+	host = strings.ToLower(host)
+	key := make([]string, 0, len(ips)+1)
+	key = append(key, host)
+	for _, ip := range ips {
+		key = append(key, ip.String())
+	}
+	ctx = proxy.WithDialKey(ctx, "resolved "+strings.Join(key, " "))
+	return ctx.WithValue(ctxKeyResolved, &resolved{host, ips})
+}
+
+// Resolved returns the IPs pinned to host in ctx, if any.
+func Resolved(ctx context.Context, host string) ([]net.IP, bool) {
+	r, ok := ctx.Value(ctxKeyResolved).(*resolved)
+	if !ok || r.host != strings.ToLower(host) {
+		return nil, false
+	}
+	return r.ips, true
+}
+
+// LookupForDial returns the IPs that Dial would connect to for host: those
+// pinned to it in ctx if any, otherwise what it resolves to.
+func (r *Resolver) LookupForDial(ctx context.Context, host string) ([]net.IP, error) {
+	if ips, pinned := Resolved(ctx, host); pinned {
+		return ips, nil
+	}
+	return r.LookupIP(ctx, host)
+}
+
+// Dial connects to addr at one of the IPs its host resolves to, following the
+// egress.Binding in ctx if there is one (see egress.DialIPs). If IPs were
+// pinned to the host in ctx, only those are tried.
+func (r *Resolver) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.New("Unable to split host and port for %v: %v", addr, err)
+	}
+	ips, err := r.LookupForDial(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("No addresses to dial for %v", host)
+	}
+	return egress.DialIPs(ctx, network, ips, port)
+}
@@ -0,0 +1,287 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	maxMessageSize = 65535
+	dnsMessageType = "application/dns-message"
+)
+
+// answer is the result of a single query.
+type answer struct {
+	ips []net.IP
+	ttl time.Duration
+	err error
+}
+
+// query resolves the A and AAAA records for host on the given server, in
+// parallel.
+func (r *Resolver) query(ctx context.Context, s *server, host string) ([]net.IP, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.opts.Timeout)
+	defer cancel()
+
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, notFound(host)
+	}
+	answers := make(chan *answer, 2)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		go func(qtype dnsmessage.Type) {
+			a := &answer{}
+			a.ips, a.ttl, a.err = r.queryType(ctx, s, name, qtype)
+			answers <- a
+		}(qtype)
+	}
+
+	var ips []net.IP
+	var ttl, negativeTTL time.Duration
+	var firstErr error
+	answered := false
+	for i := 0; i < 2; i++ {
+		a := <-answers
+		switch {
+		case a.err != nil && !isNotFound(a.err):
+			if firstErr == nil {
+				firstErr = a.err
+			}
+		case len(a.ips) > 0:
+			if len(ips) == 0 || a.ttl < ttl {
+				ttl = a.ttl
+			}
+			ips = append(ips, a.ips...)
+		case !answered || a.ttl < negativeTTL:
+			answered = true
+			negativeTTL = a.ttl
+		}
+	}
+	switch {
+	case len(ips) > 0:
+		// Even if the other query failed, the addresses we have are good
+		return sortIPs(ips), ttl, nil
+	case firstErr != nil:
+		return nil, 0, firstErr
+	default:
+		// No addresses of either type, cache that like a missing name
+		return nil, negativeTTL, notFound(host)
+	}
+}
+
+// queryType queries records of a single type. A name without records of that
+// type isn't an error, its TTL comes from the SOA record if there is one.
+func (r *Resolver) queryType(ctx context.Context, s *server, name dnsmessage.Name, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	// DoH queries use ID 0 to be cache friendly (RFC 8484 section 4.1)
+	var id [2]byte
+	if s.network != "https" {
+		rand.Read(id[:])
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: binary.BigEndian.Uint16(id[:]), RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: name, Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, 0, errors.New("Unable to pack DNS query: %v", err)
+	}
+
+	var resp []byte
+	switch s.network {
+	case "https":
+		resp, err = r.exchangeHTTPS(ctx, s, query)
+	case "tcp":
+		resp, err = exchangeTCP(ctx, s.addr, query)
+	default:
+		resp, err = exchangeUDP(ctx, s.addr, query)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var p dnsmessage.Parser
+	header, err := p.Start(resp)
+	if err != nil {
+		return nil, 0, errors.New("Unable to parse DNS response from %v: %v", s, err)
+	}
+	if header.ID != msg.Header.ID {
+		return nil, 0, errors.New("Mismatched DNS response ID from %v", s)
+	}
+	if header.Truncated && s.network == "udp" {
+		return r.queryType(ctx, &server{network: "tcp", addr: s.addr}, name, qtype)
+	}
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, r.negativeTTL(&p), notFound(strings.TrimSuffix(name.String(), "."))
+	default:
+		return nil, 0, errors.New("DNS server %v responded %v", s, header.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, errors.New("Unable to parse DNS response from %v: %v", s, err)
+	}
+
+	var ips []net.IP
+	var ttl time.Duration
+	for {
+		h, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, errors.New("Unable to parse DNS answer from %v: %v", s, err)
+		}
+		var ip net.IP
+		switch {
+		case h.Type == qtype && qtype == dnsmessage.TypeA:
+			a, err := p.AResource()
+			if err != nil {
+				return nil, 0, errors.New("Unable to parse A record from %v: %v", s, err)
+			}
+			ip = net.IP(a.A[:])
+		case h.Type == qtype && qtype == dnsmessage.TypeAAAA:
+			aaaa, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, errors.New("Unable to parse AAAA record from %v: %v", s, err)
+			}
+			ip = net.IP(aaaa.AAAA[:])
+		default:
+			// CNAMEs leading up to the addresses
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, errors.New("Unable to parse DNS answer from %v: %v", s, err)
+			}
+			continue
+		}
+		ips = append(ips, ip)
+		recordTTL := time.Duration(h.TTL) * time.Second
+		if len(ips) == 1 || recordTTL < ttl {
+			ttl = recordTTL
+		}
+	}
+	if len(ips) == 0 {
+		return nil, r.negativeTTL(&p), nil
+	}
+	return ips, ttl, nil
+}
+
+// negativeTTL determines how long to cache the absence of records, which is
+// the minimum of the SOA record's TTL and MINIMUM field according to RFC 2308
+// section 5, falling back to NegativeTTL. p must be positioned before the
+// authority section.
+func (r *Resolver) negativeTTL(p *dnsmessage.Parser) time.Duration {
+	if err := p.SkipAllQuestions(); err != nil && err != dnsmessage.ErrSectionDone {
+		return r.opts.NegativeTTL
+	}
+	if err := p.SkipAllAnswers(); err != nil && err != dnsmessage.ErrSectionDone {
+		return r.opts.NegativeTTL
+	}
+	for {
+		h, err := p.AuthorityHeader()
+		if err != nil {
+			return r.opts.NegativeTTL
+		}
+		if h.Type != dnsmessage.TypeSOA {
+			if err := p.SkipAuthority(); err != nil {
+				return r.opts.NegativeTTL
+			}
+			continue
+		}
+		soa, err := p.SOAResource()
+		if err != nil {
+			return r.opts.NegativeTTL
+		}
+		ttl := h.TTL
+		if soa.MinTTL < ttl {
+			ttl = soa.MinTTL
+		}
+		return time.Duration(ttl) * time.Second
+	}
+}
+
+func exchangeUDP(ctx context.Context, addr string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, errors.New("Unable to dial DNS server %v: %v", addr, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, errors.New("Unable to send DNS query to %v: %v", addr, err)
+	}
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, errors.New("Unable to read DNS response from %v: %v", addr, err)
+		}
+		// Ignore stray responses to other queries
+		if n >= 2 && bytes.Equal(buf[:2], query[:2]) {
+			return buf[:n], nil
+		}
+	}
+}
+
+func exchangeTCP(ctx context.Context, addr string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, errors.New("Unable to dial DNS server %v: %v", addr, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	framed := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	copy(framed[2:], query)
+	if _, err := conn.Write(framed); err != nil {
+		return nil, errors.New("Unable to send DNS query to %v: %v", addr, err)
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, errors.New("Unable to read DNS response from %v: %v", addr, err)
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, errors.New("Unable to read DNS response from %v: %v", addr, err)
+	}
+	return resp, nil
+}
+
+func (r *Resolver) exchangeHTTPS(ctx context.Context, s *server, query []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, errors.New("Unable to build DoH request for %v: %v", s.url, err)
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+	resp, err := r.opts.DoHClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.New("Unable to query DoH server %v: %v", s.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("DoH server %v responded %v", s.url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+	if err != nil {
+		return nil, errors.New("Unable to read DoH response from %v: %v", s.url, err)
+	}
+	return body, nil
+}
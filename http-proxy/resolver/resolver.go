@@ -0,0 +1,342 @@
+// Package resolver resolves host names for the proxy, caching answers
+// (including negative ones) for as long as their TTL allows. Names can be
+// resolved by the system resolver or by querying DNS servers directly over
+// UDP, TCP or HTTPS (DoH, RFC 8484).
+//
+// Resolved IPs can be pinned to a request's context with WithResolved so that
+// the IPs that filters checked are exactly the ones that get dialed, which
+// keeps DNS rebinding from sneaking past checks like BlockLocal.
+package resolver
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+)
+
+const (
+	defaultTimeout     = 5 * time.Second
+	defaultMaxTTL      = time.Hour
+	defaultNegativeTTL = 30 * time.Second
+	defaultSystemTTL   = time.Minute
+	defaultCacheSize   = 10000
+)
+
+var (
+	log = golog.LoggerFor("http-proxy.resolver")
+)
+
+// Opts configures a Resolver.
+type Opts struct {
+	// Servers are the DNS servers to query, in order of preference. Entries
+	// are "udp://host:port", "tcp://host:port" or DoH URLs like
+	// "https://dns.example.com/dns-query". A plain "host:port" means UDP and
+	// the port defaults to 53. Answers over UDP that are truncated are retried
+	// over TCP. If empty, the system resolver is used.
+	Servers []string
+
+	// Timeout limits each query to a server, defaults to 5 seconds.
+	Timeout time.Duration
+
+	// MinTTL and MaxTTL bound how long answers are cached, regardless of their
+	// TTL. MaxTTL defaults to 1 hour.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+
+	// NegativeTTL is how long names that don't exist (or have no addresses)
+	// are cached if the answer doesn't say, defaults to 30 seconds.
+	NegativeTTL time.Duration
+
+	// SystemTTL is how long answers from the system resolver are cached,
+	// since it doesn't tell their TTL. Defaults to 1 minute.
+	SystemTTL time.Duration
+
+	// CacheSize limits the number of names cached, defaults to 10000.
+	CacheSize int
+
+	// DoHClient is used for DoH queries, defaults to http.DefaultClient.
+	DoHClient *http.Client
+}
+
+// Validate checks that the Opts are usable.
+func (opts *Opts) Validate() error {
+	if opts.Timeout < 0 || opts.MinTTL < 0 || opts.MaxTTL < 0 || opts.NegativeTTL < 0 || opts.SystemTTL < 0 || opts.CacheSize < 0 {
+		return errors.New("DNS timeouts, TTLs and cache size must not be negative")
+	}
+	_, err := parseServers(opts.Servers)
+	return err
+}
+
+func (opts *Opts) applyDefaults() {
+	if opts.Timeout == 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.MaxTTL == 0 {
+		opts.MaxTTL = defaultMaxTTL
+	}
+	if opts.NegativeTTL == 0 {
+		opts.NegativeTTL = defaultNegativeTTL
+	}
+	if opts.SystemTTL == 0 {
+		opts.SystemTTL = defaultSystemTTL
+	}
+	if opts.CacheSize == 0 {
+		opts.CacheSize = defaultCacheSize
+	}
+	if opts.DoHClient == nil {
+		opts.DoHClient = http.DefaultClient
+	}
+}
+
+// Resolver resolves and caches host names. It's safe for concurrent use.
+type Resolver struct {
+	opts    Opts
+	servers []*server
+	now     func() time.Time
+
+	entries  map[string]*list.Element
+	lru      *list.List
+	inflight map[string]*lookup
+	mx       sync.Mutex
+}
+
+type entry struct {
+	host    string
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+type lookup struct {
+	done chan struct{}
+	ips  []net.IP
+	err  error
+}
+
+// New creates a Resolver.
+func New(opts *Opts) (*Resolver, error) {
+	if opts == nil {
+		opts = &Opts{}
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	r := &Resolver{
+		opts:     *opts,
+		now:      time.Now,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		inflight: make(map[string]*lookup),
+	}
+	r.opts.applyDefaults()
+	r.servers, _ = parseServers(opts.Servers)
+	return r, nil
+}
+
+// LookupIP resolves host to its IPv4 and IPv6 addresses, IPv4 first. IP
+// addresses resolve to themselves. Names that don't exist return a
+// *net.DNSError whose IsNotFound is true.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return nil, notFound(host)
+	}
+
+	r.mx.Lock()
+	if e := r.cached(host); e != nil {
+		r.mx.Unlock()
+		return e.ips, e.err
+	}
+	l := r.inflight[host]
+	if l == nil {
+		l = &lookup{done: make(chan struct{})}
+		r.inflight[host] = l
+		// Whoever starts the lookup may give up on it before others do, so
+		// resolve independently of their context. Queries time out on their own.
+		go r.resolve(context.WithoutCancel(ctx), host, l)
+	}
+	r.mx.Unlock()
+	select {
+	case <-l.done:
+		return l.ips, l.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resolve looks up host for everyone waiting on l.
+func (r *Resolver) resolve(ctx context.Context, host string, l *lookup) {
+	var ttl time.Duration
+	if len(r.servers) == 0 {
+		l.ips, ttl, l.err = r.lookupSystem(ctx, host)
+	} else {
+		l.ips, ttl, l.err = r.lookupServers(ctx, host)
+	}
+
+	r.mx.Lock()
+	delete(r.inflight, host)
+	if l.err == nil || isNotFound(l.err) {
+		r.cache(host, l.ips, l.err, ttl)
+	}
+	r.mx.Unlock()
+	close(l.done)
+}
+
+func (r *Resolver) lookupSystem(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.opts.Timeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, r.opts.NegativeTTL, notFound(host)
+		}
+		return nil, 0, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return sortIPs(ips), r.opts.SystemTTL, nil
+}
+
+// lookupServers queries the configured servers in turn until one of them
+// answers.
+func (r *Resolver) lookupServers(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	var lastErr error
+	for _, s := range r.servers {
+		ips, ttl, err := r.query(ctx, s, host)
+		if err == nil || isNotFound(err) {
+			return ips, ttl, err
+		}
+		log.Debugf("Unable to resolve %v using %v: %v", host, s, err)
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, 0, errors.New("Unable to resolve %v: %v", host, lastErr)
+}
+
+// cached returns the unexpired cache entry for host, if any. Must be called
+// with mx held.
+func (r *Resolver) cached(host string) *entry {
+	el := r.entries[host]
+	if el == nil {
+		return nil
+	}
+	e := el.Value.(*entry)
+	if !r.now().Before(e.expires) {
+		r.lru.Remove(el)
+		delete(r.entries, host)
+		return nil
+	}
+	r.lru.MoveToFront(el)
+	return e
+}
+
+// cache caches an answer, evicting the least recently used names if the cache
+// is full. Must be called with mx held.
+func (r *Resolver) cache(host string, ips []net.IP, err error, ttl time.Duration) {
+	if ttl < r.opts.MinTTL {
+		ttl = r.opts.MinTTL
+	}
+	if ttl > r.opts.MaxTTL {
+		ttl = r.opts.MaxTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	e := &entry{host: host, ips: ips, err: err, expires: r.now().Add(ttl)}
+	if el := r.entries[host]; el != nil {
+		el.Value = e
+		r.lru.MoveToFront(el)
+		return
+	}
+	r.entries[host] = r.lru.PushFront(e)
+	for r.lru.Len() > r.opts.CacheSize {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.entries, oldest.Value.(*entry).host)
+	}
+}
+
+type server struct {
+	network string
+	addr    string
+	url     string
+}
+
+func (s *server) String() string {
+	if s.url != "" {
+		return s.url
+	}
+	return s.network + "://" + s.addr
+}
+
+func parseServers(specs []string) ([]*server, error) {
+	servers := make([]*server, 0, len(specs))
+	for _, spec := range specs {
+		network, addr := "udp", spec
+		if idx := strings.Index(spec, "://"); idx >= 0 {
+			network, addr = spec[:idx], spec[idx+3:]
+		}
+		switch network {
+		case "https":
+			u, err := url.Parse(spec)
+			if err != nil || u.Host == "" {
+				return nil, errors.New("Invalid DoH server URL %v", spec)
+			}
+			servers = append(servers, &server{network: network, url: spec})
+			continue
+		case "udp", "tcp":
+		default:
+			return nil, errors.New("DNS server %v has unsupported protocol %v", spec, network)
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		if net.ParseIP(host) == nil {
+			return nil, errors.New("DNS server %v must be an IP address", spec)
+		}
+		servers = append(servers, &server{network: network, addr: addr})
+	}
+	return servers, nil
+}
+
+func notFound(host string) error {
+	return &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+// sortIPs puts IPv4 addresses before IPv6 ones, keeping their order
+// otherwise.
+func sortIPs(ips []net.IP) []net.IP {
+	sorted := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			sorted = append(sorted, ip)
+		}
+	}
+	for _, ip := range ips {
+		if ip.To4() == nil {
+			sorted = append(sorted, ip)
+		}
+	}
+	return sorted
+}
@@ -0,0 +1,398 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNS is a stand-in DNS server answering from a fixed set of records over
+// UDP, TCP and DoH.
+type fakeDNS struct {
+	records     map[string][]net.IP
+	ttl         uint32
+	truncateUDP bool
+	delay       time.Duration
+
+	queries   int64
+	udpConn   net.PacketConn
+	tcpLn     net.Listener
+	dohServer *httptest.Server
+	mx        sync.Mutex
+}
+
+func newFakeDNS(t *testing.T, records map[string][]net.IP) *fakeDNS {
+	f := &fakeDNS{records: records, ttl: 60}
+	var err error
+	f.udpConn, err = net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// Use the same port for TCP, like real DNS servers
+	f.tcpLn, err = net.Listen("tcp", f.udpConn.LocalAddr().String())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	f.dohServer = httptest.NewTLSServer(http.HandlerFunc(f.serveDoH))
+	go f.serveUDP()
+	go f.serveTCP()
+	t.Cleanup(func() {
+		f.udpConn.Close()
+		f.tcpLn.Close()
+		f.dohServer.Close()
+	})
+	return f
+}
+
+func (f *fakeDNS) addr() string {
+	return f.udpConn.LocalAddr().String()
+}
+
+func (f *fakeDNS) setRecords(records map[string][]net.IP) {
+	f.mx.Lock()
+	f.records = records
+	f.mx.Unlock()
+}
+
+func (f *fakeDNS) setTTL(ttl uint32) {
+	f.mx.Lock()
+	f.ttl = ttl
+	f.mx.Unlock()
+}
+
+// setTruncateUDP makes UDP responses truncated, forcing TCP.
+func (f *fakeDNS) setTruncateUDP(truncate bool) {
+	f.mx.Lock()
+	f.truncateUDP = truncate
+	f.mx.Unlock()
+}
+
+// setDelay delays every answer.
+func (f *fakeDNS) setDelay(delay time.Duration) {
+	f.mx.Lock()
+	f.delay = delay
+	f.mx.Unlock()
+}
+
+func (f *fakeDNS) shouldTruncateUDP() bool {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	return f.truncateUDP
+}
+
+func (f *fakeDNS) numQueries() int {
+	return int(atomic.LoadInt64(&f.queries))
+}
+
+func (f *fakeDNS) serveUDP() {
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := f.udpConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		resp := f.answer(buf[:n], f.shouldTruncateUDP())
+		if resp != nil {
+			f.udpConn.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (f *fakeDNS) serveTCP() {
+	for {
+		conn, err := f.tcpLn.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var length [2]byte
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+			resp := f.answer(query, false)
+			framed := make([]byte, 2+len(resp))
+			binary.BigEndian.PutUint16(framed, uint16(len(resp)))
+			copy(framed[2:], resp)
+			conn.Write(framed)
+		}()
+	}
+}
+
+func (f *fakeDNS) serveDoH(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost || req.Header.Get("Content-Type") != dnsMessageType {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	query, _ := ioutil.ReadAll(req.Body)
+	answer := f.answer(query, false)
+	if answer == nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	resp.Header().Set("Content-Type", dnsMessageType)
+	resp.Write(answer)
+}
+
+func (f *fakeDNS) answer(query []byte, truncate bool) []byte {
+	atomic.AddInt64(&f.queries, 1)
+	f.mx.Lock()
+	delay := f.delay
+	f.mx.Unlock()
+	time.Sleep(delay)
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+	q := msg.Questions[0]
+	msg.Header.Response = true
+	msg.Header.Truncated = truncate
+	if truncate {
+		b, _ := msg.Pack()
+		return b
+	}
+
+	f.mx.Lock()
+	ips, found := f.records[q.Name.String()]
+	ttl := f.ttl
+	f.mx.Unlock()
+	if !found {
+		msg.Header.RCode = dnsmessage.RCodeNameError
+		soaName := dnsmessage.MustNewName("example.")
+		msg.Authorities = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: soaName, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 300},
+			Body:   &dnsmessage.SOAResource{NS: soaName, MBox: soaName, MinTTL: 5},
+		}}
+		b, _ := msg.Pack()
+		return b
+	}
+	for _, ip := range ips {
+		h := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: ttl}
+		if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+			var a [4]byte
+			copy(a[:], ip4)
+			h.Type = dnsmessage.TypeA
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: h, Body: &dnsmessage.AResource{A: a}})
+		} else if ip.To4() == nil && q.Type == dnsmessage.TypeAAAA {
+			var aaaa [16]byte
+			copy(aaaa[:], ip)
+			h.Type = dnsmessage.TypeAAAA
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: h, Body: &dnsmessage.AAAAResource{AAAA: aaaa}})
+		}
+	}
+	b, _ := msg.Pack()
+	return b
+}
+
+func newTestResolver(t *testing.T, opts *Opts) (*Resolver, *time.Time) {
+	r, err := New(opts)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	return r, &now
+}
+
+func TestCacheRespectsTTL(t *testing.T) {
+	dns := newFakeDNS(t, map[string][]net.IP{
+		"a.example.": {net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")},
+	})
+	r, now := newTestResolver(t, &Opts{Servers: []string{dns.addr()}})
+
+	ips, err := r.LookupIP(context.Background(), "A.example")
+	if assert.NoError(t, err) {
+		// IPv4 first
+		assert.Equal(t, []net.IP{net.ParseIP("192.0.2.1").To4(), net.ParseIP("2001:db8::1")}, ips)
+	}
+	assert.Equal(t, 2, dns.numQueries(), "should have queried A and AAAA")
+
+	dns.setRecords(map[string][]net.IP{"a.example.": {net.ParseIP("192.0.2.2")}})
+	*now = now.Add(59 * time.Second)
+	ips, err = r.LookupIP(context.Background(), "a.example.")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "192.0.2.1", ips[0].String(), "should have used cached answer")
+	}
+	assert.Equal(t, 2, dns.numQueries())
+
+	*now = now.Add(time.Second)
+	ips, err = r.LookupIP(context.Background(), "a.example")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []net.IP{net.ParseIP("192.0.2.2").To4()}, ips, "should have resolved again once TTL expired")
+	}
+	assert.Equal(t, 4, dns.numQueries())
+}
+
+func TestConcurrentLookupsOutliveFirst(t *testing.T) {
+	dns := newFakeDNS(t, map[string][]net.IP{"a.example.": {net.ParseIP("192.0.2.1")}})
+	dns.setDelay(100 * time.Millisecond)
+	r, _ := newTestResolver(t, &Opts{Servers: []string{dns.addr()}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := r.LookupIP(ctx, "a.example")
+		firstErr <- err
+	}()
+	for dns.numQueries() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	second := make(chan []net.IP, 1)
+	go func() {
+		ips, err := r.LookupIP(context.Background(), "a.example")
+		assert.NoError(t, err)
+		second <- ips
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	assert.Equal(t, context.Canceled, <-firstErr)
+	ips := <-second
+	if assert.Len(t, ips, 1, "second lookup shouldn't fail because the first one gave up") {
+		assert.Equal(t, "192.0.2.1", ips[0].String())
+	}
+	assert.Equal(t, 2, dns.numQueries(), "should have resolved only once")
+}
+
+func TestCacheTTLBounds(t *testing.T) {
+	dns := newFakeDNS(t, map[string][]net.IP{"a.example.": {net.ParseIP("192.0.2.1")}})
+	dns.setTTL(0)
+	r, now := newTestResolver(t, &Opts{Servers: []string{dns.addr()}, MinTTL: 10 * time.Second, MaxTTL: 20 * time.Second})
+	r.LookupIP(context.Background(), "a.example")
+	*now = now.Add(9 * time.Second)
+	r.LookupIP(context.Background(), "a.example")
+	assert.Equal(t, 2, dns.numQueries(), "TTL of 0 should have been raised to MinTTL")
+
+	dns.setTTL(3600)
+	*now = now.Add(time.Second)
+	r.LookupIP(context.Background(), "a.example")
+	assert.Equal(t, 4, dns.numQueries())
+	*now = now.Add(20 * time.Second)
+	r.LookupIP(context.Background(), "a.example")
+	assert.Equal(t, 6, dns.numQueries(), "TTL should have been capped at MaxTTL")
+}
+
+func TestNegativeCaching(t *testing.T) {
+	dns := newFakeDNS(t, map[string][]net.IP{})
+	r, now := newTestResolver(t, &Opts{Servers: []string{dns.addr()}})
+
+	_, err := r.LookupIP(context.Background(), "missing.example")
+	assert.True(t, isNotFound(err), "%v", err)
+	_, err = r.LookupIP(context.Background(), "missing.example")
+	assert.True(t, isNotFound(err), "%v", err)
+	assert.Equal(t, 2, dns.numQueries(), "missing name should have been cached")
+
+	// The SOA's MINIMUM of 5 seconds applies
+	*now = now.Add(5 * time.Second)
+	dns.setRecords(map[string][]net.IP{"missing.example.": {net.ParseIP("192.0.2.1")}})
+	ips, err := r.LookupIP(context.Background(), "missing.example")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "192.0.2.1", ips[0].String())
+	}
+}
+
+func TestDoH(t *testing.T) {
+	dns := newFakeDNS(t, map[string][]net.IP{"a.example.": {net.ParseIP("192.0.2.1")}})
+	r, _ := newTestResolver(t, &Opts{
+		Servers:   []string{dns.dohServer.URL + "/dns-query"},
+		DoHClient: dns.dohServer.Client(),
+	})
+	ips, err := r.LookupIP(context.Background(), "a.example")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "192.0.2.1", ips[0].String())
+	}
+	_, err = r.LookupIP(context.Background(), "missing.example")
+	assert.True(t, isNotFound(err), "%v", err)
+}
+
+func TestTruncatedFallsBackToTCP(t *testing.T) {
+	dns := newFakeDNS(t, map[string][]net.IP{"a.example.": {net.ParseIP("192.0.2.1")}})
+	dns.setTruncateUDP(true)
+	r, _ := newTestResolver(t, &Opts{Servers: []string{"udp://" + dns.addr()}})
+	ips, err := r.LookupIP(context.Background(), "a.example")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "192.0.2.1", ips[0].String())
+	}
+	assert.Equal(t, 4, dns.numQueries(), "should have queried over UDP and then TCP")
+}
+
+func TestFailover(t *testing.T) {
+	dns := newFakeDNS(t, map[string][]net.IP{"a.example.": {net.ParseIP("192.0.2.1")}})
+	// Nothing listens here, so the query fails quickly
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	deadAddr := l.Addr().String()
+	l.Close()
+
+	r, _ := newTestResolver(t, &Opts{Servers: []string{"tcp://" + deadAddr, "tcp://" + dns.addr()}, Timeout: time.Second})
+	ips, err := r.LookupIP(context.Background(), "a.example")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "192.0.2.1", ips[0].String())
+	}
+
+	r, _ = newTestResolver(t, &Opts{Servers: []string{"tcp://" + deadAddr}, Timeout: time.Second})
+	_, err = r.LookupIP(context.Background(), "a.example")
+	assert.Error(t, err)
+	assert.False(t, isNotFound(err), "failure to resolve shouldn't look like a missing name")
+}
+
+func TestInvalidServers(t *testing.T) {
+	for _, server := range []string{"dns.example.com", "quic://192.0.2.1", "https://"} {
+		_, err := New(&Opts{Servers: []string{server}})
+		assert.Error(t, err, server)
+	}
+}
+
+func TestDialHonorsPinnedIPs(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	// The name resolves to an address where nothing listens, but the pinned
+	// IP is used instead
+	dns := newFakeDNS(t, map[string][]net.IP{"a.example.": {net.ParseIP("192.0.2.1")}})
+	r, _ := newTestResolver(t, &Opts{Servers: []string{dns.addr()}})
+	ctx := WithResolved(filters.BackgroundContext(), "A.example", []net.IP{net.ParseIP("127.0.0.1")})
+	conn, err := r.Dial(ctx, "tcp", net.JoinHostPort("a.example", port))
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	assert.Equal(t, 0, dns.numQueries(), "shouldn't have resolved pinned host")
+
+	ctx = WithResolved(filters.BackgroundContext(), "a.example", nil)
+	_, err = r.Dial(ctx, "tcp", net.JoinHostPort("a.example", port))
+	assert.Error(t, err, "pinning no IPs should fail dial")
+
+	dns.setRecords(map[string][]net.IP{"b.example.": {net.ParseIP("127.0.0.1")}})
+	conn, err = r.Dial(ctx, "tcp", net.JoinHostPort("b.example", port))
+	if assert.NoError(t, err, "IPs pinned to other hosts shouldn't apply") {
+		conn.Close()
+	}
+}
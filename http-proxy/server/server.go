@@ -1,27 +1,50 @@
 package server
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/getlantern/errors"
 	"github.com/getlantern/golog"
+	"github.com/getlantern/keyman"
+	"github.com/getlantern/lampshade"
+	"github.com/getlantern/netx"
 	"github.com/getlantern/proxy"
 	"github.com/getlantern/proxy/filters"
 	"github.com/getlantern/tlsdefaults"
 
 	"github.com/getlantern/http-proxy/buffers"
 	"github.com/getlantern/http-proxy/listeners"
+	"github.com/getlantern/http-proxy/proxyfilters"
+	"github.com/getlantern/http-proxy/resolver"
+)
+
+const (
+	// shutdownPollInterval is how often Shutdown checks for connections that
+	// have become idle.
+	shutdownPollInterval = 100 * time.Millisecond
+
+	// newConnGracePeriod is how long Shutdown waits for a new connection to
+	// send its first request before considering it idle.
+	newConnGracePeriod = 5 * time.Second
 )
 
 var (
 	testingLocal = false
 	log          = golog.LoggerFor("server")
+
+	// ErrServerClosed is returned by the Serve and ListenAndServe methods after
+	// a call to Shutdown.
+	ErrServerClosed = errors.New("Server closed")
 )
 
 type listenerGenerator func(net.Listener) net.Listener
@@ -31,6 +54,47 @@ type Opts struct {
 	IdleTimeout time.Duration
 	Filter      filters.Filter
 	Dial        proxy.DialFunc
+
+	// SOCKS5 enables serving SOCKS5 clients on the same listeners as HTTP
+	// clients. SOCKS5 requests go through the same Filter as HTTP CONNECT
+	// requests.
+	SOCKS5 bool
+
+	// SOCKS5Passwords, if set, requires SOCKS5 clients to authenticate with a
+	// username and password. Credentials are also passed to the Filter as
+	// Proxy-Authorization, whether or not they were checked here.
+	SOCKS5Passwords proxyfilters.PasswordBackend
+
+	// DisableSOCKS5UDP refuses SOCKS5 UDP ASSOCIATE requests. UDP datagrams
+	// are always relayed directly from this host, so disable it if
+	// destinations should only be reached through Dial.
+	DisableSOCKS5UDP bool
+
+	// MITM, if set, selects CONNECT tunnels to intercept, see proxy.Opts.
+	MITM proxy.MITMFunc
+
+	// MITMUpstreamTLSConfig configures TLS to the origins of intercepted
+	// requests, see proxy.Opts.
+	MITMUpstreamTLSConfig *tls.Config
+
+	// Pool configures the pool of upstream connections shared by all clients,
+	// see proxy.Opts.
+	Pool *proxy.PoolOpts
+
+	// ProxyProtocol, if set, reads PROXY protocol headers from trusted load
+	// balancers on all listeners, so that connections report the real client
+	// address (see listeners.NewProxyProtocolListener). This happens before
+	// Allow checks the address.
+	ProxyProtocol *listeners.ProxyProtocolOpts
+
+	// Resolver, if set, resolves the destinations of SOCKS5 UDP datagrams that
+	// the Filter didn't already resolve. It defaults to the system resolver.
+	Resolver *resolver.Resolver
+
+	// OnLampshadeListener, if set, is called with every lampshade listener
+	// that the Server starts, for example to export the stats of its sessions
+	// (see metrics.Proxy.LampshadeListener).
+	OnLampshadeListener func(lampshade.Listener)
 }
 
 // Server is an HTTP proxy server.
@@ -39,31 +103,69 @@ type Server struct {
 	// from the given IP address. If unspecified, all connections are allowed.
 	Allow              func(string) bool
 	proxy              proxy.Proxy
+	filter             filters.Filter
 	listenerGenerators []listenerGenerator
+	socks5             bool
+	socks5Passwords    proxyfilters.PasswordBackend
+	socks5UDP          bool
+	proxyProtocol      *listeners.ProxyProtocolOpts
+	resolver           *resolver.Resolver
+	onLampshade        func(lampshade.Listener)
+
+	listeners    map[net.Listener]bool
+	conns        map[net.Conn]*connState
+	shuttingDown bool
+	mx           sync.Mutex
+}
+
+// connState tracks how many requests (or tunnels) a connection is in the middle
+// of processing so that Shutdown knows which connections it can close right
+// away. HTTP/2 connections can process many at once.
+type connState struct {
+	active  int
+	handled bool
+	since   time.Time
 }
 
 // New constructs a new HTTP proxy server using the given options
 func New(opts *Opts) *Server {
-	return &Server{
-		proxy: proxy.New(&proxy.Opts{
-			IdleTimeout:        opts.IdleTimeout,
-			Dial:               opts.Dial,
-			Filter:             opts.Filter,
-			BufferSource:       buffers.Pool(),
-			OKWaitsForUpstream: true,
-			OnError: func(ctx filters.Context, req *http.Request, read bool, err error) *http.Response {
-				status := http.StatusBadGateway
-				if read {
-					status = http.StatusBadRequest
-				}
-				return &http.Response{
-					Request:    req,
-					StatusCode: status,
-					Body:       ioutil.NopCloser(strings.NewReader(err.Error())),
-				}
-			},
-		}),
+	s := &Server{
+		filter:          opts.Filter,
+		socks5:          opts.SOCKS5,
+		socks5Passwords: opts.SOCKS5Passwords,
+		socks5UDP:       !opts.DisableSOCKS5UDP,
+		proxyProtocol:   opts.ProxyProtocol,
+		resolver:        opts.Resolver,
+		onLampshade:     opts.OnLampshadeListener,
+		listeners:       make(map[net.Listener]bool),
+		conns:           make(map[net.Conn]*connState),
 	}
+	if s.filter == nil {
+		s.filter = filters.Join()
+	}
+	filter := filters.Join(filters.FilterFunc(s.trackRequest), s.filter)
+	s.proxy = proxy.New(&proxy.Opts{
+		IdleTimeout:           opts.IdleTimeout,
+		Dial:                  opts.Dial,
+		Filter:                filter,
+		BufferSource:          buffers.Pool(),
+		OKWaitsForUpstream:    true,
+		MITM:                  opts.MITM,
+		MITMUpstreamTLSConfig: opts.MITMUpstreamTLSConfig,
+		Pool:                  opts.Pool,
+		OnError: func(ctx filters.Context, req *http.Request, read bool, err error) *http.Response {
+			status := http.StatusBadGateway
+			if read {
+				status = http.StatusBadRequest
+			}
+			return &http.Response{
+				Request:    req,
+				StatusCode: status,
+				Body:       ioutil.NopCloser(strings.NewReader(err.Error())),
+			}
+		},
+	})
+	return s
 }
 
 func (s *Server) AddListenerWrappers(listenerGens ...listenerGenerator) {
@@ -87,14 +189,59 @@ func (s *Server) ListenAndServeHTTPS(addr, keyfile, certfile string, readyCb fun
 		return err
 	}
 
-	listener, err := tlsdefaults.NewListener(s.wrapListenerIfNecessary(l), keyfile, certfile)
+	tlsConfig, err := tlsdefaults.BuildListenerConfig(l.Addr().String(), keyfile, certfile)
 	if err != nil {
 		return err
 	}
+	// Clients that support it get to multiplex their requests and tunnels over
+	// a single HTTP/2 connection
+	tlsConfig.NextProtos = []string{proxy.ALPNProtoH2, "http/1.1"}
+	listener := tls.NewListener(s.wrapListenerIfNecessary(l), tlsConfig)
 	log.Debugf("Listen https on %s", addr)
 	return s.serve(listener, readyCb)
 }
 
+// ListenAndServeLampshade serves lampshade-multiplexed connections on the
+// given address, using the RSA private key in keyfile to decrypt session
+// initialization. Every lampshade stream is handled just like a regular
+// connection, using the same filters and listener wrappers as the other
+// listeners on this Server.
+func (s *Server) ListenAndServeLampshade(addr, keyfile string, readyCb func(addr string)) error {
+	return s.ListenAndServeLampshadeWithFallback(addr, keyfile, nil, readyCb)
+}
+
+// ListenAndServeLampshadeWithFallback is like ListenAndServeLampshade, except
+// that connections which don't start a valid lampshade session, like those
+// from active probes, are handed to fallback (see lampshade.Fallback). If
+// fallback is nil, they're ignored until they give up.
+func (s *Server) ListenAndServeLampshadeWithFallback(addr, keyfile string, fallback lampshade.Fallback, readyCb func(addr string)) error {
+	return s.ListenAndServeLampshadeWithOpts(addr, keyfile, &lampshade.ListenerOpts{Fallback: fallback}, readyCb)
+}
+
+// ListenAndServeLampshadeWithOpts is like ListenAndServeLampshade, but with
+// more options. The Server supplies the pool and the private key from keyfile.
+func (s *Server) ListenAndServeLampshadeWithOpts(addr, keyfile string, opts *lampshade.ListenerOpts, readyCb func(addr string)) error {
+	pk, err := keyman.LoadPKFromFile(keyfile)
+	if err != nil {
+		return errors.New("Unable to load lampshade private key from %v: %v", keyfile, err)
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	lopts := *opts
+	lopts.Pool = buffers.Pool()
+	lopts.ServerPrivateKey = pk.RSA()
+	listener := lampshade.WrapListenerWithOpts(s.wrapListenerIfNecessary(l), &lopts)
+	if s.onLampshade != nil {
+		s.onLampshade(listener)
+	}
+	log.Debugf("Listen lampshade on %s", addr)
+	return s.serve(listener, readyCb)
+}
+
 func (s *Server) Serve(listener net.Listener, readyCb func(addr string)) error {
 	return s.serve(s.wrapListenerIfNecessary(listener), readyCb)
 }
@@ -106,6 +253,12 @@ func (s *Server) serve(listener net.Listener, readyCb func(addr string)) error {
 		l = wrap(l)
 	}
 
+	if !s.trackListener(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.untrackListener(l)
+
 	if readyCb != nil {
 		readyCb(l.Addr().String())
 	}
@@ -114,6 +267,9 @@ func (s *Server) serve(listener net.Listener, readyCb func(addr string)) error {
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if s.isShuttingDown() {
+				return ErrServerClosed
+			}
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				// delay code based on net/http.Server
 				if tempDelay == 0 {
@@ -140,11 +296,13 @@ func (s *Server) handle(conn net.Conn) {
 	if isWrapConn {
 		wrapConn.OnState(http.StateNew)
 	}
+	s.trackConn(conn)
 	go func() {
-		err := s.proxy.Handle(context.Background(), conn, conn)
+		err := s.serveConn(conn)
 		if err != nil {
 			log.Errorf("Error handling connection: %v", err)
 		}
+		s.untrackConn(conn)
 		if isWrapConn {
 			wrapConn.OnState(http.StateClosed)
 		}
@@ -152,7 +310,200 @@ func (s *Server) handle(conn net.Conn) {
 	}()
 }
 
+// serveConn serves a single connection, sniffing whether it speaks SOCKS5 or
+// HTTP if SOCKS5 is enabled.
+func (s *Server) serveConn(conn net.Conn) error {
+	if !s.socks5 {
+		return s.proxy.Handle(context.Background(), conn, conn)
+	}
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		conn.Close()
+		return nil
+	}
+	if isSOCKS5(first[0]) {
+		return s.handleSOCKS5(conn, br)
+	}
+	return s.proxy.Handle(context.Background(), br, conn)
+}
+
+// PoolStats returns a snapshot of the pool of upstream connections.
+func (s *Server) PoolStats() *proxy.PoolStats {
+	return s.proxy.PoolStats()
+}
+
+// ServePoolStats serves the stats of the pool of upstream connections as JSON,
+// for debugging.
+func (s *Server) ServePoolStats(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(resp).Encode(s.PoolStats()); err != nil {
+		log.Errorf("Unable to encode pool stats: %v", err)
+	}
+}
+
+// Shutdown gracefully shuts down the server. It stops accepting new
+// connections, closes connections that are idle and waits for in-flight
+// requests and CONNECT tunnels to finish. Responses sent during shutdown
+// include Connection: close so that clients don't reuse their connections.
+//
+// If ctx expires before all connections have finished, Shutdown forcibly
+// closes the remaining connections and returns the context's error.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mx.Lock()
+	s.shuttingDown = true
+	for l := range s.listeners {
+		if err := l.Close(); err != nil {
+			log.Debugf("Error closing listener %v: %v", l.Addr(), err)
+		}
+	}
+	s.mx.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		remaining := s.closeIdleConns()
+		if remaining == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			log.Debugf("Forcibly closing %d remaining connections", s.closeAllConns())
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) isShuttingDown() bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.shuttingDown
+}
+
+func (s *Server) trackListener(l net.Listener) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.listeners[l] = true
+	return true
+}
+
+func (s *Server) untrackListener(l net.Listener) {
+	s.mx.Lock()
+	delete(s.listeners, l)
+	s.mx.Unlock()
+}
+
+func (s *Server) trackConn(conn net.Conn) {
+	s.mx.Lock()
+	s.conns[conn] = &connState{since: time.Now()}
+	s.mx.Unlock()
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mx.Lock()
+	delete(s.conns, conn)
+	s.mx.Unlock()
+}
+
+func (s *Server) setActive(conn net.Conn, active bool) {
+	s.mx.Lock()
+	// Connections may be wrapped after being tracked (e.g. for SOCKS5)
+	var state *connState
+	netx.WalkWrapped(conn, func(wrapped net.Conn) bool {
+		state = s.conns[wrapped]
+		return state == nil
+	})
+	if state != nil {
+		if active {
+			state.active++
+		} else if state.active > 0 {
+			state.active--
+		}
+		state.handled = true
+	}
+	s.mx.Unlock()
+}
+
+// closeIdleConns closes all idle connections and returns the number of
+// connections that remain open.
+func (s *Server) closeIdleConns() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	remaining := 0
+	now := time.Now()
+	for conn, state := range s.conns {
+		// Brand new connections get a grace period to send their first request
+		if state.active > 0 || !state.handled && now.Sub(state.since) < newConnGracePeriod {
+			remaining++
+			continue
+		}
+		forceClose(conn)
+		delete(s.conns, conn)
+	}
+	return remaining
+}
+
+func (s *Server) closeAllConns() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	n := len(s.conns)
+	for conn := range s.conns {
+		forceClose(conn)
+		delete(s.conns, conn)
+	}
+	return n
+}
+
+// forceClose closes the given connection without waiting on pending i/o.
+// Wrappers like idletiming hold locks while reading, so we first close the
+// innermost connection to interrupt any pending reads and writes.
+func forceClose(conn net.Conn) {
+	var innermost net.Conn
+	netx.WalkWrapped(conn, func(wrapped net.Conn) bool {
+		innermost = wrapped
+		return true
+	})
+	if err := innermost.Close(); err != nil {
+		log.Tracef("Error closing connection: %v", err)
+	}
+	go conn.Close()
+}
+
+// trackRequest is a filter that marks connections as active while they're
+// processing a request, and asks clients to close their connections once the
+// server is shutting down.
+func (s *Server) trackRequest(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+	downstream := ctx.DownstreamConn()
+	s.setActive(downstream, true)
+	resp, nextCtx, err := next(ctx, req)
+	if resp != nil && resp.Body == nil && (req.Method == http.MethodConnect && resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusSwitchingProtocols) {
+		// The connection remains active for as long as the tunnel (or upgraded
+		// connection) is open. Tunnels over HTTP/2 streams have a body instead,
+		// which is closed when they end.
+		return resp, nextCtx, err
+	}
+	if resp != nil && s.isShuttingDown() {
+		resp.Close = true
+	}
+	if resp == nil || resp.Body == nil {
+		s.setActive(downstream, false)
+	} else {
+		resp.Body = proxyfilters.OnBodyClosed(resp.Body, func() {
+			s.setActive(downstream, false)
+		})
+	}
+	return resp, nextCtx, err
+}
+
 func (s *Server) wrapListenerIfNecessary(l net.Listener) net.Listener {
+	if s.proxyProtocol != nil {
+		log.Debug("Wrapping listener with PROXY protocol")
+		l = listeners.NewProxyProtocolListener(l, s.proxyProtocol)
+	}
 	if s.Allow != nil {
 		log.Debug("Wrapping listener with Allow")
 		return &allowinglistener{l, s.Allow}
@@ -2,9 +2,11 @@ package server
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -13,13 +15,22 @@ import (
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/getlantern/keyman"
+	"github.com/getlantern/lampshade"
+	"github.com/getlantern/proxy"
+	"github.com/getlantern/proxy/filters"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
 
+	"github.com/getlantern/http-proxy/buffers"
+	"github.com/getlantern/http-proxy/egress"
 	"github.com/getlantern/http-proxy/listeners"
+	"github.com/getlantern/http-proxy/proxyfilters"
+	"github.com/getlantern/http-proxy/resolver"
 )
 
 const (
@@ -437,10 +448,648 @@ func TestDisconnectingServer(t *testing.T) {
 	}
 }
 
+func TestMultipleListeners(t *testing.T) {
+	s := basicServer(0, 30*time.Second)
+
+	httpAddr, _ := startServer(s)
+
+	// Probes are proxied to the origin as if it were a decoy web server
+	originURL, _ := url.Parse(httpOriginServer.server.URL)
+	lampshadeReady := make(chan string)
+	go func() {
+		if err := s.ListenAndServeLampshadeWithFallback("localhost:0", "key.pem", lampshade.ProxyFallbackTo(originURL.Host), func(addr string) {
+			lampshadeReady <- addr
+		}); err != nil {
+			log.Errorf("Unable to serve lampshade: %v", err)
+			close(lampshadeReady)
+		}
+	}()
+	lampshadeAddr, ok := <-lampshadeReady
+	if !assert.True(t, ok, "lampshade listener should start") {
+		return
+	}
+
+	pk, err := keyman.LoadPKFromFile("key.pem")
+	if !assert.NoError(t, err) {
+		return
+	}
+	dialer := lampshade.NewDialer(&lampshade.DialerOpts{
+		Pool:            buffers.Pool(),
+		Cipher:          lampshade.AES128GCM,
+		ServerPublicKey: &pk.RSA().PublicKey,
+	})
+
+	get := func(conn net.Conn) {
+		defer conn.Close()
+		_, err := fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", originURL.Host)
+		if !assert.NoError(t, err) {
+			return
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, originResponse, string(body))
+	}
+
+	conn, err := net.Dial("tcp", httpAddr)
+	if assert.NoError(t, err) {
+		get(conn)
+	}
+
+	// Several streams multiplexed over the same physical lampshade connection
+	for i := 0; i < 3; i++ {
+		stream, err := dialer.Dial(func() (net.Conn, error) {
+			return net.Dial("tcp", lampshadeAddr)
+		})
+		if assert.NoError(t, err) {
+			get(stream)
+		}
+	}
+
+	// The same listener serves protocol version 2
+	v2Dialer := lampshade.NewDialer(&lampshade.DialerOpts{
+		Pool:            buffers.Pool(),
+		Cipher:          lampshade.ChaCha20Poly1305,
+		ServerPublicKey: &pk.RSA().PublicKey,
+		ProtocolVersion: lampshade.ProtocolVersion2,
+	})
+	stream, err := v2Dialer.Dial(func() (net.Conn, error) {
+		return net.Dial("tcp", lampshadeAddr)
+	})
+	if assert.NoError(t, err) {
+		get(stream)
+	}
+
+	// Plain HTTP to the lampshade listener reaches the fallback
+	conn, err = net.Dial("tcp", lampshadeAddr)
+	if assert.NoError(t, err) {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		get(conn)
+	}
+}
+
+func TestShutdownWaitsForActiveRequest(t *testing.T) {
+	_, slowOrigin := newOriginHandler(originResponse, false)
+	defer slowOrigin.Close()
+	slowOrigin.Timeout(300*time.Millisecond, originResponse)
+	originURL, _ := url.Parse(slowOrigin.server.URL)
+
+	s := basicServer(0, 30*time.Second)
+	addr, served := startServer(s)
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", originURL.Host)
+	if !assert.NoError(t, err) {
+		return
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownErr <- s.Shutdown(ctx)
+	}()
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if !assert.NoError(t, err, "in-flight request should complete") {
+		return
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, originResponse, string(body))
+	assert.True(t, resp.Close, "response during shutdown should close connection")
+
+	assert.NoError(t, <-shutdownErr)
+	assert.Equal(t, ErrServerClosed, <-served)
+
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err, "should no longer accept connections")
+}
+
+func TestShutdownClosesIdleConnections(t *testing.T) {
+	s := basicServer(0, 30*time.Second)
+	addr, served := startServer(s)
+	originURL, _ := url.Parse(httpOriginServer.server.URL)
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", originURL.Host)
+	if !assert.NoError(t, err) {
+		return
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ioutil.ReadAll(resp.Body)
+	assert.False(t, resp.Close)
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, s.Shutdown(ctx))
+	assert.True(t, time.Since(start) < time.Second, "idle connection shouldn't delay shutdown")
+	assert.Equal(t, ErrServerClosed, <-served)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = br.ReadByte()
+	assert.Error(t, err, "idle connection should have been closed")
+}
+
+func TestShutdownDeadlineClosesTunnels(t *testing.T) {
+	s := basicServer(0, 30*time.Second)
+	addr, _ := startServer(s)
+	originURL, _ := url.Parse(httpOriginServer.server.URL)
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", originURL.Host, originURL.Host)
+	if !assert.NoError(t, err) {
+		return
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if !assert.NoError(t, err) || !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.Shutdown(ctx), "open tunnel should hold up shutdown until deadline")
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = br.ReadByte()
+	assert.Error(t, err, "tunnel should have been forcibly closed")
+}
+
+func TestUpgrade(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Upgrade") != "echo" || req.Header.Get("Connection") != "Upgrade" {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := resp.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+	defer origin.Close()
+	originURL, _ := url.Parse(origin.URL)
+
+	var statuses []int
+	var statusesMx sync.Mutex
+	s := New(&Opts{
+		IdleTimeout: 30 * time.Second,
+		Filter: filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+			resp, nextCtx, err := next(ctx, req)
+			if resp != nil {
+				statusesMx.Lock()
+				statuses = append(statuses, resp.StatusCode)
+				statusesMx.Unlock()
+			}
+			return resp, nextCtx, err
+		}),
+	})
+	addr, _ := startServer(s)
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "GET %s/ws HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n", origin.URL, originURL.Host)
+	if !assert.NoError(t, err) {
+		return
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if !assert.NoError(t, err) || !assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode) {
+		return
+	}
+	assert.Equal(t, "echo", resp.Header.Get("Upgrade"))
+	assert.Equal(t, "Upgrade", resp.Header.Get("Connection"))
+
+	// The connection is now piped straight through to the origin
+	for _, msg := range []string{"hello", "world"} {
+		_, err = conn.Write([]byte(msg))
+		if !assert.NoError(t, err) {
+			return
+		}
+		echoed := make([]byte, len(msg))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadFull(br, echoed)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, msg, string(echoed))
+	}
+
+	statusesMx.Lock()
+	assert.Equal(t, []int{http.StatusSwitchingProtocols}, statuses, "upgrade should have gone through filters")
+	statusesMx.Unlock()
+}
+
+func TestHTTP2(t *testing.T) {
+	echoOrigin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Upgrade") != "echo" || req.Header.Get("Connection") != "Upgrade" {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := resp.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+	defer echoOrigin.Close()
+	originURL, _ := url.Parse(httpOriginURL)
+
+	var requests []string
+	var requestsMx sync.Mutex
+	s := New(&Opts{
+		IdleTimeout: 30 * time.Second,
+		Filter: filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+			resp, nextCtx, err := next(ctx, req)
+			if resp != nil {
+				requestsMx.Lock()
+				requests = append(requests, fmt.Sprintf("%v %d", req.Method, resp.StatusCode))
+				requestsMx.Unlock()
+			}
+			return resp, nextCtx, err
+		}),
+	})
+	ready := make(chan string)
+	go s.ListenAndServeHTTPS("localhost:0", "key.pem", "cert.pem", func(addr string) {
+		ready <- addr
+	})
+	addr := <-ready
+
+	tlsConn, err := tls.Dial("tcp", addr, &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h2"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer tlsConn.Close()
+	if !assert.Equal(t, "h2", tlsConn.ConnectionState().NegotiatedProtocol) {
+		return
+	}
+	cc, err := (&http2.Transport{}).NewClientConn(tlsConn)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Plain request
+	req, _ := http.NewRequest(http.MethodGet, httpOriginURL, nil)
+	resp, err := cc.RoundTrip(req)
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, originResponse, string(body))
+	}
+
+	// Concurrent CONNECT tunnels over the same connection
+	const numTunnels = 5
+	var wg sync.WaitGroup
+	wg.Add(numTunnels)
+	for i := 0; i < numTunnels; i++ {
+		go func() {
+			defer wg.Done()
+			pr, pw := io.Pipe()
+			req, _ := http.NewRequest(http.MethodConnect, "http://"+originURL.Host, pr)
+			resp, err := cc.RoundTrip(req)
+			if !assert.NoError(t, err) || !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+				return
+			}
+			defer resp.Body.Close()
+			fmt.Fprintf(pw, "GET / HTTP/1.1\r\nHost: %v\r\n\r\n", originURL.Host)
+			tunneledResp, err := http.ReadResponse(bufio.NewReader(resp.Body), nil)
+			if assert.NoError(t, err) {
+				body, _ := ioutil.ReadAll(tunneledResp.Body)
+				assert.Equal(t, originResponse, string(body))
+			}
+			pw.Close()
+		}()
+	}
+	wg.Wait()
+
+	// Extended CONNECT maps to an HTTP/1.1 upgrade
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req, _ = http.NewRequest(http.MethodConnect, echoOrigin.URL+"/ws", pr)
+	req.Header.Set(":protocol", "echo")
+	resp, err = cc.RoundTrip(req)
+	if !assert.NoError(t, err) || !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+		return
+	}
+	defer resp.Body.Close()
+	for _, msg := range []string{"hello", "world"} {
+		_, err = pw.Write([]byte(msg))
+		if !assert.NoError(t, err) {
+			return
+		}
+		echoed := make([]byte, len(msg))
+		_, err = io.ReadFull(resp.Body, echoed)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, msg, string(echoed))
+	}
+
+	requestsMx.Lock()
+	assert.Len(t, requests, 2+numTunnels)
+	assert.Equal(t, "GET 200", requests[0])
+	for _, request := range requests[1 : 1+numTunnels] {
+		assert.Equal(t, "CONNECT 200", request)
+	}
+	assert.Equal(t, "GET 101", requests[len(requests)-1], "extended CONNECT should look like an upgrade to filters")
+	requestsMx.Unlock()
+}
+
+func TestPoolSharedAcrossClients(t *testing.T) {
+	var newConns int32
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte(originResponse))
+	}))
+	origin.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&newConns, 1)
+		}
+	}
+	origin.Start()
+	defer origin.Close()
+	originURL, _ := url.Parse(origin.URL)
+
+	s := New(&Opts{IdleTimeout: 30 * time.Second})
+	addr, _ := startServer(s)
+
+	// Each request comes from a different client connection
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		fmt.Fprintf(conn, "GET %v/ HTTP/1.1\r\nHost: %v\r\n\r\n", origin.URL, originURL.Host)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if assert.NoError(t, err) {
+			body, _ := ioutil.ReadAll(resp.Body)
+			assert.Equal(t, originResponse, string(body))
+		}
+		conn.Close()
+	}
+
+	assert.EqualValues(t, 1, atomic.LoadInt32(&newConns), "clients should have shared a single upstream connection")
+	stats := s.PoolStats().Origins[originURL.Host]
+	if assert.NotNil(t, stats) {
+		assert.EqualValues(t, 1, stats.Open)
+		assert.EqualValues(t, 1, stats.Dials)
+		assert.EqualValues(t, 3, stats.Requests)
+		assert.EqualValues(t, 2, stats.Reused)
+	}
+}
+
+func TestPoolPreDialsCONNECT(t *testing.T) {
+	originURL, _ := url.Parse(httpOriginURL)
+	s := New(&Opts{
+		IdleTimeout: 30 * time.Second,
+		Pool:        &proxy.PoolOpts{PreDialCONNECT: 1},
+	})
+	addr, _ := startServer(s)
+
+	connect := func() {
+		conn, err := net.Dial("tcp", addr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", originURL.Host, originURL.Host)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		if !assert.NoError(t, err) || !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			return
+		}
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %v\r\n\r\n", originURL.Host)
+		resp, err = http.ReadResponse(br, nil)
+		if assert.NoError(t, err) {
+			body, _ := ioutil.ReadAll(resp.Body)
+			assert.Equal(t, originResponse, string(body))
+		}
+	}
+
+	connect()
+	waitForSpares := func(expected int) bool {
+		for i := 0; i < 100; i++ {
+			if stats := s.PoolStats().Origins[originURL.Host]; stats != nil && stats.Spares == expected {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+	if !assert.True(t, waitForSpares(1), "should have pre-dialed a spare") {
+		return
+	}
+	connect()
+	stats := s.PoolStats().Origins[originURL.Host]
+	if assert.NotNil(t, stats) {
+		assert.EqualValues(t, 1, stats.SpareHits, "second tunnel should have used the spare")
+	}
+	assert.True(t, waitForSpares(1), "should have replaced the spare")
+}
+
 //
 // Auxiliary functions
 //
 
+func TestEgress(t *testing.T) {
+	clientAddrs := make(chan string, 10)
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		host, _, _ := net.SplitHostPort(req.RemoteAddr)
+		clientAddrs <- host
+		resp.Write([]byte(originResponse))
+	}))
+	defer origin.Close()
+	originURL, _ := url.Parse(origin.URL)
+
+	r, _ := resolver.New(nil)
+	policy, _ := egress.New(&egress.Opts{Rules: []*egress.Rule{{SourceIPs: []string{"127.0.0.2", "127.0.0.3"}}}})
+	var egressAddrs []string
+	var mx sync.Mutex
+	recordEgress := filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		return next(proxy.OnUpstreamConn(ctx, func(conn net.Conn) {
+			mx.Lock()
+			egressAddrs = append(egressAddrs, conn.LocalAddr().(*net.TCPAddr).IP.String())
+			mx.Unlock()
+		}), req)
+	})
+	s := New(&Opts{
+		IdleTimeout: 30 * time.Second,
+		Filter:      filters.Join(recordEgress, proxyfilters.Egress(policy)),
+		Dial: func(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+			return r.Dial(ctx, network, addr)
+		},
+	})
+	addr, _ := startServer(s)
+
+	for i := 0; i < 4; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		fmt.Fprintf(conn, "GET %v/ HTTP/1.1\r\nHost: %v\r\n\r\n", origin.URL, originURL.Host)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if assert.NoError(t, err) {
+			body, _ := ioutil.ReadAll(resp.Body)
+			assert.Equal(t, originResponse, string(body))
+		}
+		conn.Close()
+	}
+
+	var seen []string
+	for i := 0; i < 4; i++ {
+		seen = append(seen, <-clientAddrs)
+	}
+	assert.Equal(t, []string{"127.0.0.2", "127.0.0.3", "127.0.0.2", "127.0.0.3"}, seen, "should have rotated through source IPs")
+	mx.Lock()
+	assert.Equal(t, seen, egressAddrs, "should have reported egress addresses")
+	mx.Unlock()
+	stats := s.PoolStats().Origins[originURL.Host]
+	if assert.NotNil(t, stats) {
+		assert.EqualValues(t, 2, stats.Dials, "each source IP should have had its own pooled connection")
+		assert.EqualValues(t, 2, stats.Reused)
+	}
+}
+
+func TestRewriteHeaders(t *testing.T) {
+	originHeaders := make(chan http.Header, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		originHeaders <- req.Header
+		resp.Header().Set("Server", "origin")
+		resp.Write([]byte(originResponse))
+	}))
+	defer origin.Close()
+	originURL, _ := url.Parse(origin.URL)
+
+	rewrite, err := proxyfilters.RewriteHeaders(&proxyfilters.HeaderOpts{Rules: []*proxyfilters.HeaderRule{{
+		Request:  []*proxyfilters.HeaderAction{{Action: "strip"}, {Action: "forwarded"}, {Action: "via"}},
+		Response: []*proxyfilters.HeaderAction{{Action: "remove", Name: "Server"}, {Action: "via"}},
+	}}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	s := New(&Opts{
+		IdleTimeout: 30 * time.Second,
+		Filter:      rewrite,
+	})
+	addr, _ := startServer(s)
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET %v/ HTTP/1.1\r\nHost: %v\r\nX-Forwarded-For: 192.0.2.1\r\nVia: 1.1 client\r\n\r\n", origin.URL, originURL.Host)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, originResponse, string(body))
+	assert.Empty(t, resp.Header.Get("Server"))
+	assert.Equal(t, "1.1 http-proxy", resp.Header.Get("Via"))
+
+	header := <-originHeaders
+	assert.Empty(t, header.Get("X-Forwarded-For"))
+	assert.Equal(t, "1.1 http-proxy", header.Get("Via"))
+	assert.Equal(t, `for=127.0.0.1;host="`+originURL.Host+`";proto=http`, header.Get("Forwarded"))
+}
+
+func TestProxyProtocol(t *testing.T) {
+	remoteAddrs := make(chan string, 10)
+	recordRemoteAddr := filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		remoteAddrs <- req.RemoteAddr
+		return &http.Response{StatusCode: http.StatusNoContent}, ctx, nil
+	})
+	newServer := func(trusted string) *Server {
+		_, ipNet, _ := net.ParseCIDR(trusted)
+		s := New(&Opts{
+			IdleTimeout:   30 * time.Second,
+			Filter:        recordRemoteAddr,
+			ProxyProtocol: &listeners.ProxyProtocolOpts{TrustedCIDRs: []*net.IPNet{ipNet}, HeaderTimeout: time.Second},
+		})
+		s.Allow = func(ip string) bool {
+			return ip != "192.0.2.66"
+		}
+		return s
+	}
+	v2Header := func(src, dst string) []byte {
+		header := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, 0x21, 0, 36)
+		header = append(header, net.ParseIP(src)...)
+		header = append(header, net.ParseIP(dst)...)
+		return append(header, 0xdc, 0x04, 0x01, 0xbb)
+	}
+	request := func(addr string, header []byte) (*http.Response, error) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		conn.Write(append(header, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"...))
+		return http.ReadResponse(bufio.NewReader(conn), nil)
+	}
+
+	addr, _ := startServer(newServer("127.0.0.0/8"))
+	resp, err := request(addr, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+	if assert.NoError(t, err) && assert.Equal(t, http.StatusNoContent, resp.StatusCode) {
+		assert.Equal(t, "192.0.2.1:56324", <-remoteAddrs)
+	}
+	resp, err = request(addr, v2Header("2001:db8::1", "2001:db8::2"))
+	if assert.NoError(t, err) && assert.Equal(t, http.StatusNoContent, resp.StatusCode) {
+		assert.Equal(t, "[2001:db8::1]:56324", <-remoteAddrs)
+	}
+	resp, err = request(addr, []byte("PROXY UNKNOWN\r\n"))
+	if assert.NoError(t, err) && assert.Equal(t, http.StatusNoContent, resp.StatusCode) {
+		assert.Contains(t, <-remoteAddrs, "127.0.0.1:", "should have kept balancer's address")
+	}
+	_, err = request(addr, nil)
+	assert.Error(t, err, "trusted source without header should have been disconnected")
+	_, err = request(addr, []byte("PROXY TCP4 192.0.2.66 198.51.100.1 56324 443\r\n"))
+	assert.Error(t, err, "Allow should have checked the real client address")
+
+	// Headers from untrusted sources aren't honored
+	addr, _ = startServer(newServer("10.0.0.0/8"))
+	resp, err = request(addr, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+	resp, err = request(addr, nil)
+	if assert.NoError(t, err) && assert.Equal(t, http.StatusNoContent, resp.StatusCode) {
+		assert.Contains(t, <-remoteAddrs, "127.0.0.1:")
+	}
+}
+
 func testRoundTrip(t *testing.T, addr string, isTLS bool, origin *originHandler, checkerFn func(conn net.Conn, originURL *url.URL)) {
 	var conn net.Conn
 	var err error
@@ -497,6 +1146,19 @@ func basicServer(maxConns uint64, idleTimeout time.Duration) *Server {
 	return srv
 }
 
+// startServer serves HTTP on a random local port and returns the address as
+// well as a channel that receives the result of serving.
+func startServer(s *Server) (string, chan error) {
+	ready := make(chan string)
+	served := make(chan error, 1)
+	go func() {
+		served <- s.ListenAndServeHTTP("localhost:0", func(addr string) {
+			ready <- addr
+		})
+	}()
+	return <-ready, served
+}
+
 func setupNewHTTPServer(maxConns uint64, idleTimeout time.Duration) (string, error) {
 	s := basicServer(maxConns, idleTimeout)
 	var err error
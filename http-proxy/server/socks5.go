@@ -0,0 +1,318 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/errors"
+)
+
+// SOCKS5 support (RFC 1928, RFC 1929). SOCKS5 requests are translated into
+// synthetic CONNECT requests so that they go through the same filters as HTTP
+// clients, and the HTTP response from the filters is translated back into a
+// SOCKS reply.
+
+const (
+	socks5Version         = 5
+	socks5PasswordVersion = 1
+
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5NoAcceptable = 0xff
+
+	socks5CmdConnect      = 0x01
+	socks5CmdUDPAssociate = 0x03
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5Succeeded           = 0x00
+	socks5GeneralFailure      = 0x01
+	socks5NotAllowed          = 0x02
+	socks5HostUnreachable     = 0x04
+	socks5TTLExpired          = 0x06
+	socks5CmdNotSupported     = 0x07
+	socks5AddrTypeUnsupported = 0x08
+)
+
+// isSOCKS5 determines whether a connection speaks SOCKS5 from its first byte.
+// HTTP requests always start with a method name, so there's no ambiguity.
+func isSOCKS5(firstByte byte) bool {
+	return firstByte == socks5Version
+}
+
+// handleSOCKS5 performs the SOCKS5 handshake on conn and then serves the
+// requested command.
+func (s *Server) handleSOCKS5(conn net.Conn, br *bufio.Reader) error {
+	authorization, err := s.socks5Authenticate(conn, br)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(br, header); err != nil {
+		conn.Close()
+		return errors.New("Unable to read SOCKS5 request: %v", err)
+	}
+	if header[0] != socks5Version {
+		conn.Close()
+		return errors.New("Unsupported SOCKS version %d", header[0])
+	}
+	addr, err := readSOCKS5Addr(br)
+	if err != nil {
+		writeSOCKS5Reply(conn, socks5AddrTypeUnsupported, nil)
+		conn.Close()
+		return err
+	}
+
+	switch header[1] {
+	case socks5CmdConnect:
+		return s.socks5Connect(conn, br, addr, authorization)
+	case socks5CmdUDPAssociate:
+		if !s.socks5UDP {
+			writeSOCKS5Reply(conn, socks5CmdNotSupported, nil)
+			conn.Close()
+			return errors.New("SOCKS5 UDP associate is disabled")
+		}
+		return s.socks5UDPAssociate(conn, br, authorization)
+	default:
+		writeSOCKS5Reply(conn, socks5CmdNotSupported, nil)
+		conn.Close()
+		return errors.New("Unsupported SOCKS5 command %d", header[1])
+	}
+}
+
+// socks5Authenticate negotiates the authentication method and returns the
+// equivalent Proxy-Authorization header value, if any.
+func (s *Server) socks5Authenticate(conn net.Conn, br *bufio.Reader) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return "", errors.New("Unable to read SOCKS5 greeting: %v", err)
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return "", errors.New("Unable to read SOCKS5 auth methods: %v", err)
+	}
+
+	// Prefer username/password since the credentials may be needed by filters
+	// even if we don't check them here
+	method := byte(socks5NoAcceptable)
+	for _, m := range methods {
+		if m == socks5AuthPassword {
+			method = m
+			break
+		}
+		if m == socks5AuthNone && s.socks5Passwords == nil {
+			method = m
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	switch method {
+	case socks5AuthNone:
+		return "", nil
+	case socks5AuthPassword:
+		return s.socks5CheckPassword(conn, br)
+	default:
+		return "", errors.New("No acceptable SOCKS5 auth method in %v", methods)
+	}
+}
+
+func (s *Server) socks5CheckPassword(conn net.Conn, br *bufio.Reader) (string, error) {
+	readString := func() (string, error) {
+		length, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, length)
+		_, err = io.ReadFull(br, b)
+		return string(b), err
+	}
+	version, err := br.ReadByte()
+	if err != nil {
+		return "", errors.New("Unable to read SOCKS5 credentials: %v", err)
+	}
+	if version != socks5PasswordVersion {
+		return "", errors.New("Unsupported SOCKS5 username/password version %d", version)
+	}
+	username, err := readString()
+	if err != nil {
+		return "", errors.New("Unable to read SOCKS5 username: %v", err)
+	}
+	password, err := readString()
+	if err != nil {
+		return "", errors.New("Unable to read SOCKS5 password: %v", err)
+	}
+
+	if s.socks5Passwords != nil && !s.socks5Passwords.CheckPassword(username, password) {
+		conn.Write([]byte{socks5PasswordVersion, 1})
+		return "", errors.New("Invalid SOCKS5 credentials for %v", username)
+	}
+	if _, err := conn.Write([]byte{socks5PasswordVersion, 0}); err != nil {
+		return "", err
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)), nil
+}
+
+// socks5Connect hands the connection to the proxy as a CONNECT request to
+// addr. The proxy's response is translated into a SOCKS5 reply by socks5Conn.
+func (s *Server) socks5Connect(conn net.Conn, br *bufio.Reader, addr string, authorization string) error {
+	sc := &socks5Conn{Conn: conn, reader: br}
+	req := syntheticCONNECT(addr, authorization)
+	return s.proxy.Handle(context.Background(), io.MultiReader(strings.NewReader(req), br), sc)
+}
+
+func syntheticCONNECT(addr string, authorization string) string {
+	req := fmt.Sprintf("CONNECT %v HTTP/1.1\r\nHost: %v\r\n", addr, addr)
+	if authorization != "" {
+		req += "Proxy-Authorization: " + authorization + "\r\n"
+	}
+	return req + "\r\n"
+}
+
+// readSOCKS5Addr reads an ATYP, DST.ADDR, DST.PORT triple and returns it as a
+// host:port string.
+func readSOCKS5Addr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if atyp[0] == socks5AddrIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", errors.New("Unsupported SOCKS5 address type %d", atyp[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// appendSOCKS5Addr encodes addr as ATYP, ADDR, PORT. A nil addr is encoded as
+// 0.0.0.0:0.
+func appendSOCKS5Addr(b []byte, addr net.Addr) []byte {
+	ip := net.IPv4zero
+	port := 0
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socks5AddrIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socks5AddrIPv6)
+		b = append(b, ip.To16()...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+func writeSOCKS5Reply(conn net.Conn, reply byte, bound net.Addr) error {
+	_, err := conn.Write(appendSOCKS5Addr([]byte{socks5Version, reply, 0}, bound))
+	return err
+}
+
+// socks5ReplyFor maps the status of the proxy's response to a CONNECT onto a
+// SOCKS5 reply code.
+func socks5ReplyFor(status int) byte {
+	switch status {
+	case http.StatusOK:
+		return socks5Succeeded
+	case http.StatusForbidden, http.StatusProxyAuthRequired, http.StatusTooManyRequests:
+		return socks5NotAllowed
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return socks5HostUnreachable
+	case http.StatusGatewayTimeout:
+		return socks5TTLExpired
+	default:
+		return socks5GeneralFailure
+	}
+}
+
+// socks5Conn intercepts the HTTP response that the proxy writes for the
+// synthetic CONNECT request and replaces it with the equivalent SOCKS5 reply.
+// Once the reply has been sent, writes pass through if the tunnel succeeded
+// and are discarded otherwise.
+type socks5Conn struct {
+	net.Conn
+	reader  io.Reader
+	head    []byte
+	replied bool
+	failed  bool
+}
+
+func (c *socks5Conn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *socks5Conn) Write(b []byte) (int, error) {
+	if c.replied {
+		if c.failed {
+			return len(b), nil
+		}
+		return c.Conn.Write(b)
+	}
+
+	c.head = append(c.head, b...)
+	end := bytes.Index(c.head, []byte("\r\n\r\n"))
+	if end < 0 {
+		return len(b), nil
+	}
+	c.replied = true
+	status := 0
+	statusLine := string(c.head[:bytes.IndexByte(c.head, '\r')])
+	if parts := strings.SplitN(statusLine, " ", 3); len(parts) >= 2 {
+		status, _ = strconv.Atoi(parts[1])
+	}
+	reply := socks5ReplyFor(status)
+	c.failed = reply != socks5Succeeded
+	if err := writeSOCKS5Reply(c.Conn, reply, nil); err != nil {
+		return 0, err
+	}
+	if rest := c.head[end+4:]; !c.failed && len(rest) > 0 {
+		if _, err := c.Conn.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	c.head = nil
+	return len(b), nil
+}
+
+// Wrapped implements the interface netx.WrappedConn
+func (c *socks5Conn) Wrapped() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy/dialer"
+	"github.com/getlantern/http-proxy/proxyfilters"
+	"github.com/getlantern/http-proxy/resolver"
+)
+
+type staticPasswords map[string]string
+
+func (p staticPasswords) CheckPassword(username, password string) bool {
+	expected, found := p[username]
+	return found && expected == password
+}
+
+func socks5Server(opts *Opts) string {
+	opts.IdleTimeout = 30 * time.Second
+	opts.SOCKS5 = true
+	addr, _ := startServer(New(opts))
+	return addr
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	originURL, _ := url.Parse(httpOriginServer.server.URL)
+	_, originPort, _ := net.SplitHostPort(originURL.Host)
+	port, _ := strconv.Atoi(originPort)
+	addr := socks5Server(&Opts{
+		Filter: proxyfilters.RestrictConnectPorts([]int{port}),
+	})
+
+	get := func(conn net.Conn) {
+		defer conn.Close()
+		_, err := fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", originURL.Host)
+		if !assert.NoError(t, err) {
+			return
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, originResponse, string(body))
+	}
+
+	socks := mustSOCKS5(addr, "", "")
+	for _, target := range []string{originURL.Host, "localhost:" + originPort, "[::1]:" + originPort} {
+		conn, err := socks.DialContext(context.Background(), "tcp", target)
+		if target == "[::1]:"+originPort && err != nil {
+			// IPv6 loopback not available
+			continue
+		}
+		if assert.NoError(t, err, target) {
+			get(conn)
+		}
+	}
+
+	_, err := socks.DialContext(context.Background(), "tcp", "localhost:1")
+	assert.Error(t, err, "filters should apply to SOCKS5")
+
+	// HTTP still works on the same port
+	conn, err := net.Dial("tcp", addr)
+	if assert.NoError(t, err) {
+		get(conn)
+	}
+}
+
+func TestSOCKS5Auth(t *testing.T) {
+	originURL, _ := url.Parse(httpOriginServer.server.URL)
+	addr := socks5Server(&Opts{
+		SOCKS5Passwords: staticPasswords{"user": "pass"},
+	})
+
+	conn, err := mustSOCKS5(addr, "user", "pass").DialContext(context.Background(), "tcp", originURL.Host)
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+
+	for _, socks := range []dialer.Parent{mustSOCKS5(addr, "user", "wrong"), mustSOCKS5(addr, "", "")} {
+		_, err = socks.DialContext(context.Background(), "tcp", originURL.Host)
+		assert.Error(t, err)
+	}
+}
+
+func TestSOCKS5AuthViaFilter(t *testing.T) {
+	originURL, _ := url.Parse(httpOriginServer.server.URL)
+	addr := socks5Server(&Opts{
+		Filter: proxyfilters.ProxyAuth(&proxyfilters.AuthOpts{Passwords: staticPasswords{"user": "pass"}}),
+	})
+
+	conn, err := mustSOCKS5(addr, "user", "pass").DialContext(context.Background(), "tcp", originURL.Host)
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+
+	_, err = mustSOCKS5(addr, "user", "wrong").DialContext(context.Background(), "tcp", originURL.Host)
+	assert.Error(t, err, "credentials should be checked by the auth filter")
+}
+
+func TestSOCKS5UDPAssociate(t *testing.T) {
+	echo, echoPort := udpEcho(t)
+	if echo == nil {
+		return
+	}
+	defer echo.Close()
+
+	addr := socks5Server(&Opts{
+		Filter: proxyfilters.RestrictConnectPorts([]int{echoPort}),
+	})
+	conn, client := socks5UDPClient(t, addr)
+	if client == nil {
+		return
+	}
+	defer conn.Close()
+	defer client.Close()
+
+	// Not allowed by filter, dropped
+	client.Write(ipv4Datagram(echoPort+1, "blocked"))
+	client.Write(ipv4Datagram(echoPort, "hello"))
+	b := make([]byte, 1024)
+	n, err := client.Read(b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, ipv4Datagram(echoPort, "hello"), b[:n])
+	}
+}
+
+func TestSOCKS5UDPAssociateDisabled(t *testing.T) {
+	addr := socks5Server(&Opts{DisableSOCKS5UDP: true})
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte{5, 1, 0})
+	conn.Write([]byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0})
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, reply); assert.NoError(t, err) {
+		assert.EqualValues(t, 7, reply[3], "command should not be supported")
+	}
+}
+
+func TestSOCKS5UDPAssociatePinnedIPs(t *testing.T) {
+	echo, echoPort := udpEcho(t)
+	if echo == nil {
+		return
+	}
+	defer echo.Close()
+
+	// The name doesn't resolve, so the datagram only gets through if the relay
+	// sends to the IPs the filter pinned.
+	addr := socks5Server(&Opts{
+		Filter: filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+			host, _, _ := net.SplitHostPort(req.Host)
+			return next(resolver.WithResolved(ctx, host, []net.IP{net.IPv4(127, 0, 0, 1)}), req)
+		}),
+	})
+	conn, client := socks5UDPClient(t, addr)
+	if client == nil {
+		return
+	}
+	defer conn.Close()
+	defer client.Close()
+
+	datagram := []byte{0, 0, 0, 3, byte(len("udp.invalid"))}
+	datagram = append(datagram, "udp.invalid"...)
+	datagram = append(datagram, byte(echoPort>>8), byte(echoPort))
+	client.Write(append(datagram, "hello"...))
+	b := make([]byte, 1024)
+	n, err := client.Read(b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, ipv4Datagram(echoPort, "hello"), b[:n], "reply should come from the pinned IP")
+	}
+}
+
+func TestSOCKS5UDPDestinationsBounded(t *testing.T) {
+	r := &socks5UDPRelay{destinations: make(map[string]*net.UDPConn)}
+	for i := 0; i < maxSOCKS5UDPDestinations+10; i++ {
+		r.remember(fmt.Sprintf("127.0.0.1:%d", i+1), nil)
+	}
+	assert.Len(t, r.destinations, maxSOCKS5UDPDestinations)
+	assert.Len(t, r.order, maxSOCKS5UDPDestinations)
+	_, found := r.destinations["127.0.0.1:1"]
+	assert.False(t, found, "oldest destination should have been evicted")
+	_, found = r.destinations[fmt.Sprintf("127.0.0.1:%d", maxSOCKS5UDPDestinations+10)]
+	assert.True(t, found, "newest destination should be kept")
+}
+
+// udpEcho starts a UDP echo server on localhost.
+func udpEcho(t *testing.T) (*net.UDPConn, int) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.NoError(t, err) {
+		return nil, 0
+	}
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			n, from, err := echo.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(b[:n], from)
+		}
+	}()
+	return echo, echo.LocalAddr().(*net.UDPAddr).Port
+}
+
+// socks5UDPClient sets up a UDP association with the SOCKS5 server at addr and
+// returns the control connection and a UDP socket connected to the relay.
+func socks5UDPClient(t *testing.T, addr string) (net.Conn, *net.UDPConn) {
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return nil, nil
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Greeting and UDP ASSOCIATE from 0.0.0.0:0
+	conn.Write([]byte{5, 1, 0})
+	conn.Write([]byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0})
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, reply); !assert.NoError(t, err) {
+		conn.Close()
+		return nil, nil
+	}
+	assert.Equal(t, []byte{5, 0}, reply[:2])
+	assert.EqualValues(t, 0, reply[3], "association should succeed")
+	relayAddr := &net.UDPAddr{IP: net.IP(reply[6:10]), Port: int(binary.BigEndian.Uint16(reply[10:]))}
+
+	client, err := net.DialUDP("udp", nil, relayAddr)
+	if !assert.NoError(t, err) {
+		conn.Close()
+		return nil, nil
+	}
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, client
+}
+
+// ipv4Datagram builds a SOCKS5 UDP datagram to 127.0.0.1:port.
+func ipv4Datagram(port int, payload string) []byte {
+	b := []byte{0, 0, 0, 1, 127, 0, 0, 1, byte(port >> 8), byte(port)}
+	return append(b, payload...)
+}
+
+func mustSOCKS5(addr, username, password string) dialer.Parent {
+	socks, _ := dialer.SOCKS5(addr, username, password)
+	return socks
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+
+	"github.com/getlantern/http-proxy/egress"
+	"github.com/getlantern/http-proxy/resolver"
+)
+
+const (
+	maxDatagramSize = 65535
+
+	// maxSOCKS5UDPDestinations limits how many destinations one association
+	// keeps sockets open for.
+	maxSOCKS5UDPDestinations = 256
+)
+
+// socks5UDPAssociate relays UDP datagrams between the client and the
+// destinations it addresses for as long as the control connection stays open.
+// Each destination is checked against the filters as if it were a CONNECT
+// request. Note that the control connection is still subject to the idle
+// timeout, which UDP traffic doesn't reset.
+//
+// The address the client says it will send from is ignored since it's often
+// wrong behind NAT. Instead, the first datagram from the client's IP
+// determines its UDP address.
+func (s *Server) socks5UDPAssociate(conn net.Conn, br *bufio.Reader, authorization string) error {
+	defer conn.Close()
+
+	var localIP net.IP
+	if tcpAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = tcpAddr.IP
+	}
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		writeSOCKS5Reply(conn, socks5GeneralFailure, nil)
+		return errors.New("Unable to listen for SOCKS5 UDP associate: %v", err)
+	}
+	defer pc.Close()
+	if err := writeSOCKS5Reply(conn, socks5Succeeded, pc.LocalAddr()); err != nil {
+		return err
+	}
+
+	s.setActive(conn, true)
+	defer s.setActive(conn, false)
+	go func() {
+		// The association terminates when the control connection closes
+		io.Copy(ioutil.Discard, br)
+		pc.Close()
+	}()
+
+	relay := &socks5UDPRelay{
+		s:             s,
+		conn:          conn,
+		pc:            pc,
+		authorization: authorization,
+		destinations:  make(map[string]*net.UDPConn),
+	}
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		relay.clientIP = tcpAddr.IP
+	}
+	defer relay.closeDestinations()
+	relay.run()
+	return nil
+}
+
+type socks5UDPRelay struct {
+	s             *Server
+	conn          net.Conn
+	pc            *net.UDPConn
+	authorization string
+	clientIP      net.IP
+	client        *net.UDPAddr
+	// destinations are the sockets connected to the destinations the client
+	// addressed, keyed by the address it gave. Destinations that didn't pass
+	// the filters map to nil. Only the maxSOCKS5UDPDestinations most recent are
+	// kept, in order.
+	destinations map[string]*net.UDPConn
+	order        []string
+}
+
+func (r *socks5UDPRelay) run() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := r.pc.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		// Replies come in on the destination sockets, so anything else is
+		// dropped.
+		if r.isClient(from) {
+			r.forward(buf[:n])
+		}
+	}
+}
+
+func (r *socks5UDPRelay) isClient(from *net.UDPAddr) bool {
+	if r.client != nil {
+		return from.IP.Equal(r.client.IP) && from.Port == r.client.Port
+	}
+	if r.clientIP != nil && !from.IP.Equal(r.clientIP) {
+		return false
+	}
+	// First datagram from the client's IP determines its port
+	r.client = from
+	return true
+}
+
+// forward sends a datagram from the client (with its SOCKS5 UDP request
+// header) to its destination.
+func (r *socks5UDPRelay) forward(datagram []byte) {
+	if len(datagram) < 4 || datagram[2] != 0 {
+		// Fragmentation is not supported
+		return
+	}
+	payload := bytes.NewReader(datagram[3:])
+	addr, err := readSOCKS5Addr(payload)
+	if err != nil {
+		log.Debugf("Dropping SOCKS5 UDP datagram: %v", err)
+		return
+	}
+	dest, checked := r.destinations[addr]
+	if !checked {
+		dest = r.dial(addr)
+		r.remember(addr, dest)
+	}
+	if dest == nil {
+		return
+	}
+	dest.Write(datagram[len(datagram)-payload.Len():])
+}
+
+// dial connects a socket to addr if the filters allow it, or returns nil. It
+// dials the IPs that the filters checked, if they pinned any, so that the
+// destination can't resolve differently by the time we send to it.
+func (r *socks5UDPRelay) dial(addr string) *net.UDPConn {
+	ctx, allowed := r.s.socks5Allowed(r.conn, addr, r.authorization)
+	if !allowed {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	ips, pinned := resolver.Resolved(ctx, host)
+	if !pinned {
+		ips, err = r.s.lookupIP(ctx, host)
+		if err != nil {
+			log.Debugf("Unable to resolve SOCKS5 UDP destination %v: %v", addr, err)
+			return nil
+		}
+	}
+	conn, err := egress.DialIPs(ctx, "udp", ips, port)
+	if err != nil {
+		log.Debugf("Unable to dial SOCKS5 UDP destination %v: %v", addr, err)
+		return nil
+	}
+	dest := conn.(*net.UDPConn)
+	go r.relayReplies(dest)
+	return dest
+}
+
+// relayReplies sends datagrams from dest back to the client until dest is
+// closed.
+func (r *socks5UDPRelay) relayReplies(dest *net.UDPConn) {
+	from := dest.RemoteAddr()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := dest.Read(buf)
+		if err != nil {
+			if refused(err) {
+				continue
+			}
+			return
+		}
+		datagram := appendSOCKS5Addr([]byte{0, 0, 0}, from)
+		datagram = append(datagram, buf[:n]...)
+		r.pc.WriteToUDP(datagram, r.client)
+	}
+}
+
+// refused reports whether err is from an ICMP port unreachable for an earlier
+// datagram, which doesn't end the relay.
+func refused(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+	sysErr, ok := opErr.Err.(*os.SyscallError)
+	return ok && sysErr.Err == syscall.ECONNREFUSED
+}
+
+// remember adds dest for addr, evicting the oldest destination if there are
+// too many.
+func (r *socks5UDPRelay) remember(addr string, dest *net.UDPConn) {
+	if len(r.order) >= maxSOCKS5UDPDestinations {
+		oldest := r.order[0]
+		r.order = r.order[1:]
+		if evicted := r.destinations[oldest]; evicted != nil {
+			evicted.Close()
+		}
+		delete(r.destinations, oldest)
+	}
+	r.destinations[addr] = dest
+	r.order = append(r.order, addr)
+}
+
+func (r *socks5UDPRelay) closeDestinations() {
+	for _, dest := range r.destinations {
+		if dest != nil {
+			dest.Close()
+		}
+	}
+}
+
+// socks5Allowed checks whether the filters would allow a CONNECT to addr from
+// conn, without dialing. It returns the context the filters left, which
+// carries what they decided about the destination, like the IPs they checked
+// and the egress binding.
+func (s *Server) socks5Allowed(conn net.Conn, addr string, authorization string) (filters.Context, bool) {
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(syntheticCONNECT(addr, authorization))))
+	if err != nil {
+		return nil, false
+	}
+	req.RemoteAddr = conn.RemoteAddr().String()
+	ctx := filters.WrapContext(context.Background(), conn)
+	var allowedCtx filters.Context
+	resp, _, _ := s.filter.Apply(ctx, req, func(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+		allowedCtx = ctx
+		return &http.Response{StatusCode: http.StatusOK}, ctx, nil
+	})
+	if resp == nil {
+		return nil, false
+	}
+	if resp.Body != nil {
+		resp.Body.Close()
+	}
+	if resp.StatusCode != http.StatusOK || allowedCtx == nil {
+		log.Debugf("SOCKS5 UDP to %v not allowed: %d", addr, resp.StatusCode)
+		return nil, false
+	}
+	return allowedCtx, true
+}
+
+// lookupIP resolves host with the server's Resolver, or the system resolver if
+// it doesn't have one.
+func (s *Server) lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if s.resolver != nil {
+		return s.resolver.LookupIP(ctx, host)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
@@ -0,0 +1,36 @@
+//go:build !plan9
+// +build !plan9
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// onReload calls reload every time the process receives SIGHUP.
+func onReload(reload func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			reload()
+		}
+	}()
+}
+
+// onShutdown calls shutdown when the process receives SIGTERM or SIGINT. A
+// second signal makes the process exit immediately.
+func onShutdown(shutdown func()) {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-ch
+		log.Debugf("Received %v, shutting down gracefully", sig)
+		go shutdown()
+		sig = <-ch
+		log.Debugf("Received %v again, exiting immediately", sig)
+		os.Exit(1)
+	}()
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+)
+
+// onReload is unsupported on Plan 9, which has no SIGHUP.
+func onReload(reload func()) {
+	log.Debug("Config reloading is not supported on this platform")
+}
+
+// onShutdown calls shutdown when the process is interrupted. A second
+// interrupt makes the process exit immediately.
+func onShutdown(shutdown func()) {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, os.Interrupt)
+	go func() {
+		<-ch
+		log.Debug("Interrupted, shutting down gracefully")
+		go shutdown()
+		<-ch
+		log.Debug("Interrupted again, exiting immediately")
+		os.Exit(1)
+	}()
+}
@@ -0,0 +1,83 @@
+package throttle
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bucket is a token bucket whose tokens are bytes. Tokens can be borrowed,
+// leaving the bucket in debt, in which case the borrower waits until the debt
+// would have been repaid.
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mx     sync.Mutex
+
+	// stats, updated atomically
+	bytes  int64
+	waited int64
+}
+
+func newBucket(limits *Limits) *bucket {
+	return &bucket{
+		rate:   float64(limits.BytesPerSecond),
+		burst:  float64(limits.burst()),
+		tokens: float64(limits.burst()),
+		last:   time.Now(),
+	}
+}
+
+// take takes n tokens from the bucket and returns how long to wait until
+// they'd have been available.
+func (b *bucket) take(n int, now time.Time) time.Duration {
+	atomic.AddInt64(&b.bytes, int64(n))
+	b.mx.Lock()
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+	b.tokens -= float64(n)
+	tokens := b.tokens
+	b.mx.Unlock()
+	if tokens >= 0 {
+		return 0
+	}
+	wait := time.Duration(-tokens / b.rate * float64(time.Second))
+	atomic.AddInt64(&b.waited, int64(wait))
+	return wait
+}
+
+// limiter limits a client, user or everything, with separate buckets for each
+// direction.
+type limiter struct {
+	limits *Limits
+	// down limits data sent to clients
+	down *bucket
+	// up limits data received from clients
+	up    *bucket
+	conns int64
+}
+
+func newLimiter(limits *Limits) *limiter {
+	return &limiter{
+		limits: limits,
+		down:   newBucket(limits),
+		up:     newBucket(limits),
+	}
+}
+
+func (l *limiter) stats() *LimiterStats {
+	return &LimiterStats{
+		BytesPerSecond: l.limits.BytesPerSecond,
+		Conns:          int(atomic.LoadInt64(&l.conns)),
+		BytesSent:      atomic.LoadInt64(&l.down.bytes),
+		BytesReceived:  atomic.LoadInt64(&l.up.bytes),
+		Throttled:      time.Duration(atomic.LoadInt64(&l.down.waited) + atomic.LoadInt64(&l.up.waited)),
+	}
+}
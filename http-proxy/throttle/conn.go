@@ -0,0 +1,198 @@
+package throttle
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/http-proxy/listeners"
+)
+
+type throttledListener struct {
+	net.Listener
+	t *Throttle
+}
+
+func (l *throttledListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tc := &throttledConn{
+		Conn:   conn,
+		t:      l.t,
+		closed: make(chan struct{}),
+	}
+	tc.WrapConnEmbeddable, _ = conn.(listeners.WrapConnEmbeddable)
+	if l.t.global != nil {
+		atomic.AddInt64(&l.t.global.conns, 1)
+	}
+	tc.client, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+	tc.clientLimiter = l.t.clients.acquire(tc.client)
+	return tc, nil
+}
+
+// throttledConn throttles reads and writes according to the limiters that
+// apply to it. Writes are split into chunks no bigger than the smallest burst
+// so that they can't exceed it. Reads are throttled after the fact, which
+// delays the next read and lets TCP flow control slow down the client.
+type throttledConn struct {
+	listeners.WrapConnEmbeddable
+	net.Conn
+	t             *Throttle
+	client        string
+	clientLimiter *limiter
+	user          string
+	userLimiter   *limiter
+	mx            sync.RWMutex
+	closeOnce     sync.Once
+	closed        chan struct{}
+}
+
+func (c *throttledConn) limiters() []*limiter {
+	result := make([]*limiter, 0, 3)
+	if c.t.global != nil {
+		result = append(result, c.t.global)
+	}
+	if c.clientLimiter != nil {
+		result = append(result, c.clientLimiter)
+	}
+	c.mx.RLock()
+	if c.userLimiter != nil {
+		result = append(result, c.userLimiter)
+	}
+	c.mx.RUnlock()
+	return result
+}
+
+// chunkSize returns the most that may be transferred at once, or 0 if
+// unlimited
+func chunkSize(limiters []*limiter) int {
+	size := 0
+	for _, l := range limiters {
+		burst := int(l.limits.burst())
+		if size == 0 || burst < size {
+			size = burst
+		}
+	}
+	if size > 0 && size < minChunkSize {
+		size = minChunkSize
+	}
+	return size
+}
+
+func (c *throttledConn) Read(b []byte) (int, error) {
+	limiters := c.limiters()
+	if size := chunkSize(limiters); size > 0 && len(b) > size {
+		b = b[:size]
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.wait(limiters, n, func(l *limiter) *bucket { return l.up })
+	}
+	return n, err
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	limiters := c.limiters()
+	size := chunkSize(limiters)
+	if size == 0 {
+		return c.Conn.Write(b)
+	}
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		if !c.wait(limiters, len(chunk), func(l *limiter) *bucket { return l.down }) {
+			return written, net.ErrClosed
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// wait takes n bytes from the relevant bucket of each limiter and waits as
+// long as the slowest one requires. It returns false if the connection was
+// closed while waiting.
+func (c *throttledConn) wait(limiters []*limiter, n int, bucketFor func(*limiter) *bucket) bool {
+	now := time.Now()
+	var wait time.Duration
+	for _, l := range limiters {
+		if w := bucketFor(l).take(n, now); w > wait {
+			wait = w
+		}
+	}
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.closed:
+		return false
+	}
+}
+
+func (c *throttledConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		if c.t.global != nil {
+			atomic.AddInt64(&c.t.global.conns, -1)
+		}
+		c.t.clients.release(c.client, c.clientLimiter)
+		c.mx.Lock()
+		c.t.users.release(c.user, c.userLimiter)
+		c.userLimiter = nil
+		c.mx.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+func (c *throttledConn) setUser(user string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if user == c.user {
+		return
+	}
+	select {
+	case <-c.closed:
+		return
+	default:
+	}
+	c.t.users.release(c.user, c.userLimiter)
+	c.user = user
+	c.userLimiter = c.t.users.acquire(user)
+}
+
+func (c *throttledConn) OnState(s http.ConnState) {
+	if c.WrapConnEmbeddable != nil {
+		c.WrapConnEmbeddable.OnState(s)
+	}
+}
+
+// Responds to the "throttle.user" message type
+func (c *throttledConn) ControlMessage(msgType string, data interface{}) {
+	if msgType == controlMessageUser {
+		if user, ok := data.(string); ok {
+			c.setUser(user)
+		}
+	}
+	if c.WrapConnEmbeddable != nil {
+		c.WrapConnEmbeddable.ControlMessage(msgType, data)
+	}
+}
+
+// Wrapped implements the interface netx.WrappedConn
+func (c *throttledConn) Wrapped() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,204 @@
+// Package throttle shapes the bandwidth of proxy clients with token buckets.
+// Limits can apply globally, per client IP and per authenticated user, and are
+// enforced on connections so that they cover both plain HTTP and CONNECT
+// tunnels. Each limit applies to each direction separately.
+package throttle
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/netx"
+	"github.com/getlantern/proxy/filters"
+
+	"github.com/getlantern/http-proxy/listeners"
+	"github.com/getlantern/http-proxy/proxyfilters"
+)
+
+const (
+	// controlMessageUser is the control message that tells a connection which
+	// user it belongs to
+	controlMessageUser = "throttle.user"
+
+	minChunkSize = 1024
+)
+
+var (
+	log = golog.LoggerFor("http-proxy.throttle")
+)
+
+// Limits configures a single bandwidth limit.
+type Limits struct {
+	// BytesPerSecond is the sustained rate.
+	BytesPerSecond int64
+
+	// Burst is how many bytes can be transferred at once after a period of
+	// inactivity. Defaults to BytesPerSecond.
+	Burst int64
+}
+
+func (l *Limits) burst() int64 {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.BytesPerSecond
+}
+
+// Opts configures a Throttle. Nil or zero limits are disabled.
+type Opts struct {
+	// Global limits all clients together.
+	Global *Limits
+
+	// PerClient limits each client IP.
+	PerClient *Limits
+
+	// PerUser limits each authenticated user (see proxyfilters.ProxyAuth),
+	// across all of their connections.
+	PerUser *Limits
+}
+
+// Throttle enforces bandwidth limits on connections accepted via its Listener.
+type Throttle struct {
+	global  *limiter
+	clients *limiterGroup
+	users   *limiterGroup
+}
+
+// New constructs a new Throttle.
+func New(opts *Opts) *Throttle {
+	t := &Throttle{
+		clients: newLimiterGroup(opts.PerClient),
+		users:   newLimiterGroup(opts.PerUser),
+	}
+	if enabled(opts.Global) {
+		t.global = newLimiter(opts.Global)
+	}
+	return t
+}
+
+func enabled(limits *Limits) bool {
+	return limits != nil && limits.BytesPerSecond > 0
+}
+
+// LimiterStats are statistics for one limit.
+type LimiterStats struct {
+	BytesPerSecond int64         `json:"bytesPerSecond"`
+	Conns          int           `json:"conns"`
+	BytesSent      int64         `json:"bytesSent"`
+	BytesReceived  int64         `json:"bytesReceived"`
+	Throttled      time.Duration `json:"throttled"`
+}
+
+// Stats are live statistics for a Throttle. Clients and users are only
+// included while they have open connections. Throttled is the total time
+// that transfers were delayed.
+type Stats struct {
+	Global  *LimiterStats            `json:"global,omitempty"`
+	Clients map[string]*LimiterStats `json:"clients"`
+	Users   map[string]*LimiterStats `json:"users"`
+}
+
+// Stats gets a snapshot of the current Stats.
+func (t *Throttle) Stats() *Stats {
+	stats := &Stats{
+		Clients: t.clients.stats(),
+		Users:   t.users.stats(),
+	}
+	if t.global != nil {
+		stats.Global = t.global.stats()
+	}
+	return stats
+}
+
+// ServeHTTP serves the current Stats as JSON.
+func (t *Throttle) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(resp).Encode(t.Stats()); err != nil {
+		log.Errorf("Unable to encode throttle stats: %v", err)
+	}
+}
+
+// Listener wraps l so that its connections are throttled.
+func (t *Throttle) Listener(l net.Listener) net.Listener {
+	return &throttledListener{l, t}
+}
+
+// Filter returns a filter that applies the per-user limit to a connection once
+// its user is known. It must come after the filter that authenticates users.
+func (t *Throttle) Filter() filters.Filter {
+	return filters.FilterFunc(func(ctx filters.Context, req *http.Request, next filters.Next) (*http.Response, filters.Context, error) {
+		if t.users.enabled() {
+			if user := proxyfilters.AuthenticatedIdentity(ctx); user != "" {
+				netx.WalkWrapped(ctx.DownstreamConn(), func(conn net.Conn) bool {
+					wc, ok := conn.(listeners.WrapConn)
+					if ok {
+						wc.ControlMessage(controlMessageUser, user)
+					}
+					return !ok
+				})
+			}
+		}
+		return next(ctx, req)
+	})
+}
+
+// limiterGroup is a set of limiters that exist only while they're in use.
+type limiterGroup struct {
+	limits   *Limits
+	limiters map[string]*limiter
+	mx       sync.Mutex
+}
+
+func newLimiterGroup(limits *Limits) *limiterGroup {
+	return &limiterGroup{
+		limits:   limits,
+		limiters: make(map[string]*limiter),
+	}
+}
+
+func (g *limiterGroup) enabled() bool {
+	return enabled(g.limits)
+}
+
+// acquire gets the limiter for key, creating it if necessary. Every call must
+// be matched with a call to release.
+func (g *limiterGroup) acquire(key string) *limiter {
+	if !g.enabled() {
+		return nil
+	}
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	l := g.limiters[key]
+	if l == nil {
+		l = newLimiter(g.limits)
+		g.limiters[key] = l
+	}
+	atomic.AddInt64(&l.conns, 1)
+	return l
+}
+
+func (g *limiterGroup) release(key string, l *limiter) {
+	if l == nil {
+		return
+	}
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	if atomic.AddInt64(&l.conns, -1) == 0 {
+		delete(g.limiters, key)
+	}
+}
+
+func (g *limiterGroup) stats() map[string]*LimiterStats {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	stats := make(map[string]*LimiterStats, len(g.limiters))
+	for key, l := range g.limiters {
+		stats[key] = l.stats()
+	}
+	return stats
+}
@@ -0,0 +1,171 @@
+package throttle
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testRate  = 100 * 1024
+	testBurst = 10 * 1024
+	testSize  = 60 * 1024
+)
+
+// startServer starts a throttled server that writes testSize bytes to each
+// client once it has sent a byte, and reads everything they send.
+func startServer(t *testing.T, throttle *Throttle) (net.Listener, chan net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return nil, nil
+	}
+	tl := throttle.Listener(l)
+	conns := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := tl.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+			go func() {
+				if _, err := conn.Read(make([]byte, 1)); err != nil {
+					conn.Close()
+					return
+				}
+				conn.Write(make([]byte, testSize))
+				io.Copy(ioutil.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return tl, conns
+}
+
+func download(t *testing.T, addr string) time.Duration {
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return 0
+	}
+	defer conn.Close()
+	start := time.Now()
+	conn.Write([]byte{0})
+	_, err = io.ReadFull(conn, make([]byte, testSize))
+	assert.NoError(t, err)
+	return time.Since(start)
+}
+
+func TestPerClient(t *testing.T) {
+	throttle := New(&Opts{PerClient: &Limits{BytesPerSecond: testRate, Burst: testBurst}})
+	l, _ := startServer(t, throttle)
+	if l == nil {
+		return
+	}
+	defer l.Close()
+
+	elapsed := download(t, l.Addr().String())
+	expected := time.Duration(float64(testSize-testBurst) / testRate * float64(time.Second))
+	assert.True(t, elapsed >= expected*8/10, "download should have been throttled, took %v", elapsed)
+	assert.True(t, elapsed < expected*3, "download was throttled too much, took %v", elapsed)
+
+	// Clients are forgotten once their connections close
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, throttle.Stats().Clients)
+}
+
+func TestGlobalAndStats(t *testing.T) {
+	throttle := New(&Opts{Global: &Limits{BytesPerSecond: testRate, Burst: testBurst}})
+	l, _ := startServer(t, throttle)
+	if l == nil {
+		return
+	}
+	defer l.Close()
+
+	// Two concurrent clients share the global limit
+	start := time.Now()
+	done := make(chan bool)
+	for i := 0; i < 2; i++ {
+		go func() {
+			download(t, l.Addr().String())
+			done <- true
+		}()
+	}
+	<-done
+	<-done
+	elapsed := time.Since(start)
+	expected := time.Duration(float64(2*testSize-testBurst) / testRate * float64(time.Second))
+	assert.True(t, elapsed >= expected*8/10, "downloads should have shared global limit, took %v", elapsed)
+
+	stats := throttle.Stats()
+	if assert.NotNil(t, stats.Global) {
+		assert.EqualValues(t, 2*testSize, stats.Global.BytesSent)
+		assert.True(t, stats.Global.Throttled > 0)
+	}
+	assert.Empty(t, stats.Clients)
+
+	rec := httptest.NewRecorder()
+	throttle.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/throttle", nil))
+	assert.True(t, strings.Contains(rec.Body.String(), `"bytesSent":`), rec.Body.String())
+}
+
+func TestPerUser(t *testing.T) {
+	throttle := New(&Opts{PerUser: &Limits{BytesPerSecond: testRate, Burst: testBurst}})
+	l, conns := startServer(t, throttle)
+	if l == nil {
+		return
+	}
+	defer l.Close()
+
+	// Unauthenticated clients aren't throttled
+	elapsed := download(t, l.Addr().String())
+	assert.True(t, elapsed < 200*time.Millisecond, "unauthenticated download shouldn't be throttled, took %v", elapsed)
+	<-conns
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	serverConn := <-conns
+	serverConn.(*throttledConn).ControlMessage(controlMessageUser, "alice")
+	start := time.Now()
+	conn.Write([]byte{0})
+	io.ReadFull(conn, make([]byte, testSize))
+	elapsed = time.Since(start)
+	assert.True(t, elapsed >= 300*time.Millisecond, "user should have been throttled, took %v", elapsed)
+
+	stats := throttle.Stats()
+	if assert.Contains(t, stats.Users, "alice") {
+		assert.Equal(t, 1, stats.Users["alice"].Conns)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	throttle := New(&Opts{PerClient: &Limits{BytesPerSecond: testRate, Burst: testBurst}})
+	l, _ := startServer(t, throttle)
+	if l == nil {
+		return
+	}
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	go io.Copy(ioutil.Discard, conn)
+	// Upload more than the socket buffers can absorb so that we see the
+	// throttling on the client side
+	start := time.Now()
+	payload := make([]byte, 4*1024*1024)
+	conn.SetWriteDeadline(time.Now().Add(500 * time.Millisecond))
+	n, _ := conn.Write(payload)
+	conn.Close()
+	assert.True(t, n < len(payload), "upload should have been throttled, wrote %d in %v", n, time.Since(start))
+}
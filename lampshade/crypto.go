@@ -3,13 +3,18 @@ package lampshade
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdh"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"fmt"
+	"io"
+	"math/big"
+	"time"
 
 	"github.com/Yawning/chacha20"
 	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
 )
 
 // Cipher specifies a stream cipher
@@ -267,7 +272,7 @@ func nonceGenerator(iv []byte) func() []byte {
 	}
 }
 
-func buildClientInitMsg(serverPublicKey *rsa.PublicKey, windowSize int, maxPadding int, cs *cryptoSpec) ([]byte, error) {
+func buildClientInitMsg(serverPublicKey *rsa.PublicKey, windowSize int, maxPadding int, cs *cryptoSpec, ts time.Time) ([]byte, error) {
 	var plainText []byte
 	_windowSize := make([]byte, winSize)
 	binaryEncoding.PutUint32(_windowSize, uint32(windowSize))
@@ -279,6 +284,7 @@ func buildClientInitMsg(serverPublicKey *rsa.PublicKey, windowSize int, maxPaddi
 	plainText = append(plainText, cs.dataSendIV...)
 	plainText = append(plainText, cs.metaRecvIV...)
 	plainText = append(plainText, cs.dataRecvIV...)
+	plainText = appendTimestamp(plainText, ts)
 	cipherText, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, serverPublicKey, plainText, nil)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to encrypt init msg: %v", err)
@@ -287,9 +293,25 @@ func buildClientInitMsg(serverPublicKey *rsa.PublicKey, windowSize int, maxPaddi
 }
 
 func decodeClientInitMsg(serverPrivateKey *rsa.PrivateKey, msg []byte) (windowSize int, maxPadding int, cs *cryptoSpec, err error) {
+	pt, err := decryptClientInitMsg(serverPrivateKey, msg)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return parseClientInitMsg(pt)
+}
+
+func decryptClientInitMsg(serverPrivateKey *rsa.PrivateKey, msg []byte) ([]byte, error) {
 	pt, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, serverPrivateKey, msg, nil)
 	if err != nil {
-		return 0, 0, nil, fmt.Errorf("Unable to decrypt init message: %v", err)
+		return nil, fmt.Errorf("Unable to decrypt init message: %v", err)
+	}
+	return pt, nil
+}
+
+// parseClientInitMsg parses the decrypted version 1 client init message pt.
+func parseClientInitMsg(pt []byte) (windowSize int, maxPadding int, cs *cryptoSpec, err error) {
+	if len(pt) < winSize+2 {
+		return 0, 0, nil, fmt.Errorf("Init message too short")
 	}
 	_windowSize, pt := consume(pt, winSize)
 	windowSize = int(binaryEncoding.Uint32(_windowSize))
@@ -302,6 +324,9 @@ func decodeClientInitMsg(serverPrivateKey *rsa.PrivateKey, msg []byte) (windowSi
 		return 0, 0, nil, fmt.Errorf("Unknown cipher code: %d", cs.cipherCode)
 	}
 	ivSize := cs.cipherCode.ivSize()
+	if len(pt) < maxSecretSize+2*metaIVSize+2*ivSize {
+		return 0, 0, nil, fmt.Errorf("Init message too short")
+	}
 	cs.secret, pt = consume(pt, maxSecretSize)
 	cs.metaSendIV, pt = consume(pt, metaIVSize)
 	cs.dataSendIV, pt = consume(pt, ivSize)
@@ -310,6 +335,243 @@ func decodeClientInitMsg(serverPrivateKey *rsa.PrivateKey, msg []byte) (windowSi
 	return
 }
 
+// isClientInitMsgV2 checks whether the decrypted client init message pt is
+// for protocol version 2. Version 1 messages don't have a version field, but
+// they're never as long as version 2 ones.
+func isClientInitMsgV2(pt []byte) bool {
+	return len(pt) == clientInitV2Size && pt[0] == ProtocolVersion2
+}
+
+// clientInitTimestamp returns the timestamp of the decrypted client init
+// message pt, if it has one.
+func clientInitTimestamp(pt []byte) (time.Time, bool) {
+	if isClientInitMsgV2(pt) {
+		return time.Unix(int64(binaryEncoding.Uint32(pt[versionSize:])), 0), true
+	}
+	if len(pt) < winSize+2 {
+		return time.Time{}, false
+	}
+	cipherCode := Cipher(pt[winSize+1])
+	if !cipherCode.valid() || len(pt) != winSize+2+maxSecretSize+2*metaIVSize+2*cipherCode.ivSize()+initTSSize {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(binaryEncoding.Uint32(pt[len(pt)-initTSSize:])), 0), true
+}
+
+func appendTimestamp(b []byte, ts time.Time) []byte {
+	_ts := make([]byte, initTSSize)
+	binaryEncoding.PutUint32(_ts, uint32(ts.Unix()))
+	return append(b, _ts...)
+}
+
+// clientHandshakeV2 is the client's half of a version 2 key exchange.
+type clientHandshakeV2 struct {
+	cipherCode Cipher
+	privateKey *ecdh.PrivateKey
+	initSecret []byte
+	padLen     int
+}
+
+func newClientHandshakeV2(cipherCode Cipher, maxPadding int) (*clientHandshakeV2, error) {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate ephemeral key: %v", err)
+	}
+	initSecret, err := newSecret()
+	if err != nil {
+		return nil, err
+	}
+	padLen, err := randomPadLen(maxPadding)
+	if err != nil {
+		return nil, err
+	}
+	return &clientHandshakeV2{cipherCode, privateKey, initSecret, padLen}, nil
+}
+
+// buildClientInitMsgV2 builds the version 2 client init message, followed by
+// random padding.
+func buildClientInitMsgV2(serverPublicKey *rsa.PublicKey, windowSize int, maxPadding int, hs *clientHandshakeV2, ts time.Time) ([]byte, error) {
+	plainText := make([]byte, 0, clientInitV2Size)
+	plainText = append(plainText, ProtocolVersion2)
+	plainText = appendTimestamp(plainText, ts)
+	plainText = append(plainText, make([]byte, v2ReservedSize)...)
+	_windowSize := make([]byte, winSize)
+	binaryEncoding.PutUint32(_windowSize, uint32(windowSize))
+	plainText = append(plainText, _windowSize...)
+	plainText = append(plainText, byte(maxPadding))
+	plainText = append(plainText, byte(hs.cipherCode))
+	_padLen := make([]byte, padLenSize)
+	binaryEncoding.PutUint16(_padLen, uint16(hs.padLen))
+	plainText = append(plainText, _padLen...)
+	plainText = append(plainText, hs.privateKey.PublicKey().Bytes()...)
+	plainText = append(plainText, hs.initSecret...)
+	cipherText, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, serverPublicKey, plainText, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to encrypt init msg: %v", err)
+	}
+	padding, err := newIV(hs.padLen)
+	if err != nil {
+		return nil, err
+	}
+	return append(cipherText, padding...), nil
+}
+
+// readServerHello reads the server's ephemeral key from r and derives the
+// session's cryptoSpec.
+func (hs *clientHandshakeV2) readServerHello(r io.Reader) (*cryptoSpec, error) {
+	hello := make([]byte, serverHelloSize)
+	if _, err := io.ReadFull(r, hello); err != nil {
+		return nil, fmt.Errorf("Unable to read server hello: %v", err)
+	}
+	clientKey := hs.privateKey.PublicKey().Bytes()
+	aead, err := helloAEAD(hs.initSecret)
+	if err != nil {
+		return nil, err
+	}
+	pt, err := aead.Open(hello[:0], make([]byte, aead.NonceSize()), hello, clientKey)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to authenticate server hello: %v", err)
+	}
+	serverKey, pt := consume(pt, x25519KeySize)
+	padLen := int(binaryEncoding.Uint16(pt))
+	if _, err := io.CopyN(io.Discard, r, int64(padLen)); err != nil {
+		return nil, fmt.Errorf("Unable to read server hello padding: %v", err)
+	}
+	peerKey, err := ecdh.X25519().NewPublicKey(serverKey)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid server ephemeral key: %v", err)
+	}
+	shared, err := hs.privateKey.ECDH(peerKey)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to agree on shared secret: %v", err)
+	}
+	return deriveCryptoSpecV2(hs.cipherCode, shared, hs.initSecret, clientKey, serverKey)
+}
+
+// serverHandshakeV2 is the server's half of a version 2 key exchange, decoded
+// from the client init message.
+type serverHandshakeV2 struct {
+	windowSize int
+	maxPadding int
+	cipherCode Cipher
+	clientKey  []byte
+	initSecret []byte
+	padLen     int
+}
+
+func decodeClientInitMsgV2(pt []byte) (*serverHandshakeV2, error) {
+	hs := &serverHandshakeV2{}
+	_, pt = consume(pt, versionSize+initTSSize+v2ReservedSize)
+	_windowSize, pt := consume(pt, winSize)
+	hs.windowSize = int(binaryEncoding.Uint32(_windowSize))
+	_maxPadding, pt := consume(pt, 1)
+	hs.maxPadding = int(_maxPadding[0])
+	_cipherCode, pt := consume(pt, 1)
+	hs.cipherCode = Cipher(_cipherCode[0])
+	if !hs.cipherCode.valid() {
+		return nil, fmt.Errorf("Unknown cipher code: %d", hs.cipherCode)
+	}
+	_padLen, pt := consume(pt, padLenSize)
+	hs.padLen = int(binaryEncoding.Uint16(_padLen))
+	hs.clientKey, pt = consume(pt, x25519KeySize)
+	hs.initSecret, _ = consume(pt, maxSecretSize)
+	return hs, nil
+}
+
+// respond reads the rest of the client's init padding from conn, sends the
+// server hello and derives the session's cryptoSpec (from the client's
+// perspective).
+func (hs *serverHandshakeV2) respond(conn io.ReadWriter) (*cryptoSpec, error) {
+	if _, err := io.CopyN(io.Discard, conn, int64(hs.padLen)); err != nil {
+		return nil, fmt.Errorf("Unable to read client init padding: %v", err)
+	}
+	peerKey, err := ecdh.X25519().NewPublicKey(hs.clientKey)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid client ephemeral key: %v", err)
+	}
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate ephemeral key: %v", err)
+	}
+	shared, err := privateKey.ECDH(peerKey)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to agree on shared secret: %v", err)
+	}
+	serverKey := privateKey.PublicKey().Bytes()
+	cs, err := deriveCryptoSpecV2(hs.cipherCode, shared, hs.initSecret, hs.clientKey, serverKey)
+	if err != nil {
+		return nil, err
+	}
+
+	padLen, err := randomPadLen(hs.maxPadding)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := helloAEAD(hs.initSecret)
+	if err != nil {
+		return nil, err
+	}
+	pt := make([]byte, 0, serverHelloSize+padLen)
+	pt = append(pt, serverKey...)
+	_padLen := make([]byte, padLenSize)
+	binaryEncoding.PutUint16(_padLen, uint16(padLen))
+	pt = append(pt, _padLen...)
+	hello := aead.Seal(pt[:0], make([]byte, aead.NonceSize()), pt, hs.clientKey)
+	padding, err := newIV(padLen)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(hello, padding...)); err != nil {
+		return nil, fmt.Errorf("Unable to send server hello: %v", err)
+	}
+	return cs, nil
+}
+
+// helloAEAD builds the AEAD that protects the server hello. Its key is only
+// ever used once, so the nonce is always zero.
+func helloAEAD(initSecret []byte) (cipher.AEAD, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, initSecret, nil, []byte("lampshade v2 hello")), key); err != nil {
+		return nil, fmt.Errorf("Unable to derive hello key: %v", err)
+	}
+	return chacha20poly1305.New(key)
+}
+
+// deriveCryptoSpecV2 derives the session's secret and initialization vectors
+// (from the client's perspective) from the ephemeral shared secret, bound to
+// the init secret and both ephemeral keys.
+func deriveCryptoSpecV2(cipherCode Cipher, shared []byte, initSecret []byte, clientKey []byte, serverKey []byte) (*cryptoSpec, error) {
+	info := append([]byte("lampshade v2 session"), clientKey...)
+	info = append(info, serverKey...)
+	kdf := hkdf.New(sha256.New, shared, initSecret, info)
+	ivSize := cipherCode.ivSize()
+	cs := &cryptoSpec{
+		cipherCode: cipherCode,
+		secret:     make([]byte, maxSecretSize),
+		metaSendIV: make([]byte, metaIVSize),
+		dataSendIV: make([]byte, ivSize),
+		metaRecvIV: make([]byte, metaIVSize),
+		dataRecvIV: make([]byte, ivSize),
+	}
+	for _, b := range [][]byte{cs.secret, cs.metaSendIV, cs.dataSendIV, cs.metaRecvIV, cs.dataRecvIV} {
+		if _, err := io.ReadFull(kdf, b); err != nil {
+			return nil, fmt.Errorf("Unable to derive session keys: %v", err)
+		}
+	}
+	return cs, nil
+}
+
+func randomPadLen(maxPadding int) (int, error) {
+	if maxPadding <= 0 {
+		return 0, nil
+	}
+	l, err := rand.Int(rand.Reader, big.NewInt(int64(maxPadding)))
+	if err != nil {
+		return 0, fmt.Errorf("Unable to choose padding length: %v", err)
+	}
+	return int(l.Int64()), nil
+}
+
 func consume(b []byte, length int) ([]byte, []byte) {
 	return b[:length], b[length:]
 }
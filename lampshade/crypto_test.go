@@ -5,7 +5,9 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/Yawning/chacha20"
 	"github.com/getlantern/keyman"
@@ -46,7 +48,7 @@ func doTestInit(t *testing.T, cipherCode Cipher) {
 		return
 	}
 
-	msg, err := buildClientInitMsg(publicKey, windowSize, maxPadding, cs)
+	msg, err := buildClientInitMsg(publicKey, windowSize, maxPadding, cs, time.Now())
 	if !assert.NoError(t, err) {
 		return
 	}
@@ -65,6 +67,104 @@ func doTestInit(t *testing.T, cipherCode Cipher) {
 	assert.EqualValues(t, cs.dataRecvIV, _cs.dataRecvIV)
 }
 
+func TestInitV2(t *testing.T) {
+	privateKey, publicKey, _, err := initCrypto(ChaCha20Poly1305)
+	if !assert.NoError(t, err) {
+		return
+	}
+	hs, err := newClientHandshakeV2(ChaCha20Poly1305, maxPadding)
+	if !assert.NoError(t, err) {
+		return
+	}
+	msg, err := buildClientInitMsgV2(publicKey, windowSize, maxPadding, hs, time.Now())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, clientInitSize+hs.padLen, len(msg), "init message should be followed by padding")
+
+	pt, err := decryptClientInitMsg(privateKey, msg[:clientInitSize])
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.True(t, isClientInitMsgV2(pt)) {
+		return
+	}
+	serverHS, err := decodeClientInitMsgV2(pt)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, windowSize, serverHS.windowSize)
+	assert.Equal(t, maxPadding, serverHS.maxPadding)
+	assert.Equal(t, Cipher(ChaCha20Poly1305), serverHS.cipherCode)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write(msg[clientInitSize:])
+	serverCS := make(chan *cryptoSpec, 1)
+	go func() {
+		cs, err := serverHS.respond(server)
+		assert.NoError(t, err)
+		serverCS <- cs
+	}()
+	clientCS, err := hs.readServerHello(client)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, clientCS, <-serverCS, "both ends should derive the same secrets")
+	assert.NotEqual(t, hs.initSecret, clientCS.secret, "session secret should come from the key exchange")
+
+	// A hello from someone who doesn't know the init secret is rejected
+	impostor := *serverHS
+	impostor.initSecret = make([]byte, maxSecretSize)
+	impostor.padLen = 0
+	go impostor.respond(server)
+	_, err = hs.readServerHello(client)
+	assert.Error(t, err)
+}
+
+func TestInitVersionDetection(t *testing.T) {
+	privateKey, publicKey, _, err := initCrypto(AES128GCM)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, cipherCode := range []Cipher{NoEncryption, AES128GCM, ChaCha20Poly1305} {
+		cs, err := newCryptoSpec(cipherCode)
+		if !assert.NoError(t, err) {
+			return
+		}
+		// A window whose first byte looks like version 2
+		msg, err := buildClientInitMsg(publicKey, 2<<24, maxPadding, cs, time.Now())
+		if !assert.NoError(t, err) {
+			return
+		}
+		pt, err := decryptClientInitMsg(privateKey, msg)
+		if assert.NoError(t, err) {
+			assert.False(t, isClientInitMsgV2(pt), "version 1 message shouldn't look like version 2")
+			ts, ok := clientInitTimestamp(pt)
+			assert.True(t, ok, cipherCode)
+			assert.WithinDuration(t, time.Now(), ts, 2*time.Second, cipherCode)
+			_, ok = clientInitTimestamp(pt[:len(pt)-initTSSize])
+			assert.False(t, ok, "messages from older clients don't have a timestamp")
+		}
+	}
+
+	// Servers that only understand version 1 reject version 2 messages
+	hs, _ := newClientHandshakeV2(AES128GCM, 0)
+	msg, err := buildClientInitMsgV2(publicKey, windowSize, 0, hs, time.Now())
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, _, _, err = decodeClientInitMsg(privateKey, msg)
+	assert.Error(t, err)
+	pt, err := decryptClientInitMsg(privateKey, msg)
+	if assert.NoError(t, err) {
+		ts, ok := clientInitTimestamp(pt)
+		assert.True(t, ok)
+		assert.WithinDuration(t, time.Now(), ts, 2*time.Second)
+	}
+}
+
 func TestCryptoPrototypeNoEncryption(t *testing.T) {
 	doTestCryptoPrototype(t, NoEncryption)
 }
@@ -35,6 +35,15 @@ type DialerOpts struct {
 
 	// ServerPublicKey - if provided, this dialer will use encryption.
 	ServerPublicKey *rsa.PublicKey
+
+	// ProtocolVersion - ProtocolVersion1 (the default) or ProtocolVersion2,
+	//                   which provides forward secrecy but requires a server
+	//                   that supports it.
+	ProtocolVersion int
+
+	// DefaultPriority - the Priority of streams opened with Dial and
+	//                   DialStream. If invalid, defaults to PriorityNormal.
+	DefaultPriority Priority
 }
 
 // NewDialer wraps the given dial function with support for multiplexing. The
@@ -53,12 +62,19 @@ func NewDialer(opts *DialerOpts) Dialer {
 	if opts.MaxStreamsPerConn <= 0 || opts.MaxStreamsPerConn > maxID {
 		opts.MaxStreamsPerConn = maxID
 	}
-	log.Debugf("Initializing Dialer with   windowSize: %v   maxPadding: %v   maxStreamsPerConn: %v   pingInterval: %v   cipher: %v",
+	if opts.ProtocolVersion != ProtocolVersion2 {
+		opts.ProtocolVersion = ProtocolVersion1
+	}
+	if !opts.DefaultPriority.valid() {
+		opts.DefaultPriority = PriorityNormal
+	}
+	log.Debugf("Initializing Dialer with   windowSize: %v   maxPadding: %v   maxStreamsPerConn: %v   pingInterval: %v   cipher: %v   version: %v",
 		opts.WindowSize,
 		opts.MaxPadding,
 		opts.MaxStreamsPerConn,
 		opts.PingInterval,
-		opts.Cipher)
+		opts.Cipher,
+		opts.ProtocolVersion)
 	return &dialer{
 		windowSize:       opts.WindowSize,
 		maxPadding:       opts.MaxPadding,
@@ -68,6 +84,9 @@ func NewDialer(opts *DialerOpts) Dialer {
 		pool:             opts.Pool,
 		cipherCode:       opts.Cipher,
 		serverPublicKey:  opts.ServerPublicKey,
+		version:          opts.ProtocolVersion,
+		defaultPriority:  opts.DefaultPriority,
+		sessions:         make(map[*session]bool),
 	}
 }
 
@@ -80,7 +99,10 @@ type dialer struct {
 	pool             BufferPool
 	cipherCode       Cipher
 	serverPublicKey  *rsa.PublicKey
+	version          int
+	defaultPriority  Priority
 	current          *session
+	sessions         map[*session]bool
 	lastDialed       time.Time
 	id               uint16
 	mx               sync.Mutex
@@ -91,6 +113,10 @@ func (d *dialer) Dial(dial DialFN) (net.Conn, error) {
 }
 
 func (d *dialer) DialStream(dial DialFN) (Stream, error) {
+	return d.DialStreamWithPriority(dial, d.defaultPriority)
+}
+
+func (d *dialer) DialStreamWithPriority(dial DialFN, priority Priority) (Stream, error) {
 	d.mx.Lock()
 	current := d.current
 	idsExhausted := false
@@ -123,6 +149,7 @@ func (d *dialer) DialStream(dial DialFN) (Stream, error) {
 	d.mx.Unlock()
 
 	c, _ := current.getOrCreateStream(id)
+	c.SetPriority(priority)
 	return c, nil
 }
 
@@ -143,21 +170,60 @@ func (d *dialer) startSession(dial DialFN) (*session, error) {
 		return nil, err
 	}
 
+	if d.version == ProtocolVersion2 {
+		return d.startSessionV2(conn)
+	}
+
 	cs, err := newCryptoSpec(d.cipherCode)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to create crypto spec for %v: %v", d.cipherCode, err)
 	}
 
 	// Generate the client init message
-	clientInitMsg, err := buildClientInitMsg(d.serverPublicKey, d.windowSize, d.maxPadding, cs)
+	clientInitMsg, err := buildClientInitMsg(d.serverPublicKey, d.windowSize, d.maxPadding, cs, time.Now())
 	if err != nil {
 		return nil, fmt.Errorf("Unable to generate client init message: %v", err)
 	}
 
-	d.current, err = startSession(conn, d.windowSize, d.maxPadding, d.pingInterval, cs, clientInitMsg, d.pool, nil, d.sessionClosed)
+	d.current, err = startSession(conn, d.windowSize, d.maxPadding, d.pingInterval, cs, clientInitMsg, nil, d.pool, nil, d.sessionClosed, d.defaultPriority)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to start session: %v", err)
 	}
+	d.sessions[d.current] = true
+	return d.current, nil
+}
+
+// startSessionV2 starts a session whose secrets come from a key exchange with
+// the server. The exchange happens in the background, streams can be opened
+// right away.
+func (d *dialer) startSessionV2(conn net.Conn) (*session, error) {
+	hs, err := newClientHandshakeV2(d.cipherCode, d.maxPadding)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to start key exchange: %v", err)
+	}
+	clientInitMsg, err := buildClientInitMsgV2(d.serverPublicKey, d.windowSize, d.maxPadding, hs, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("Unable to generate client init message: %v", err)
+	}
+	handshake := func() (*cryptoSpec, error) {
+		if err := conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(clientInitMsg); err != nil {
+			return nil, fmt.Errorf("Unable to send client init message: %v", err)
+		}
+		cs, err := hs.readServerHello(conn)
+		if err != nil {
+			return nil, err
+		}
+		return cs, conn.SetDeadline(time.Time{})
+	}
+
+	d.current, err = startSession(conn, d.windowSize, d.maxPadding, d.pingInterval, nil, nil, handshake, d.pool, nil, d.sessionClosed, d.defaultPriority)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to start session: %v", err)
+	}
+	d.sessions[d.current] = true
 	return d.current, nil
 }
 
@@ -167,5 +233,16 @@ func (d *dialer) sessionClosed(s *session) {
 		log.Debug("Current session no longer usable, clearing")
 		d.current = nil
 	}
+	delete(d.sessions, s)
 	d.mx.Unlock()
 }
+
+func (d *dialer) Sessions() []Session {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	sessions := make([]Session, 0, len(d.sessions))
+	for s := range d.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
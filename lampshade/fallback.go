@@ -0,0 +1,128 @@
+package lampshade
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// Fallback handles connections that don't start a valid lampshade session, like
+// those from active probes. To make probing uninformative, a Fallback should
+// behave like whatever else might plausibly be listening on the same address.
+type Fallback interface {
+	// Handle takes over conn, which sent received before it was rejected, and
+	// closes it when done.
+	Handle(conn net.Conn, received []byte)
+}
+
+// FallbackFunc adapts a function to a Fallback.
+type FallbackFunc func(conn net.Conn, received []byte)
+
+// Handle implements the Fallback interface.
+func (fn FallbackFunc) Handle(conn net.Conn, received []byte) {
+	fn(conn, received)
+}
+
+// DiscardFallback reads and discards whatever the client sends without ever
+// responding, until the client gives up. This is the default.
+func DiscardFallback() Fallback {
+	return FallbackFunc(func(conn net.Conn, received []byte) {
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	})
+}
+
+// DelayedCloseFallback is like DiscardFallback, except that it closes
+// connections after a random delay between min and max, like a server that
+// times out idle clients.
+func DelayedCloseFallback(min, max time.Duration) Fallback {
+	return FallbackFunc(func(conn net.Conn, received []byte) {
+		delay := min
+		if max > min {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(max-min)))
+			if err == nil {
+				delay += time.Duration(n.Int64())
+			}
+		}
+		timer := time.AfterFunc(delay, func() {
+			conn.Close()
+		})
+		io.Copy(io.Discard, conn)
+		timer.Stop()
+		conn.Close()
+	})
+}
+
+// ProxyFallback transparently proxies connections to a decoy backend (like a
+// local web server) obtained from dial, replaying what the client already sent.
+// If dial fails, it falls back to DiscardFallback.
+func ProxyFallback(dial func() (net.Conn, error)) Fallback {
+	discard := DiscardFallback()
+	return FallbackFunc(func(conn net.Conn, received []byte) {
+		backend, err := dial()
+		if err != nil {
+			log.Debugf("Unable to dial fallback backend: %v", err)
+			discard.Handle(conn, received)
+			return
+		}
+		defer backend.Close()
+		if _, err := backend.Write(received); err != nil {
+			log.Debugf("Unable to write to fallback backend: %v", err)
+			conn.Close()
+			return
+		}
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			io.Copy(backend, conn)
+			closeWrite(backend)
+		}()
+		io.Copy(conn, backend)
+		// The backend is done, so close the client like it would have
+		conn.Close()
+		wg.Wait()
+	})
+}
+
+// ProxyFallbackTo is a ProxyFallback that dials the TCP address addr.
+func ProxyFallbackTo(addr string) Fallback {
+	return ProxyFallback(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", addr, handshakeTimeout)
+	})
+}
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("HEAD "), []byte("POST "), []byte("PUT "), []byte("DELETE "),
+	[]byte("CONNECT "), []byte("OPTIONS "), []byte("TRACE "), []byte("PATCH "), []byte("PRI "),
+}
+
+// plaintextProtocol returns the name of the protocol that received starts
+// with, if it's one that probes commonly use, or "" if it isn't or there isn't
+// enough to tell yet. Since client init msgs are encrypted, the chance that
+// one starts like this is negligible.
+func plaintextProtocol(received []byte) string {
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(received, method) {
+			return "HTTP request"
+		}
+	}
+	// TLS handshake record (version 3.x) with a ClientHello no longer than a
+	// record may be
+	if len(received) >= 6 && received[0] == 0x16 && received[1] == 0x03 && received[2] <= 0x04 && received[3] < 0x40 && received[5] == 0x01 {
+		return "TLS ClientHello"
+	}
+	return ""
+}
+
+// closeWrite signals EOF to the other end of conn if it supports half-closing,
+// so that backends still respond to clients that half-close.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
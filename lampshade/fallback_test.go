@@ -0,0 +1,182 @@
+package lampshade
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyFallback(t *testing.T) {
+	decoy := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("decoy " + req.URL.Path))
+	}))
+	defer decoy.Close()
+
+	l, pk, err := replayServer(&ListenerOpts{
+		Fallback: ProxyFallbackTo(decoy.Listener.Addr().String()),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	// Shorter than a client init msg, forwarded as soon as it's recognized
+	assertDecoyResponse(t, l.Addr().String(), "GET /short HTTP/1.1\r\nHost: example.com\r\n\r\n", "decoy /short")
+	// Longer than a client init msg, forwarded once it fails to decrypt
+	long := fmt.Sprintf("GET /long HTTP/1.1\r\nHost: example.com\r\nX-Padding: %v\r\n\r\n", strings.Repeat("a", clientInitSize))
+	assertDecoyResponse(t, l.Addr().String(), long, "decoy /long")
+
+	// Real clients are unaffected
+	dialer := NewDialer(&DialerOpts{
+		WindowSize:      windowSize,
+		Pool:            NewBufferPool(100),
+		Cipher:          AES128GCM,
+		ServerPublicKey: &pk.RSA().PublicKey,
+	})
+	conn, err := dialer.Dial(func() (net.Conn, error) {
+		return net.Dial("tcp", l.Addr().String())
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(testdata))
+	if !assert.NoError(t, err) {
+		return
+	}
+	b := make([]byte, len(testdata))
+	_, err = io.ReadFull(conn, b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, testdata, string(b))
+	}
+}
+
+func TestFallbackWithoutWaitingForInitTimeout(t *testing.T) {
+	type handoff struct {
+		received []byte
+		at       time.Time
+	}
+	handoffs := make(chan handoff, 1)
+	l, _, err := replayServer(&ListenerOpts{
+		Fallback: FallbackFunc(func(conn net.Conn, received []byte) {
+			handoffs <- handoff{append([]byte(nil), received...), time.Now()}
+			conn.Close()
+		}),
+		InitTimeout:     time.Minute,
+		InitIdleTimeout: 100 * time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	tlsHello := []byte{0x16, 0x03, 0x01, 0x02, 0x00, 0x01, 0x00, 0x01, 0xfc, 0x03, 0x03}
+	for _, probe := range [][]byte{
+		[]byte("GET / HTTP/1.1\r\n"),
+		[]byte("OPTIONS * HTTP/1.1\r\n\r\n"),
+		tlsHello,
+		largeData[:clientInitSize/2],
+	} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if !assert.NoError(t, err) {
+			return
+		}
+		start := time.Now()
+		_, err = conn.Write(probe)
+		if !assert.NoError(t, err) {
+			conn.Close()
+			return
+		}
+		select {
+		case h := <-handoffs:
+			assert.Equal(t, probe, h.received)
+			assert.True(t, h.at.Sub(start) < 2*time.Second, "handed off too late: %v", h.at.Sub(start))
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "probe not handed to fallback", "%q", probe)
+		}
+		conn.Close()
+	}
+}
+
+func TestPlaintextProtocol(t *testing.T) {
+	assert.Equal(t, "HTTP request", plaintextProtocol([]byte("GET /index.html")))
+	assert.Equal(t, "HTTP request", plaintextProtocol([]byte("CONNECT example.com:443 HTTP/1.1")))
+	assert.Equal(t, "TLS ClientHello", plaintextProtocol([]byte{0x16, 0x03, 0x03, 0x00, 0xc8, 0x01}))
+	assert.Equal(t, "", plaintextProtocol([]byte("GE")), "not enough to tell yet")
+	assert.Equal(t, "", plaintextProtocol([]byte{0x16, 0x03}), "not enough to tell yet")
+	assert.Equal(t, "", plaintextProtocol([]byte{0x16, 0x03, 0x03, 0x00, 0xc8, 0x02}), "not a ClientHello")
+	assert.Equal(t, "", plaintextProtocol(largeData[:clientInitSize]))
+}
+
+func TestProxyFallbackUnavailable(t *testing.T) {
+	l, _, err := replayServer(&ListenerOpts{
+		Fallback: ProxyFallback(func() (net.Conn, error) {
+			return nil, fmt.Errorf("unavailable")
+		}),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	assertIgnored(t, l.Addr().String(), largeData[:clientInitSize], "garbage with unavailable decoy")
+}
+
+func TestDelayedCloseFallback(t *testing.T) {
+	minDelay, maxDelay := 100*time.Millisecond, 200*time.Millisecond
+	l, _, err := replayServer(&ListenerOpts{
+		Fallback: DelayedCloseFallback(minDelay, maxDelay),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	start := time.Now()
+	_, err = conn.Write(largeData[:clientInitSize])
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(make([]byte, 1))
+	elapsed := time.Since(start)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+	assert.True(t, elapsed >= minDelay, "closed too soon: %v", elapsed)
+	assert.True(t, elapsed < maxDelay+time.Second, "closed too late: %v", elapsed)
+}
+
+func assertDecoyResponse(t *testing.T, addr string, req string, expected string) {
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(req))
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, expected, string(body))
+	}
+}
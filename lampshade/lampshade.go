@@ -69,13 +69,11 @@
 //   To initialize a session, the client sends the below, encrypted using
 //   RSA OAEP using the server's PK:
 //
-//     +---------+-----+---------+--------+--------+----------+----------+----------+----------+
-//     | Version | Win | Max Pad | Cipher | Secret | Send IV1 | Send IV2 | Recv IV1 | Recv IV2 |
-//     +---------+-----+---------+--------+--------+----------+----------+----------+----------+
-//     |    1    |  4  |    1    |    1   |   32   |    12    |    12    |    12    |    12    |
-//     +---------+-----+---------+--------+--------+----------+----------+----------+----------+
-//
-//       Version - the version of the protocol (currently 1)
+//     +-----+---------+--------+--------+----------+----------+----------+----------+----+
+//     | Win | Max Pad | Cipher | Secret | Send IV1 | Send IV2 | Recv IV1 | Recv IV2 | TS |
+//     +-----+---------+--------+--------+----------+----------+----------+----------+----+
+//     |  4  |    1    |    1   |   32   |    12    |    12    |    12    |    12    |  4 |
+//     +-----+---------+--------+--------+----------+----------+----------+----------+----+
 //
 //       Win        - transmit window size in # of frames
 //
@@ -97,6 +95,51 @@
 //                    decrypting the frame length and IV2 is used for decrypting
 //                    the data.
 //
+//       TS         - the time at which the message was built, in seconds since
+//                    the Unix epoch. Older clients don't send it.
+//
+// Client Init Message (version 2)
+//
+//   Version 1 sessions can be decrypted by anyone who records them and later
+//   obtains the server's private key. Version 2 derives the session secret
+//   from an ephemeral X25519 key exchange instead. The client sends the below,
+//   also encrypted using RSA OAEP with the server's PK to 256 bytes, followed
+//   by Pad Len random bytes:
+//
+//     +---------+----+----------+-----+---------+--------+---------+------------+-------------+
+//     | Version | TS | Reserved | Win | Max Pad | Cipher | Pad Len | Client Key | Init Secret |
+//     +---------+----+----------+-----+---------+--------+---------+------------+-------------+
+//     |    1    |  4 |     1    |  4  |    1    |    1   |    2    |     32     |     32      |
+//     +---------+----+----------+-----+---------+--------+---------+------------+-------------+
+//
+//       Version     - 2. Version 1 messages are never 78 bytes long, which
+//                     tells them apart.
+//
+//       TS          - same as in version 1
+//
+//       Reserved    - zero, which makes servers that only support version 1
+//                     reject the message for its unknown cipher
+//
+//       Client Key  - the client's ephemeral X25519 public key
+//
+//       Init Secret - 256 bits of secret used to authenticate the server hello
+//
+//   The server responds with its hello, encrypted with ChaCha20_poly1305 using
+//   a key derived from Init Secret via HKDF-SHA256, a zero nonce and Client
+//   Key as additional data, followed by Pad Len random bytes:
+//
+//     +------------+---------+-----+
+//     | Server Key | Pad Len | MAC |
+//     +------------+---------+-----+
+//     |     32     |    2    |  16 |
+//     +------------+---------+-----+
+//
+//   Only the holder of the server's private key can produce a valid hello,
+//   which authenticates the server. Both ends then derive the Secret and the
+//   Send and Recv IVs of version 1 from the X25519 shared secret using
+//   HKDF-SHA256, salted with Init Secret and bound to both ephemeral keys.
+//   The client doesn't send any frames until it has received the hello.
+//
 // Session Framing:
 //
 //   Where possible, lampshade coalesces multiple stream-level frames into a
@@ -127,6 +170,17 @@
 //   XOR'ed with a frame sequence number, similar AES128_GCM in TLS 1.3
 //   (see https://blog.cloudflare.com/tls-nonce-nse/).
 //
+// Replay Protection:
+//
+//   Listeners reject init messages whose TS is too far from their own clock
+//   and remember the init messages they've seen in a replay cache, rejecting
+//   duplicates, so that recorded init messages can't be replayed to find out
+//   whether a server speaks lampshade. Rejected connections (like connections
+//   whose init message doesn't decrypt) are handed to the listener's
+//   Fallback along with whatever they sent. By default, that reads from them
+//   until the client gives up, without ever sending anything, but it can also
+//   proxy them to a decoy backend like a web server (see ProxyFallback).
+//
 // Padding:
 //
 //   - used only when there weren't enough pending writes to coalesce
@@ -188,6 +242,15 @@
 //       to buffer, the server can adjust the window by sending an ACK with a
 //       negative value
 //
+// Prioritization:
+//
+//   Each end schedules the frames that its streams send using weighted fair
+//   queueing. Streams have a priority (bulk, normal or interactive) whose
+//   weight determines their share of the physical connection when streams
+//   compete for it, and streams that have just started sending go ahead of
+//   streams with a backlog. Priorities are local to each end and aren't sent
+//   over the wire.
+//
 // Ping Protocol:
 //
 //   Dialers can optionally be configured to use an embedded ping/echo protocol
@@ -203,6 +266,7 @@ package lampshade
 import (
 	"encoding/binary"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/getlantern/golog"
@@ -219,7 +283,23 @@ const (
 	maxSecretSize  = 32
 	metaIVSize     = 12
 
-	protocolVersion1 = 1
+	// ProtocolVersion1 initializes sessions with secrets chosen by the client
+	// and encrypted with the server's RSA key.
+	ProtocolVersion1 = 1
+	// ProtocolVersion2 derives session secrets from an ephemeral X25519 key
+	// exchange, so that recorded sessions can't be decrypted even if the
+	// server's RSA key is compromised later.
+	ProtocolVersion2 = 2
+
+	// version 2 key exchange
+	initTSSize       = 4
+	v2ReservedSize   = 1
+	padLenSize       = 2
+	x25519KeySize    = 32
+	helloMACSize     = 16
+	clientInitV2Size = versionSize + initTSSize + v2ReservedSize + winSize + 1 + 1 + padLenSize + x25519KeySize + maxSecretSize
+	serverHelloSize  = x25519KeySize + padLenSize + helloMACSize
+	handshakeTimeout = 30 * time.Second
 
 	// NoEncryption is no encryption
 	NoEncryption = 1
@@ -295,6 +375,25 @@ type StatsTracking interface {
 	EMARTT() time.Duration
 }
 
+// GlobalStats are counts of the sessions and streams in this process, across
+// all Dialers and Listeners.
+type GlobalStats struct {
+	OpenSessions    int64
+	ClosingSessions int64
+	ClosedSessions  int64
+	OpenStreams     int64
+}
+
+// GetGlobalStats gets a snapshot of the current GlobalStats.
+func GetGlobalStats() *GlobalStats {
+	return &GlobalStats{
+		OpenSessions:    atomic.LoadInt64(&openSessions),
+		ClosingSessions: atomic.LoadInt64(&closingSessions),
+		ClosedSessions:  atomic.LoadInt64(&closedSessions),
+		OpenStreams:     atomic.LoadInt64(&openStreams),
+	}
+}
+
 // DialFN is a function that dials the server
 type DialFN func() (net.Conn, error)
 
@@ -305,6 +404,23 @@ type Dialer interface {
 	Dial(dial DialFN) (net.Conn, error)
 
 	DialStream(dial DialFN) (Stream, error)
+
+	// DialStreamWithPriority() is like DialStream, but with the given priority
+	// instead of the Dialer's default.
+	DialStreamWithPriority(dial DialFN, priority Priority) (Stream, error)
+
+	// Sessions() lists the live sessions started by this Dialer, including
+	// ones that are no longer used for new streams but still have open
+	// streams.
+	Sessions() []Session
+}
+
+// Listener is a net.Listener that accepts multiplexed streams.
+type Listener interface {
+	net.Listener
+
+	// Sessions() lists the live sessions accepted by this Listener.
+	Sessions() []Session
 }
 
 // Session is a wrapper around a net.Conn that supports multiplexing.
@@ -314,6 +430,10 @@ type Session interface {
 
 	// Wrapped() exposes access to the net.Conn that's wrapped by this Session.
 	Wrapped() net.Conn
+
+	// Stats() gets a snapshot of the traffic on this Session and its open
+	// streams.
+	Stats() *SessionStats
 }
 
 // Stream is a net.Conn that also exposes access to the underlying Session
@@ -326,6 +446,16 @@ type Stream interface {
 	// Wrapped() exposes the wrapped connection (same thing as Session(), but
 	// implements netx.WrappedConn interface)
 	Wrapped() net.Conn
+
+	// Stats() gets a snapshot of the traffic on this Stream.
+	Stats() *StreamStats
+
+	// SetPriority() changes the priority of data written to this Stream from
+	// now on. Invalid priorities are ignored.
+	SetPriority(priority Priority)
+
+	// Priority() gets the Stream's current priority.
+	Priority() Priority
 }
 
 // BufferPool is a pool of reusable buffers
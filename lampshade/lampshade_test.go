@@ -7,6 +7,7 @@ import (
 	"net"
 	"os"
 	"runtime/pprof"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -120,6 +121,123 @@ func TestStreamCloseRemoteAfterEcho(t *testing.T) {
 	wg.Wait()
 }
 
+func TestGlobalStats(t *testing.T) {
+	l, _, dial, _, err := echoServerAndDialer(0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	before := GetGlobalStats()
+	conn, err := dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Write([]byte("hi"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	b := make([]byte, 2)
+	_, err = io.ReadFull(conn, b)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	during := GetGlobalStats()
+	assert.Equal(t, before.OpenSessions+2, during.OpenSessions, "client and server sessions should be open")
+	assert.Equal(t, before.OpenStreams+2, during.OpenStreams, "client and server streams should be open")
+
+	conn.Close()
+	time.Sleep(250 * time.Millisecond)
+	assert.Equal(t, before.OpenStreams, GetGlobalStats().OpenStreams, "streams should be closed on both ends")
+}
+
+func TestSessionStats(t *testing.T) {
+	l, dialer, dial, _, err := echoServerAndDialer(0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	conns := make([]net.Conn, 2)
+	for i := range conns {
+		conn, err := dial()
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+	for i := 0; i < 10; i++ {
+		for _, conn := range conns {
+			_, err = conn.Write([]byte(testdata))
+			if !assert.NoError(t, err) {
+				return
+			}
+			b := make([]byte, len(testdata))
+			_, err = io.ReadFull(conn, b)
+			if !assert.NoError(t, err) {
+				return
+			}
+		}
+	}
+	expectedBytes := int64(10 * len(testdata))
+
+	sessions := dialer.Sessions()
+	if !assert.Len(t, sessions, 1) {
+		return
+	}
+	stats := sessions[0].Stats()
+	assert.Equal(t, conns[0].LocalAddr(), stats.LocalAddr)
+	assert.True(t, stats.Writes > 0)
+	assert.True(t, stats.BytesSent > 2*expectedBytes, "bytes sent should include overhead")
+	assert.True(t, stats.BytesRecv > 2*expectedBytes, "bytes received should include overhead")
+	assert.True(t, stats.ACKsRecv > 0)
+	assert.True(t, stats.ACKsSent > 0)
+	assert.True(t, stats.ACKLatency > 0)
+	if assert.Len(t, stats.Streams, 2) {
+		sort.Slice(stats.Streams, func(i, j int) bool { return stats.Streams[i].ID < stats.Streams[j].ID })
+		var framesSent int64
+		for i, ss := range stats.Streams {
+			assert.EqualValues(t, i, ss.ID)
+			assert.Equal(t, expectedBytes, ss.BytesSent)
+			assert.Equal(t, expectedBytes, ss.BytesRecv)
+			assert.True(t, ss.FramesSent >= 10)
+			assert.True(t, ss.FramesRecv >= 10)
+			assert.Equal(t, windowSize, ss.SendWindow, "everything sent should have been ACK'ed")
+			assert.Equal(t, windowSize, ss.RecvWindow, "everything received should have been ACK'ed")
+			assert.True(t, ss.ACKsRecv > 0)
+			assert.True(t, ss.ACKsSent > 0)
+			assert.True(t, ss.ACKLatency > 0)
+			framesSent += ss.FramesSent
+		}
+		assert.True(t, stats.FramesSent >= framesSent+stats.ACKsSent)
+	}
+	assert.Equal(t, stats.Streams[0], conns[0].(Stream).Stats())
+
+	serverSessions := l.(Listener).Sessions()
+	if !assert.Len(t, serverSessions, 1) {
+		return
+	}
+	serverStats := serverSessions[0].Stats()
+	assert.Equal(t, stats.BytesSent, serverStats.BytesRecv+clientInitSize, "server should have received everything the client sent")
+	assert.Len(t, serverStats.Streams, 2)
+
+	conns[0].Close()
+	time.Sleep(250 * time.Millisecond)
+	stats = sessions[0].Stats()
+	assert.EqualValues(t, 1, stats.RSTsSent)
+	assert.Len(t, stats.Streams, 1)
+	serverStats = serverSessions[0].Stats()
+	assert.EqualValues(t, 1, serverStats.RSTsRecv)
+	assert.Len(t, serverStats.Streams, 1)
+
+	sessions[0].Close()
+	assert.Empty(t, dialer.Sessions())
+	time.Sleep(250 * time.Millisecond)
+	assert.Empty(t, l.(Listener).Sessions())
+}
+
 func TestPhysicalConnCloseRemotePrematurely(t *testing.T) {
 	l, _, dial, _, err := echoServerAndDialer(0)
 	if !assert.NoError(t, err) {
@@ -301,7 +419,49 @@ func doTestConnBasicFlow(t *testing.T) {
 	assert.True(t, dialer.EMARTT() > 0)
 }
 
+func TestConnMultiplexV2(t *testing.T) {
+	l, v2Dialer, dial, wg, err := echoServerAndDialerWithVersion(0, ProtocolVersion2)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	// Both versions are served by the same listener
+	v1Dialer := NewDialer(&DialerOpts{
+		WindowSize:      windowSize,
+		Pool:            NewBufferPool(100),
+		Cipher:          ChaCha20Poly1305,
+		ServerPublicKey: v2Dialer.(*dialer).serverPublicKey})
+	doDial := func() (net.Conn, error) {
+		return tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	}
+	for _, dial := range []DialFN{dial, dial, func() (net.Conn, error) { return v1Dialer.Dial(doDial) }} {
+		conn, err := dial()
+		if !assert.NoError(t, err) {
+			return
+		}
+		// Give the dialer a reason to ping
+		time.Sleep(2 * testPingInterval)
+		_, err = conn.Write([]byte(testdata))
+		if !assert.NoError(t, err) {
+			return
+		}
+		b := make([]byte, len(testdata))
+		_, err = io.ReadFull(conn, b)
+		if assert.NoError(t, err) {
+			assert.Equal(t, testdata, string(b))
+		}
+		conn.Close()
+	}
+	wg.Wait()
+	assert.True(t, v2Dialer.EMARTT() > 0)
+}
+
 func echoServerAndDialer(maxStreamsPerConn uint16) (net.Listener, Dialer, DialFN, *sync.WaitGroup, error) {
+	return echoServerAndDialerWithVersion(maxStreamsPerConn, ProtocolVersion1)
+}
+
+func echoServerAndDialerWithVersion(maxStreamsPerConn uint16, version int) (net.Listener, Dialer, DialFN, *sync.WaitGroup, error) {
 	pk, err := keyman.GeneratePK(2048)
 	if err != nil {
 		return nil, nil, nil, nil, err
@@ -383,7 +543,8 @@ func echoServerAndDialer(maxStreamsPerConn uint16) (net.Listener, Dialer, DialFN
 		PingInterval:      testPingInterval,
 		Pool:              pool,
 		Cipher:            AES128GCM,
-		ServerPublicKey:   &pk.RSA().PublicKey})
+		ServerPublicKey:   &pk.RSA().PublicKey,
+		ProtocolVersion:   version})
 
 	return l, dialer, func() (net.Conn, error) {
 		return dialer.Dial(doDial)
@@ -5,15 +5,82 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/getlantern/ops"
 )
 
+const (
+	defaultMaxClockSkew    = 2 * time.Minute
+	defaultReplayCacheSize = 100000
+	defaultInitTimeout     = 10 * time.Second
+	defaultInitIdleTimeout = 1 * time.Second
+)
+
+// ListenerOpts configures options for wrapping Listeners
+type ListenerOpts struct {
+	// Pool - BufferPool to use
+	Pool BufferPool
+
+	// ServerPrivateKey - if provided, this listener will expect connections to
+	//                    use encryption
+	ServerPrivateKey *rsa.PrivateKey
+
+	// MaxClockSkew - how far the timestamps of client init messages may be from
+	//                the listener's clock. Init messages outside of this are
+	//                rejected as replays. If <= 0, defaults to 2 minutes.
+	MaxClockSkew time.Duration
+
+	// ReplayCacheSize - how many init messages the replay cache is sized for
+	//                   per 2 * MaxClockSkew. More than that make it mistake
+	//                   more new init messages for replays. If <= 0, defaults
+	//                   to 100,000.
+	ReplayCacheSize int
+
+	// RequireTimestamp - if true, rejects init messages from older clients that
+	//                    don't include a timestamp. Otherwise, those are only
+	//                    protected from replays for as long as they're in the
+	//                    replay cache.
+	RequireTimestamp bool
+
+	// Fallback - handles connections that don't start a valid session, like
+	//            those from active probes. If nil, defaults to
+	//            DiscardFallback.
+	Fallback Fallback
+
+	// InitTimeout - how long clients have to send the client init msg before
+	//               they're handed to the Fallback with whatever they sent,
+	//               so that probes which send less than a client init msg
+	//               still get a response. If <= 0, defaults to 10 seconds.
+	InitTimeout time.Duration
+
+	// InitIdleTimeout - how long clients that sent part of the client init
+	//                   msg may pause before they're handed to the Fallback.
+	//                   Real clients send it all at once, so this is much
+	//                   shorter than InitTimeout. Clients that start with an
+	//                   HTTP request or TLS handshake are handed over right
+	//                   away. If <= 0, defaults to 1 second.
+	InitIdleTimeout time.Duration
+
+	// DefaultPriority - the Priority of accepted streams. If invalid, defaults
+	//                   to PriorityNormal.
+	DefaultPriority Priority
+}
+
 type listener struct {
 	wrapped          net.Listener
 	pool             BufferPool
 	serverPrivateKey *rsa.PrivateKey
+	maxClockSkew     time.Duration
+	requireTimestamp bool
+	replayCache      *replayCache
+	fallback         Fallback
+	initTimeout      time.Duration
+	initIdleTimeout  time.Duration
+	defaultPriority  Priority
+	sessions         map[*session]bool
+	sessionsMx       sync.Mutex
 	errCh            chan error
 	connCh           chan net.Conn
 }
@@ -33,14 +100,50 @@ type listener struct {
 //
 // serverPrivateKey - if provided, this listener will expect connections to use
 //                    encryption
-func WrapListener(wrapped net.Listener, pool BufferPool, serverPrivateKey *rsa.PrivateKey) net.Listener {
+//
+// Clients may use either protocol version, see ProtocolVersion1 and
+// ProtocolVersion2.
+func WrapListener(wrapped net.Listener, pool BufferPool, serverPrivateKey *rsa.PrivateKey) Listener {
+	return WrapListenerWithOpts(wrapped, &ListenerOpts{
+		Pool:             pool,
+		ServerPrivateKey: serverPrivateKey,
+	})
+}
+
+// WrapListenerWithOpts is like WrapListener, but with more options.
+func WrapListenerWithOpts(wrapped net.Listener, opts *ListenerOpts) Listener {
 	// TODO: add a maxWindowSize
+	if opts.MaxClockSkew <= 0 {
+		opts.MaxClockSkew = defaultMaxClockSkew
+	}
+	if opts.ReplayCacheSize <= 0 {
+		opts.ReplayCacheSize = defaultReplayCacheSize
+	}
+	if opts.Fallback == nil {
+		opts.Fallback = DiscardFallback()
+	}
+	if opts.InitTimeout <= 0 {
+		opts.InitTimeout = defaultInitTimeout
+	}
+	if opts.InitIdleTimeout <= 0 {
+		opts.InitIdleTimeout = defaultInitIdleTimeout
+	}
 	l := &listener{
 		wrapped:          wrapped,
-		pool:             pool,
-		serverPrivateKey: serverPrivateKey,
-		connCh:           make(chan net.Conn),
-		errCh:            make(chan error),
+		pool:             opts.Pool,
+		serverPrivateKey: opts.ServerPrivateKey,
+		maxClockSkew:     opts.MaxClockSkew,
+		requireTimestamp: opts.RequireTimestamp,
+		// Init messages pass the timestamp check for up to 2 * MaxClockSkew, so
+		// that's how long they need to be remembered
+		replayCache:     newReplayCache(opts.ReplayCacheSize, 2*opts.MaxClockSkew),
+		fallback:        opts.Fallback,
+		initTimeout:     opts.InitTimeout,
+		initIdleTimeout: opts.InitIdleTimeout,
+		defaultPriority: opts.DefaultPriority,
+		sessions:        make(map[*session]bool),
+		connCh:          make(chan net.Conn),
+		errCh:           make(chan error),
 	}
 	ops.Go(l.process)
 	trackStats()
@@ -107,15 +210,138 @@ func (l *listener) onConn(conn net.Conn) {
 func (l *listener) doOnConn(conn net.Conn) error {
 	// Read client init msg
 	initMsg := make([]byte, clientInitSize)
-	// Try to read start sequence
-	_, err := io.ReadFull(conn, initMsg)
+	n, err := l.readClientInitMsg(conn, initMsg)
 	if err != nil {
+		if netErr, ok := err.(net.Error); (ok && netErr.Timeout()) || n > 0 {
+			// Probably not a lampshade client
+			return l.reject(conn, initMsg[:n], fmt.Errorf("Unable to read client init msg: %v", err))
+		}
 		return fmt.Errorf("Unable to read client init msg: %v", err)
 	}
-	windowSize, maxPadding, cs, err := decodeClientInitMsg(l.serverPrivateKey, initMsg)
+	pt, err := decryptClientInitMsg(l.serverPrivateKey, initMsg)
 	if err != nil {
-		return fmt.Errorf("Unable to decode client init msg: %v", err)
+		return l.reject(conn, initMsg, err)
+	}
+	if err := l.checkReplay(pt, time.Now()); err != nil {
+		return l.reject(conn, initMsg, err)
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+	if isClientInitMsgV2(pt) {
+		return l.onConnV2(conn, pt)
+	}
+	windowSize, maxPadding, cs, err := parseClientInitMsg(pt)
+	if err != nil {
+		return l.reject(conn, initMsg, fmt.Errorf("Unable to decode client init msg: %v", err))
+	}
+	return l.startSession(conn, windowSize, maxPadding, cs.reversed())
+}
+
+// readClientInitMsg reads the client init msg into initMsg like io.ReadFull,
+// except that it gives up early on clients that can't be sending one, either
+// because they started with a plaintext protocol or because they paused for
+// longer than the InitIdleTimeout.
+func (l *listener) readClientInitMsg(conn net.Conn, initMsg []byte) (int, error) {
+	deadline := time.Now().Add(l.initTimeout)
+	n := 0
+	for n < len(initMsg) {
+		readDeadline := deadline
+		if n > 0 {
+			if idleDeadline := time.Now().Add(l.initIdleTimeout); idleDeadline.Before(deadline) {
+				readDeadline = idleDeadline
+			}
+		}
+		if err := conn.SetReadDeadline(readDeadline); err != nil {
+			return n, err
+		}
+		read, err := conn.Read(initMsg[n:])
+		n += read
+		if protocol := plaintextProtocol(initMsg[:n]); protocol != "" {
+			return n, fmt.Errorf("Received %v instead", protocol)
+		}
+		if err != nil {
+			if err == io.EOF && n > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// startSession starts a session on conn and tracks it until it closes.
+func (l *listener) startSession(conn net.Conn, windowSize int, maxPadding int, cs *cryptoSpec) error {
+	l.sessionsMx.Lock()
+	defer l.sessionsMx.Unlock()
+	s, err := startSession(conn, windowSize, maxPadding, 0, cs, nil, nil, l.pool, l.connCh, l.sessionClosed, l.defaultPriority)
+	if err != nil {
+		return err
 	}
-	startSession(conn, windowSize, maxPadding, 0, cs.reversed(), nil, l.pool, l.connCh, nil)
+	l.sessions[s] = true
 	return nil
 }
+
+func (l *listener) sessionClosed(s *session) {
+	l.sessionsMx.Lock()
+	delete(l.sessions, s)
+	l.sessionsMx.Unlock()
+}
+
+func (l *listener) Sessions() []Session {
+	l.sessionsMx.Lock()
+	defer l.sessionsMx.Unlock()
+	sessions := make([]Session, 0, len(l.sessions))
+	for s := range l.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// checkReplay checks that the decrypted client init message pt is recent and
+// hasn't been seen before.
+func (l *listener) checkReplay(pt []byte, now time.Time) error {
+	ts, ok := clientInitTimestamp(pt)
+	if ok {
+		if skew := now.Sub(ts); skew > l.maxClockSkew || skew < -l.maxClockSkew {
+			return fmt.Errorf("Client init msg timestamp %v is off by %v", ts, skew)
+		}
+	} else if l.requireTimestamp {
+		return fmt.Errorf("Client init msg has no timestamp")
+	}
+	if l.replayCache.checkAndAdd(pt, now) {
+		return fmt.Errorf("Client init msg was replayed")
+	}
+	return nil
+}
+
+// reject hands connections that didn't send a valid client init msg to the
+// Fallback, which treats them all the same so that probes can't tell why they
+// were rejected.
+func (l *listener) reject(conn net.Conn, received []byte, reason error) error {
+	log.Debugf("Rejecting connection from %v: %v", conn.RemoteAddr(), reason)
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+	l.fallback.Handle(conn, received)
+	return nil
+}
+
+// onConnV2 completes the version 2 key exchange before starting the session.
+func (l *listener) onConnV2(conn net.Conn, pt []byte) error {
+	hs, err := decodeClientInitMsgV2(pt)
+	if err != nil {
+		return fmt.Errorf("Unable to decode client init msg: %v", err)
+	}
+	if err := conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return err
+	}
+	cs, err := hs.respond(conn)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+	return l.startSession(conn, hs.windowSize, hs.maxPadding, cs.reversed())
+}
@@ -24,13 +24,14 @@ type receiveBuffer struct {
 	in            chan []byte
 	ack           chan []byte
 	pool          BufferPool
+	stats         *streamStats
 	poolable      []byte
 	current       []byte
 	closed        bool
 	mx            sync.RWMutex
 }
 
-func newReceiveBuffer(defaultHeader []byte, ack chan []byte, pool BufferPool, windowSize int) *receiveBuffer {
+func newReceiveBuffer(defaultHeader []byte, ack chan []byte, pool BufferPool, windowSize int, stats *streamStats) *receiveBuffer {
 	ackInterval := int(math.Ceil(float64(windowSize) / 10))
 	return &receiveBuffer{
 		defaultHeader: defaultHeader,
@@ -39,6 +40,7 @@ func newReceiveBuffer(defaultHeader []byte, ack chan []byte, pool BufferPool, wi
 		in:            make(chan []byte, windowSize),
 		ack:           ack,
 		pool:          pool,
+		stats:         stats,
 	}
 }
 
@@ -145,6 +147,7 @@ func (buf *receiveBuffer) sendACK() {
 		// Don't bother acking
 		return
 	}
+	buf.stats.onACKSent(buf.unacked)
 	buf.ack <- ackWithFrames(buf.defaultHeader, int32(buf.unacked))
 }
 
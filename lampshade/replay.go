@@ -0,0 +1,120 @@
+package lampshade
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// replayFalsePositiveRate is the rate at which a full replay cache
+	// mistakes new init messages for replays.
+	replayFalsePositiveRate = 1e-6
+)
+
+// replayCache remembers init messages for at least one rotation interval, and
+// at most two, using a pair of bloom filters. New messages go into the
+// current filter and both filters are checked. Each rotation discards the
+// previous filter and starts a new current one, so memory use is bounded
+// regardless of how many messages come in. Bloom filters have no false
+// negatives, so replays within the interval are always caught, but new
+// messages are occasionally mistaken for replays.
+type replayCache struct {
+	current        *bloomFilter
+	previous       *bloomFilter
+	rotateInterval time.Duration
+	rotated        time.Time
+	mx             sync.Mutex
+}
+
+// newReplayCache builds a replayCache that holds up to capacity messages per
+// rotateInterval at the target false positive rate.
+func newReplayCache(capacity int, rotateInterval time.Duration) *replayCache {
+	return &replayCache{
+		current:        newBloomFilter(capacity, replayFalsePositiveRate),
+		previous:       newBloomFilter(capacity, replayFalsePositiveRate),
+		rotateInterval: rotateInterval,
+		rotated:        time.Now(),
+	}
+}
+
+// checkAndAdd checks whether msg has been seen before and remembers it.
+func (c *replayCache) checkAndAdd(msg []byte, now time.Time) (seen bool) {
+	key := sha256.Sum256(msg)
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if elapsed := now.Sub(c.rotated); elapsed >= 2*c.rotateInterval {
+		c.current.reset()
+		c.previous.reset()
+		c.rotated = now
+	} else if elapsed >= c.rotateInterval {
+		c.previous.reset()
+		c.current, c.previous = c.previous, c.current
+		c.rotated = c.rotated.Add(c.rotateInterval)
+	}
+
+	if c.current.contains(key) || c.previous.contains(key) {
+		return true
+	}
+	c.current.add(key)
+	return false
+}
+
+// bloomFilter is a fixed-size bloom filter keyed by SHA-256 hashes.
+type bloomFilter struct {
+	bits   []uint64
+	m      uint64
+	hashes int
+}
+
+func newBloomFilter(capacity int, falsePositiveRate float64) *bloomFilter {
+	if capacity < 1 {
+		capacity = 1
+	}
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	hashes := int(math.Round(float64(m) / float64(capacity) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	return &bloomFilter{
+		bits:   make([]uint64, (m+63)/64),
+		m:      m,
+		hashes: hashes,
+	}
+}
+
+// positions derives the bit positions for key by double hashing.
+func (f *bloomFilter) positions(key [sha256.Size]byte, fn func(pos uint64) bool) {
+	h1 := binary.BigEndian.Uint64(key[:8])
+	h2 := binary.BigEndian.Uint64(key[8:16]) | 1
+	for i := 0; i < f.hashes; i++ {
+		if !fn((h1 + uint64(i)*h2) % f.m) {
+			return
+		}
+	}
+}
+
+func (f *bloomFilter) add(key [sha256.Size]byte) {
+	f.positions(key, func(pos uint64) bool {
+		f.bits[pos/64] |= 1 << (pos % 64)
+		return true
+	})
+}
+
+func (f *bloomFilter) contains(key [sha256.Size]byte) bool {
+	found := true
+	f.positions(key, func(pos uint64) bool {
+		found = f.bits[pos/64]&(1<<(pos%64)) != 0
+		return found
+	})
+	return found
+}
+
+func (f *bloomFilter) reset() {
+	for i := range f.bits {
+		f.bits[i] = 0
+	}
+}
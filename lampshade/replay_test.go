@@ -0,0 +1,235 @@
+package lampshade
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/keyman"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayCache(t *testing.T) {
+	start := time.Now()
+	c := newReplayCache(1000, time.Minute)
+	c.rotated = start
+	for i := 0; i < 1000; i++ {
+		assert.False(t, c.checkAndAdd([]byte(fmt.Sprint(i)), start))
+	}
+	assert.True(t, c.checkAndAdd([]byte("1"), start.Add(30*time.Second)))
+	assert.True(t, c.checkAndAdd([]byte("1"), start.Add(90*time.Second)), "should remember messages from the previous interval")
+	assert.False(t, c.checkAndAdd([]byte("2"), start.Add(121*time.Second)), "should forget messages after two intervals")
+	assert.True(t, c.checkAndAdd([]byte("2"), start.Add(150*time.Second)), "should remember messages added after rotating")
+	assert.False(t, c.checkAndAdd([]byte("1"), start.Add(10*time.Minute)), "should forget everything after a long pause")
+
+	falsePositives := 0
+	for i := 1000; i < 101000; i++ {
+		if c.current.contains(sha256Key(fmt.Sprint(i))) {
+			falsePositives++
+		}
+	}
+	assert.True(t, falsePositives < 5, "too many false positives: %d", falsePositives)
+}
+
+func TestReplayedInit(t *testing.T) {
+	doTestReplayedInit(t, ProtocolVersion1)
+}
+
+func TestReplayedInitV2(t *testing.T) {
+	doTestReplayedInit(t, ProtocolVersion2)
+}
+
+func doTestReplayedInit(t *testing.T, version int) {
+	l, pk, err := replayServer(&ListenerOpts{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	// Capture what the client sends
+	var captured []byte
+	var mx sync.Mutex
+	dialer := NewDialer(&DialerOpts{
+		WindowSize:      windowSize,
+		Pool:            NewBufferPool(100),
+		Cipher:          AES128GCM,
+		ServerPublicKey: &pk.RSA().PublicKey,
+		ProtocolVersion: version,
+	})
+	conn, err := dialer.Dial(func() (net.Conn, error) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		return &capturingConn{Conn: conn, captured: &captured, mx: &mx}, nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(testdata))
+	if !assert.NoError(t, err) {
+		return
+	}
+	b := make([]byte, len(testdata))
+	_, err = io.ReadFull(conn, b)
+	if !assert.NoError(t, err) || !assert.Equal(t, testdata, string(b)) {
+		return
+	}
+
+	mx.Lock()
+	replay := append([]byte(nil), captured...)
+	mx.Unlock()
+	assertIgnored(t, l.Addr().String(), replay, "replayed init")
+}
+
+func TestStaleInit(t *testing.T) {
+	l, pk, err := replayServer(&ListenerOpts{MaxClockSkew: time.Minute})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	cs, _ := newCryptoSpec(AES128GCM)
+	for _, ts := range []time.Time{time.Now().Add(-2 * time.Minute), time.Now().Add(2 * time.Minute)} {
+		msg, err := buildClientInitMsg(&pk.RSA().PublicKey, windowSize, 0, cs, ts)
+		if assert.NoError(t, err) {
+			assertIgnored(t, l.Addr().String(), msg, "stale init")
+		}
+	}
+
+	// Messages from older clients without a timestamp
+	legacy, err := legacyInitMsg(&pk.RSA().PublicKey, cs)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assertAccepted(t, l.Addr().String(), legacy)
+	assertIgnored(t, l.Addr().String(), legacy, "replayed init without timestamp")
+
+	strict, _, err := replayServer(&ListenerOpts{ServerPrivateKey: pk.RSA(), RequireTimestamp: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer strict.Close()
+	legacy, err = legacyInitMsg(&pk.RSA().PublicKey, cs)
+	if assert.NoError(t, err) {
+		assertIgnored(t, strict.Addr().String(), legacy, "init without timestamp")
+	}
+}
+
+func TestGarbageInit(t *testing.T) {
+	l, _, err := replayServer(&ListenerOpts{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	assertIgnored(t, l.Addr().String(), largeData[:clientInitSize+100], "garbage")
+}
+
+// replayServer starts an echo server with the given options, generating a key
+// unless one is given.
+func replayServer(opts *ListenerOpts) (net.Listener, *keyman.PrivateKey, error) {
+	pk, err := keyman.GeneratePK(2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.ServerPrivateKey == nil {
+		opts.ServerPrivateKey = pk.RSA()
+	}
+	opts.Pool = NewBufferPool(100)
+	wrapped, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	l := WrapListenerWithOpts(wrapped, opts)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l, pk, nil
+}
+
+// assertIgnored sends msg and checks that the server neither responds nor
+// closes the connection.
+func assertIgnored(t *testing.T, addr string, msg []byte, description string) {
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write(msg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+	n, err := conn.Read(make([]byte, 1))
+	assert.Equal(t, 0, n, description)
+	if netErr, ok := err.(net.Error); assert.True(t, ok, "%v: %v", description, err) {
+		assert.True(t, netErr.Timeout(), "%v should have been read without a response, got %v", description, err)
+	}
+}
+
+// assertAccepted sends the version 1 init msg and checks that the connection
+// stays open long enough to be used.
+func assertAccepted(t *testing.T, addr string, msg []byte) {
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write(msg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// The server doesn't respond until it gets frames, but it shouldn't
+	// reject anything either
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	netErr, ok := err.(net.Error)
+	assert.True(t, ok && netErr.Timeout(), "unexpected %v", err)
+}
+
+// legacyInitMsg builds a version 1 init msg like older clients that didn't
+// include a timestamp.
+func legacyInitMsg(serverPublicKey *rsa.PublicKey, cs *cryptoSpec) ([]byte, error) {
+	plainText := make([]byte, winSize)
+	binaryEncoding.PutUint32(plainText, uint32(windowSize))
+	plainText = append(plainText, 0, byte(cs.cipherCode))
+	plainText = append(plainText, cs.secret...)
+	plainText = append(plainText, cs.metaSendIV...)
+	plainText = append(plainText, cs.dataSendIV...)
+	plainText = append(plainText, cs.metaRecvIV...)
+	plainText = append(plainText, cs.dataRecvIV...)
+	return rsa.EncryptOAEP(sha256.New(), rand.Reader, serverPublicKey, plainText, nil)
+}
+
+func sha256Key(s string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(s))
+}
+
+type capturingConn struct {
+	net.Conn
+	captured *[]byte
+	mx       *sync.Mutex
+}
+
+func (c *capturingConn) Write(b []byte) (int, error) {
+	c.mx.Lock()
+	*c.captured = append(*c.captured, b...)
+	c.mx.Unlock()
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,207 @@
+package lampshade
+
+import (
+	"container/heap"
+	"fmt"
+	"sync"
+)
+
+// Priority is the scheduling class of a stream. When streams on a session
+// compete to send, each one gets a share of the physical connection in
+// proportion to its priority's weight, so that bulk transfers don't starve
+// interactive streams. Priorities only affect what each end sends, they aren't
+// communicated to the other end.
+type Priority int
+
+const (
+	// PriorityBulk is for large transfers that can tolerate latency, like
+	// downloads.
+	PriorityBulk Priority = 1
+	// PriorityNormal is the default.
+	PriorityNormal Priority = 2
+	// PriorityInteractive is for latency sensitive streams, like remote shells.
+	PriorityInteractive Priority = 3
+
+	bulkWeight        = 1
+	normalWeight      = 4
+	interactiveWeight = 16
+)
+
+func (p Priority) valid() bool {
+	return p >= PriorityBulk && p <= PriorityInteractive
+}
+
+// weight is the relative share of the connection that streams with this
+// priority get.
+func (p Priority) weight() int {
+	switch p {
+	case PriorityBulk:
+		return bulkWeight
+	case PriorityInteractive:
+		return interactiveWeight
+	default:
+		return normalWeight
+	}
+}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityBulk:
+		return "bulk"
+	case PriorityNormal:
+		return "normal"
+	case PriorityInteractive:
+		return "interactive"
+	default:
+		return fmt.Sprintf("unknown priority: %d", int(p))
+	}
+}
+
+// scheduler orders the frames sent by a session's streams using start-time
+// fair queueing. Each frame is tagged with a virtual start time, which is the
+// later of the scheduler's virtual time and the virtual finish time of the
+// stream's previous frame. Frames take longer to finish the larger they are
+// and the smaller their stream's weight is. The scheduler always sends the
+// frame with the earliest start time, so a newly active stream goes ahead of
+// streams that have a backlog, and busy streams share the connection in
+// proportion to their weights.
+type scheduler struct {
+	active      queueHeap
+	virtualTime float64
+	seq         uint64
+	ready       chan struct{}
+	mx          sync.Mutex
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// streamQueue holds the frames that one stream is waiting to send.
+type streamQueue struct {
+	sched      *scheduler
+	priority   Priority
+	frames     []queuedFrame
+	lastFinish float64
+	index      int // position in scheduler.active, -1 if not active
+}
+
+type queuedFrame struct {
+	frame []byte
+	start float64
+	seq   uint64
+}
+
+// newQueue adds a queue for a stream with the given priority.
+func (sched *scheduler) newQueue(priority Priority) *streamQueue {
+	if !priority.valid() {
+		priority = PriorityNormal
+	}
+	return &streamQueue{sched: sched, priority: priority, index: -1}
+}
+
+// push queues frame to be sent.
+func (q *streamQueue) push(frame []byte) {
+	sched := q.sched
+	sched.mx.Lock()
+	start := sched.virtualTime
+	if q.lastFinish > start {
+		start = q.lastFinish
+	}
+	q.lastFinish = start + float64(len(frame))/float64(q.priority.weight())
+	sched.seq++
+	q.frames = append(q.frames, queuedFrame{frame: frame, start: start, seq: sched.seq})
+	if q.index < 0 {
+		heap.Push(&sched.active, q)
+	}
+	sched.mx.Unlock()
+	sched.signal()
+}
+
+// setPriority changes the priority of frames pushed from now on.
+func (q *streamQueue) setPriority(priority Priority) {
+	if !priority.valid() {
+		return
+	}
+	q.sched.mx.Lock()
+	q.priority = priority
+	q.sched.mx.Unlock()
+}
+
+func (q *streamQueue) getPriority() Priority {
+	q.sched.mx.Lock()
+	defer q.sched.mx.Unlock()
+	return q.priority
+}
+
+// pop returns the next frame to send, or nil if there aren't any.
+func (sched *scheduler) pop() []byte {
+	sched.mx.Lock()
+	if len(sched.active) == 0 {
+		sched.mx.Unlock()
+		return nil
+	}
+	q := sched.active[0]
+	next := q.frames[0]
+	q.frames[0] = queuedFrame{}
+	q.frames = q.frames[1:]
+	sched.virtualTime = next.start
+	if len(q.frames) == 0 {
+		heap.Pop(&sched.active)
+		q.frames = nil
+	} else {
+		heap.Fix(&sched.active, 0)
+	}
+	more := len(sched.active) > 0
+	sched.mx.Unlock()
+	if more {
+		sched.signal()
+	}
+	return next.frame
+}
+
+// signal notifies the session that there are frames to send.
+func (sched *scheduler) signal() {
+	select {
+	case sched.ready <- struct{}{}:
+	default:
+		// already signaled
+	}
+}
+
+// queueHeap is a heap of the active streamQueues ordered by the start time of
+// their next frame.
+type queueHeap []*streamQueue
+
+func (h queueHeap) Len() int { return len(h) }
+
+func (h queueHeap) Less(i, j int) bool {
+	a, b := h[i].frames[0], h[j].frames[0]
+	if a.start != b.start {
+		return a.start < b.start
+	}
+	return a.seq < b.seq
+}
+
+func (h queueHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *queueHeap) Push(x interface{}) {
+	q := x.(*streamQueue)
+	q.index = len(*h)
+	*h = append(*h, q)
+}
+
+func (h *queueHeap) Pop() interface{} {
+	old := *h
+	q := old[len(old)-1]
+	old[len(old)-1] = nil
+	q.index = -1
+	*h = old[:len(old)-1]
+	return q
+}
@@ -0,0 +1,251 @@
+package lampshade
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/keyman"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedulerNewStreamGoesFirst(t *testing.T) {
+	sched := newScheduler()
+	bulk := sched.newQueue(PriorityBulk)
+	interactive := sched.newQueue(PriorityInteractive)
+	for i := 0; i < 100; i++ {
+		bulk.push([]byte(fmt.Sprintf("b%d", i)))
+	}
+	assert.Equal(t, "b0", string(sched.pop()))
+	interactive.push([]byte("i0"))
+	assert.Equal(t, "i0", string(sched.pop()), "interactive frame should go ahead of bulk backlog")
+	assert.Equal(t, "b1", string(sched.pop()))
+}
+
+func TestSchedulerWeights(t *testing.T) {
+	for _, test := range []struct {
+		a, b     Priority
+		expected int
+	}{
+		{PriorityNormal, PriorityNormal, 1},
+		{PriorityBulk, PriorityNormal, normalWeight / bulkWeight},
+		{PriorityBulk, PriorityInteractive, interactiveWeight / bulkWeight},
+		{PriorityNormal, PriorityInteractive, interactiveWeight / normalWeight},
+	} {
+		sched := newScheduler()
+		a := sched.newQueue(test.a)
+		b := sched.newQueue(test.b)
+		frame := make([]byte, maxFrameSize)
+		for i := 0; i < 1000; i++ {
+			a.push(append(frame[:0:0], 'a'))
+			b.push(append(frame[:0:0], 'b'))
+		}
+		counts := make(map[byte]int)
+		for i := 0; i < 17*(test.expected+1); i++ {
+			counts[sched.pop()[0]]++
+		}
+		assert.InDelta(t, test.expected, float64(counts['b'])/float64(counts['a']), 0.5, "%v vs %v", test.a, test.b)
+	}
+}
+
+func TestSchedulerPreservesStreamOrder(t *testing.T) {
+	sched := newScheduler()
+	queues := []*streamQueue{sched.newQueue(PriorityBulk), sched.newQueue(PriorityNormal), sched.newQueue(PriorityInteractive)}
+	for i := 0; i < 100; i++ {
+		for j, q := range queues {
+			q.push([]byte{byte(j), byte(i)})
+		}
+	}
+	next := make([]byte, len(queues))
+	for frame := sched.pop(); frame != nil; frame = sched.pop() {
+		assert.Equal(t, next[frame[0]], frame[1])
+		next[frame[0]]++
+	}
+	for _, n := range next {
+		assert.EqualValues(t, 100, n)
+	}
+	select {
+	case <-sched.ready:
+	default:
+		t.Fatal("scheduler should have been signaled")
+	}
+}
+
+func TestStreamPriority(t *testing.T) {
+	l, dialer, dial, _, err := echoServerAndDialer(0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	conn, err := dial()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	assert.Equal(t, PriorityNormal, conn.(Stream).Priority(), "should default to normal priority")
+
+	// Reuses the existing session
+	stream, err := dialer.DialStreamWithPriority(func() (net.Conn, error) {
+		return nil, fmt.Errorf("shouldn't dial")
+	}, PriorityInteractive)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer stream.Close()
+	assert.Equal(t, PriorityInteractive, stream.Priority())
+	assert.Equal(t, PriorityInteractive, stream.Stats().Priority)
+	stream.SetPriority(Priority(27))
+	assert.Equal(t, PriorityInteractive, stream.Priority(), "invalid priority should be ignored")
+	stream.SetPriority(PriorityBulk)
+	assert.Equal(t, PriorityBulk, stream.Priority())
+
+	for _, c := range []net.Conn{conn, stream} {
+		_, err = c.Write([]byte(testdata))
+		if !assert.NoError(t, err) {
+			return
+		}
+		b := make([]byte, len(testdata))
+		_, err = io.ReadFull(c, b)
+		if assert.NoError(t, err) {
+			assert.Equal(t, testdata, string(b))
+		}
+	}
+}
+
+const (
+	benchBandwidth    = 10 * 1024 * 1024 // bytes per second
+	benchMessageSize  = 8 * 1024
+	benchStreamBulk   = 'b'
+	benchStreamEchoer = 'e'
+)
+
+// BenchmarkInteractiveLatency measures the round trip time (ns/op) of messages
+// on an interactive stream while a bulk stream saturates a bandwidth-limited
+// physical connection.
+func BenchmarkInteractiveLatency(b *testing.B) {
+	b.Run("idle", func(b *testing.B) {
+		doBenchmarkInteractiveLatency(b, 0, PriorityNormal)
+	})
+	b.Run("bulk normal, interactive normal", func(b *testing.B) {
+		doBenchmarkInteractiveLatency(b, PriorityNormal, PriorityNormal)
+	})
+	b.Run("bulk bulk, interactive interactive", func(b *testing.B) {
+		doBenchmarkInteractiveLatency(b, PriorityBulk, PriorityInteractive)
+	})
+}
+
+func doBenchmarkInteractiveLatency(b *testing.B, bulkPriority, interactivePriority Priority) {
+	pk, err := keyman.GeneratePK(2048)
+	if err != nil {
+		b.Fatal(err)
+	}
+	_lst, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	lst := WrapListener(_lst, NewBufferPool(100), pk.RSA())
+	defer lst.Close()
+	go func() {
+		for {
+			conn, err := lst.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				kind := make([]byte, 1)
+				if _, err := io.ReadFull(conn, kind); err != nil {
+					return
+				}
+				if kind[0] == benchStreamBulk {
+					io.Copy(io.Discard, conn)
+				} else {
+					io.Copy(conn, conn)
+				}
+			}()
+		}
+	}()
+
+	dialer := NewDialer(&DialerOpts{
+		Pool:            NewBufferPool(100),
+		Cipher:          AES128GCM,
+		ServerPublicKey: &pk.RSA().PublicKey,
+	})
+	dial := func() (net.Conn, error) {
+		conn, err := net.Dial("tcp", lst.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		return &throttledConn{Conn: conn, bandwidth: benchBandwidth}, nil
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	if bulkPriority != 0 {
+		bulk, err := dialer.DialStreamWithPriority(dial, bulkPriority)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer bulk.Close()
+		if _, err := bulk.Write([]byte{benchStreamBulk}); err != nil {
+			b.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					if _, err := bulk.Write(largeData); err != nil {
+						return
+					}
+				}
+			}
+		}()
+		// Give the bulk stream time to build a backlog
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	interactive, err := dialer.DialStreamWithPriority(dial, interactivePriority)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer interactive.Close()
+	if _, err := interactive.Write([]byte{benchStreamEchoer}); err != nil {
+		b.Fatal(err)
+	}
+	msg := make([]byte, benchMessageSize)
+	echo := make([]byte, benchMessageSize)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := interactive.Write(msg); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(interactive, echo); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	// Stop writing before closing the bulk stream
+	close(stop)
+	wg.Wait()
+}
+
+// throttledConn limits the rate at which it writes to emulate a connection
+// with the given bandwidth in bytes per second.
+type throttledConn struct {
+	net.Conn
+	bandwidth int
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	time.Sleep(time.Duration(len(b)) * time.Second / time.Duration(c.bandwidth))
+	return c.Conn.Write(b)
+}
@@ -2,6 +2,7 @@ package lampshade
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/getlantern/ops"
@@ -24,29 +25,33 @@ var (
 type sendBuffer struct {
 	defaultHeader  []byte
 	window         *window
+	queue          *streamQueue
+	stats          *streamStats
 	in             chan []byte
 	closeRequested chan bool
 	closed         sync.WaitGroup
 }
 
-func newSendBuffer(defaultHeader []byte, out chan []byte, windowSize int) *sendBuffer {
+func newSendBuffer(defaultHeader []byte, queue *streamQueue, windowSize int, stats *streamStats) *sendBuffer {
 	buf := &sendBuffer{
 		defaultHeader:  defaultHeader,
 		window:         newWindow(windowSize),
+		queue:          queue,
+		stats:          stats,
 		in:             make(chan []byte, windowSize),
 		closeRequested: make(chan bool, 1),
 	}
 	buf.closed.Add(1)
-	ops.Go(func() { buf.sendLoop(out) })
+	ops.Go(buf.sendLoop)
 	return buf
 }
 
-func (buf *sendBuffer) sendLoop(out chan []byte) {
+func (buf *sendBuffer) sendLoop() {
 	sendRST := false
 
 	defer func() {
 		if sendRST {
-			buf.sendRST(out)
+			buf.sendRST()
 		}
 
 		// drain remaining writes
@@ -70,14 +75,14 @@ func (buf *sendBuffer) sendLoop(out chan []byte) {
 				select {
 				case <-windowAvailable:
 					// send allowed
-					out <- append(frame, buf.defaultHeader...)
+					buf.send(frame)
 				case sendRST = <-buf.closeRequested:
 					// close requested before window available
 					signalClose()
 					select {
 					case <-windowAvailable:
 						// send allowed
-						out <- append(frame, buf.defaultHeader...)
+						buf.send(frame)
 					case <-closeTimer.C:
 						// closed before window available
 						return
@@ -99,6 +104,18 @@ func (buf *sendBuffer) sendLoop(out chan []byte) {
 	}
 }
 
+func (buf *sendBuffer) send(frame []byte) {
+	buf.stats.onDataSent(len(frame))
+	buf.queue.push(append(frame, buf.defaultHeader...))
+}
+
+// ack adds ACK'ed frames back to the window, returning the ACK latency if
+// it completed a sample.
+func (buf *sendBuffer) ack(frames int) (time.Duration, bool) {
+	buf.window.add(frames)
+	return buf.stats.onACK(frames)
+}
+
 func (buf *sendBuffer) close(sendRST bool) {
 	select {
 	case buf.closeRequested <- sendRST:
@@ -109,7 +126,9 @@ func (buf *sendBuffer) close(sendRST bool) {
 	buf.closed.Wait()
 }
 
-func (buf *sendBuffer) sendRST(out chan []byte) {
-	// Send an RST frame with the streamID
-	out <- withFrameType(buf.defaultHeader, frameTypeRST)
+func (buf *sendBuffer) sendRST() {
+	// Send an RST frame with the streamID. It's queued like data so that it's
+	// sent after any data that's still queued.
+	atomic.StoreInt32(&buf.stats.rstSent, 1)
+	buf.queue.push(withFrameType(buf.defaultHeader, frameTypeRST))
 }
@@ -13,8 +13,16 @@ func TestSendBuffer(t *testing.T) {
 
 	depth := 5
 
+	sched := newScheduler()
+	buf := newSendBuffer(header, sched.newQueue(PriorityNormal), depth, newStreamStats())
 	out := make(chan []byte)
-	buf := newSendBuffer(header, out, depth)
+	go func() {
+		for range sched.ready {
+			for frame := sched.pop(); frame != nil; frame = sched.pop() {
+				out <- frame
+			}
+		}
+	}()
 
 	// write loop
 	go func() {
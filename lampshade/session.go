@@ -25,6 +25,7 @@ var (
 	openSessions    int64
 	closingSessions int64
 	closedSessions  int64
+	openStreams     int64
 	recvLoops       int64
 	sendLoops       int64
 	trackStatsOnce  sync.Once
@@ -54,6 +55,8 @@ type session struct {
 	dataDecrypt      func([]byte) ([]byte, error)
 	dataEncrypt      func(dst []byte, src []byte) []byte
 	clientInitMsg    []byte
+	handshake        func() (*cryptoSpec, error)
+	ready            chan struct{}
 	pool             BufferPool
 	pingInterval     time.Duration
 	lastPing         time.Time
@@ -66,6 +69,9 @@ type session struct {
 	connCh           chan net.Conn
 	beforeClose      func(*session)
 	emaRTT           *ema.EMA
+	stats            *sessionStats
+	sched            *scheduler
+	defaultPriority  Priority
 	closeCh          chan struct{}
 	closeOnce        sync.Once
 	mx               sync.RWMutex
@@ -75,15 +81,18 @@ type session struct {
 // If connCh is provided, the session will notify of new streams as they are
 // opened. If beforeClose is provided, the session will use it to notify when
 // it's about to close. If clientInitMsg is provided, this message will be sent
-// with the first frame sent in this session.
-func startSession(conn net.Conn, windowSize int, maxPadding int, pingInterval time.Duration, cs *cryptoSpec, clientInitMsg []byte, pool BufferPool, connCh chan net.Conn, beforeClose func(*session)) (*session, error) {
+// with the first frame sent in this session. If cs is nil, handshake is
+// performed before anything else is sent or received to obtain it. Streams
+// start out with defaultPriority.
+func startSession(conn net.Conn, windowSize int, maxPadding int, pingInterval time.Duration, cs *cryptoSpec, clientInitMsg []byte, handshake func() (*cryptoSpec, error), pool BufferPool, connCh chan net.Conn, beforeClose func(*session), defaultPriority Priority) (*session, error) {
 	s := &session{
 		Conn:             conn,
 		windowSize:       windowSize,
 		maxPadding:       big.NewInt(int64(maxPadding)),
 		paddingEnabled:   maxPadding > 0,
-		cipherOverhead:   cs.cipherCode.overhead(),
 		clientInitMsg:    clientInitMsg,
+		handshake:        handshake,
+		ready:            make(chan struct{}),
 		pool:             pool,
 		pingInterval:     pingInterval,
 		lastPing:         time.Now(),
@@ -95,15 +104,18 @@ func startSession(conn net.Conn, windowSize int, maxPadding int, pingInterval ti
 		closed:           make(map[uint16]bool),
 		connCh:           connCh,
 		beforeClose:      beforeClose,
+		stats:            newSessionStats(),
+		sched:            newScheduler(),
+		defaultPriority:  defaultPriority,
 		closeCh:          make(chan struct{}),
 	}
-	var err error
-	s.metaEncrypt, s.dataEncrypt, s.metaDecrypt, s.dataDecrypt, err = cs.crypters()
-	if err != nil {
-		return nil, err
+	if cs != nil {
+		if err := s.initCrypto(cs); err != nil {
+			return nil, err
+		}
 	}
 	atomic.AddInt64(&openSessions, 1)
-	isClient := clientInitMsg != nil
+	isClient := clientInitMsg != nil || handshake != nil
 	if isClient {
 		s.emaRTT = ema.NewDuration(0, 0.5)
 	}
@@ -112,12 +124,36 @@ func startSession(conn net.Conn, windowSize int, maxPadding int, pingInterval ti
 	return s, nil
 }
 
+// initCrypto sets up the session's encryption and marks it ready for use.
+func (s *session) initCrypto(cs *cryptoSpec) error {
+	var err error
+	s.metaEncrypt, s.dataEncrypt, s.metaDecrypt, s.dataDecrypt, err = cs.crypters()
+	if err != nil {
+		return err
+	}
+	s.cipherOverhead = cs.cipherCode.overhead()
+	close(s.ready)
+	return nil
+}
+
 func (s *session) recvLoop() {
 	atomic.AddInt64(&recvLoops, 1)
 	defer func() {
 		atomic.AddInt64(&recvLoops, -1)
 	}()
 
+	// Wait for the handshake, if any. If the session closes during the
+	// handshake, the send loop reports the error to streams.
+	select {
+	case <-s.ready:
+	default:
+		select {
+		case <-s.ready:
+		case <-s.closeCh:
+			return
+		}
+	}
+
 	echoTS := make([]byte, tsSize)
 	lengthBuffer := make([]byte, lenSize)
 	var sessionFrame []byte
@@ -131,6 +167,7 @@ func (s *session) recvLoop() {
 		}
 		s.metaDecrypt(lengthBuffer)
 		l := int(binaryEncoding.Uint16(lengthBuffer))
+		atomic.AddInt64(&s.stats.bytesRecv, int64(lenSize+l))
 
 		// Then read the session frame
 		if cap(sessionFrame) < l {
@@ -169,11 +206,15 @@ func (s *session) recvLoop() {
 			}
 
 			frameType, id := frameTypeAndID(header)
+			if frameType != frameTypePadding {
+				atomic.AddInt64(&s.stats.framesRecv, 1)
+			}
 			switch frameType {
 			case frameTypePadding:
 				// Padding is always at the end of a session frame, so stop processing
 				break frameLoop
 			case frameTypeACK:
+				atomic.AddInt64(&s.stats.acksRecv, 1)
 				c, open := s.getOrCreateStream(id)
 				if !open {
 					// Stream was already closed, ignore
@@ -186,15 +227,19 @@ func (s *session) recvLoop() {
 					return
 				}
 				ackedFrames := int(binaryEncoding.Uint32(_ackedFrames))
-				c.sb.window.add(ackedFrames)
+				if latency, sampled := c.sb.ack(ackedFrames); sampled {
+					s.stats.emaACKLatency.UpdateDuration(latency)
+				}
 				continue
 			case frameTypeRST:
 				// Closing existing connection
+				atomic.AddInt64(&s.stats.rstsRecv, 1)
 				s.mx.Lock()
 				c := s.streams[id]
 				s.closeStream(id)
 				s.mx.Unlock()
 				if c != nil {
+					atomic.StoreInt32(&c.stats.rstRecv, 1)
 					// Close, but don't send an RST back the other way since the other end is
 					// already closed.
 					c.close(false, nil, nil)
@@ -242,6 +287,8 @@ func (s *session) recvLoop() {
 				// Stream was already closed, ignore
 				continue
 			}
+			atomic.AddInt64(&c.stats.framesRecv, 1)
+			atomic.AddInt64(&c.stats.bytesRecv, int64(dataLength))
 			c.rb.submit(b)
 		}
 	}
@@ -253,6 +300,17 @@ func (s *session) sendLoop() {
 		atomic.AddInt64(&sendLoops, -1)
 	}()
 
+	if s.handshake != nil {
+		cs, err := s.handshake()
+		if err == nil {
+			err = s.initCrypto(cs)
+		}
+		if err != nil {
+			s.onSessionError(fmt.Errorf("Unable to complete handshake: %v", err), nil)
+			return
+		}
+	}
+
 	for {
 		select {
 		case <-s.closeCh:
@@ -268,6 +326,12 @@ func (s *session) sendLoop() {
 				// closed
 				return
 			}
+		case <-s.sched.ready:
+			frame := s.sched.pop()
+			if frame != nil && !s.send(frame) {
+				// closed
+				return
+			}
 		}
 	}
 }
@@ -294,6 +358,7 @@ type sender struct {
 	*session
 	coalescedBytes int
 	coalesced      int
+	frames         int
 	startOfData    int
 	closedStreams  []uint16
 }
@@ -340,6 +405,7 @@ func (snd *sender) send(frame []byte) (open bool) {
 			snd.sendSessionFrame[i] = 0
 		}
 		snd.coalescedBytes += l
+		atomic.AddInt64(&snd.stats.paddingBytes, int64(l))
 	}
 
 	framesData := snd.sendSessionFrame[snd.startOfData : snd.startOfData+snd.coalescedBytes]
@@ -354,7 +420,12 @@ func (snd *sender) send(frame []byte) (open bool) {
 	snd.metaEncrypt(lenBuf)
 
 	// Write session frame to wire
-	_, err := snd.Write(snd.sendSessionFrame[:snd.startOfData+snd.coalescedBytes])
+	n, err := snd.Write(snd.sendSessionFrame[:snd.startOfData+snd.coalescedBytes])
+	atomic.AddInt64(&snd.stats.bytesSent, int64(n))
+	atomic.AddInt64(&snd.stats.writes, 1)
+	if snd.frames > 1 {
+		atomic.AddInt64(&snd.stats.coalescedWrites, 1)
+	}
 	if err != nil {
 		snd.onSessionError(nil, err)
 	}
@@ -375,8 +446,13 @@ func (snd *sender) coalesceAdditionalFrames() bool {
 			// pending echo immediately available, add it
 			snd.bufferFrame(frame)
 		default:
-			// no more frames immediately available
-			return true
+			// take the next frame from the streams, if any
+			frame := snd.sched.pop()
+			if frame == nil {
+				// no more frames immediately available
+				return true
+			}
+			snd.bufferFrame(frame)
 		}
 	}
 	return true
@@ -384,6 +460,8 @@ func (snd *sender) coalesceAdditionalFrames() bool {
 
 func (snd *sender) bufferFrame(frame []byte) {
 	snd.coalesced++
+	snd.frames++
+	atomic.AddInt64(&snd.stats.framesSent, 1)
 	dataLen := len(frame) - headerSize
 	if dataLen > MaxDataLen {
 		panic(fmt.Sprintf("Data length of %d exceeds maximum allowed of %d", dataLen, MaxDataLen))
@@ -394,10 +472,14 @@ func (snd *sender) bufferFrame(frame []byte) {
 	switch frameType {
 	case frameTypeRST:
 		// RST frames only contain the header
+		atomic.AddInt64(&snd.stats.rstsSent, 1)
 		snd.closedStreams = append(snd.closedStreams, streamID)
 		return
 	case frameTypeACK, frameTypePing, frameTypeEcho:
 		// ACK, ping and echo frames also have additional data
+		if frameType == frameTypeACK {
+			atomic.AddInt64(&snd.stats.acksSent, 1)
+		}
 		snd.coalesce(frame[:dataLen])
 		return
 	default:
@@ -460,16 +542,20 @@ func (s *session) getOrCreateStream(id uint16) (*stream, bool) {
 	}
 
 	defaultHeader := newHeader(frameTypeData, id)
+	stats := newStreamStats()
 	c = &stream{
 		Conn:       s,
 		session:    s,
+		id:         id,
+		stats:      stats,
 		pool:       s.pool,
-		sb:         newSendBuffer(defaultHeader, s.out, s.windowSize),
-		rb:         newReceiveBuffer(defaultHeader, s.out, s.pool, s.windowSize),
+		sb:         newSendBuffer(defaultHeader, s.sched.newQueue(s.defaultPriority), s.windowSize, stats),
+		rb:         newReceiveBuffer(defaultHeader, s.out, s.pool, s.windowSize, stats),
 		writeTimer: time.NewTimer(oneYear),
 	}
 	s.streams[id] = c
 	s.mx.Unlock()
+	atomic.AddInt64(&openStreams, 1)
 	if s.connCh != nil {
 		s.connCh <- c
 	}
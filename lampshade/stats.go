@@ -0,0 +1,229 @@
+package lampshade
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/ema"
+)
+
+// SessionStats is a snapshot of the traffic on a Session.
+type SessionStats struct {
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+
+	// Started is when the session started.
+	Started time.Time
+
+	// BytesSent and BytesRecv are the bytes written to and read from the
+	// physical connection, including framing, padding and encryption overhead.
+	// BytesRecv doesn't include the client init msg.
+	BytesSent int64
+	BytesRecv int64
+
+	// FramesSent and FramesRecv are the stream frames of all types (data, ACK,
+	// RST, ping and echo) sent and received.
+	FramesSent int64
+	FramesRecv int64
+
+	// Writes are the session frames written to the physical connection, of
+	// which CoalescedWrites combined more than one stream frame.
+	Writes          int64
+	CoalescedWrites int64
+
+	// PaddingBytes are the bytes of random padding sent.
+	PaddingBytes int64
+
+	ACKsSent int64
+	ACKsRecv int64
+	RSTsSent int64
+	RSTsRecv int64
+
+	// EMARTT is the moving average round trip time measured by pings (dialer
+	// sessions with a PingInterval only).
+	EMARTT time.Duration
+
+	// ACKLatency is the moving average time between sending data and getting
+	// it ACK'ed across all streams, which includes the time until the other
+	// end reads it.
+	ACKLatency time.Duration
+
+	// Streams are the session's open streams.
+	Streams []*StreamStats
+}
+
+// StreamStats is a snapshot of the traffic on a Stream.
+type StreamStats struct {
+	ID       uint16
+	Priority Priority
+
+	// BytesSent and BytesRecv are the data bytes sent and received, excluding
+	// framing.
+	BytesSent int64
+	BytesRecv int64
+
+	// FramesSent and FramesRecv are the data frames sent and received.
+	FramesSent int64
+	FramesRecv int64
+
+	// SendWindow is how many more frames can be sent before waiting for ACKs.
+	SendWindow int
+
+	// RecvWindow is how many more frames the other end can send before
+	// waiting for ACKs.
+	RecvWindow int
+
+	ACKsSent int64
+	ACKsRecv int64
+
+	// ACKLatency is the moving average time between sending data and getting
+	// it ACK'ed, which includes the time until the other end reads it.
+	ACKLatency time.Duration
+
+	// RSTSent and RSTRecv indicate whether the stream was closed by this end or
+	// the other end.
+	RSTSent bool
+	RSTRecv bool
+}
+
+// sessionStats tracks the traffic on a session.
+type sessionStats struct {
+	bytesSent       int64
+	bytesRecv       int64
+	framesSent      int64
+	framesRecv      int64
+	writes          int64
+	coalescedWrites int64
+	paddingBytes    int64
+	acksSent        int64
+	acksRecv        int64
+	rstsSent        int64
+	rstsRecv        int64
+	started         time.Time
+	emaACKLatency   *ema.EMA
+}
+
+func newSessionStats() *sessionStats {
+	return &sessionStats{
+		started:       time.Now(),
+		emaACKLatency: ema.NewDuration(0, 0.5),
+	}
+}
+
+// streamStats tracks the traffic on a stream. ACK latency is sampled by timing
+// one frame at a time until it's ACK'ed.
+type streamStats struct {
+	bytesSent     int64
+	bytesRecv     int64
+	framesSent    int64
+	framesRecv    int64
+	acksSent      int64
+	acksRecv      int64
+	framesACKed   int64 // sent frames ACK'ed by the other end
+	recvACKed     int64 // received frames ACK'ed to the other end
+	rstSent       int32
+	rstRecv       int32
+	emaACKLatency *ema.EMA
+	sampleFrame   int64 // frame being timed, 0 if none
+	sampleSent    time.Time
+	mx            sync.Mutex
+}
+
+func newStreamStats() *streamStats {
+	return &streamStats{
+		emaACKLatency: ema.NewDuration(0, 0.5),
+	}
+}
+
+// onDataSent records a data frame of length n being sent.
+func (s *streamStats) onDataSent(n int) {
+	atomic.AddInt64(&s.bytesSent, int64(n))
+	sent := atomic.AddInt64(&s.framesSent, 1)
+	s.mx.Lock()
+	if s.sampleFrame == 0 {
+		s.sampleFrame = sent
+		s.sampleSent = time.Now()
+	}
+	s.mx.Unlock()
+}
+
+// onACK records an ACK for the given number of frames and returns the ACK
+// latency if it completed a sample.
+func (s *streamStats) onACK(frames int) (latency time.Duration, sampled bool) {
+	atomic.AddInt64(&s.acksRecv, 1)
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.framesACKed += int64(frames)
+	if s.sampleFrame == 0 || s.framesACKed < s.sampleFrame {
+		return 0, false
+	}
+	latency = time.Since(s.sampleSent)
+	s.sampleFrame = 0
+	s.emaACKLatency.UpdateDuration(latency)
+	return latency, true
+}
+
+// onACKSent records an ACK for the given number of received frames.
+func (s *streamStats) onACKSent(frames int) {
+	atomic.AddInt64(&s.acksSent, 1)
+	atomic.AddInt64(&s.recvACKed, int64(frames))
+}
+
+// Stats gets a snapshot of the session's stats, including its open streams.
+func (s *session) Stats() *SessionStats {
+	st := s.stats
+	stats := &SessionStats{
+		LocalAddr:       s.LocalAddr(),
+		RemoteAddr:      s.RemoteAddr(),
+		Started:         st.started,
+		BytesSent:       atomic.LoadInt64(&st.bytesSent),
+		BytesRecv:       atomic.LoadInt64(&st.bytesRecv),
+		FramesSent:      atomic.LoadInt64(&st.framesSent),
+		FramesRecv:      atomic.LoadInt64(&st.framesRecv),
+		Writes:          atomic.LoadInt64(&st.writes),
+		CoalescedWrites: atomic.LoadInt64(&st.coalescedWrites),
+		PaddingBytes:    atomic.LoadInt64(&st.paddingBytes),
+		ACKsSent:        atomic.LoadInt64(&st.acksSent),
+		ACKsRecv:        atomic.LoadInt64(&st.acksRecv),
+		RSTsSent:        atomic.LoadInt64(&st.rstsSent),
+		RSTsRecv:        atomic.LoadInt64(&st.rstsRecv),
+		ACKLatency:      st.emaACKLatency.GetDuration(),
+	}
+	if s.emaRTT != nil {
+		stats.EMARTT = s.EMARTT()
+	}
+	s.mx.RLock()
+	streams := make([]*stream, 0, len(s.streams))
+	for _, c := range s.streams {
+		streams = append(streams, c)
+	}
+	s.mx.RUnlock()
+	stats.Streams = make([]*StreamStats, 0, len(streams))
+	for _, c := range streams {
+		stats.Streams = append(stats.Streams, c.Stats())
+	}
+	return stats
+}
+
+// Stats gets a snapshot of the stream's stats.
+func (c *stream) Stats() *StreamStats {
+	st := c.stats
+	framesRecv := atomic.LoadInt64(&st.framesRecv)
+	return &StreamStats{
+		ID:         c.id,
+		Priority:   c.Priority(),
+		BytesSent:  atomic.LoadInt64(&st.bytesSent),
+		BytesRecv:  atomic.LoadInt64(&st.bytesRecv),
+		FramesSent: atomic.LoadInt64(&st.framesSent),
+		FramesRecv: framesRecv,
+		SendWindow: c.sb.window.available(),
+		RecvWindow: c.rb.windowSize - int(framesRecv-atomic.LoadInt64(&st.recvACKed)),
+		ACKsSent:   atomic.LoadInt64(&st.acksSent),
+		ACKsRecv:   atomic.LoadInt64(&st.acksRecv),
+		ACKLatency: st.emaACKLatency.GetDuration(),
+		RSTSent:    atomic.LoadInt32(&st.rstSent) == 1,
+		RSTRecv:    atomic.LoadInt32(&st.rstRecv) == 1,
+	}
+}
@@ -3,6 +3,7 @@ package lampshade
 import (
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,6 +12,8 @@ import (
 type stream struct {
 	net.Conn
 	session       *session
+	id            uint16
+	stats         *streamStats
 	pool          BufferPool
 	rb            *receiveBuffer
 	sb            *sendBuffer
@@ -110,6 +113,7 @@ func (c *stream) close(sendRST bool, readErr error, writeErr error) error {
 		c.rb.close()
 		c.sb.close(sendRST)
 		c.writeTimer.Stop()
+		atomic.AddInt64(&openStreams, -1)
 	}
 	c.mx.Unlock()
 	return nil
@@ -145,6 +149,14 @@ func (c *stream) SetWriteDeadline(t time.Time) error {
 	return nil
 }
 
+func (c *stream) SetPriority(priority Priority) {
+	c.sb.queue.setPriority(priority)
+}
+
+func (c *stream) Priority() Priority {
+	return c.sb.queue.getPriority()
+}
+
 func (c *stream) Session() Session {
 	return c.session
 }
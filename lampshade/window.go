@@ -61,6 +61,13 @@ func (w *window) sub(delta int) chan bool {
 	return w.positiveAgain
 }
 
+// available returns the current size of the window.
+func (w *window) available() int {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	return w.size
+}
+
 func (w *window) timedOut(delta int) error {
 	// undo the subtraction
 	w.add(delta)
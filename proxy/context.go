@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"net"
 
 	"github.com/getlantern/proxy/filters"
@@ -11,8 +12,62 @@ type contextKey string
 const (
 	ctxKeyUpstream     = contextKey("upstream")
 	ctxKeyUpstreamAddr = contextKey("upstreamAddr")
+	ctxKeyMITM         = contextKey("mitm")
+	ctxKeyIntercepted  = contextKey("intercepted")
+
+	ctxKeyOnUpstreamConn = contextKey("onUpstreamConn")
+	ctxKeyPoolPartition  = contextKey("poolPartition")
+	ctxKeyDialKey        = contextKey("dialKey")
 )
 
+// OnUpstreamConn registers fn to be called with the upstream connection that
+// the request ends up using, whether it was dialed for the request, pre-dialed
+// or reused from the pool. Functions registered by earlier filters are still
+// called.
+func OnUpstreamConn(ctx filters.Context, fn func(conn net.Conn)) filters.Context {
+	if prev, ok := ctx.Value(ctxKeyOnUpstreamConn).(func(net.Conn)); ok {
+		next := fn
+		fn = func(conn net.Conn) {
+			prev(conn)
+			next(conn)
+		}
+	}
+	return ctx.WithValue(ctxKeyOnUpstreamConn, fn)
+}
+
+func notifyUpstreamConn(ctx context.Context, conn net.Conn) {
+	if fn, ok := ctx.Value(ctxKeyOnUpstreamConn).(func(net.Conn)); ok {
+		fn(conn)
+	}
+}
+
+// WithPoolPartition places the request in a partition of the upstream
+// connection pool. Pooled connections are only reused by requests in the same
+// partition, which matters when the dial function dials differently depending
+// on the request, for example from different source addresses. Pre-dialed
+// CONNECT connections are only used outside of partitions.
+func WithPoolPartition(ctx filters.Context, partition string) filters.Context {
+	return ctx.WithValue(ctxKeyPoolPartition, partition)
+}
+
+func poolPartition(ctx context.Context) string {
+	partition, _ := ctx.Value(ctxKeyPoolPartition).(string)
+	return partition
+}
+
+// WithDialKey records how the dial function will dial the request differently
+// because of other values in its context, for example because a filter pinned
+// the destination to the IPs it checked. Pre-dialed CONNECT connections are
+// only used by requests with the same dial key as the one that prompted them.
+func WithDialKey(ctx filters.Context, key string) filters.Context {
+	return ctx.WithValue(ctxKeyDialKey, key)
+}
+
+func dialKey(ctx context.Context) string {
+	key, _ := ctx.Value(ctxKeyDialKey).(string)
+	return key
+}
+
 func upstreamConn(ctx filters.Context) net.Conn {
 	upstream := ctx.Value(ctxKeyUpstream)
 	if upstream == nil {
@@ -0,0 +1,539 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+const (
+	defaultMaxIdleConnsPerOrigin = 8
+	defaultMaxIdleConns          = 256
+	defaultPoolIdleTimeout       = 90 * time.Second
+	defaultHealthCheckInterval   = 30 * time.Second
+
+	// healthCheckTimeout is how long a health check waits for a connection to
+	// show that it's been closed.
+	healthCheckTimeout = time.Millisecond
+
+	// maxSpareReceived limits how much a spare connection may receive from its
+	// origin (like a greeting) while it waits to be used.
+	maxSpareReceived = 64 * 1024
+)
+
+// PoolOpts configures the pool of upstream connections that's shared by all
+// downstream connections. Idle connections are closed after the proxy's
+// IdleTimeout (90 seconds if that's unset).
+type PoolOpts struct {
+	// MaxConnsPerOrigin limits the number of connections (idle or in use) for
+	// forwarding plain HTTP requests to each origin. Requests wait for a
+	// connection once the limit is reached. 0 means no limit.
+	MaxConnsPerOrigin int
+
+	// MaxIdleConnsPerOrigin limits the number of idle keep-alive connections
+	// kept for each origin, defaults to 8.
+	MaxIdleConnsPerOrigin int
+
+	// MaxIdleConns limits the total number of idle connections, including
+	// pre-dialed ones, defaults to 256.
+	MaxIdleConns int
+
+	// PreDialCONNECT, if positive, is the number of spare connections to keep
+	// dialed to every origin that recently received a CONNECT request, so that
+	// the next tunnel to it doesn't have to wait for a dial. Ignored unless
+	// OKWaitsForUpstream is set, since otherwise tunnels don't wait for a dial
+	// anyway.
+	PreDialCONNECT int
+
+	// HealthCheckInterval is how often pre-dialed connections are checked for
+	// having been closed by their origin, defaults to 30 seconds. Keep-alive
+	// connections don't need checking, since the transport notices right away.
+	HealthCheckInterval time.Duration
+}
+
+func (opts *PoolOpts) applyDefaults() {
+	if opts.MaxIdleConnsPerOrigin <= 0 {
+		opts.MaxIdleConnsPerOrigin = defaultMaxIdleConnsPerOrigin
+	}
+	if opts.MaxIdleConns <= 0 {
+		opts.MaxIdleConns = defaultMaxIdleConns
+	}
+	if opts.HealthCheckInterval <= 0 {
+		opts.HealthCheckInterval = defaultHealthCheckInterval
+	}
+}
+
+// PoolStats is a snapshot of the upstream connection pool, for debugging.
+type PoolStats struct {
+	Origins map[string]*OriginStats `json:"origins"`
+}
+
+// OriginStats describes the pooled connections to a single origin.
+type OriginStats struct {
+	// Open is the number of open connections for forwarding plain HTTP
+	// requests, whether idle or in use.
+	Open int64 `json:"open"`
+	// Dials is the number of connections dialed for plain HTTP requests.
+	Dials int64 `json:"dials"`
+	// Requests is the number of plain HTTP requests sent to the origin.
+	Requests int64 `json:"requests"`
+	// Reused is how many of those requests reused a pooled connection.
+	Reused int64 `json:"reused"`
+	// Spares is the number of pre-dialed connections waiting for a CONNECT.
+	Spares int `json:"spares"`
+	// SpareHits is the number of CONNECT requests that got a spare.
+	SpareHits int64 `json:"spareHits"`
+	// SparesEvicted is the number of spares closed because they failed a
+	// health check or expired.
+	SparesEvicted int64 `json:"sparesEvicted"`
+}
+
+// pool pools upstream connections across downstream connections. Plain HTTP
+// requests go through a shared http.Transport, and CONNECT requests can take
+// spare connections that were dialed ahead of time.
+type pool struct {
+	opts        PoolOpts
+	idleTimeout time.Duration
+	dial        DialFunc
+	tlsConfig   *tls.Config
+	transport   *http.Transport
+	partitions  map[string]*http.Transport
+
+	origins       map[string]*originStats
+	spares        map[spareKey][]*spare
+	numSpares     int
+	pendingSpares map[spareKey]int
+	checking      bool
+	mx            sync.Mutex
+}
+
+type originStats struct {
+	open          int64
+	dials         int64
+	requests      int64
+	reused        int64
+	spareHits     int64
+	sparesEvicted int64
+	// spares and pendingSpares are guarded by pool.mx
+	spares        int
+	pendingSpares int
+}
+
+// spareKey identifies which CONNECT requests can use a spare. Spares are
+// dialed with the context of the request that prompted them, so they're only
+// used by requests that would be dialed the same way (see WithDialKey).
+type spareKey struct {
+	addr    string
+	dialKey string
+}
+
+type spare struct {
+	conn    net.Conn
+	expires time.Time
+	// received is what the origin sent before the spare was used, like a
+	// greeting, which the tunnel still needs to see
+	received []byte
+}
+
+func newPool(opts *PoolOpts, idleTimeout time.Duration, dial DialFunc, tlsConfig *tls.Config) *pool {
+	if opts == nil {
+		opts = &PoolOpts{}
+	}
+	p := &pool{
+		opts:          *opts,
+		idleTimeout:   idleTimeout,
+		dial:          dial,
+		tlsConfig:     tlsConfig,
+		partitions:    make(map[string]*http.Transport),
+		origins:       make(map[string]*originStats),
+		spares:        make(map[spareKey][]*spare),
+		pendingSpares: make(map[spareKey]int),
+	}
+	p.opts.applyDefaults()
+	if p.idleTimeout <= 0 {
+		p.idleTimeout = defaultPoolIdleTimeout
+	}
+	p.transport = p.newTransport()
+	return p
+}
+
+func (p *pool) newTransport() *http.Transport {
+	return &http.Transport{
+		DialContext:         p.dialHTTP,
+		TLSClientConfig:     p.tlsConfig,
+		IdleConnTimeout:     p.idleTimeout,
+		MaxIdleConns:        p.opts.MaxIdleConns,
+		MaxIdleConnsPerHost: p.opts.MaxIdleConnsPerOrigin,
+		MaxConnsPerHost:     p.opts.MaxConnsPerOrigin,
+	}
+}
+
+// transportFor returns the transport for the given pool partition. Partitions
+// are expected to be few, so their transports are kept for good.
+func (p *pool) transportFor(partition string) *http.Transport {
+	if partition == "" {
+		return p.transport
+	}
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	t := p.partitions[partition]
+	if t == nil {
+		t = p.newTransport()
+		p.partitions[partition] = t
+	}
+	return t
+}
+
+// roundTrip sends a request upstream on a pooled connection.
+func (p *pool) roundTrip(req *http.Request) (*http.Response, error) {
+	origin := originForURL(req.URL)
+	stats := p.statsFor(origin)
+	atomic.AddInt64(&stats.requests, 1)
+	ctx := req.Context()
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&stats.reused, 1)
+			}
+			notifyUpstreamConn(ctx, info.Conn)
+		},
+	}
+	resp, err := p.transportFor(poolPartition(ctx)).RoundTrip(req.WithContext(httptrace.WithClientTrace(ctx, trace)))
+	// Connections that stay open keep the stats around
+	p.forgetIfUnused(origin)
+	return resp, err
+}
+
+func (p *pool) dialHTTP(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := p.dial(ctx, false, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	origin := originFor(addr)
+	stats := p.statsFor(origin)
+	atomic.AddInt64(&stats.dials, 1)
+	atomic.AddInt64(&stats.open, 1)
+	return &pooledConn{Conn: conn, pool: p, origin: origin, stats: stats}, nil
+}
+
+// dialCONNECT dials addr for a CONNECT tunnel, using a spare connection if
+// one is available.
+func (p *pool) dialCONNECT(ctx context.Context, network, addr string) (net.Conn, error) {
+	if p.opts.PreDialCONNECT <= 0 || poolPartition(ctx) != "" {
+		conn, err := p.dial(ctx, true, network, addr)
+		if err == nil {
+			notifyUpstreamConn(ctx, conn)
+		}
+		return conn, err
+	}
+	key := spareKey{addr, dialKey(ctx)}
+	stats := p.statsFor(addr)
+	conn := p.takeHealthySpare(key, stats)
+	if conn == nil {
+		var err error
+		conn, err = p.dial(ctx, true, network, addr)
+		if err != nil {
+			p.forgetIfUnused(addr)
+			return nil, err
+		}
+	}
+	notifyUpstreamConn(ctx, conn)
+	// The origin is reachable and in use, so have spares ready for next time
+	p.replenish(ctx, network, key)
+	return conn, nil
+}
+
+func (p *pool) takeHealthySpare(key spareKey, stats *originStats) net.Conn {
+	for {
+		s := p.takeSpare(key)
+		if s == nil {
+			return nil
+		}
+		if s.healthy(time.Now()) {
+			atomic.AddInt64(&stats.spareHits, 1)
+			return s.take()
+		}
+		atomic.AddInt64(&stats.sparesEvicted, 1)
+		s.conn.Close()
+	}
+}
+
+func (p *pool) takeSpare(key spareKey) *spare {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	spares := p.spares[key]
+	if len(spares) == 0 {
+		return nil
+	}
+	// Take the most recently dialed one, which is the most likely to be alive
+	s := spares[len(spares)-1]
+	p.setSpares(key, spares[:len(spares)-1])
+	return s
+}
+
+// replenish dials spares for key in the background, up to PreDialCONNECT.
+// The spares are dialed with ctx's values (but not its cancellation), so that
+// they're dialed like the request that prompted them.
+func (p *pool) replenish(ctx context.Context, network string, key spareKey) {
+	p.mx.Lock()
+	missing := p.opts.PreDialCONNECT - len(p.spares[key]) - p.pendingSpares[key]
+	if available := p.opts.MaxIdleConns - p.numSpares; missing > available {
+		missing = available
+	}
+	if missing <= 0 {
+		p.mx.Unlock()
+		return
+	}
+	p.setPendingSpares(key, missing)
+	if !p.checking {
+		p.checking = true
+		go p.checkSpares()
+	}
+	p.mx.Unlock()
+
+	for i := 0; i < missing; i++ {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+			conn, err := p.dial(ctx, true, network, key.addr)
+			cancel()
+			p.mx.Lock()
+			defer p.mx.Unlock()
+			p.setPendingSpares(key, -1)
+			if err != nil {
+				log.Debugf("Unable to pre-dial %v: %v", key.addr, err)
+				p.forgetIfUnusedLocked(key.addr)
+				return
+			}
+			p.setSpares(key, append(p.spares[key], &spare{conn: conn, expires: time.Now().Add(p.idleTimeout)}))
+		}()
+	}
+}
+
+// checkSpares periodically closes spares that expired or failed a health
+// check, until there are none left.
+func (p *pool) checkSpares() {
+	ticker := time.NewTicker(p.opts.HealthCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.mx.Lock()
+		candidates := make(map[spareKey][]*spare, len(p.spares))
+		for key, spares := range p.spares {
+			candidates[key] = spares
+			p.setSpares(key, nil)
+		}
+		p.mx.Unlock()
+
+		// Check without holding the lock, since checks take a bit
+		now := time.Now()
+		healthy := make(map[spareKey][]*spare, len(candidates))
+		for key, spares := range candidates {
+			for _, s := range spares {
+				if s.healthy(now) {
+					healthy[key] = append(healthy[key], s)
+					continue
+				}
+				atomic.AddInt64(&p.statsFor(key.addr).sparesEvicted, 1)
+				s.conn.Close()
+			}
+		}
+
+		p.mx.Lock()
+		for key, spares := range healthy {
+			p.setSpares(key, append(spares, p.spares[key]...))
+		}
+		for key := range candidates {
+			p.forgetIfUnusedLocked(key.addr)
+		}
+		if p.numSpares == 0 {
+			p.checking = false
+			p.mx.Unlock()
+			return
+		}
+		p.mx.Unlock()
+	}
+}
+
+// setSpares replaces the spares for key, keeping the counts up to date. Must
+// be called with mx held.
+func (p *pool) setSpares(key spareKey, spares []*spare) {
+	delta := len(spares) - len(p.spares[key])
+	p.numSpares += delta
+	p.statsForLocked(key.addr).spares += delta
+	if len(spares) == 0 {
+		delete(p.spares, key)
+	} else {
+		p.spares[key] = spares
+	}
+}
+
+// setPendingSpares adds delta to the number of spares being dialed for key,
+// keeping the counts up to date. Must be called with mx held.
+func (p *pool) setPendingSpares(key spareKey, delta int) {
+	p.numSpares += delta
+	p.statsForLocked(key.addr).pendingSpares += delta
+	p.pendingSpares[key] += delta
+	if p.pendingSpares[key] == 0 {
+		delete(p.pendingSpares, key)
+	}
+}
+
+func (p *pool) statsFor(origin string) *originStats {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.statsForLocked(origin)
+}
+
+func (p *pool) statsForLocked(origin string) *originStats {
+	stats := p.origins[origin]
+	if stats == nil {
+		stats = &originStats{}
+		p.origins[origin] = stats
+	}
+	return stats
+}
+
+// forgetIfUnused drops the stats for an origin once there's no connection to it
+// left, so that the stats don't keep growing with every origin ever seen.
+func (p *pool) forgetIfUnused(origin string) {
+	p.mx.Lock()
+	p.forgetIfUnusedLocked(origin)
+	p.mx.Unlock()
+}
+
+func (p *pool) forgetIfUnusedLocked(origin string) {
+	stats := p.origins[origin]
+	if stats != nil && atomic.LoadInt64(&stats.open) == 0 && stats.spares == 0 && stats.pendingSpares == 0 {
+		delete(p.origins, origin)
+	}
+}
+
+func (p *pool) stats() *PoolStats {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	result := &PoolStats{Origins: make(map[string]*OriginStats, len(p.origins))}
+	for origin, stats := range p.origins {
+		result.Origins[origin] = &OriginStats{
+			Open:          atomic.LoadInt64(&stats.open),
+			Dials:         atomic.LoadInt64(&stats.dials),
+			Requests:      atomic.LoadInt64(&stats.requests),
+			Reused:        atomic.LoadInt64(&stats.reused),
+			Spares:        stats.spares,
+			SpareHits:     atomic.LoadInt64(&stats.spareHits),
+			SparesEvicted: atomic.LoadInt64(&stats.sparesEvicted),
+		}
+	}
+	return result
+}
+
+// originForURL is the origin of requests to u, matching the originFor of the
+// address that the transport dials for them.
+func originForURL(u *url.URL) string {
+	host := u.Hostname()
+	if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+		host = ascii
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return originFor(net.JoinHostPort(host, port))
+}
+
+// originFor lowercases the host and strips default ports so that plain HTTP
+// stats are keyed by the host alone, which is how they're usually requested.
+func originFor(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return strings.ToLower(addr)
+	}
+	if port == "80" {
+		return strings.ToLower(host)
+	}
+	return net.JoinHostPort(strings.ToLower(host), port)
+}
+
+// healthy checks whether a spare is still usable, meaning that it hasn't
+// expired and the origin hasn't closed it. Some protocols (like SMTP, SSH and
+// FTP) have the origin speak first, so whatever it sent is kept for the tunnel.
+func (s *spare) healthy(now time.Time) bool {
+	if !now.Before(s.expires) {
+		return false
+	}
+	if err := s.conn.SetReadDeadline(time.Now().Add(healthCheckTimeout)); err != nil {
+		return false
+	}
+	defer s.conn.SetReadDeadline(time.Time{})
+	b := make([]byte, 4096)
+	for len(s.received) < maxSpareReceived {
+		n, err := s.conn.Read(b)
+		s.received = append(s.received, b[:n]...)
+		if err != nil {
+			netErr, ok := err.(net.Error)
+			return ok && netErr.Timeout()
+		}
+	}
+	// Origins don't usually send this much unprompted
+	return false
+}
+
+// take returns the spare's connection for use by a tunnel.
+func (s *spare) take() net.Conn {
+	if len(s.received) == 0 {
+		return s.conn
+	}
+	return &spareConn{Conn: s.conn, received: s.received}
+}
+
+// spareConn is a spare connection that first returns what its origin sent
+// while it was waiting to be used.
+type spareConn struct {
+	net.Conn
+	received []byte
+}
+
+func (c *spareConn) Read(b []byte) (int, error) {
+	if len(c.received) > 0 {
+		n := copy(b, c.received)
+		c.received = c.received[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *spareConn) Wrapped() net.Conn {
+	return c.Conn
+}
+
+// pooledConn keeps track of how many connections to an origin are open.
+type pooledConn struct {
+	net.Conn
+	pool      *pool
+	origin    string
+	stats     *originStats
+	closeOnce sync.Once
+}
+
+func (c *pooledConn) Close() error {
+	c.closeOnce.Do(func() {
+		if atomic.AddInt64(&c.stats.open, -1) == 0 {
+			c.pool.forgetIfUnused(c.origin)
+		}
+	})
+	return c.Conn.Close()
+}
+
+func (c *pooledConn) Wrapped() net.Conn {
+	return c.Conn
+}
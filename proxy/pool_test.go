@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	ht "net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/filters"
+	"github.com/stretchr/testify/assert"
+)
+
+func netDial(ctx context.Context, isCONNECT bool, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+func TestPoolMaxConnsPerOrigin(t *testing.T) {
+	var active, maxActive int32
+	release := make(chan struct{})
+	origin := ht.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			max := atomic.LoadInt32(&maxActive)
+			if n <= max || atomic.CompareAndSwapInt32(&maxActive, max, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&active, -1)
+	}))
+	defer origin.Close()
+
+	p := newPool(&PoolOpts{MaxConnsPerOrigin: 1}, 0, netDial, nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+			resp, err := p.roundTrip(req.WithContext(filters.BackgroundContext()))
+			if assert.NoError(t, err) {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.EqualValues(t, 1, atomic.LoadInt32(&maxActive), "requests should have waited for the one connection")
+	stats := p.stats().Origins[originFor(origin.Listener.Addr().String())]
+	if assert.NotNil(t, stats) {
+		assert.EqualValues(t, 1, stats.Dials)
+		assert.EqualValues(t, 3, stats.Requests)
+		assert.EqualValues(t, 2, stats.Reused)
+	}
+}
+
+func TestPoolPartitions(t *testing.T) {
+	origin := ht.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {}))
+	defer origin.Close()
+
+	p := newPool(nil, 0, netDial, nil)
+	get := func(partition string) {
+		ctx := filters.BackgroundContext()
+		if partition != "" {
+			ctx = WithPoolPartition(ctx, partition)
+		}
+		req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+		resp, err := p.roundTrip(req.WithContext(ctx))
+		if assert.NoError(t, err) {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+
+	get("a")
+	get("a")
+	get("b")
+	get("")
+	stats := p.stats().Origins[originFor(origin.Listener.Addr().String())]
+	if assert.NotNil(t, stats) {
+		assert.EqualValues(t, 3, stats.Dials, "partitions shouldn't share connections")
+		assert.EqualValues(t, 1, stats.Reused, "requests in the same partition should share connections")
+	}
+}
+
+func TestPoolOrigins(t *testing.T) {
+	for rawURL, expected := range map[string]string{
+		"http://example.com/":        "example.com",
+		"http://Example.COM:80/":     "example.com",
+		"http://example.com:8080/":   "example.com:8080",
+		"https://example.com/":       "example.com:443",
+		"https://example.com:443/":   "example.com:443",
+		"http://bücher.example/":     "xn--bcher-kva.example",
+		"http://[2001:db8::1]:8080/": "[2001:db8::1]:8080",
+	} {
+		u, _ := url.Parse(rawURL)
+		assert.Equal(t, expected, originForURL(u), rawURL)
+	}
+	assert.Equal(t, "example.com", originFor("Example.com:80"))
+
+	var closeConns int32
+	origin := ht.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&closeConns) == 1 {
+			resp.Header().Set("Connection", "close")
+		}
+	}))
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+
+	p := newPool(nil, 0, netDial, nil)
+	get := func(host string) {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+host+":"+port+"/", nil)
+		resp, err := p.roundTrip(req.WithContext(filters.BackgroundContext()))
+		if assert.NoError(t, err) {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+	get("localhost")
+	get("LOCALHOST")
+	stats := p.stats()
+	if assert.Len(t, stats.Origins, 1, "requests and dials should share stats") {
+		s := stats.Origins["localhost:"+port]
+		if assert.NotNil(t, s) {
+			// The transport itself doesn't share connections between the two
+			assert.EqualValues(t, 2, s.Requests)
+			assert.EqualValues(t, 2, s.Dials)
+			assert.EqualValues(t, 2, s.Open)
+		}
+	}
+
+	// Once the connection is gone, so are the stats
+	p.transport.CloseIdleConnections()
+	atomic.StoreInt32(&closeConns, 1)
+	get("localhost")
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && len(p.stats().Origins) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Empty(t, p.stats().Origins, "stats should have been forgotten after a successful request")
+}
+
+func TestPoolSpares(t *testing.T) {
+	l := greetingOrigin(t, "220 ready\r\n", false)
+	if l == nil {
+		return
+	}
+	defer l.Close()
+	addr := l.Addr().String()
+
+	p := newPool(&PoolOpts{PreDialCONNECT: 1}, 0, netDial, nil)
+	ctx := filters.BackgroundContext()
+	conn, err := p.dialCONNECT(ctx, "tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn.Close()
+	waitForSpares(t, p, addr, 1)
+
+	// The spare is used, and it has kept what the origin sent while it waited
+	conn, err = p.dialCONNECT(ctx, "tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, len("220 ready\r\n"))
+	_, err = io.ReadFull(conn, b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "220 ready\r\n", string(b))
+	}
+	stats := p.stats().Origins[addr]
+	if assert.NotNil(t, stats) {
+		assert.EqualValues(t, 1, stats.SpareHits)
+		assert.EqualValues(t, 0, stats.SparesEvicted)
+	}
+	waitForSpares(t, p, addr, 1)
+
+	// Requests that would be dialed differently don't get the spare
+	pinned, err := p.dialCONNECT(WithDialKey(ctx, "pinned"), "tcp", addr)
+	if assert.NoError(t, err) {
+		pinned.Close()
+	}
+	assert.EqualValues(t, 1, p.stats().Origins[addr].SpareHits)
+	// and get spares of their own
+	waitForSpares(t, p, addr, 2)
+}
+
+func TestPoolSparesEvicted(t *testing.T) {
+	l := greetingOrigin(t, "", true)
+	if l == nil {
+		return
+	}
+	defer l.Close()
+	addr := l.Addr().String()
+
+	p := newPool(&PoolOpts{PreDialCONNECT: 2, HealthCheckInterval: 50 * time.Millisecond}, 0, netDial, nil)
+	conn, err := p.dialCONNECT(filters.BackgroundContext(), "tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn.Close()
+
+	// The origin closes every connection, so the spares are evicted by health
+	// checks until the origin is forgotten
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if p.stats().Origins[addr] == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Nil(t, p.stats().Origins[addr], "origin should be forgotten once its spares are evicted")
+	p.mx.Lock()
+	assert.Equal(t, 0, p.numSpares)
+	p.mx.Unlock()
+}
+
+// greetingOrigin accepts connections, sending greeting to each and then
+// closing them if closeConns is set.
+func greetingOrigin(t *testing.T, greeting string, closeConns bool) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if greeting != "" {
+				conn.Write([]byte(greeting))
+			}
+			if closeConns {
+				conn.Close()
+			}
+		}
+	}()
+	return l
+}
+
+func waitForSpares(t *testing.T, p *pool, addr string, expected int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if stats := p.stats().Origins[addr]; stats != nil && stats.Spares == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Fail(t, "spares not dialed", "expected %d spares for %v", expected, addr)
+}
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
@@ -31,6 +32,9 @@ type Proxy interface {
 
 	// Serve runs a server on the given Listener
 	Serve(l net.Listener) error
+
+	// PoolStats returns a snapshot of the pool of upstream connections.
+	PoolStats() *PoolStats
 }
 
 // Opts defines options for configuring a Proxy
@@ -57,10 +61,28 @@ type Opts struct {
 
 	// Dial is the function that's used to dial upstream.
 	Dial DialFunc
+
+	// MITM, if specified, is consulted for every CONNECT request that makes it
+	// through the Filter. Tunnels for which it returns a tls.Config are
+	// intercepted: TLS from the client is terminated using that config, the
+	// decrypted HTTP/1.1 requests are run through the Filter like any other
+	// request and then sent to the origin over a new TLS connection (CONNECT
+	// only).
+	MITM MITMFunc
+
+	// MITMUpstreamTLSConfig configures the TLS connections to the origins of
+	// intercepted requests. Leave nil to verify origins against the system's
+	// root CAs.
+	MITMUpstreamTLSConfig *tls.Config
+
+	// Pool configures the pool of upstream connections that's shared by all
+	// downstream connections. Leave nil to use the defaults.
+	Pool *PoolOpts
 }
 
 type proxy struct {
 	*Opts
+	pool *pool
 }
 
 // New creates a new Proxy configured with the specified Opts.
@@ -77,7 +99,20 @@ func New(opts *Opts) Proxy {
 	}
 	opts.applyHTTPDefaults()
 	opts.applyCONNECTDefaults()
-	return &proxy{opts}
+	p := newPool(opts.Pool, opts.IdleTimeout, opts.Dial, opts.MITMUpstreamTLSConfig)
+	if !opts.OKWaitsForUpstream {
+		// Tunnels are dialed after responding OK, so spares wouldn't help
+		p.opts.PreDialCONNECT = 0
+	}
+	return &proxy{
+		Opts: opts,
+		pool: p,
+	}
+}
+
+// PoolStats implements the interface Proxy
+func (proxy *proxy) PoolStats() *PoolStats {
+	return proxy.pool.stats()
 }
 
 // OnFirstOnly returns a filter that applies the given filter only on the first
@@ -56,6 +56,15 @@ func (proxy *proxy) nextCONNECT(downstream net.Conn) filters.Next {
 			}
 		}
 
+		if proxy.MITM != nil {
+			if tlsConfig := proxy.MITM(ctx, modifiedReq); tlsConfig != nil {
+				// We'll dial the origin for each intercepted request
+				respondOK()
+				nextCtx = nextCtx.WithValue(ctxKeyMITM, &mitmTunnel{modifiedReq.URL.Host, tlsConfig})
+				return resp, nextCtx, nil
+			}
+		}
+
 		if !proxy.OKWaitsForUpstream {
 			// We preemptively respond with an OK on the client. Some user agents like
 			// Chrome consider any non-200 OK response from the proxy to indicate that
@@ -75,7 +84,7 @@ func (proxy *proxy) nextCONNECT(downstream net.Conn) filters.Next {
 		// Note - for CONNECT requests, we use the Host from the request URL, not the
 		// Host header. See discussion here:
 		// https://ask.wireshark.org/questions/22988/http-host-header-with-and-without-port-number
-		upstream, err := proxy.Dial(ctx, true, "tcp", modifiedReq.URL.Host)
+		upstream, err := proxy.pool.dialCONNECT(ctx, "tcp", modifiedReq.URL.Host)
 		if err != nil {
 			if proxy.OKWaitsForUpstream {
 				return badGateway(ctx, modifiedReq, err)
@@ -106,6 +115,7 @@ func (proxy *proxy) dialAndCopy(ctx filters.Context, addr string, downstream net
 	if err != nil {
 		return err
 	}
+	notifyUpstreamConn(ctx, upstream)
 	return proxy.copy(upstream, downstream)
 }
 
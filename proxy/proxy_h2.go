@@ -0,0 +1,294 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/netx"
+	"github.com/getlantern/preconn"
+	"github.com/getlantern/proxy/filters"
+	"golang.org/x/net/http2"
+)
+
+const (
+	// ALPNProtoH2 is the ALPN protocol that TLS listeners need to offer for
+	// clients to speak HTTP/2 to the proxy.
+	ALPNProtoH2 = "h2"
+)
+
+// negotiatedH2 checks whether downstream is a TLS connection on which the
+// client negotiated HTTP/2, completing the handshake if necessary.
+func negotiatedH2(downstream net.Conn) (bool, error) {
+	var tlsConn *tls.Conn
+	netx.WalkWrapped(downstream, func(conn net.Conn) bool {
+		tlsConn, _ = conn.(*tls.Conn)
+		return tlsConn == nil
+	})
+	if tlsConn == nil {
+		return false, nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return false, err
+	}
+	return tlsConn.ConnectionState().NegotiatedProtocol == ALPNProtoH2, nil
+}
+
+// serveH2 serves an HTTP/2 connection. Every stream is handled like a separate
+// HTTP/1.1 connection carrying a single request, so filters see the same kinds
+// of requests regardless of the protocol the client speaks:
+//
+//   - CONNECT streams become CONNECT tunnels, many of which can share the
+//     connection.
+//   - Extended CONNECT streams (RFC 8441) become HTTP/1.1 upgrade requests for
+//     the protocol in :protocol, for example WebSocket handshakes.
+//   - Other requests are forwarded as usual.
+func (proxy *proxy) serveH2(ctx context.Context, downstreamIn io.Reader, downstream net.Conn) error {
+	conn := downstream
+	if br, ok := downstreamIn.(*bufio.Reader); ok && br.Buffered() > 0 {
+		b, _ := br.Peek(br.Buffered())
+		conn = preconn.Wrap(downstream, b)
+	}
+
+	server := &http2.Server{IdleTimeout: proxy.IdleTimeout}
+	server.ServeConn(conn, &http2.ServeConnOpts{
+		Context: ctx,
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			proxy.serveH2Stream(downstream, rw, req)
+		}),
+	})
+	return nil
+}
+
+func (proxy *proxy) serveH2Stream(downstream net.Conn, rw http.ResponseWriter, req *http.Request) {
+	stream := &h2Stream{Conn: downstream, rc: http.NewResponseController(rw)}
+	stream.body = &countingBody{ReadCloser: req.Body, n: &stream.recv}
+	stream.rw = &countingResponseWriter{ResponseWriter: rw, n: &stream.sent}
+	if req.ContentLength != 0 {
+		// Leave empty bodies alone so that they're still known to be empty when
+		// forwarded
+		req.Body = stream.body
+	}
+	fctx := filters.WrapContext(req.Context(), stream)
+
+	var next filters.Next
+	protocol := req.Header.Get(":protocol")
+	switch {
+	case req.Method == http.MethodConnect && protocol == "":
+		next = proxy.nextCONNECT(stream)
+	case req.Method == http.MethodConnect:
+		toUpgradeRequest(req, protocol)
+		next = func(ctx filters.Context, modifiedReq *http.Request) (*http.Response, filters.Context, error) {
+			upstreamReq := prepareRequest(modifiedReq.WithContext(ctx))
+			if upstreamReq.URL.Port() == "443" {
+				upstreamReq.URL.Scheme = "https"
+			}
+			return proxy.roundTripUpgrade(ctx, upstreamReq)
+		}
+	default:
+		next = func(ctx filters.Context, modifiedReq *http.Request) (*http.Response, filters.Context, error) {
+			resp, err := proxy.pool.roundTrip(prepareRequest(modifiedReq.WithContext(ctx)))
+			return resp, ctx, err
+		}
+	}
+
+	resp, nextCtx, err := proxy.Filter.Apply(fctx, req.WithContext(fctx), tunnelBody(next))
+	if err != nil && resp == nil {
+		resp = proxy.OnError(fctx, req, false, err)
+	}
+	if resp == nil {
+		// Reset the stream, like closing an HTTP/1.1 connection without a
+		// response
+		panic(http.ErrAbortHandler)
+	}
+	if resp.Body != nil {
+		defer resp.Body.Close()
+	}
+
+	upstream := upstreamConn(nextCtx)
+	upstreamAddr := upstreamAddr(nextCtx)
+	tunnel := interceptedTunnel(nextCtx)
+	if upstream == nil && upstreamAddr == "" && tunnel == nil {
+		proxy.writeH2Response(stream.rw, resp)
+		return
+	}
+
+	// HTTP/2 tunnels are established with a 200 response, including ones that
+	// stand for upgraded HTTP/1.1 connections
+	header := rw.Header()
+	copyHeadersForForwarding(header, resp.Header)
+	header.Del("Sec-Websocket-Accept")
+	rw.WriteHeader(http.StatusOK)
+	if err := stream.rc.Flush(); err != nil {
+		log.Debugf("Unable to respond to HTTP/2 tunnel request: %v", err)
+		return
+	}
+
+	switch {
+	case tunnel != nil:
+		err = proxy.intercept(nextCtx, req.RemoteAddr, tunnel, stream)
+	case upstream != nil:
+		err = proxy.copy(upstream, stream)
+	default:
+		err = proxy.dialAndCopy(nextCtx, upstreamAddr, stream)
+	}
+	if err != nil {
+		log.Debugf("Error tunneling HTTP/2 stream: %v", err)
+	}
+}
+
+func (proxy *proxy) writeH2Response(rw http.ResponseWriter, resp *http.Response) {
+	resp = prepareResponse(resp, false)
+	header := rw.Header()
+	for key, values := range resp.Header {
+		header[key] = values
+	}
+	rw.WriteHeader(resp.StatusCode)
+	if resp.Body == nil {
+		return
+	}
+	buf := proxy.BufferSource.Get()
+	defer proxy.BufferSource.Put(buf)
+	if _, err := io.CopyBuffer(rw, resp.Body, buf); err != nil && isUnexpected(err) {
+		log.Debugf("Unable to copy response body to HTTP/2 stream: %v", err)
+	}
+}
+
+// tunnelBody gives responses that establish tunnels an empty body. Over
+// HTTP/2, a tunnel ends with its stream rather than with the connection, so the
+// body gets closed once the tunnel is done to let filters know.
+func tunnelBody(next filters.Next) filters.Next {
+	return func(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+		resp, nextCtx, err := next(ctx, req)
+		isTunnel := upstreamConn(nextCtx) != nil || upstreamAddr(nextCtx) != "" || interceptedTunnel(nextCtx) != nil
+		if resp != nil && resp.Body == nil && isTunnel {
+			resp.Body = http.NoBody
+		}
+		return resp, nextCtx, err
+	}
+}
+
+// toUpgradeRequest turns an extended CONNECT request into the equivalent
+// HTTP/1.1 upgrade request. The stream's data is only piped once the upgrade
+// succeeds, so the request itself has no body. Since HTTP/2 WebSocket
+// handshakes don't carry a Sec-WebSocket-Key, a fresh one is generated for the
+// origin.
+func toUpgradeRequest(req *http.Request, protocol string) {
+	req.Method = http.MethodGet
+	req.Body = http.NoBody
+	req.ContentLength = 0
+	req.Header.Del(":protocol")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", protocol)
+	if protocol == "websocket" && req.Header.Get("Sec-Websocket-Key") == "" {
+		key := make([]byte, 16)
+		rand.Read(key)
+		req.Header.Set("Sec-Websocket-Key", base64.StdEncoding.EncodeToString(key))
+	}
+}
+
+// StreamConn is implemented by the downstream connections of HTTP/2 streams.
+// Since all of a connection's streams share the connection that they wrap, the
+// bytes transferred on it can't be attributed to individual requests, so
+// streams count their own.
+type StreamConn interface {
+	net.Conn
+
+	// BytesTransferred returns the number of bytes of request and response
+	// bodies (or tunneled data) received from and sent to the client on the
+	// stream so far.
+	BytesTransferred() (recv int, sent int)
+}
+
+// h2Stream adapts an HTTP/2 stream to a net.Conn so that it can serve as the
+// downstream end of a tunnel. It wraps the HTTP/2 connection, from which it
+// takes its addresses.
+type h2Stream struct {
+	net.Conn
+	body io.ReadCloser
+	rw   http.ResponseWriter
+	rc   *http.ResponseController
+	recv int64
+	sent int64
+}
+
+// BytesTransferred implements the interface StreamConn
+func (s *h2Stream) BytesTransferred() (int, int) {
+	return int(atomic.LoadInt64(&s.recv)), int(atomic.LoadInt64(&s.sent))
+}
+
+func (s *h2Stream) Read(b []byte) (int, error) {
+	return s.body.Read(b)
+}
+
+func (s *h2Stream) Write(b []byte) (int, error) {
+	n, err := s.rw.Write(b)
+	if err == nil {
+		err = s.rc.Flush()
+	}
+	return n, err
+}
+
+// Close closes the stream's request body. The response ends once the handler
+// for the stream returns.
+func (s *h2Stream) Close() error {
+	return s.body.Close()
+}
+
+func (s *h2Stream) SetDeadline(t time.Time) error {
+	if err := s.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return s.SetWriteDeadline(t)
+}
+
+func (s *h2Stream) SetReadDeadline(t time.Time) error {
+	if err := s.rc.SetReadDeadline(t); err != nil {
+		return errors.New("Unable to set read deadline on HTTP/2 stream: %v", err)
+	}
+	return nil
+}
+
+func (s *h2Stream) SetWriteDeadline(t time.Time) error {
+	if err := s.rc.SetWriteDeadline(t); err != nil {
+		return errors.New("Unable to set write deadline on HTTP/2 stream: %v", err)
+	}
+	return nil
+}
+
+func (s *h2Stream) Wrapped() net.Conn {
+	return s.Conn
+}
+
+// countingBody counts the bytes read from a request body into n.
+type countingBody struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(b.n, int64(n))
+	return n, err
+}
+
+// countingResponseWriter counts the bytes of the response body written into
+// n.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n *int64
+}
+
+func (rw *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(p)
+	atomic.AddInt64(rw.n, int64(n))
+	return n, err
+}
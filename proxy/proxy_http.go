@@ -40,6 +40,17 @@ func (proxy *proxy) Handle(ctx context.Context, downstreamIn io.Reader, downstre
 		}
 	}()
 
+	h2, err := negotiatedH2(downstream)
+	if err != nil {
+		if isUnexpected(err) {
+			return errors.New("Unable to complete TLS handshake with downstream: %v", err)
+		}
+		return nil
+	}
+	if h2 {
+		return proxy.serveH2(ctx, downstreamIn, downstream)
+	}
+
 	var downstreamBuffered *bufio.Reader
 	switch r := downstreamIn.(type) {
 	case *bufio.Reader:
@@ -72,27 +83,23 @@ func (proxy *proxy) Handle(ctx context.Context, downstreamIn io.Reader, downstre
 	if req.Method == http.MethodConnect {
 		next = proxy.nextCONNECT(downstream)
 	} else {
-		tr := &http.Transport{
-			DialContext: func(ctx context.Context, net, addr string) (net.Conn, error) {
-				return proxy.Dial(ctx, false, net, addr)
-			},
-			IdleConnTimeout: proxy.IdleTimeout,
-			// since we have one transport per downstream connection, we don't need
-			// more than this
-			MaxIdleConnsPerHost: 1,
-		}
-
-		defer tr.CloseIdleConnections()
 		next = func(ctx filters.Context, modifiedReq *http.Request) (*http.Response, filters.Context, error) {
-			resp, err := tr.RoundTrip(prepareRequest(modifiedReq.WithContext(ctx)))
+			upstreamReq := prepareRequest(modifiedReq.WithContext(ctx))
+			if isUpgrade(modifiedReq) {
+				return proxy.roundTripUpgrade(ctx, upstreamReq)
+			}
+			resp, err := proxy.pool.roundTrip(upstreamReq)
 			return resp, ctx, err
 		}
 	}
 
-	return proxy.processRequests(fctx, req.RemoteAddr, req, downstream, downstreamBuffered, next)
+	return proxy.processRequests(fctx, req.RemoteAddr, req, downstream, downstreamBuffered, next, nil)
 }
 
-func (proxy *proxy) processRequests(ctx filters.Context, remoteAddr string, req *http.Request, downstream net.Conn, downstreamBuffered *bufio.Reader, next filters.Next) error {
+// processRequests processes requests read from downstream until the connection
+// closes or turns into a tunnel. If specified, prepareReq is applied to every
+// subsequent request read from downstream before it's filtered.
+func (proxy *proxy) processRequests(ctx filters.Context, remoteAddr string, req *http.Request, downstream net.Conn, downstreamBuffered *bufio.Reader, next filters.Next, prepareReq func(*http.Request)) error {
 	var readErr error
 	var resp *http.Response
 	var err error
@@ -124,6 +131,10 @@ func (proxy *proxy) processRequests(ctx filters.Context, remoteAddr string, req
 			downstream = preconn.Wrap(downstream, b)
 		}
 
+		if tunnel := interceptedTunnel(ctx); tunnel != nil {
+			return proxy.intercept(ctx, remoteAddr, tunnel, downstream)
+		}
+
 		if isConnect {
 			if upstream != nil {
 				return proxy.copy(upstream, downstream)
@@ -158,6 +169,9 @@ func (proxy *proxy) processRequests(ctx filters.Context, remoteAddr string, req
 		// Preserve remote address from original request
 		ctx = ctx.IncrementRequestNumber()
 		req.RemoteAddr = remoteAddr
+		if prepareReq != nil {
+			prepareReq(req)
+		}
 		req = req.WithContext(ctx)
 	}
 }
@@ -203,6 +217,9 @@ func prepareRequest(req *http.Request) *http.Request {
 	// Ensure we have a HOST header (important for Go 1.6+ because http.Server
 	// strips the HOST header from the inbound request)
 	newHeader.Set("Host", req.Host)
+	if isUpgrade(req) {
+		keepUpgradeHeaders(newHeader, req.Header)
+	}
 	req.Header = newHeader
 
 	// Request URL
@@ -229,6 +246,9 @@ func prepareResponse(resp *http.Response, belowHTTP11 bool) *http.Response {
 	origHeader := resp.Header
 	resp.Header = make(http.Header)
 	copyHeadersForForwarding(resp.Header, origHeader)
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		keepUpgradeHeaders(resp.Header, origHeader)
+	}
 	// Below added due to CoAdvisor test failure
 	if resp.Header.Get("Date") == "" {
 		resp.Header.Set("Date", time.Now().Format(time.RFC850))
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/proxy/filters"
+)
+
+// MITMFunc decides whether to intercept the given CONNECT request. To intercept
+// it, return the tls.Config with which to terminate TLS from the client,
+// otherwise return nil.
+type MITMFunc func(ctx filters.Context, req *http.Request) *tls.Config
+
+// mitmTunnel is an intercepted CONNECT tunnel
+type mitmTunnel struct {
+	addr      string
+	tlsConfig *tls.Config
+}
+
+func interceptedTunnel(ctx filters.Context) *mitmTunnel {
+	tunnel := ctx.Value(ctxKeyMITM)
+	if tunnel == nil {
+		return nil
+	}
+	return tunnel.(*mitmTunnel)
+}
+
+// Intercepted returns the address of the CONNECT tunnel from which the current
+// request was intercepted (see Opts.MITM), or "" if the request wasn't
+// intercepted.
+func Intercepted(ctx context.Context) string {
+	addr, _ := ctx.Value(ctxKeyIntercepted).(string)
+	return addr
+}
+
+// intercept terminates TLS on the downstream connection and processes the
+// requests inside it like plain HTTP requests, sending them to the tunnel's
+// address over TLS.
+func (proxy *proxy) intercept(ctx filters.Context, remoteAddr string, tunnel *mitmTunnel, downstream net.Conn) error {
+	tlsConn := tls.Server(downstream, tunnel.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return errors.New("Unable to complete TLS handshake with client to intercept %v: %v", tunnel.addr, err)
+	}
+	tlsBuffered := bufio.NewReader(tlsConn)
+
+	req, err := http.ReadRequest(tlsBuffered)
+	if err != nil {
+		if isUnexpected(err) {
+			return errors.New("Error reading intercepted request: %v", err)
+		}
+		return nil
+	}
+
+	next := func(ctx filters.Context, modifiedReq *http.Request) (*http.Response, filters.Context, error) {
+		upstreamReq := prepareRequest(modifiedReq.WithContext(ctx))
+		// Always go to the origin that the client connected to, regardless of
+		// the Host header
+		upstreamReq.URL.Scheme = "https"
+		upstreamReq.URL.Host = tunnel.addr
+		if isUpgrade(modifiedReq) {
+			return proxy.roundTripUpgrade(ctx, upstreamReq)
+		}
+		resp, err := proxy.pool.roundTrip(upstreamReq)
+		return resp, ctx, err
+	}
+
+	ctx = ctx.WithValue(ctxKeyMITM, nil).WithValue(ctxKeyIntercepted, tunnel.addr).IncrementRequestNumber()
+	prepare := func(req *http.Request) {
+		req.URL.Scheme = "https"
+		req.URL.Host = tunnel.addr
+	}
+	req.RemoteAddr = remoteAddr
+	prepare(req)
+	return proxy.processRequests(ctx, remoteAddr, req.WithContext(ctx), tlsConn, tlsBuffered, next, prepare)
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/preconn"
+	"github.com/getlantern/proxy/filters"
+)
+
+// isUpgrade checks whether the request asks to switch protocols, like
+// WebSocket handshakes do.
+func isUpgrade(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range req.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// roundTripUpgrade sends an upgrade request (already prepared for forwarding)
+// upstream on a dedicated connection. If upstream switches protocols, the
+// connection is stored in the context so that it gets piped to downstream just
+// like a CONNECT tunnel, once the 101 response has been written.
+func (proxy *proxy) roundTripUpgrade(ctx filters.Context, req *http.Request) (*http.Response, filters.Context, error) {
+	addr := req.URL.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		if req.URL.Scheme == "https" {
+			addr = net.JoinHostPort(addr, "443")
+		} else {
+			addr = net.JoinHostPort(addr, "80")
+		}
+	}
+	upstream, err := proxy.Dial(ctx, false, "tcp", addr)
+	if err != nil {
+		return nil, ctx, err
+	}
+	notifyUpstreamConn(ctx, upstream)
+	if req.URL.Scheme == "https" {
+		upstream, err = proxy.tlsClient(ctx, upstream, req.URL.Hostname())
+		if err != nil {
+			return nil, ctx, err
+		}
+	}
+
+	if err := req.Write(upstream); err != nil {
+		upstream.Close()
+		return nil, ctx, errors.New("Unable to write upgrade request upstream: %v", err)
+	}
+	upstreamBuffered := bufio.NewReader(upstream)
+	resp, err := http.ReadResponse(upstreamBuffered, req)
+	if err != nil {
+		upstream.Close()
+		return nil, ctx, errors.New("Unable to read upgrade response from upstream: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// Upstream declined, the connection is only good for this response
+		resp.Body = &closingBody{ReadCloser: resp.Body, conn: upstream}
+		resp.Close = true
+		return resp, ctx, nil
+	}
+
+	// The upgraded connection takes the place of the body
+	resp.Body.Close()
+	resp.Body = nil
+	if buffered := upstreamBuffered.Buffered(); buffered > 0 {
+		b, _ := upstreamBuffered.Peek(buffered)
+		upstream = preconn.Wrap(upstream, b)
+	}
+	return resp, ctx.WithValue(ctxKeyUpstream, upstream), nil
+}
+
+func (proxy *proxy) tlsClient(ctx filters.Context, conn net.Conn, serverName string) (net.Conn, error) {
+	var tlsConfig *tls.Config
+	if proxy.MITMUpstreamTLSConfig != nil {
+		tlsConfig = proxy.MITMUpstreamTLSConfig.Clone()
+	} else {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = serverName
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, errors.New("Unable to complete TLS handshake with %v: %v", serverName, err)
+	}
+	return tlsConn, nil
+}
+
+// keepUpgradeHeaders restores the headers that negotiate an upgrade, which
+// are hop-by-hop and therefore not forwarded by default.
+func keepUpgradeHeaders(dst, src http.Header) {
+	dst.Set("Connection", "Upgrade")
+	dst.Set("Upgrade", src.Get("Upgrade"))
+}
+
+// closingBody closes the connection that a body was read from once the body is
+// closed.
+type closingBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b *closingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.conn.Close()
+	return err
+}